@@ -0,0 +1,54 @@
+// Command engine runs the TCP engine on its own: it owns the rooms and
+// the fan-out, and gateways started with cmd/gateway connect to it over
+// ENGINE_URL. cmd/server runs both in one process.
+package main
+
+import (
+	"flag"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/iLeoon/realtime-gateway/internal/config"
+	"github.com/iLeoon/realtime-gateway/internal/db"
+	"github.com/iLeoon/realtime-gateway/internal/transport/http/resource/token"
+	"github.com/iLeoon/realtime-gateway/internal/transport/tcp"
+	"github.com/iLeoon/realtime-gateway/pkg/log"
+)
+
+func main() {
+	logLevel := flag.String("log", "info", `usage: -log=[level]    level: [info - debug - error]`)
+	flag.Parse()
+	if *logLevel == "" {
+		log.Fatal("invalid usage for log level")
+		os.Exit(1)
+	}
+	_ = log.SetLevel(*logLevel)
+
+	// Load the configuration variables, the gateway's HTTP and OAuth
+	// settings aren't needed.
+	conf, err := config.LoadEngine()
+	if err != nil {
+		log.Fatal("faild to load configuration variables", err)
+		os.Exit(1)
+	}
+	// Connect to database.
+	db, dbErr := db.Connect(conf)
+	if dbErr != nil {
+		log.Fatal("error on trying to connect to the database", "error", dbErr)
+		os.Exit(1)
+	}
+
+	// Verifies the assertions gateways attach to connect packets.
+	assertions := token.NewService(conf)
+
+	engine := tcp.NewServer(conf, db, make(chan struct{}), assertions)
+	go engine.Start()
+
+	// On SIGINT or SIGTERM the engine writes its snapshot, see
+	// ENGINE_SNAPSHOT_FILE, so the next start is warm.
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	<-stop
+	engine.Shutdown()
+}
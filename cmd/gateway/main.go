@@ -0,0 +1,71 @@
+// Command gateway runs the WebSocket gateway and the REST API without an
+// engine. Every WebSocket session dials the engine started with
+// cmd/engine at ENGINE_URL, and redials it when the engine restarts.
+// With ENGINE_URLS users are spread over several engines.
+// cmd/server runs both in one process.
+package main
+
+import (
+	"flag"
+	"os"
+
+	"github.com/iLeoon/realtime-gateway/internal/config"
+	"github.com/iLeoon/realtime-gateway/internal/db"
+	"github.com/iLeoon/realtime-gateway/internal/router"
+	"github.com/iLeoon/realtime-gateway/internal/transport/http"
+	"github.com/iLeoon/realtime-gateway/internal/transport/http/middleware"
+	"github.com/iLeoon/realtime-gateway/internal/transport/http/resource/token"
+	"github.com/iLeoon/realtime-gateway/internal/transport/tcp"
+	"github.com/iLeoon/realtime-gateway/internal/transport/websocket"
+	"github.com/iLeoon/realtime-gateway/pkg/log"
+)
+
+func main() {
+	logLevel := flag.String("log", "info", `usage: -log=[level]    level: [info - debug - error]`)
+	flag.Parse()
+	if *logLevel == "" {
+		log.Fatal("invalid usage for log level")
+		os.Exit(1)
+	}
+	_ = log.SetLevel(*logLevel)
+
+	// Load the configuration variables.
+	conf, err := config.Load()
+	if err != nil {
+		log.Fatal("faild to load configuration variables", err)
+		os.Exit(1)
+	}
+	// The REST API still reads and writes the database.
+	db, dbErr := db.Connect(conf)
+	if dbErr != nil {
+		log.Fatal("error on trying to connect to the database", "error", dbErr)
+		os.Exit(1)
+	}
+
+	// Signs the assertions the engine checks on every connect packet.
+	assertions := token.NewService(conf)
+
+	// The same origin allowlist guards the REST API and the WebSocket upgrade.
+	corsPolicy := middleware.NewCorsPolicy(conf)
+
+	//Start new WebSocket server instance.
+	server := websocket.New(conf, corsPolicy)
+
+	// Start new router instance and pass the WebSocket server connections map.
+	router := router.New(server)
+
+	// Sessions reach the engine through the factory, the engine doesn't
+	// have to be up yet.
+	tcpFactory, err := tcp.NewFactory(conf, router, server, assertions)
+	if err != nil {
+		log.Fatal("failed to set up the engine link", err)
+		os.Exit(1)
+	}
+
+	// Retrieve the handler then pass it to the http server.
+	wsHandler := server.Handle(tcpFactory)
+
+	// Membership changes made through the API travel to the engine as
+	// packets instead of in-process calls.
+	http.Start(conf, db, wsHandler, tcp.NewNotifier(tcpFactory), tcpFactory, corsPolicy)
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/iLeoon/realtime-gateway/internal/errors"
+	"github.com/iLeoon/realtime-gateway/internal/protocol"
+	"github.com/iLeoon/realtime-gateway/internal/protocol/capture"
+	"github.com/iLeoon/realtime-gateway/internal/protocol/packets"
+)
+
+func runDecode(args []string) error {
+	fs := flag.NewFlagSet("decode", flag.ExitOnError)
+	format := fs.String("format", "hex", "input format: hex, bin or capture")
+	version := fs.Uint("version", 0, "protocol version of the connection, 0 guesses it from each frame's header")
+	fs.Parse(args)
+
+	in, err := openInput(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	switch *format {
+	case "capture":
+		return decodeCapture(in)
+	case "bin":
+		return decodeStream(in, uint8(*version))
+	case "hex":
+		raw, err := io.ReadAll(in)
+		if err != nil {
+			return err
+		}
+		b, err := parseHex(string(raw))
+		if err != nil {
+			return err
+		}
+		return decodeStream(bytes.NewReader(b), uint8(*version))
+	}
+	return fmt.Errorf("unknown format %q", *format)
+}
+
+func openInput(name string) (io.ReadCloser, error) {
+	if name == "" || name == "-" {
+		return io.NopCloser(os.Stdin), nil
+	}
+	return os.Open(name)
+}
+
+// parseHex accepts hex digits separated by any whitespace, lines starting
+// with '#' are comments.
+func parseHex(s string) ([]byte, error) {
+	var digits strings.Builder
+	for _, line := range strings.Split(s, "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "#") {
+			continue
+		}
+		digits.WriteString(strings.Join(strings.Fields(line), ""))
+	}
+	return hex.DecodeString(digits.String())
+}
+
+// decodeStream prints every frame of r. A frame whose payload doesn't
+// decode is reported and skipped, the stream is still in sync after it.
+func decodeStream(r io.Reader, version uint8) error {
+	br := bufio.NewReader(r)
+	dec := protocol.NewDecoder(br)
+	for i := 1; ; i++ {
+		v := version
+		if v == 0 {
+			v = guessVersion(br)
+		}
+		frame, err := dec.Decode(v)
+		var pktErr *protocol.PacketError
+		switch {
+		case err == nil:
+			fmt.Printf("#%d %s\n", i, describe(frame))
+		case errors.As(err, &pktErr):
+			fmt.Printf("#%d %s: %v\n", i, packets.Name(pktErr.Opcode), err)
+		case errors.Is(err, io.EOF):
+			return nil
+		default:
+			return fmt.Errorf("frame #%d: %w", i, err)
+		}
+	}
+}
+
+// guessVersion reads the magic byte of the next frame: a Version2 header
+// means the connection negotiated Version2. Version3 shares the header,
+// pass -version 3 to decode its layouts.
+func guessVersion(br *bufio.Reader) uint8 {
+	b, err := br.Peek(1)
+	if err == nil && b[0] == 0x8A {
+		return packets.Version2
+	}
+	return packets.Version1
+}
+
+func decodeCapture(r io.Reader) error {
+	cr, err := capture.NewReader(r)
+	if err != nil {
+		return err
+	}
+	for {
+		rec, err := cr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s conn=%d %-3s ", rec.Time.UTC().Format("15:04:05.000000"), rec.Conn, rec.Direction)
+		frame, err := rec.Decode()
+		if err != nil {
+			fmt.Printf("%x: %v\n", rec.Frame, err)
+			continue
+		}
+		fmt.Println(describe(frame))
+	}
+}
+
+// describe renders a frame on one line: header fields, then the packet
+// as JSON.
+func describe(f *protocol.Frame) string {
+	var b strings.Builder
+	header := "v1"
+	if f.Header.Magic == 0x8A {
+		header = "v2"
+	}
+	fmt.Fprintf(&b, "%s %s len=%d", packets.Name(f.Header.Opcode), header, f.Header.Length)
+	if f.Header.Flags != 0 {
+		fmt.Fprintf(&b, " flags=%#02x", f.Header.Flags)
+	}
+	if f.CorrelationID != 0 {
+		fmt.Fprintf(&b, " id=%d", f.CorrelationID)
+	}
+	payload, err := json.Marshal(f.Payload)
+	if err != nil {
+		payload = []byte(f.Payload.String())
+	}
+	fmt.Fprintf(&b, " %s", payload)
+	return b.String()
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/iLeoon/realtime-gateway/internal/protocol"
+	"github.com/iLeoon/realtime-gateway/internal/protocol/packets"
+)
+
+// goldenDir is the wire corpus of the protocol package, see its
+// golden_test.go.
+const goldenDir = "../../internal/protocol/testdata/golden"
+
+// opaquePacket can't be marshalled, describe falls back to its String.
+type opaquePacket struct{ packets.PingPacket }
+
+func (*opaquePacket) MarshalJSON() ([]byte, error) { return nil, errors.New("opaque") }
+func (*opaquePacket) String() string               { return "OpaquePacket{}" }
+
+func TestDescribe(t *testing.T) {
+	tests := []struct {
+		name  string
+		frame *protocol.Frame
+		want  string
+	}{
+		{
+			"v1",
+			&protocol.Frame{Header: protocol.FrameHeader{Magic: 0x89, Opcode: packets.Connect, Length: 8}, Payload: &packets.ConnectPacket{ConnectionID: 7, UserID: 42}},
+			`connect v1 len=8 {"ConnectionID":7,"UserID":42,"Token":""}`,
+		},
+		{
+			"v2 with flags and a correlation ID",
+			&protocol.Frame{Header: protocol.FrameHeader{Magic: 0x8A, Opcode: packets.Typing, Flags: protocol.FlagCorrelated, Length: 9}, Payload: &packets.TypingPacket{ConversationID: 3, IsTyping: true}, CorrelationID: 5},
+			`typing v2 len=9 flags=0x01 id=5 {"ConversationID":3,"IsTyping":true}`,
+		},
+		{
+			"empty payload",
+			&protocol.Frame{Header: protocol.FrameHeader{Magic: 0x89, Opcode: packets.Ping}, Payload: &packets.PingPacket{}},
+			`ping v1 len=0 {}`,
+		},
+		{
+			"payload without JSON",
+			&protocol.Frame{Header: protocol.FrameHeader{Magic: 0x89, Opcode: packets.Ping}, Payload: &opaquePacket{}},
+			`ping v1 len=0 OpaquePacket{}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := describe(tt.frame); got != tt.want {
+				t.Fatalf("describe() = %s\nwant         %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// goldenFile is one frame of the corpus: the String of its packet on the
+// comment line, then the hex.
+type goldenFile struct {
+	name    string
+	version uint8
+	comment string
+	raw     []byte
+}
+
+func readGoldenFiles(t *testing.T) []goldenFile {
+	t.Helper()
+	paths, err := filepath.Glob(filepath.Join(goldenDir, "*.hex"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) == 0 {
+		t.Fatalf("no golden frames in %s", goldenDir)
+	}
+	files := make([]goldenFile, 0, len(paths))
+	for _, p := range paths {
+		content, err := os.ReadFile(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		g := goldenFile{name: strings.TrimSuffix(filepath.Base(p), ".hex")}
+		// The layout is the second part of the name, e.g. connect.v2.token.
+		switch strings.Split(g.name, ".")[1] {
+		case "v1":
+			g.version = packets.Version1
+		case "v2":
+			g.version = packets.Version2
+		case "v3":
+			g.version = packets.Version3
+		default:
+			t.Fatalf("%s: no version in the name", g.name)
+		}
+		first, _, _ := strings.Cut(string(content), "\n")
+		g.comment = strings.TrimSpace(strings.TrimPrefix(first, "#"))
+		if g.raw, err = parseHex(string(content)); err != nil {
+			t.Fatalf("%s: %v", g.name, err)
+		}
+		files = append(files, g)
+	}
+	return files
+}
+
+// TestDecodeGolden decodes every golden frame the way decode reads a hex
+// dump, the packet must be the one its comment line names.
+func TestDecodeGolden(t *testing.T) {
+	for _, g := range readGoldenFiles(t) {
+		t.Run(g.name, func(t *testing.T) {
+			frame, err := protocol.NewDecoder(strings.NewReader(string(g.raw))).Decode(g.version)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := strings.TrimSpace(frame.Payload.String()); got != g.comment {
+				t.Fatalf("decoded %s\nwant    %s", got, g.comment)
+			}
+			if !strings.HasPrefix(describe(frame), packets.Name(frame.Header.Opcode)+" ") {
+				t.Fatalf("describe() = %s", describe(frame))
+			}
+		})
+	}
+}
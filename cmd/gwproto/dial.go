@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/iLeoon/realtime-gateway/internal/errors"
+	"github.com/iLeoon/realtime-gateway/internal/protocol"
+	"github.com/iLeoon/realtime-gateway/internal/protocol/capture"
+	"github.com/iLeoon/realtime-gateway/internal/protocol/packets"
+)
+
+const dialHelp = `commands, one per line:
+  send <conversationID> <text>
+  update <messageID> <conversationID> <text>
+  delete <messageID> <conversationID>
+  typing <conversationID> [on|off]
+  raw <type> <json>
+  quit
+`
+
+func runDial(args []string) error {
+	fs := flag.NewFlagSet("dial", flag.ExitOnError)
+	addr := fs.String("addr", defaultAddr(), "engine host:port or URL, defaults to $ENGINE_URL or $TCP_SERVER_PORT")
+	userID := fs.Uint("user", 1, "user ID sent in the connect packet")
+	connID := fs.Uint("conn", uint(time.Now().Unix()%1_000_000)+1, "connection ID sent in the connect packet")
+	legacy := fs.Bool("legacy", false, "skip the handshake and speak version 1")
+	record := fs.String("record", "", "write the session to this capture file")
+	token := fs.String("token", "", "engine assertion for the user, needed over tcp:// and when ENGINE_REQUIRE_TOKEN is set")
+	fs.Parse(args)
+	if *addr == "" {
+		return fmt.Errorf("set -addr, ENGINE_URL or TCP_SERVER_PORT")
+	}
+
+	var rec *capture.Writer
+	if *record != "" {
+		f, err := os.Create(*record)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if rec, err = capture.NewWriter(f); err != nil {
+			return err
+		}
+		defer rec.Flush()
+	}
+
+	s, err := connect(*addr, *legacy, rec)
+	if err != nil {
+		return err
+	}
+	defer s.conn.Close()
+	fmt.Printf("connected to %s, protocol version %d, features %#x\n", *addr, s.proto.Version, s.proto.Features)
+
+	closed := make(chan struct{})
+	go func() {
+		s.readLoop()
+		close(closed)
+	}()
+
+	if err := s.send(&packets.ConnectPacket{ConnectionID: uint32(*connID), UserID: uint32(*userID), Token: *token}); err != nil {
+		return err
+	}
+	fmt.Print(dialHelp)
+
+	lines := make(chan string)
+	go func() {
+		sc := bufio.NewScanner(os.Stdin)
+		for sc.Scan() {
+			lines <- sc.Text()
+		}
+		close(lines)
+	}()
+
+	for {
+		select {
+		case <-closed:
+			return fmt.Errorf("the engine closed the connection")
+		case line, ok := <-lines:
+			if !ok || strings.TrimSpace(line) == "quit" {
+				if err := s.send(&packets.DisconnectPacket{ConnectionID: uint32(*connID), UserID: uint32(*userID)}); err != nil {
+					return err
+				}
+				// The engine closes the connection once it processed the
+				// disconnect, give the last replies a moment to arrive.
+				select {
+				case <-closed:
+				case <-time.After(time.Second):
+				}
+				return nil
+			}
+			if strings.TrimSpace(line) == "" {
+				continue
+			}
+			pkt, err := parseCommand(line, s.proto.Version)
+			if err != nil {
+				fmt.Println("!", err)
+				continue
+			}
+			if err := s.send(pkt); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func parseCommand(line string, version uint8) (packets.BuildPayload, error) {
+	fields := strings.Fields(line)
+	arg := func(i int) uint32 {
+		if i >= len(fields) {
+			return 0
+		}
+		v, _ := strconv.ParseUint(fields[i], 10, 32)
+		return uint32(v)
+	}
+	rest := func(i int) string {
+		if i >= len(fields) {
+			return ""
+		}
+		return strings.Join(fields[i:], " ")
+	}
+
+	switch fields[0] {
+	case "send":
+		return &packets.SendMessagePacket{ConversationID: arg(1), Content: rest(2)}, nil
+	case "update":
+		return &packets.UpdateMessagePacket{MessageID: arg(1), ConversationID: arg(2), Content: rest(3)}, nil
+	case "delete":
+		return &packets.DeleteMessagePacket{MessageID: arg(1), ConversationID: arg(2)}, nil
+	case "typing":
+		return &packets.TypingPacket{ConversationID: arg(1), IsTyping: rest(2) != "off"}, nil
+	case "raw":
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("usage: raw <type> <json>")
+		}
+		return packetFromJSON(fields[1], rest(2), version)
+	}
+	return nil, fmt.Errorf("unknown command %q", fields[0])
+}
+
+// session is a connection to the engine acting as a gateway would.
+type session struct {
+	conn   net.Conn
+	proto  protocol.Negotiated
+	mu     sync.Mutex
+	nextID uint32
+}
+
+// connect dials addr and runs the handshake, falling back to version 1
+// like the gateway does when the engine predates it.
+func connect(addr string, legacy bool, rec *capture.Writer) (*session, error) {
+	conn, err := dialRecorded(addr, rec, 1)
+	if err != nil || legacy {
+		return &session{conn: conn, proto: protocol.Legacy}, err
+	}
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	proto, err := protocol.ClientHandshake(conn)
+	if errors.Is(err, protocol.ErrLegacyPeer) {
+		conn.Close()
+		fmt.Println("the engine doesn't know the handshake, redialing as version 1")
+		conn, err = dialRecorded(addr, rec, 2)
+		return &session{conn: conn, proto: protocol.Legacy}, err
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	if cc, ok := conn.(*capture.Conn); ok {
+		cc.SetVersion(proto.Version)
+	}
+	return &session{conn: conn, proto: proto}, nil
+}
+
+func dialRecorded(addr string, rec *capture.Writer, id uint32) (net.Conn, error) {
+	conn, err := dialEngine(addr)
+	if err != nil || rec == nil {
+		return conn, err
+	}
+	return capture.NewConn(conn, rec, id, capture.Outbound), nil
+}
+
+// send writes pkt, tagged with a fresh correlation ID when the engine
+// supports them so its ack or error shows up.
+func (s *session) send(pkt packets.BuildPayload) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	frame := protocol.ConstructFrame(pkt).ForVersion(s.proto.Version)
+	if s.proto.Has(packets.FeatureCorrelation) && pkt.Type() != packets.Pong {
+		s.nextID++
+		frame.WithCorrelation(s.nextID)
+	}
+	if s.proto.Has(packets.FeatureCompression) {
+		frame.WithCompression(protocol.DefaultCompressionThreshold)
+	}
+	if err := frame.EncodeFrame(s.conn); err != nil {
+		return err
+	}
+	if pkt.Type() != packets.Pong {
+		fmt.Println(">", describe(frame))
+	}
+	return nil
+}
+
+// readLoop prints what the engine sends and answers its pings.
+func (s *session) readLoop() {
+	dec := protocol.NewDecoder(s.conn)
+	for {
+		frame, err := dec.Decode(s.proto.Version)
+		var pktErr *protocol.PacketError
+		if errors.As(err, &pktErr) {
+			fmt.Printf("< %s: %v\n", packets.Name(pktErr.Opcode), err)
+			continue
+		}
+		if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+			fmt.Println("< connection closed")
+			return
+		}
+		if err != nil {
+			fmt.Println("<", err)
+			return
+		}
+		if frame.Header.Opcode == packets.Ping {
+			if err := s.send(&packets.PongPacket{}); err != nil {
+				fmt.Println("! failed to answer the ping:", err)
+			}
+			continue
+		}
+		fmt.Println("<", describe(frame))
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/iLeoon/realtime-gateway/internal/protocol"
+	"github.com/iLeoon/realtime-gateway/internal/protocol/packets"
+)
+
+func runEncode(args []string) error {
+	fs := flag.NewFlagSet("encode", flag.ExitOnError)
+	typ := fs.String("type", "", "packet type, e.g. send_message, typing, connect")
+	version := fs.Uint("version", uint(packets.Version1), "protocol version to encode for")
+	id := fs.Uint("id", 0, "correlation ID, Version2 only")
+	compress := fs.Int("compress", 0, "compress payloads from this size, Version2 only")
+	format := fs.String("format", "hex", "output format: hex or bin")
+	fs.Parse(args)
+
+	pkt, err := packetFromJSON(*typ, fs.Arg(0), uint8(*version))
+	if err != nil {
+		return err
+	}
+	b, err := encodeFrame(pkt, uint8(*version), uint32(*id), *compress)
+	if err != nil {
+		return err
+	}
+
+	switch *format {
+	case "bin":
+		_, err = os.Stdout.Write(b)
+		return err
+	case "hex":
+		fmt.Printf("# %s\n%s", strings.TrimSpace(pkt.String()), wrapHex(b))
+		return nil
+	}
+	return fmt.Errorf("unknown format %q", *format)
+}
+
+// encodeFrame frames pkt for version, id and compress only apply from
+// Version2 on.
+func encodeFrame(pkt packets.BuildPayload, version uint8, id uint32, compress int) ([]byte, error) {
+	frame := protocol.ConstructFrame(pkt).ForVersion(version).WithCorrelation(id).WithCompression(compress)
+	var buf bytes.Buffer
+	if err := frame.EncodeFrame(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// packetFromJSON builds a packet of the named type, fields are matched by
+// their Go names, case insensitively.
+func packetFromJSON(name, body string, version uint8) (packets.BuildPayload, error) {
+	opcode, ok := packets.Opcode(name)
+	if !ok {
+		return nil, fmt.Errorf("unknown packet type %q", name)
+	}
+	pkt, err := packets.ConstructPacket(opcode, version)
+	if err != nil {
+		return nil, err
+	}
+	if strings.TrimSpace(body) == "" {
+		return pkt, nil
+	}
+	dec := json.NewDecoder(strings.NewReader(body))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(pkt); err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return pkt, nil
+}
+
+func wrapHex(b []byte) string {
+	var out strings.Builder
+	enc := hex.EncodeToString(b)
+	for len(enc) > 64 {
+		out.WriteString(enc[:64] + "\n")
+		enc = enc[64:]
+	}
+	out.WriteString(enc + "\n")
+	return out.String()
+}
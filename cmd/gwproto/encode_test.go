@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/iLeoon/realtime-gateway/internal/protocol"
+	"github.com/iLeoon/realtime-gateway/internal/protocol/packets"
+)
+
+// TestEncodeGolden turns every golden frame into the JSON encode takes
+// and encodes it again with the frame's correlation ID, the bytes must be
+// the golden ones. Relays are encoded as decoded. Compressed frames
+// aren't byte for byte stable, they only have to decode to the same
+// packet.
+func TestEncodeGolden(t *testing.T) {
+	for _, g := range readGoldenFiles(t) {
+		t.Run(g.name, func(t *testing.T) {
+			frame, err := protocol.NewDecoder(bytes.NewReader(g.raw)).Decode(g.version)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// The packet a relay carries is an interface, JSON can't say
+			// which one. The decoded relay is encoded as it is.
+			pkt := frame.Payload
+			if frame.Header.Opcode != packets.Relay {
+				body, err := json.Marshal(frame.Payload)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if pkt, err = packetFromJSON(packets.Name(frame.Header.Opcode), string(body), g.version); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			compressed := frame.Header.Flags&protocol.FlagCompressed != 0
+			var compress int
+			if compressed {
+				compress = protocol.DefaultCompressionThreshold
+			}
+			b, err := encodeFrame(pkt, g.version, frame.CorrelationID, compress)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !compressed {
+				if !bytes.Equal(b, g.raw) {
+					t.Fatalf("encoded %x\nwant    %x", b, g.raw)
+				}
+				return
+			}
+			again, err := protocol.NewDecoder(bytes.NewReader(b)).Decode(g.version)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := strings.TrimSpace(again.Payload.String()); got != g.comment {
+				t.Fatalf("encoded %s\nwant    %s", got, g.comment)
+			}
+		})
+	}
+}
@@ -0,0 +1,94 @@
+// Command gwproto inspects and speaks the gateway↔engine binary protocol.
+//
+//	gwproto decode [-format hex|bin|capture] [-version n] [file]
+//	gwproto encode -type send_message [-version n] [-id n] [-compress n] [-format hex|bin] '{"ConversationID":1,"Content":"hi"}'
+//	gwproto dial [-addr url] [-user n] [-conn n] [-legacy] [-record file] [-token jwt]
+//	gwproto replay [-addr url] [-speed n] file
+//
+// -addr takes host:port or an engine URL (tcp://, unix:// or tls://), tls://
+// reads its credentials from ENGINE_TLS_CA, ENGINE_TLS_CERT and
+// ENGINE_TLS_KEY like the gateway does.
+//
+// Hex input may contain whitespace and '#' comment lines, so the golden
+// frames in internal/protocol/testdata can be fed to decode as they are.
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/iLeoon/realtime-gateway/internal/config"
+	"github.com/iLeoon/realtime-gateway/internal/transport/tcp"
+	"github.com/iLeoon/realtime-gateway/pkg/log"
+)
+
+const usage = `usage: gwproto <command> [flags]
+
+commands:
+  decode   print the frames of a hex, binary or capture dump
+  encode   build a frame from a packet written as JSON
+  dial     connect to an engine as a fake gateway and send packets from stdin
+  replay   send the gateway side of a capture to an engine
+
+run gwproto <command> -h for the flags of a command.
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	// The protocol packages log at info level, keep the output readable.
+	_ = log.SetLevel("error")
+
+	var err error
+	switch cmd, args := os.Args[1], os.Args[2:]; cmd {
+	case "decode":
+		err = runDecode(args)
+	case "encode":
+		err = runEncode(args)
+	case "dial":
+		err = runDial(args)
+	case "replay":
+		err = runReplay(args)
+	case "help", "-h", "--help":
+		fmt.Print(usage)
+		return
+	default:
+		fmt.Fprintf(os.Stderr, "gwproto: unknown command %q\n\n%s", cmd, usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "gwproto:", err)
+		os.Exit(1)
+	}
+}
+
+// dialEngine connects to addr, a host:port or an engine URL.
+func dialEngine(addr string) (net.Conn, error) {
+	if !strings.Contains(addr, "://") {
+		addr = "tcp://" + addr
+	}
+	transport, err := tcp.ParseTransport(addr, config.EngineAuth{
+		EngineTLSCA:         os.Getenv("ENGINE_TLS_CA"),
+		EngineTLSCert:       os.Getenv("ENGINE_TLS_CERT"),
+		EngineTLSKey:        os.Getenv("ENGINE_TLS_KEY"),
+		EngineTLSServerName: os.Getenv("ENGINE_TLS_SERVER_NAME"),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return transport.Dial(context.Background())
+}
+
+// defaultAddr is the engine the gateway would dial with the same
+// environment.
+func defaultAddr() string {
+	if u := os.Getenv("ENGINE_URL"); u != "" {
+		return u
+	}
+	return os.Getenv("TCP_SERVER_PORT")
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/iLeoon/realtime-gateway/internal/errors"
+	"github.com/iLeoon/realtime-gateway/internal/protocol"
+	"github.com/iLeoon/realtime-gateway/internal/protocol/capture"
+	"github.com/iLeoon/realtime-gateway/internal/protocol/packets"
+)
+
+// runReplay sends the inbound frames of a capture to an engine, one
+// connection per recorded connection, and prints what the engine answers.
+// The frames go out byte for byte, handshake included.
+func runReplay(args []string) error {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	addr := fs.String("addr", defaultAddr(), "engine host:port or URL, defaults to $ENGINE_URL or $TCP_SERVER_PORT")
+	speed := fs.Float64("speed", 1, "replay speed, 2 is twice as fast, 0 sends without waiting")
+	wait := fs.Duration("wait", 2*time.Second, "how long to keep reading after a connection's last frame")
+	fs.Parse(args)
+	if *addr == "" {
+		return fmt.Errorf("set -addr, ENGINE_URL or TCP_SERVER_PORT")
+	}
+
+	in, err := openInput(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	cr, err := capture.NewReader(in)
+	if err != nil {
+		return err
+	}
+	records, err := cr.ReadAll()
+	if err != nil {
+		return err
+	}
+	if len(records) == 0 {
+		return fmt.Errorf("the capture is empty")
+	}
+
+	// Group the gateway side of each connection, keeping capture order.
+	byConn := map[uint32][]capture.Record{}
+	var order []uint32
+	for _, rec := range records {
+		if rec.Direction != capture.Inbound {
+			continue
+		}
+		if _, ok := byConn[rec.Conn]; !ok {
+			order = append(order, rec.Conn)
+		}
+		byConn[rec.Conn] = append(byConn[rec.Conn], rec)
+	}
+
+	start := time.Now()
+	origin := records[0].Time
+	var wg sync.WaitGroup
+	for _, id := range order {
+		wg.Add(1)
+		go func(id uint32, recs []capture.Record) {
+			defer wg.Done()
+			if err := replayConn(*addr, id, recs, start, origin, *speed, *wait); err != nil {
+				fmt.Printf("conn=%d ! %v\n", id, err)
+			}
+		}(id, byConn[id])
+	}
+	wg.Wait()
+	return nil
+}
+
+func replayConn(addr string, id uint32, recs []capture.Record, start, origin time.Time, speed float64, wait time.Duration) error {
+	conn, err := dialEngine(addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		replayRead(conn, id)
+	}()
+
+	for _, rec := range recs {
+		if speed > 0 {
+			at := start.Add(time.Duration(float64(rec.Time.Sub(origin)) / speed))
+			time.Sleep(time.Until(at))
+		}
+		if frame, err := rec.Decode(); err == nil {
+			fmt.Printf("conn=%d > %s\n", id, describe(frame))
+		}
+		if _, err := conn.Write(rec.Frame); err != nil {
+			return err
+		}
+	}
+
+	select {
+	case <-done:
+	case <-time.After(wait):
+	}
+	return nil
+}
+
+// replayRead prints the engine's frames. The connection switches to the
+// negotiated version once the recorded Hello got its HelloAck.
+func replayRead(conn net.Conn, id uint32) {
+	dec := protocol.NewDecoder(conn)
+	version := packets.Version1
+	for {
+		frame, err := dec.Decode(version)
+		var pktErr *protocol.PacketError
+		if errors.As(err, &pktErr) {
+			fmt.Printf("conn=%d < %s: %v\n", id, packets.Name(pktErr.Opcode), err)
+			continue
+		}
+		if err != nil {
+			return
+		}
+		if ack, ok := frame.Payload.(*packets.HelloAckPacket); ok {
+			version = ack.Version
+		}
+		fmt.Printf("conn=%d < %s\n", id, describe(frame))
+	}
+}
@@ -8,6 +8,8 @@ import (
 	"github.com/iLeoon/realtime-gateway/internal/db"
 	"github.com/iLeoon/realtime-gateway/internal/router"
 	"github.com/iLeoon/realtime-gateway/internal/transport/http"
+	"github.com/iLeoon/realtime-gateway/internal/transport/http/middleware"
+	"github.com/iLeoon/realtime-gateway/internal/transport/http/resource/token"
 	"github.com/iLeoon/realtime-gateway/internal/transport/tcp"
 	"github.com/iLeoon/realtime-gateway/internal/transport/websocket"
 	"github.com/iLeoon/realtime-gateway/pkg/log"
@@ -39,25 +41,36 @@ func main() {
 		os.Exit(1)
 	}
 
+	// The gateway signs every connect packet and the engine checks it, see
+	// config.EngineAuth.
+	assertions := token.NewService(conf)
+
 	// Run the TCP server.
-	tcpServer := tcp.NewServer(conf, db, tcpServerReady)
+	tcpServer := tcp.NewServer(conf, db, tcpServerReady, assertions)
 	go tcpServer.Start()
 
 	<-tcpServerReady
 
+	// The same origin allowlist guards the REST API and the WebSocket upgrade.
+	corsPolicy := middleware.NewCorsPolicy(conf)
+
 	//Start new WebSocket server instance.
-	server := websocket.New(conf)
+	server := websocket.New(conf, corsPolicy)
 
 	// Start new router instance and pass the WebSocket server connections map.
 	router := router.New(server)
 
 	// Start a new TCP Factory to manage connections between TCP server
 	// and WebSocket gateway.
-	tcpFactory := tcp.NewFactory(conf, router, server)
+	tcpFactory, err := tcp.NewFactory(conf, router, server, assertions)
+	if err != nil {
+		log.Fatal("failed to set up the engine link", err)
+		os.Exit(1)
+	}
 
 	// Retrieve the handler then pass it to the http server.
 	wsHandler := server.Handle(tcpFactory)
 
-	http.Start(conf, db, wsHandler, tcpServer)
+	http.Start(conf, db, wsHandler, tcpServer, tcpFactory, corsPolicy)
 
 }
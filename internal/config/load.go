@@ -15,3 +15,19 @@ func Load() (*Config, error) {
 	conf.LoadEnv()
 	return conf, nil
 }
+
+// LoadEngine loads the settings cmd/engine runs with. The engine serves no
+// HTTP and signs nobody in, so the HTTP server, Google OAuth and CORS
+// settings of the gateway aren't read, let alone required.
+func LoadEngine() (*Config, error) {
+
+	conf := &Config{}
+
+	for _, part := range []any{&conf.TCP, &conf.EngineLimits, &conf.Messages, &conf.PostgreSQL, &conf.JWT, &conf.EnvLoad} {
+		if err := env.Parse(part); err != nil {
+			return nil, err
+		}
+	}
+	conf.LoadEnv()
+	return conf, nil
+}
@@ -1,7 +1,11 @@
 package config
 
+import "time"
+
 type Config struct {
 	TCP
+	EngineLimits
+	Messages
 	HTTPServer
 	GoogleOAuth
 	PostgreSQL
@@ -24,14 +28,136 @@ func (c *Config) LoadEnv() {
 		c.Cors = c.FrontEndOriginDev
 		c.RedirectURL = c.RedirectURLDev
 	}
+	// The frontend origin is always part of the CORS allowlist.
+	if c.Cors != "" {
+		c.AllowedOrigins = append([]string{c.Cors}, c.AllowedOrigins...)
+	}
 }
 
 type TCP struct {
 	TCPPort string `env:"TCP_SERVER_PORT,required"`
+	// FrameCompressionThreshold is the payload size in bytes from which
+	// engine frames are compressed, 0 disables compression.
+	FrameCompressionThreshold int `env:"FRAME_COMPRESSION_THRESHOLD" envDefault:"256"`
+	// EngineRecordFile turns on traffic recording, every frame the engine
+	// reads or writes is appended to this capture file. Meant for
+	// reproducing bugs, it records message contents.
+	EngineRecordFile string `env:"ENGINE_RECORD_FILE"`
+	// OutboundQueue is the number of frames the engine queues per gateway
+	// connection before OutboundOverflow applies.
+	OutboundQueue int `env:"ENGINE_OUTBOUND_QUEUE" envDefault:"256"`
+	// OutboundOverflow is what happens to a frame that doesn't fit a full
+	// queue: "disconnect" closes the slow gateway connection, "drop" drops
+	// the frame. Typing indicators are dropped once the queue is half full.
+	OutboundOverflow string `env:"ENGINE_OUTBOUND_OVERFLOW" envDefault:"disconnect"`
+	// EngineReconnectWindow is how long a gateway session redials a lost
+	// engine before it closes the WebSocket.
+	EngineReconnectWindow time.Duration `env:"ENGINE_RECONNECT_WINDOW" envDefault:"30s"`
+	// EngineReconnectBuffer is the number of browser actions a session
+	// holds while it redials, later ones are refused with
+	// engine_unavailable.
+	EngineReconnectBuffer int `env:"ENGINE_RECONNECT_BUFFER" envDefault:"32"`
+	// EngineMemberBatch is the most users whose memberships the engine
+	// fetches in one query.
+	EngineMemberBatch int `env:"ENGINE_MEMBER_BATCH" envDefault:"200"`
+	// EngineSnapshotFile is where the engine writes its room index and
+	// online users on shutdown, and reads them back on start. Empty turns
+	// snapshots off.
+	EngineSnapshotFile string `env:"ENGINE_SNAPSHOT_FILE"`
+	// EngineSnapshotMaxAge is the oldest snapshot whose room index is used
+	// to register returning users before the database answers. Older
+	// snapshots only tell which users to prefetch.
+	EngineSnapshotMaxAge time.Duration `env:"ENGINE_SNAPSHOT_MAX_AGE" envDefault:"1m"`
+	// EngineReconcileInterval is how often the engine compares the rooms
+	// of its online users with the database, catching membership changes
+	// it wasn't notified of. 0 turns it off.
+	EngineReconcileInterval time.Duration `env:"ENGINE_RECONCILE_INTERVAL" envDefault:"5m"`
+	// EnginePeers are the ENGINE_URLs of the other engines the gateways
+	// spread users over. The members of a conversation may be connected
+	// to any of them, so the engine relays the messages, typing
+	// indicators and presence of its users to each peer. Peers
+	// authenticate like gateways, with a client certificate or an
+	// assertion signed with JWT_SECRET_KEY. Empty for a single engine.
+	EnginePeers []string `env:"ENGINE_PEERS" envSeparator:","`
+	EngineAuth
+}
+
+// EngineAuth decides who may talk to the engine. Whatever reaches a unix
+// socket or passes the tls handshake is trusted to be a gateway, over
+// plain tcp the gateway vouches for each user with an assertion.
+type EngineAuth struct {
+	// EngineURL is where the engine listens and the gateway dials:
+	// tcp://host:port, unix:///path/to.sock or tls://host:port. Empty means
+	// tcp:// on TCP_SERVER_PORT. Unix sockets are created with mode 0660,
+	// access is granted through their directory and group.
+	EngineURL string `env:"ENGINE_URL"`
+	// EngineURLs are the engines a gateway spreads its sessions over, each
+	// user goes to one of them by consistent hashing. Every engine runs
+	// with its own ENGINE_URL, a gateway with an empty list dials
+	// ENGINE_URL.
+	EngineURLs []string `env:"ENGINE_URLS" envSeparator:","`
+	// EngineTLSCA, EngineTLSCert and EngineTLSKey are the credentials of a
+	// tls:// engine URL. Each side presents the certificate and only
+	// accepts a peer whose certificate the CA signed. In a single process
+	// the certificate is used for both ends and needs the server and client
+	// auth key usages. Renewed files are picked up without a restart.
+	EngineTLSCA   string `env:"ENGINE_TLS_CA"`
+	EngineTLSCert string `env:"ENGINE_TLS_CERT"`
+	EngineTLSKey  string `env:"ENGINE_TLS_KEY"`
+	// EngineTLSServerName is the name the gateway expects in the engine's
+	// certificate, the host of ENGINE_URL when empty.
+	EngineTLSServerName string `env:"ENGINE_TLS_SERVER_NAME"`
+	// Connect packets must carry a valid assertion, signed with
+	// JWT_SECRET_KEY, for the user they name, unless they come over a
+	// unix socket or a tls link whose client certificate was verified.
+	// EngineRequireToken requires the assertion over those too.
+	EngineRequireToken bool `env:"ENGINE_REQUIRE_TOKEN"`
+	// EngineInsecureConnect lets anything that reaches a tcp:// engine
+	// connect as any user without an assertion. Only meant for local
+	// development with gateways that don't sign their packets.
+	EngineInsecureConnect bool `env:"ENGINE_INSECURE_CONNECT"`
+}
+
+// EngineLimits are the token-bucket budgets the engine enforces before
+// fan-out. Rates are tokens per second, a rate of 0 disables that bucket.
+type EngineLimits struct {
+	UserMessageRate  float64 `env:"ENGINE_USER_MESSAGE_RATE" envDefault:"5"`
+	UserMessageBurst int     `env:"ENGINE_USER_MESSAGE_BURST" envDefault:"10"`
+	UserTypingRate   float64 `env:"ENGINE_USER_TYPING_RATE" envDefault:"2"`
+	UserTypingBurst  int     `env:"ENGINE_USER_TYPING_BURST" envDefault:"5"`
+
+	PrivateMessageRate  float64 `env:"ENGINE_PRIVATE_MESSAGE_RATE" envDefault:"10"`
+	PrivateMessageBurst int     `env:"ENGINE_PRIVATE_MESSAGE_BURST" envDefault:"20"`
+	PrivateTypingRate   float64 `env:"ENGINE_PRIVATE_TYPING_RATE" envDefault:"4"`
+	PrivateTypingBurst  int     `env:"ENGINE_PRIVATE_TYPING_BURST" envDefault:"8"`
+
+	GroupMessageRate  float64 `env:"ENGINE_GROUP_MESSAGE_RATE" envDefault:"20"`
+	GroupMessageBurst int     `env:"ENGINE_GROUP_MESSAGE_BURST" envDefault:"40"`
+	GroupTypingRate   float64 `env:"ENGINE_GROUP_TYPING_RATE" envDefault:"10"`
+	GroupTypingBurst  int     `env:"ENGINE_GROUP_TYPING_BURST" envDefault:"20"`
+}
+
+// Messages is the message-size policy the gateway and the engine share.
+type Messages struct {
+	// MessageMaxChars is the most Unicode characters a message holds,
+	// capped at packets.MaxContentChars.
+	MessageMaxChars int `env:"MESSAGE_MAX_CHARS" envDefault:"2000"`
 }
 
 type HTTPServer struct {
 	HTTPPort string `env:"HTTP_PORT,required"`
+	// RateLimitStore selects where the HTTP limiter keeps its state:
+	// "memory" for a single instance, "postgres" to share budgets between instances.
+	RateLimitStore string `env:"RATE_LIMIT_STORE" envDefault:"memory"`
+	// TrustedProxies lists the CIDRs (or bare IPs) of the load balancers in
+	// front of the API. Forwarding headers are only honoured from them.
+	TrustedProxies []string `env:"TRUSTED_PROXIES" envSeparator:","`
+	// WSCompressionThreshold is the message size in bytes from which
+	// WebSocket messages are sent with permessage-deflate, 0 disables it.
+	WSCompressionThreshold int `env:"WS_COMPRESSION_THRESHOLD" envDefault:"512"`
+	// AdminToken is the bearer token of the /admin endpoints, they're off
+	// when it's empty.
+	AdminToken string `env:"ADMIN_TOKEN"`
 }
 
 type GoogleOAuth struct {
@@ -55,6 +181,9 @@ type JWT struct {
 
 type CORS struct {
 	Cors string `env:"CORS"`
+	// AllowedOrigins lists extra origins (admin console, mobile webview shell...).
+	// Entries may use a wildcard subdomain, e.g. "https://*.realtimegateway.me".
+	AllowedOrigins []string `env:"CORS_ALLOWED_ORIGINS" envSeparator:","`
 }
 
 type EnvLoad struct {
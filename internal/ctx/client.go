@@ -0,0 +1,28 @@
+package ctx
+
+import "context"
+
+type ctxClient struct{}
+
+// Client is what the gateway knows about the caller once trusted proxies
+// have been peeled off: the real address and the scheme and host the
+// request was originally sent to.
+type Client struct {
+	IP     string
+	Scheme string
+	Host   string
+}
+
+// BaseURL returns the origin the client used, e.g. "https://api.example.com".
+func (c Client) BaseURL() string {
+	return c.Scheme + "://" + c.Host
+}
+
+func SetClient(ctx context.Context, c Client) context.Context {
+	return context.WithValue(ctx, ctxClient{}, c)
+}
+
+func ClientInfo(ctx context.Context) (Client, bool) {
+	c, ok := ctx.Value(ctxClient{}).(Client)
+	return c, ok
+}
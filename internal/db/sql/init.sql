@@ -105,3 +105,26 @@ COMMENT ON TABLE providers IS
 'Store needed providers data';
 
 
+
+CREATE UNLOGGED TABLE IF NOT EXISTS rate_limit_tat(
+	key TEXT NOT NULL,
+	tat TIMESTAMPTZ NOT NULL,
+
+	PRIMARY KEY (key)
+);
+
+COMMENT ON TABLE rate_limit_tat IS
+'Token bucket state shared by every API instance.
+Stores the theoretical arrival time of the next request per limiter key, rows in the past are pruned.';
+
+CREATE UNLOGGED TABLE IF NOT EXISTS rate_limit_windows(
+	key TEXT NOT NULL,
+	window_start TIMESTAMPTZ NOT NULL,
+	count BIGINT NOT NULL DEFAULT 0,
+
+	PRIMARY KEY (key, window_start)
+);
+
+COMMENT ON TABLE rate_limit_windows IS
+'Sliding window counters shared by every API instance.
+One row per limiter key and fixed window, old windows are pruned.';
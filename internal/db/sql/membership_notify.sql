@@ -0,0 +1,30 @@
+-- Runs after init.sql. Engines LISTEN on the membership channel to keep
+-- their rooms in step with users_conversations, however the table is
+-- changed. Safe to apply again on an existing database.
+
+CREATE OR REPLACE FUNCTION notify_membership() RETURNS trigger AS $$
+BEGIN
+	IF TG_OP IN ('DELETE', 'UPDATE') THEN
+		PERFORM pg_notify('membership', json_build_object(
+			'user', OLD.user_id, 'conversation', OLD.conversation_id, 'joined', false,
+			'type', (SELECT conversation_type FROM conversations WHERE conversation_id = OLD.conversation_id))::text);
+	END IF;
+	IF TG_OP IN ('INSERT', 'UPDATE') THEN
+		PERFORM pg_notify('membership', json_build_object(
+			'user', NEW.user_id, 'conversation', NEW.conversation_id, 'joined', true,
+			'type', (SELECT conversation_type FROM conversations WHERE conversation_id = NEW.conversation_id))::text);
+	END IF;
+	RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+COMMENT ON FUNCTION notify_membership() IS
+'Tells listening engines that a user joined or left a conversation and
+the conversation''s type. An update is sent as leaving the old row and
+joining the new one.';
+
+DROP TRIGGER IF EXISTS users_conversations_notify ON users_conversations;
+
+CREATE TRIGGER users_conversations_notify
+AFTER INSERT OR DELETE OR UPDATE OF user_id, conversation_id ON users_conversations
+FOR EACH ROW EXECUTE FUNCTION notify_membership();
@@ -0,0 +1,103 @@
+package errors
+
+import "fmt"
+
+// Code pinpoints why a request failed when the Kind alone isn't enough for
+// the client to react, e.g. telling "not a member" apart from "message not
+// found" although both are Client errors. Codes travel in error packets
+// and reach browsers as error events, see Event.
+type Code uint8
+
+const (
+	NotAMember Code = iota + 1
+	MessageNotFound
+	NotAuthor
+	TooLarge
+	InvalidPayload
+	InvalidJSON
+	UnknownType
+	InvalidRequest
+	ConversationNotFound
+	InternalFailure
+	ProtocolViolation
+	TooManyErrors
+	Unauthenticated
+	EngineUnavailable
+	InvalidMsgPack
+)
+
+// codeInfo is one entry of the catalogue. Fatal codes end the session,
+// everything else is reported and the session stays open.
+type codeInfo struct {
+	name    string
+	message string
+	fatal   bool
+}
+
+var catalogue = map[Code]codeInfo{
+	NotAMember:           {"not_a_member", "you are not a member of this conversation", false},
+	MessageNotFound:      {"message_not_found", "the message doesn't exist", false},
+	NotAuthor:            {"not_author", "only the author can change this message", false},
+	TooLarge:             {"too_large", "the message is too large", false},
+	InvalidPayload:       {"invalid_payload", "the payload is missing or has invalid fields", false},
+	InvalidJSON:          {"invalid_json", "the message isn't valid JSON", false},
+	UnknownType:          {"unknown_type", "unknown message type", false},
+	InvalidRequest:       {"invalid_request", "the request was rejected", false},
+	ConversationNotFound: {"conversation_not_found", "the conversation doesn't exist", false},
+	InternalFailure:      {"internal_error", "something went wrong, try again", false},
+	ProtocolViolation:    {"protocol_violation", "protocol violation", true},
+	TooManyErrors:        {"too_many_errors", "too many invalid messages", true},
+	Unauthenticated:      {"unauthenticated", "the session couldn't be authenticated", true},
+	EngineUnavailable:    {"engine_unavailable", "reconnecting to the server, try again shortly", false},
+	InvalidMsgPack:       {"invalid_msgpack", "the message isn't valid MessagePack", false},
+}
+
+func (c Code) String() string {
+	if info, ok := catalogue[c]; ok {
+		return info.name
+	}
+	return "unknown_error"
+}
+
+// Message is a human readable description safe to show to end users.
+func (c Code) Message() string {
+	if info, ok := catalogue[c]; ok {
+		return info.message
+	}
+	return "unknown error"
+}
+
+// Fatal reports whether the session must be closed after this error.
+func (c Code) Fatal() bool {
+	return catalogue[c].fatal
+}
+
+func (c Code) Error() string {
+	return fmt.Sprintf("error code: %v", int(c))
+}
+
+// CodeOf returns the first Code found in err's chain, 0 when there is none.
+func CodeOf(err error) Code {
+	var e *Error
+	for As(err, &e) {
+		if e.Code != 0 {
+			return e.Code
+		}
+		err = e.Err
+	}
+	return 0
+}
+
+// Event is the JSON error event delivered to WebSocket clients. Action and
+// ID are set when the error answers a specific request.
+type Event struct {
+	Error   string `json:"error"`
+	Message string `json:"message"`
+	Action  string `json:"action,omitempty"`
+	ID      string `json:"id,omitempty"`
+}
+
+// Event builds the error event for c.
+func (c Code) Event(action, id string) Event {
+	return Event{Error: c.String(), Message: c.Message(), Action: action, ID: id}
+}
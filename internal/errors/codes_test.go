@@ -0,0 +1,51 @@
+package errors_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/iLeoon/realtime-gateway/internal/errors"
+)
+
+func TestCatalogue(t *testing.T) {
+	seen := map[string]bool{}
+	for c := errors.NotAMember; c <= errors.InvalidMsgPack; c++ {
+		name := c.String()
+		if name == "unknown_error" || c.Message() == "unknown error" {
+			t.Fatalf("code %d is missing from the catalogue", c)
+		}
+		if seen[name] {
+			t.Fatalf("code name %q is used twice", name)
+		}
+		seen[name] = true
+	}
+	if errors.NotAMember.Fatal() || !errors.ProtocolViolation.Fatal() {
+		t.Fatal("unexpected fatal classification")
+	}
+}
+
+func TestCodeBubblesUp(t *testing.T) {
+	inner := errors.B(errors.PathName("a"), errors.Op("inner"), errors.Client, errors.NotAMember, "no")
+	outer := errors.B(errors.PathName("b"), errors.Op("outer"), inner)
+
+	if errors.CodeOf(outer) != errors.NotAMember {
+		t.Fatalf("expected not_a_member, got %s", errors.CodeOf(outer))
+	}
+	if !errors.Is(outer, errors.NotAMember) || !errors.Is(outer, errors.Client) {
+		t.Fatal("the wrapped error lost its code or kind")
+	}
+	if errors.CodeOf(errors.New("plain")) != 0 {
+		t.Fatal("plain errors carry no code")
+	}
+}
+
+func TestEvent(t *testing.T) {
+	b, err := json.Marshal(errors.TooLarge.Event("send_message", "r1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"error":"too_large","message":"the message is too large","action":"send_message","id":"r1"}`
+	if string(b) != want {
+		t.Fatalf("got %s, want %s", b, want)
+	}
+}
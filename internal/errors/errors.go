@@ -21,6 +21,7 @@ const (
 	Network
 	ServiceUnavailable
 	Forbidden
+	RateLimited
 )
 
 func (k Kind) String() string {
@@ -39,6 +40,8 @@ func (k Kind) String() string {
 		return "service is down or unavailable"
 	case Forbidden:
 		return "forbidden"
+	case RateLimited:
+		return "too many requests"
 	}
 	return "unknown error"
 }
@@ -51,11 +54,12 @@ type Error struct {
 	Path PathName
 	Op   Op
 	Kind Kind
+	Code Code
 	Err  error
 }
 
 func (e *Error) isZero() bool {
-	return e.Path == "" && e.Op == "" && e.Kind == 0 && e.Err == nil
+	return e.Path == "" && e.Op == "" && e.Kind == 0 && e.Code == 0 && e.Err == nil
 }
 func (e *Error) Unwrap() error {
 	return e.Err
@@ -85,6 +89,8 @@ func B(args ...any) error {
 			e.Path = arg
 		case Kind:
 			e.Kind = arg
+		case Code:
+			e.Code = arg
 		case string:
 			e.Err = New(arg)
 		case *Error:
@@ -116,6 +122,14 @@ func B(args ...any) error {
 		e.Kind = prev.Kind
 		prev.Kind = 0
 	}
+
+	// Codes bubble up like kinds do.
+	if e.Code == 0 {
+		e.Code = prev.Code
+		prev.Code = 0
+	} else if prev.Code == e.Code {
+		prev.Code = 0
+	}
 	return e
 }
 
@@ -139,6 +153,11 @@ func (e *Error) Error() string {
 		b.WriteString(e.Kind.String())
 	}
 
+	if e.Code != 0 {
+		append(b, ": ")
+		b.WriteString(e.Code.String())
+	}
+
 	if e.Err != nil {
 		if prevErr, ok := e.Err.(*Error); ok {
 			if !prevErr.isZero() {
@@ -160,6 +179,11 @@ func (e *Error) Is(target error) bool {
 		return e.Kind == targetKind
 	}
 
+	// The user passed a Code (e.g., Is(err, errors.NotAMember))
+	if targetCode, ok := target.(Code); ok {
+		return e.Code == targetCode
+	}
+
 	// Case 2: The user passed another *Error struct
 	if targetErr, ok := target.(*Error); ok {
 		if targetErr.Kind != 0 && e.Kind == targetErr.Kind {
@@ -181,6 +205,12 @@ func Is[T any](err error, target T) bool {
 	return errors.Is(err, targetErr)
 }
 
+// As finds the first error in err's chain that matches target, it's a thin
+// wrapper around the standard library errors.As.
+func As(err error, target any) bool {
+	return errors.As(err, target)
+}
+
 // Errorf is equivalent to fmt.Errorf, but allows clients to import only this
 // package for all error handling.
 func Errorf(format string, args ...interface{}) error {
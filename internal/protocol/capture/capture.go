@@ -0,0 +1,177 @@
+// Package capture reads and writes recordings of engine traffic. A capture
+// is a sequence of timestamped frames exactly as they crossed the wire,
+// tagged with the connection they belong to and their direction.
+//
+// File layout, all integers big-endian:
+//
+//	"GWCAP" [1]FormatVersion
+//	then per record:
+//	[8]UnixNano [4]Conn [1]Direction [1]ProtocolVersion [4]Length [Length]Frame
+package capture
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/iLeoon/realtime-gateway/internal/errors"
+	"github.com/iLeoon/realtime-gateway/internal/protocol"
+)
+
+const path errors.PathName = "protocol/capture"
+
+const (
+	magic         = "GWCAP"
+	formatVersion = 1
+	recordHeader  = 18
+	// maxFrameLen bounds a record, no valid frame comes close to it.
+	maxFrameLen = 64 * 1024
+)
+
+// Direction tells which way a frame went, seen from the engine.
+type Direction uint8
+
+const (
+	// Inbound frames were sent by the gateway to the engine.
+	Inbound Direction = iota + 1
+	// Outbound frames were sent by the engine to the gateway.
+	Outbound
+)
+
+func (d Direction) String() string {
+	switch d {
+	case Inbound:
+		return "in"
+	case Outbound:
+		return "out"
+	}
+	return "unknown"
+}
+
+// Record is one captured frame.
+type Record struct {
+	Time      time.Time
+	Conn      uint32 // Connection sequence number within the capture.
+	Direction Direction
+	Version   uint8  // Protocol version the connection spoke.
+	Frame     []byte // The encoded frame, header included.
+}
+
+// Decode parses the captured frame.
+func (r Record) Decode() (*protocol.Frame, error) {
+	return protocol.DecodeFrameVersion(bytes.NewReader(r.Frame), r.Version)
+}
+
+// Writer appends records to a capture. It's safe for concurrent use, every
+// connection of a server may share one Writer.
+type Writer struct {
+	mu  sync.Mutex
+	w   *bufio.Writer
+	hdr [recordHeader]byte
+}
+
+// NewWriter writes the capture header to w and returns a Writer for it.
+// Records are buffered, call Flush before closing w.
+func NewWriter(w io.Writer) (*Writer, error) {
+	const op errors.Op = "capture.NewWriter"
+	cw := &Writer{w: bufio.NewWriter(w)}
+	cw.w.WriteString(magic)
+	cw.w.WriteByte(formatVersion)
+	if err := cw.w.Flush(); err != nil {
+		return nil, errors.B(path, op, errors.Internal, err)
+	}
+	return cw, nil
+}
+
+// Write appends a record.
+func (w *Writer) Write(r Record) error {
+	const op errors.Op = "capture.Write"
+	if len(r.Frame) > maxFrameLen {
+		return errors.B(path, op, errors.Internal, "frame is too large to capture")
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	binary.BigEndian.PutUint64(w.hdr[0:8], uint64(r.Time.UnixNano()))
+	binary.BigEndian.PutUint32(w.hdr[8:12], r.Conn)
+	w.hdr[12] = uint8(r.Direction)
+	w.hdr[13] = r.Version
+	binary.BigEndian.PutUint32(w.hdr[14:18], uint32(len(r.Frame)))
+	w.w.Write(w.hdr[:])
+	if _, err := w.w.Write(r.Frame); err != nil {
+		return errors.B(path, op, errors.Internal, err)
+	}
+	return nil
+}
+
+// Flush writes buffered records to the underlying writer.
+func (w *Writer) Flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.w.Flush()
+}
+
+// Reader reads records from a capture.
+type Reader struct {
+	r   *bufio.Reader
+	hdr [recordHeader]byte
+}
+
+// NewReader checks the capture header and returns a Reader positioned on
+// the first record.
+func NewReader(r io.Reader) (*Reader, error) {
+	const op errors.Op = "capture.NewReader"
+	cr := &Reader{r: bufio.NewReader(r)}
+	head := make([]byte, len(magic)+1)
+	if _, err := io.ReadFull(cr.r, head); err != nil || string(head[:len(magic)]) != magic {
+		return nil, errors.B(path, op, errors.Client, "not a capture file")
+	}
+	if head[len(magic)] != formatVersion {
+		return nil, errors.B(path, op, errors.Client, fmt.Errorf("unsupported capture format %d", head[len(magic)]))
+	}
+	return cr, nil
+}
+
+// Next returns the next record, io.EOF after the last one.
+func (r *Reader) Next() (Record, error) {
+	const op errors.Op = "capture.Next"
+	if _, err := io.ReadFull(r.r, r.hdr[:]); err != nil {
+		if err == io.EOF {
+			return Record{}, io.EOF
+		}
+		return Record{}, errors.B(path, op, errors.Client, "truncated record", err)
+	}
+	length := binary.BigEndian.Uint32(r.hdr[14:18])
+	if length > maxFrameLen {
+		return Record{}, errors.B(path, op, errors.Client, fmt.Errorf("record of %d bytes is too large", length))
+	}
+	rec := Record{
+		Time:      time.Unix(0, int64(binary.BigEndian.Uint64(r.hdr[0:8]))),
+		Conn:      binary.BigEndian.Uint32(r.hdr[8:12]),
+		Direction: Direction(r.hdr[12]),
+		Version:   r.hdr[13],
+		Frame:     make([]byte, length),
+	}
+	if _, err := io.ReadFull(r.r, rec.Frame); err != nil {
+		return Record{}, errors.B(path, op, errors.Client, "truncated record", err)
+	}
+	return rec, nil
+}
+
+// ReadAll reads every remaining record.
+func (r *Reader) ReadAll() ([]Record, error) {
+	var records []Record
+	for {
+		rec, err := r.Next()
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil {
+			return records, err
+		}
+		records = append(records, rec)
+	}
+}
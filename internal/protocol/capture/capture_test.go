@@ -0,0 +1,100 @@
+package capture_test
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/iLeoon/realtime-gateway/internal/protocol"
+	"github.com/iLeoon/realtime-gateway/internal/protocol/capture"
+	"github.com/iLeoon/realtime-gateway/internal/protocol/packets"
+)
+
+func encode(t *testing.T, pkt packets.BuildPayload, version uint8) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := protocol.ConstructFrame(pkt).ForVersion(version).EncodeFrame(&buf); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// TestConnSplitsFrames writes frames in odd sized chunks through a
+// recording connection and expects one record per frame on each side.
+func TestConnSplitsFrames(t *testing.T) {
+	var file bytes.Buffer
+	w, err := capture.NewWriter(&file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	engine, gateway := net.Pipe()
+	rec := capture.NewConn(engine, w, 7, capture.Inbound)
+
+	sent := []packets.BuildPayload{
+		&packets.ConnectPacket{ConnectionID: 1, UserID: 2},
+		&packets.SendMessagePacket{ConversationID: 3, Content: "split me"},
+		&packets.PingPacket{},
+	}
+	var stream []byte
+	for _, p := range sent {
+		stream = append(stream, encode(t, p, packets.Version1)...)
+	}
+
+	go func() {
+		for i := 0; i < len(stream); i += 5 {
+			gateway.Write(stream[i:min(i+5, len(stream))])
+		}
+	}()
+	dec := protocol.NewDecoder(rec)
+	for range sent {
+		if _, err := dec.Decode(packets.Version1); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reply := encode(t, &packets.TypingPacket{ConversationID: 3, IsTyping: true}, packets.Version1)
+	go io.Copy(io.Discard, gateway)
+	rec.Write(reply[:3])
+	rec.Write(reply[3:])
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := capture.NewReader(&file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records, err := r.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != len(sent)+1 {
+		t.Fatalf("expected %d records, got %d", len(sent)+1, len(records))
+	}
+	for i, want := range append(sent, &packets.TypingPacket{ConversationID: 3, IsTyping: true}) {
+		rec := records[i]
+		wantDir := capture.Inbound
+		if i == len(sent) {
+			wantDir = capture.Outbound
+		}
+		if rec.Conn != 7 || rec.Direction != wantDir {
+			t.Fatalf("record %d: conn %d direction %s", i, rec.Conn, rec.Direction)
+		}
+		frame, err := rec.Decode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(frame.Payload, want) {
+			t.Fatalf("record %d: got %v, want %v", i, frame.Payload, want)
+		}
+	}
+}
+
+func TestReaderRejectsOtherFiles(t *testing.T) {
+	if _, err := capture.NewReader(bytes.NewReader([]byte("not a capture"))); err == nil {
+		t.Fatal("expected an error")
+	}
+}
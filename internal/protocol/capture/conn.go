@@ -0,0 +1,89 @@
+package capture
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/iLeoon/realtime-gateway/internal/protocol"
+	"github.com/iLeoon/realtime-gateway/internal/protocol/packets"
+	"github.com/iLeoon/realtime-gateway/pkg/log"
+)
+
+// Conn records every frame read from and written to a connection. Reads
+// and writes don't have to line up with frames, the byte streams are
+// split on frame boundaries before they are recorded.
+type Conn struct {
+	net.Conn
+	w       *Writer
+	id      uint32
+	read    Direction
+	version atomic.Uint32
+	rbuf    []byte
+	wbuf    []byte
+}
+
+// NewConn wraps conn, frames are recorded under id. read is the direction
+// of the frames read from conn: Inbound on the engine, Outbound for a
+// client of the engine.
+func NewConn(conn net.Conn, w *Writer, id uint32, read Direction) *Conn {
+	c := &Conn{Conn: conn, w: w, id: id, read: read}
+	c.version.Store(uint32(packets.Version1))
+	return c
+}
+
+// SetVersion records the protocol version the connection switched to,
+// once the handshake completed.
+func (c *Conn) SetVersion(v uint8) {
+	c.version.Store(uint32(v))
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.rbuf = c.record(c.rbuf, p[:n], c.read)
+	}
+	return n, err
+}
+
+func (c *Conn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if n > 0 {
+		dir := Outbound
+		if c.read == Outbound {
+			dir = Inbound
+		}
+		c.wbuf = c.record(c.wbuf, p[:n], dir)
+	}
+	return n, err
+}
+
+// record appends p to the pending bytes of one direction and writes out
+// every complete frame. It returns what is left of the pending bytes.
+func (c *Conn) record(pending, p []byte, dir Direction) []byte {
+	pending = append(pending, p...)
+	now := time.Now()
+	for {
+		n, ok := protocol.FrameLen(pending)
+		if ok && n > maxFrameLen {
+			// Not a frame we could ever complete, keep the bytes as they are.
+			n = len(pending)
+		}
+		if !ok || len(pending) < n {
+			break
+		}
+		err := c.w.Write(Record{
+			Time:      now,
+			Conn:      c.id,
+			Direction: dir,
+			Version:   uint8(c.version.Load()),
+			Frame:     pending[:n],
+		})
+		if err != nil {
+			log.Error.Println("failed to record a frame", err)
+		}
+		pending = pending[n:]
+	}
+	// Keep the partial frame at the start of the buffer.
+	return append(pending[:0:0], pending...)
+}
@@ -0,0 +1,87 @@
+package protocol
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"sync"
+
+	"github.com/iLeoon/realtime-gateway/internal/errors"
+)
+
+// DefaultCompressionThreshold is the payload size from which compressing
+// usually pays off, smaller payloads mostly grow.
+const DefaultCompressionThreshold = 256
+
+// flate writers allocate several hundred KB each, they are reused along
+// with the sink they write to.
+var (
+	deflaters = sync.Pool{New: func() any {
+		d := &deflater{}
+		d.w, _ = flate.NewWriter(&d.out, flate.BestSpeed)
+		return d
+	}}
+	inflaters = sync.Pool{New: func() any {
+		return flate.NewReader(nil)
+	}}
+)
+
+type deflater struct {
+	w   *flate.Writer
+	out appendWriter
+}
+
+// appendWriter is an io.Writer appending to a caller-owned slice.
+type appendWriter struct {
+	b []byte
+}
+
+func (a *appendWriter) Write(p []byte) (int, error) {
+	a.b = append(a.b, p...)
+	return len(p), nil
+}
+
+// deflate appends b compressed with raw DEFLATE (RFC 1951) to dst.
+func deflate(dst, b []byte) ([]byte, error) {
+	d := deflaters.Get().(*deflater)
+	defer deflaters.Put(d)
+	d.out.b = dst
+	defer func() { d.out.b = nil }()
+	d.w.Reset(&d.out)
+	if _, err := d.w.Write(b); err != nil {
+		return nil, err
+	}
+	if err := d.w.Close(); err != nil {
+		return nil, err
+	}
+	return d.out.b, nil
+}
+
+// inflate appends b decompressed to dst, failing when the result exceeds
+// limit so a tiny frame can't expand into an arbitrarily large buffer.
+func inflate(dst, b []byte, limit uint32) ([]byte, error) {
+	const op errors.Op = "protocol.inflate"
+	r := inflaters.Get().(io.ReadCloser)
+	defer inflaters.Put(r)
+	if err := r.(flate.Resetter).Reset(bytes.NewReader(b), nil); err != nil {
+		return nil, errors.B(path, op, errors.Client, err)
+	}
+
+	out := dst
+	for {
+		if len(out) == cap(out) {
+			out = append(out, 0)[:len(out)]
+		}
+		n, err := r.Read(out[len(out):cap(out)])
+		out = out[:len(out)+n]
+		if len(out)-len(dst) > int(limit) {
+			return nil, errors.B(path, op, errors.Client, errors.TooLarge, "the decompressed payload hit the maximum size")
+		}
+		if err == io.EOF {
+			return out, nil
+		}
+		if err != nil {
+			return nil, errors.B(path, op, errors.Client, errors.InvalidPayload, err)
+		}
+	}
+}
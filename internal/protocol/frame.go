@@ -1,21 +1,52 @@
 package protocol
 
 import (
+	"bytes"
 	"encoding/binary"
 	"fmt"
 	"io"
 	"net"
+	"slices"
+	"sync"
 
 	"github.com/iLeoon/realtime-gateway/internal/errors"
 	"github.com/iLeoon/realtime-gateway/internal/protocol/packets"
 )
 
 const (
-	path          errors.PathName = "protocol/frame"
-	protocolMagic byte            = 0x89 // Protocol identifier.
-	MaxPayloadLen uint32          = 1024 // Verify payload length.
+	path            errors.PathName = "protocol/frame"
+	protocolMagic   byte            = 0x89 // Protocol identifier, Version1 header.
+	protocolMagicV2 byte            = 0x8A // Protocol identifier, header with flags.
+	MaxPayloadLen   uint32          = 1024 // Verify payload length.
+	// MaxMessageLen bounds a packet payload fragmented over several
+	// frames, see FlagFragmented.
+	MaxMessageLen uint32 = 32 * 1024
+
+	headerLen   = 6
+	headerLenV2 = 7
+)
+
+// Header flags, only Version2 frames carry them.
+const (
+	// FlagCorrelated marks a payload prefixed with a 4-byte correlation ID.
+	FlagCorrelated uint8 = 1 << iota
+	// FlagCompressed marks a packet payload compressed with raw DEFLATE.
+	// The correlation ID, when present, is never compressed.
+	FlagCompressed
+	// FlagFragmented marks a frame whose payload continues in the next
+	// one, Version3 only. Payloads above MaxPayloadLen are split over a
+	// first frame carrying the other flags and continuation frames of the
+	// same opcode that carry no flag but this one, the last fragment
+	// clears it.
+	FlagFragmented
 )
 
+// knownFlags is the set of header flags this build understands. Frames
+// carrying any other bit are rejected.
+const knownFlags = FlagCorrelated | FlagCompressed | FlagFragmented
+
+const correlationLen = 4
+
 // Frame represents a binary protocol message exchanged between
 // The WebSocket gateway and the TCP engine.
 // // Structure:
@@ -31,16 +62,33 @@ const (
 // Length:  4 bytes  - payload length
 // Payload: M bytes  - actual user/application data
 // It encapsulates both the fixed-size frame header and the variable-length payload
+//
+// Once both peers negotiated Version2 the header grows a flags byte and
+// uses a different magic value, so a decoder can always tell them apart:
+//
+//	+-------+--------+-------+--------+------------
+//	| Magic | Opcode | Flags | Length | Payload   |
+//	+-------+--------+-------+--------+------------
 type Frame struct {
 	Header  FrameHeader
 	Payload packets.BuildPayload
+	// CorrelationID ties a reply to the request it answers, 0 means none.
+	// It's only encoded on Version2 frames, see WithCorrelation.
+	CorrelationID uint32
+	// compressFrom is the payload size from which the payload is
+	// compressed, 0 disables compression. See WithCompression.
+	compressFrom int
+	// version is the protocol version set with ForVersion or decoded
+	// with, from Version3 on large payloads are fragmented.
+	version uint8
 }
 
 // FrameHeader represents the fixed-size header of every protocol frame.
-// It's 6 bytes - usually contains metadata (length, type, flags, etc.)
+// It's 6 bytes (7 with Version2) - usually contains metadata (length, type, flags, etc.)
 type FrameHeader struct {
 	Magic  uint8
 	Opcode uint8
+	Flags  uint8 // Always 0 on Version1 frames.
 	Length uint32
 }
 
@@ -58,74 +106,256 @@ func ConstructFrame(p packets.BuildPayload) *Frame {
 	}
 }
 
+// ForVersion switches the frame to the header layout of the negotiated
+// protocol version. Versioned packets are told to use its layout too.
+func (f *Frame) ForVersion(version uint8) *Frame {
+	f.version = version
+	if version >= packets.Version2 {
+		f.Header.Magic = protocolMagicV2
+	} else {
+		f.Header.Magic = protocolMagic
+		f.Header.Flags = 0
+	}
+	if v, ok := f.Payload.(packets.Versioned); ok {
+		v.SetVersion(version)
+	}
+	return f
+}
+
+// WithCompression compresses payloads of at least threshold bytes, as long
+// as it makes them smaller. The caller must only do so on connections that
+// negotiated FeatureCompression, Version1 frames are never compressed.
+func (f *Frame) WithCompression(threshold int) *Frame {
+	f.compressFrom = threshold
+	return f
+}
+
+// WithCorrelation tags the frame with a correlation ID. The caller must
+// only do so on connections that negotiated FeatureCorrelation.
+func (f *Frame) WithCorrelation(id uint32) *Frame {
+	f.CorrelationID = id
+	return f
+}
+
+// bufferPool holds frame-sized scratch buffers so encoding a frame doesn't
+// allocate one per write.
+var bufferPool = sync.Pool{New: func() any {
+	b := make([]byte, 0, headerLenV2+correlationLen+int(MaxPayloadLen))
+	return &b
+}}
+
 // EncodeFrame operates on the frame method itself, to transforms
 // the high-level frame struct into exactly the byte sequence expected by the protocol.
 //
-// It computes the payload length, writes it into the header using big-endian
-// byte order, and allocates a byte slice large enough to hold the entire
-// frame (6 bytes of header plus the payload). The header fields are written
-// manually into the first 6 bytes, after which the payload is copied into
-// the remainder of the slice. The fully encoded frame is then written to
-// the underlying connection.
+// The frame is assembled in a pooled buffer by AppendFrame and handed to w
+// in a single Write, w must not retain the slice.
 func (f *Frame) EncodeFrame(w io.Writer) error {
-	const op errors.Op = "frame.EncodeFrame"
-	// Get the actual payload slice which is a slice of bytes.
-	payloadSlice, err := f.Payload.Encode()
+	buf := bufferPool.Get().(*[]byte)
+	defer bufferPool.Put(buf)
+
+	b, err := f.AppendFrame((*buf)[:0])
 	if err != nil {
 		return err
 	}
+	*buf = b
+
+	//Write the frame into the connection
+	_, writeErr := w.Write(b)
+	if writeErr != nil {
+		return writeErr
+	}
+	return nil
+}
+
+// AppendFrame appends the encoded frame to b and returns the extended
+// slice. The header is written first with a zero length, the payload is
+// appended right after it (through packets.Appender when the packet
+// implements it) and the length is patched in once it's known.
+func (f *Frame) AppendFrame(b []byte) ([]byte, error) {
+	const op errors.Op = "frame.EncodeFrame"
+	if f.Header.Flags&^knownFlags != 0 {
+		return b, errors.B(path, op, errors.Internal, "trying to encode unknown frame flags")
+	}
+
+	start := len(b)
+	hLen := headerLen
+	flags := f.Header.Flags &^ FlagCompressed
+	if f.Header.Magic == protocolMagicV2 {
+		hLen = headerLenV2
+		if f.CorrelationID != 0 {
+			flags |= FlagCorrelated
+		}
+	} else {
+		flags = 0
+	}
+
+	// FlagFragmented is the encoder's to set, see fragment.
+	flags &^= FlagFragmented
+	b = append(b, f.Header.Magic, f.Header.Opcode)
+	if hLen == headerLenV2 {
+		b = append(b, flags)
+	}
+	b = append(b, 0, 0, 0, 0)
+
+	// The correlation ID travels as the first bytes of the payload.
+	if flags&FlagCorrelated != 0 {
+		b = binary.BigEndian.AppendUint32(b, f.CorrelationID)
+	}
+
+	payloadStart := len(b)
+	b, err := appendPayload(b, f.Payload)
+	if err != nil {
+		return b[:start], err
+	}
 	// Compute length.
-	sizeOfPayload := len(payloadSlice)
+	sizeOfPayload := len(b) - payloadStart
 
 	if sizeOfPayload == 0 && f.Header.Opcode != packets.Ping && f.Header.Opcode != packets.Pong {
-		return errors.B(path, op, errors.Internal, "trying to encode an empty payload")
+		return b[:start], errors.B(path, op, errors.Internal, "trying to encode an empty payload")
 	}
 
-	// Validate the max payload length before encoding.
-	if sizeOfPayload > int(MaxPayloadLen) {
-		return errors.B(path, op, errors.Internal, "the payload hit the maximum size")
+	// Validate the max payload length before encoding. It's the packet
+	// that is too large, not the connection that failed.
+	if sizeOfPayload > int(maxPacketLen(f.version)) {
+		return b[:start], errors.B(path, op, errors.Client, errors.TooLarge, "the payload hit the maximum size")
 	}
 
-	// A slice to hold the bytes of the exact size we need.
-	frame := make([]byte, 6+sizeOfPayload)
+	if hLen == headerLenV2 && f.compressFrom > 0 && sizeOfPayload >= f.compressFrom {
+		// Compress into the spare capacity behind the payload, then move
+		// it in place when it's worth it.
+		compressed, err := deflate(b[len(b):], b[payloadStart:])
+		if err != nil {
+			return b[:start], errors.B(path, op, errors.Internal, err)
+		}
+		if len(compressed) < sizeOfPayload {
+			n := copy(b[payloadStart:], compressed)
+			b = b[:payloadStart+n]
+			flags |= FlagCompressed
+		}
+	}
 
-	// Allocate each byte in the slice.
-	frame[0] = f.Header.Magic
-	frame[1] = f.Header.Opcode
-	binary.BigEndian.PutUint32(frame[2:], uint32(sizeOfPayload))
-	f.Header.Length = uint32(sizeOfPayload)
+	length := uint32(len(b) - start - hLen)
+	f.Header.Flags = flags
+	f.Header.Length = length
+	// Only Version3 payloads can exceed a frame, older ones were bounded
+	// above.
+	frameCap := MaxPayloadLen
+	if flags&FlagCorrelated != 0 {
+		frameCap += correlationLen
+	}
+	if length > frameCap {
+		return fragment(b, start, flags), nil
+	}
+	if hLen == headerLenV2 {
+		b[start+2] = flags
+	}
+	binary.BigEndian.PutUint32(b[start+hLen-4:], length)
+	return b, nil
+}
 
-	// After allocation of the first 6 bytes as our frame header
-	// we copy the payload slice into the rest of the frame slice.
-	copy(frame[6:], payloadSlice)
+// maxPacketLen is the largest packet payload a connection speaking version
+// takes, before compression.
+func maxPacketLen(version uint8) uint32 {
+	if version >= packets.Version3 {
+		return MaxMessageLen
+	}
+	return MaxPayloadLen
+}
 
-	//Write the frame into the connection
-	_, writeErr := w.Write(frame)
-	if writeErr != nil {
-		return writeErr
+// fragment rewrites the Version2 frame at b[start:] as a first frame of
+// at most MaxPayloadLen payload bytes, plus the correlation ID, followed by
+// continuation frames, see FlagFragmented.
+func fragment(b []byte, start int, flags uint8) []byte {
+	opcode := b[start+1]
+	body := bytes.Clone(b[start+headerLenV2:])
+	b = b[:start]
+
+	chunk := int(MaxPayloadLen)
+	if flags&FlagCorrelated != 0 {
+		chunk += correlationLen
 	}
-	return nil
+	for first := true; len(body) > 0; first = false {
+		n := min(chunk, len(body))
+		var fl uint8
+		if first {
+			fl = flags
+		}
+		if n < len(body) {
+			fl |= FlagFragmented
+		}
+		b = append(b, protocolMagicV2, opcode, fl)
+		b = binary.BigEndian.AppendUint32(b, uint32(n))
+		b = append(b, body[:n]...)
+		body = body[n:]
+		chunk = int(MaxPayloadLen)
+	}
+	return b
+}
+
+func appendPayload(b []byte, p packets.BuildPayload) ([]byte, error) {
+	if a, ok := p.(packets.Appender); ok {
+		return a.AppendEncode(b)
+	}
+	// Get the actual payload slice which is a slice of bytes.
+	payload, err := p.Encode()
+	if err != nil {
+		return b, err
+	}
+	return append(b, payload...), nil
 }
 
 // DecodeFrame reads a binary frame from the underlying connection and
 // reconstructs it into a Frame struct. It first reads the fixed-size
 // header (6 bytes) and extracts the magic byte, packet type, and payload
 // length using big-endian byte order. Once the payload length is known,
-// DecodeFrame allocates a buffer of the exact size and reads the
-// remaining bytes from the connection.
+// DecodeFrame reads the remaining bytes from the connection.
 //
 // After parsing the header and payload, DecodeFrame returns a fully
 // populated Frame struct containing both the header and the payload.
 //
-//nolint:gocyclo
+// DecodeFrame uses the Version1 packet layouts, it's what a connection
+// speaks until the handshake completes.
 func DecodeFrame(r io.Reader) (*Frame, error) {
+	return DecodeFrameVersion(r, packets.Version1)
+}
+
+// DecodeFrameVersion is DecodeFrame for a connection that negotiated
+// version. Both header layouts are accepted, the magic byte tells them
+// apart, but version decides which packet decoders are used.
+//
+// Long lived readers should keep a Decoder instead, it reuses its buffers
+// between frames.
+func DecodeFrameVersion(r io.Reader, version uint8) (*Frame, error) {
+	return NewDecoder(r).Decode(version)
+}
+
+// Decoder reads consecutive frames from one connection. The header and
+// payload buffers are reused between frames, packet decoders copy what
+// they keep. A Decoder isn't safe for concurrent use.
+type Decoder struct {
+	r        io.Reader
+	header   [headerLenV2]byte
+	payload  []byte
+	inflated []byte
+}
+
+// NewDecoder returns a Decoder reading from r. Wrapping a connection in a
+// bufio.Reader first lets the header and payload come from one read.
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{r: r}
+}
+
+// Decode reads the next frame, see DecodeFrameVersion.
+//
+//nolint:gocyclo
+func (d *Decoder) Decode(version uint8) (*Frame, error) {
 	const op errors.Op = "frame.DecodeFrame"
-	// We know the header length is 6 bytes.
-	header := make([]byte, 6)
+	// The header is at least 6 bytes, the flags byte follows for Version2.
+	header := d.header[:]
+	r := d.r
 
 	//Read frame header
-	_, err := io.ReadFull(r, header)
-
+	_, err := io.ReadFull(r, header[:headerLen])
 	// Check if the connection is dead (Remote EOF).
 	if err == io.EOF || err == io.ErrUnexpectedEOF {
 		return nil, errors.B(path, op, errors.Internal, io.EOF)
@@ -142,17 +372,50 @@ func DecodeFrame(r io.Reader) (*Frame, error) {
 	}
 
 	// Validate the magic value from the incoming packet.
-	if header[0] != protocolMagic {
+	if header[0] != protocolMagic && header[0] != protocolMagicV2 {
 		return nil, errors.B(path, op, errors.Client, "unknown magic value")
 	}
 
+	// Version2 headers carry one more byte, read it before the length.
+	if header[0] == protocolMagicV2 {
+		if version < packets.Version2 {
+			return nil, errors.B(path, op, errors.Client, "version 2 frame on a version 1 connection")
+		}
+		if _, err := io.ReadFull(r, header[headerLen:]); err != nil {
+			return nil, errors.B(path, op, errors.Internal, fmt.Errorf("error on trying to read frame header from connection: %w", err))
+		}
+		header = header[:headerLenV2]
+	} else {
+		header = header[:headerLen]
+	}
+
 	// Assign the frame fields.
 	magic := header[0]
 	opcode := header[1]
-	payloadLength := binary.BigEndian.Uint32(header[2:6])
+	var flags uint8
+	if magic == protocolMagicV2 {
+		flags = header[2]
+	}
+	payloadLength := binary.BigEndian.Uint32(header[len(header)-4:])
+
+	if flags&^knownFlags != 0 {
+		return nil, errors.B(path, op, errors.Client, fmt.Errorf("unknown frame flags %#x", flags))
+	}
+	if flags&FlagFragmented != 0 && version < packets.Version3 {
+		return nil, errors.B(path, op, errors.Client, fmt.Errorf("fragmented frame on a version %d connection", version))
+	}
+
+	// The correlation ID isn't part of the packet payload.
+	var maxLen = MaxPayloadLen
+	if flags&FlagCorrelated != 0 {
+		if payloadLength < correlationLen {
+			return nil, errors.B(path, op, errors.Client, "correlated frame is too short")
+		}
+		maxLen += correlationLen
+	}
 
 	//Validate the payload length before decoding
-	if int(payloadLength) > int(MaxPayloadLen) {
+	if payloadLength > maxLen {
 		return nil, errors.B(path, op, errors.Client, "the payload hit the maximum size")
 	}
 
@@ -165,13 +428,17 @@ func DecodeFrame(r io.Reader) (*Frame, error) {
 	}
 
 	// Build up the frame payload based on the opcode(packet type)
-	pkt, err := packets.ConstructPacket(opcode)
+	pkt, err := packets.ConstructPacket(opcode, version)
 	if err != nil {
 		return nil, errors.B(path, op, err, errors.Client)
 	}
 
-	// Create a slice to read into the incmoing payload bytes into.
-	payload := make([]byte, payloadLength)
+	// Reuse the payload buffer, it only grows up to the largest frame
+	// the connection has seen.
+	if cap(d.payload) < int(payloadLength) {
+		d.payload = make([]byte, payloadLength)
+	}
+	payload := d.payload[:payloadLength]
 
 	//Read incoming bytes into the payload slice
 	_, payloadErr := io.ReadFull(r, payload)
@@ -181,10 +448,36 @@ func DecodeFrame(r io.Reader) (*Frame, error) {
 		return nil, errors.B(path, op, errors.Internal, fmt.Errorf("error on trying to read frame payload from connection: %w", payloadErr))
 	}
 
-	// Decode the packet payload
+	if flags&FlagFragmented != 0 {
+		payload, err = d.readFragments(payload, opcode, maxLen-MaxPayloadLen+MaxMessageLen)
+		if err != nil {
+			return nil, err
+		}
+		d.payload = payload
+		flags &^= FlagFragmented
+		payloadLength = uint32(len(payload))
+	}
+
+	var correlationID uint32
+	if flags&FlagCorrelated != 0 {
+		correlationID = binary.BigEndian.Uint32(payload)
+		payload = payload[correlationLen:]
+	}
+
+	if flags&FlagCompressed != 0 {
+		inflated, err := inflate(d.inflated[:0], payload, maxPacketLen(version))
+		if err != nil {
+			return nil, &PacketError{CorrelationID: correlationID, Opcode: opcode, Err: err}
+		}
+		d.inflated = inflated
+		payload = inflated
+	}
+
+	// Decode the packet payload. The frame was read entirely, the stream
+	// is still in sync and the caller may keep the connection.
 	e := pkt.Decode(payload)
 	if e != nil {
-		return nil, e
+		return nil, &PacketError{CorrelationID: correlationID, Opcode: opcode, Err: e}
 	}
 
 	// Return the frame
@@ -192,9 +485,108 @@ func DecodeFrame(r io.Reader) (*Frame, error) {
 		Header: FrameHeader{
 			Magic:  magic,
 			Opcode: opcode,
+			Flags:  flags,
 			Length: payloadLength,
 		},
-		Payload: pkt,
+		Payload:       pkt,
+		CorrelationID: correlationID,
+		version:       version,
 	}, nil
 
 }
+
+// readFragments appends the continuation frames of a fragmented payload
+// to payload, up to limit bytes in total.
+func (d *Decoder) readFragments(payload []byte, opcode uint8, limit uint32) ([]byte, error) {
+	const op errors.Op = "frame.DecodeFrame"
+	header := d.header[:headerLenV2]
+	for {
+		if _, err := io.ReadFull(d.r, header); err != nil {
+			return nil, errors.B(path, op, errors.Internal, fmt.Errorf("error on trying to read a continuation frame from connection: %w", err))
+		}
+		if header[0] != protocolMagicV2 || header[1] != opcode {
+			return nil, errors.B(path, op, errors.Client, "fragmented payload interrupted by another frame")
+		}
+		flags := header[2]
+		if flags&^FlagFragmented != 0 {
+			return nil, errors.B(path, op, errors.Client, fmt.Errorf("continuation frame with flags %#x", flags))
+		}
+		n := binary.BigEndian.Uint32(header[3:])
+		if n == 0 || n > MaxPayloadLen {
+			return nil, errors.B(path, op, errors.Client, fmt.Errorf("continuation frame of %d bytes", n))
+		}
+		if uint32(len(payload))+n > limit {
+			return nil, errors.B(path, op, errors.Client, "the fragmented payload hit the maximum size")
+		}
+		start := len(payload)
+		payload = slices.Grow(payload, int(n))[:start+int(n)]
+		if _, err := io.ReadFull(d.r, payload[start:]); err != nil {
+			return nil, errors.B(path, op, errors.Internal, fmt.Errorf("error on trying to read a continuation frame from connection: %w", err))
+		}
+		if flags&FlagFragmented == 0 {
+			return payload, nil
+		}
+	}
+}
+
+// FrameLen reports the encoded size of the frame at the start of b, it's
+// false until the whole header is in b. Bytes that don't start with a
+// known magic value are reported as a frame of len(b), so tools that split
+// a stream into frames keep them instead of waiting forever.
+func FrameLen(b []byte) (int, bool) {
+	// A fragmented payload counts as one frame, up to its last fragment.
+	var total int
+	for {
+		n, more, ok := frameLen(b[total:])
+		if !ok {
+			return 0, false
+		}
+		total += n
+		// A fragment larger than a frame isn't one, report the size so
+		// the caller gives up on it.
+		if !more || n > headerLenV2+correlationLen+int(MaxPayloadLen) {
+			return total, true
+		}
+		// The next fragment isn't in b yet.
+		if total >= len(b) {
+			return 0, false
+		}
+	}
+}
+
+// frameLen is FrameLen for a single frame, more reports that it's
+// followed by a continuation frame.
+func frameLen(b []byte) (n int, more bool, ok bool) {
+	if len(b) == 0 {
+		return 0, false, false
+	}
+	hLen := headerLen
+	switch b[0] {
+	case protocolMagic:
+	case protocolMagicV2:
+		hLen = headerLenV2
+	default:
+		return len(b), false, true
+	}
+	if len(b) < hLen {
+		return 0, false, false
+	}
+	more = hLen == headerLenV2 && b[2]&FlagFragmented != 0
+	return hLen + int(binary.BigEndian.Uint32(b[hLen-4:hLen])), more, true
+}
+
+// PacketError reports a frame that was read in full but whose payload
+// didn't decode. Unlike framing errors it leaves the stream usable.
+type PacketError struct {
+	CorrelationID uint32
+	Opcode        uint8
+	Err           error
+}
+
+func (p *PacketError) Error() string {
+	return p.Err.Error()
+}
+
+func (p *PacketError) Unwrap() error {
+	return p.Err
+}
@@ -0,0 +1,161 @@
+package protocol_test
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/iLeoon/realtime-gateway/internal/protocol"
+	"github.com/iLeoon/realtime-gateway/internal/protocol/packets"
+)
+
+// chatText is close to what users type, compressing random bytes would
+// only measure the worst case.
+const chatText = "hey, are we still on for the review tomorrow? I pushed the changes to the branch, let me know if the tests pass on your side. "
+
+func benchPacket(size int) *packets.ResponseMessagePacket {
+	return &packets.ResponseMessagePacket{
+		AuthorID:       12,
+		ConversationID: 34,
+		MessageID:      56,
+		ResContent:     strings.Repeat(chatText, size/len(chatText)+1)[:size],
+	}
+}
+
+// BenchmarkEncodeCompression compares raw and compressed frames for
+// typical message sizes. wire-B/op is the number of bytes sent.
+func BenchmarkEncodeCompression(b *testing.B) {
+	for _, size := range []int{64, 128, 256, 512} {
+		for _, threshold := range []int{0, protocol.DefaultCompressionThreshold, 1} {
+			name := fmt.Sprintf("size=%d/threshold=%d", size, threshold)
+			b.Run(name, func(b *testing.B) {
+				pkt := benchPacket(size)
+				var buf bytes.Buffer
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					buf.Reset()
+					frame := protocol.ConstructFrame(pkt).ForVersion(packets.Version2).WithCompression(threshold)
+					if err := frame.EncodeFrame(&buf); err != nil {
+						b.Fatal(err)
+					}
+				}
+				b.ReportMetric(float64(buf.Len()), "wire-B/op")
+			})
+		}
+	}
+}
+
+func BenchmarkDecodeCompression(b *testing.B) {
+	for _, size := range []int{256, 512} {
+		for _, threshold := range []int{0, 1} {
+			b.Run(fmt.Sprintf("size=%d/threshold=%d", size, threshold), func(b *testing.B) {
+				var buf bytes.Buffer
+				frame := protocol.ConstructFrame(benchPacket(size)).ForVersion(packets.Version2).WithCompression(threshold)
+				if err := frame.EncodeFrame(&buf); err != nil {
+					b.Fatal(err)
+				}
+				raw := buf.Bytes()
+				r := bytes.NewReader(raw)
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					r.Reset(raw)
+					if _, err := protocol.DecodeFrameVersion(r, packets.Version2); err != nil && err != io.EOF {
+						b.Fatal(err)
+					}
+				}
+				b.ReportMetric(float64(len(raw)), "wire-B/op")
+			})
+		}
+	}
+}
+
+// BenchmarkEncodeFrame is the per write cost, the frame is assembled in a
+// pooled buffer and the hot packets append their payload in place.
+func BenchmarkEncodeFrame(b *testing.B) {
+	pkt := benchPacket(256)
+	b.Run("EncodeFrame", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if err := protocol.ConstructFrame(pkt).ForVersion(packets.Version2).EncodeFrame(io.Discard); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("AppendFrame", func(b *testing.B) {
+		buf := make([]byte, 0, 2048)
+		frame := protocol.ConstructFrame(pkt).ForVersion(packets.Version2)
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			var err error
+			if buf, err = frame.AppendFrame(buf[:0]); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// BenchmarkFanOut writes one message to 100 recipients, building a frame
+// per recipient against encoding it once.
+func BenchmarkFanOut(b *testing.B) {
+	const recipients = 100
+	pkt := benchPacket(256)
+	n := protocol.Negotiated{Version: packets.Version2}
+	b.Run("PerRecipient", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			for range recipients {
+				if err := protocol.ConstructFrame(pkt).ForVersion(n.Version).EncodeFrame(io.Discard); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+	b.Run("Prepared", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			pf := protocol.Prepare(pkt, 0)
+			for range recipients {
+				frame, err := pf.Bytes(n)
+				if err != nil {
+					b.Fatal(err)
+				}
+				io.Discard.Write(frame)
+			}
+			pf.Release()
+		}
+	})
+}
+
+// BenchmarkDecodeFrame compares a fresh decoder per frame, which is what
+// DecodeFrameVersion does, with one Decoder reused for the connection.
+func BenchmarkDecodeFrame(b *testing.B) {
+	var buf bytes.Buffer
+	if err := protocol.ConstructFrame(&packets.SendMessagePacket{ConversationID: 1, Content: chatText}).EncodeFrame(&buf); err != nil {
+		b.Fatal(err)
+	}
+	raw := buf.Bytes()
+	r := bytes.NewReader(raw)
+
+	b.Run("DecodeFrameVersion", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			r.Reset(raw)
+			if _, err := protocol.DecodeFrameVersion(r, packets.Version1); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("Decoder", func(b *testing.B) {
+		dec := protocol.NewDecoder(r)
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			r.Reset(raw)
+			if _, err := dec.Decode(packets.Version1); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
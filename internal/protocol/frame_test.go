@@ -1,9 +1,13 @@
 package protocol_test
 
 import (
+	"bytes"
+	"compress/flate"
 	"encoding/binary"
 	"fmt"
+	"io"
 	"net"
+	"strings"
 	"testing"
 	"time"
 
@@ -89,3 +93,425 @@ func TestCorruptFrame(t *testing.T) {
 	message := string(raw[7 : 6+length])
 	fmt.Printf("ErrorPacket → code=%d message=%q\n", code, message)
 }
+
+// legacyFrame is a ConnectPacket as encoded by engines and gateways that
+// predate the handshake.
+var legacyFrame = []byte{
+	0x89,                   // magic
+	packets.Connect,        // opcode
+	0x00, 0x00, 0x00, 0x08, // length: 8
+	0x00, 0x00, 0x00, 0x07, // connectionID = 7
+	0x00, 0x00, 0x00, 0x02, // userID = 2
+}
+
+func TestVersion1EncodingUnchanged(t *testing.T) {
+	var buf bytes.Buffer
+	pkt := &packets.ConnectPacket{ConnectionID: 7, UserID: 2}
+	if err := protocol.ConstructFrame(pkt).ForVersion(packets.Version1).EncodeFrame(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), legacyFrame) {
+		t.Fatalf("version 1 frame changed on the wire:\n got %v\nwant %v", buf.Bytes(), legacyFrame)
+	}
+}
+
+func TestDecodeAcrossVersions(t *testing.T) {
+	// A Version2 connection still accepts Version1 headers.
+	frame, err := protocol.DecodeFrameVersion(bytes.NewReader(legacyFrame), packets.Version2)
+	if err != nil {
+		t.Fatalf("decoding a legacy frame on a version 2 connection: %v", err)
+	}
+	if pkt := frame.Payload.(*packets.ConnectPacket); pkt.ConnectionID != 7 || pkt.UserID != 2 {
+		t.Fatalf("unexpected packet %v", pkt)
+	}
+
+	var buf bytes.Buffer
+	pkt := &packets.ConnectPacket{ConnectionID: 7, UserID: 2}
+	if err := protocol.ConstructFrame(pkt).ForVersion(packets.Version2).EncodeFrame(&buf); err != nil {
+		t.Fatal(err)
+	}
+	v2 := buf.Bytes()
+	if len(v2) != len(legacyFrame)+1 || v2[0] != 0x8A || v2[2] != 0 {
+		t.Fatalf("unexpected version 2 header %v", v2[:7])
+	}
+
+	frame, err = protocol.DecodeFrameVersion(bytes.NewReader(v2), packets.Version2)
+	if err != nil {
+		t.Fatalf("decoding a version 2 frame: %v", err)
+	}
+	if pkt := frame.Payload.(*packets.ConnectPacket); pkt.ConnectionID != 7 || pkt.UserID != 2 {
+		t.Fatalf("unexpected packet %v", pkt)
+	}
+
+	// A peer that never negotiated Version2 must not receive its header.
+	if _, err := protocol.DecodeFrameVersion(bytes.NewReader(v2), packets.Version1); !errors.Is(err, errors.Client) {
+		t.Fatalf("expected a client error for a version 2 frame on a version 1 connection, got %v", err)
+	}
+
+	// Unknown flag bits are rejected.
+	v2[2] = 0x80
+	if _, err := protocol.DecodeFrameVersion(bytes.NewReader(v2), packets.Version2); !errors.Is(err, errors.Client) {
+		t.Fatalf("expected a client error for unknown flags, got %v", err)
+	}
+}
+
+// startEngine accepts connections and runs fn on each of them.
+func startEngine(t *testing.T, fn func(net.Conn)) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to start test server: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				defer c.Close()
+				c.SetDeadline(time.Now().Add(3 * time.Second))
+				fn(c)
+			}(conn)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func dial(t *testing.T, addr string) net.Conn {
+	t.Helper()
+	conn, err := net.DialTimeout("tcp", addr, 2*time.Second)
+	if err != nil {
+		t.Fatalf("could not connect: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
+	return conn
+}
+
+func TestHandshakeWithNewEngine(t *testing.T) {
+	addr := startEngine(t, func(c net.Conn) {
+		frame, err := protocol.DecodeFrame(c)
+		if err != nil {
+			return
+		}
+		n, err := protocol.AcceptHello(c, frame.Payload.(*packets.HelloPacket))
+		if err != nil {
+			return
+		}
+		// Echo the next frame back using the negotiated layout.
+		frame, err = protocol.DecodeFrameVersion(c, n.Version)
+		if err != nil {
+			return
+		}
+		protocol.ConstructFrame(frame.Payload).ForVersion(n.Version).EncodeFrame(c)
+	})
+
+	conn := dial(t, addr)
+	n, err := protocol.ClientHandshake(conn)
+	if err != nil {
+		t.Fatalf("handshake failed: %v", err)
+	}
+	if n.Version != packets.CurrentVersion || n.Features != protocol.SupportedFeatures {
+		t.Fatalf("unexpected negotiation %+v", n)
+	}
+
+	pkt := &packets.TypingPacket{ConversationID: 3, IsTyping: true}
+	if err := protocol.ConstructFrame(pkt).ForVersion(n.Version).EncodeFrame(conn); err != nil {
+		t.Fatal(err)
+	}
+	frame, err := protocol.DecodeFrameVersion(conn, n.Version)
+	if err != nil {
+		t.Fatalf("reading the echo: %v", err)
+	}
+	if frame.Header.Magic != 0x8A {
+		t.Fatalf("expected a version 2 header, got magic 0x%02x", frame.Header.Magic)
+	}
+}
+
+func TestHandshakeWithLegacyEngine(t *testing.T) {
+	// Mirrors an engine built before the handshake: unknown opcodes are
+	// answered with an error packet and the connection is closed.
+	addr := startEngine(t, func(c net.Conn) {
+		header := make([]byte, 6)
+		if _, err := io.ReadFull(c, header); err != nil {
+			return
+		}
+		if header[1] > packets.RateLimited {
+			protocol.ConstructFrame(&packets.ErrorPacket{Code: errors.Client, Message: "invalid packet"}).EncodeFrame(c)
+		}
+	})
+
+	conn := dial(t, addr)
+	n, err := protocol.ClientHandshake(conn)
+	if !errors.Is(err, protocol.ErrLegacyPeer) {
+		t.Fatalf("expected ErrLegacyPeer, got %v", err)
+	}
+	if n != protocol.Legacy {
+		t.Fatalf("expected a legacy negotiation, got %+v", n)
+	}
+}
+
+func TestLegacyGatewayWithNewEngine(t *testing.T) {
+	// The engine answers in the layout of whatever the peer negotiated,
+	// Version1 when it never sent a Hello.
+	addr := startEngine(t, func(c net.Conn) {
+		frame, err := protocol.DecodeFrame(c)
+		if err != nil {
+			return
+		}
+		if _, ok := frame.Payload.(*packets.ConnectPacket); !ok {
+			return
+		}
+		protocol.ConstructFrame(&packets.PingPacket{}).ForVersion(protocol.Legacy.Version).EncodeFrame(c)
+	})
+
+	conn := dial(t, addr)
+	conn.Write(legacyFrame)
+
+	header := make([]byte, 6)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		t.Fatalf("reading the reply: %v", err)
+	}
+	if header[0] != 0x89 || header[1] != packets.Ping {
+		t.Fatalf("expected a version 1 ping, got %v", header)
+	}
+}
+
+func TestCorrelatedFrames(t *testing.T) {
+	var buf bytes.Buffer
+	pkt := &packets.SendMessagePacket{ConversationID: 4, Content: "hi"}
+	if err := protocol.ConstructFrame(pkt).ForVersion(packets.Version2).WithCorrelation(42).EncodeFrame(&buf); err != nil {
+		t.Fatal(err)
+	}
+	raw := buf.Bytes()
+	if raw[2]&protocol.FlagCorrelated == 0 {
+		t.Fatalf("correlated flag not set: %v", raw[:7])
+	}
+
+	frame, err := protocol.DecodeFrameVersion(bytes.NewReader(raw), packets.Version2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if frame.CorrelationID != 42 || frame.Payload.(*packets.SendMessagePacket).Content != "hi" {
+		t.Fatalf("unexpected frame %+v", frame)
+	}
+
+	// Version1 frames have no room for the ID, it's silently dropped.
+	buf.Reset()
+	if err := protocol.ConstructFrame(pkt).WithCorrelation(42).EncodeFrame(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if frame, err := protocol.DecodeFrame(&buf); err != nil || frame.CorrelationID != 0 {
+		t.Fatalf("expected an uncorrelated version 1 frame, got %+v, %v", frame, err)
+	}
+}
+
+func TestPacketErrorKeepsCorrelation(t *testing.T) {
+	var buf bytes.Buffer
+	// The content only fits fragmented, the whole payload is skipped.
+	pkt := &packets.SendMessagePacket{ConversationID: 4, Content: strings.Repeat("a", packets.MaxContentSize+1)}
+	if err := protocol.ConstructFrame(pkt).ForVersion(packets.Version3).WithCorrelation(7).EncodeFrame(&buf); err != nil {
+		t.Fatal(err)
+	}
+	// A second frame behind the bad one must still be readable.
+	next := &packets.TypingPacket{ConversationID: 4, IsTyping: true}
+	if err := protocol.ConstructFrame(next).ForVersion(packets.Version3).EncodeFrame(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := protocol.DecodeFrameVersion(&buf, packets.Version3)
+	var pktErr *protocol.PacketError
+	if !errors.As(err, &pktErr) || pktErr.CorrelationID != 7 {
+		t.Fatalf("expected a PacketError for correlation 7, got %v", err)
+	}
+	if errors.CodeOf(err) != errors.TooLarge {
+		t.Fatalf("expected %s, got %s", errors.TooLarge, errors.CodeOf(err))
+	}
+
+	if _, err := protocol.DecodeFrameVersion(&buf, packets.Version3); err != nil {
+		t.Fatalf("stream out of sync after a packet error: %v", err)
+	}
+}
+
+func TestErrorPacketLayouts(t *testing.T) {
+	pkt := &packets.ErrorPacket{Code: errors.Client, Reason: errors.NotAMember, Message: "request rejected"}
+	for _, version := range []uint8{packets.Version1, packets.Version2} {
+		var buf bytes.Buffer
+		if err := protocol.ConstructFrame(pkt).ForVersion(version).EncodeFrame(&buf); err != nil {
+			t.Fatal(err)
+		}
+		frame, err := protocol.DecodeFrameVersion(&buf, version)
+		if err != nil {
+			t.Fatalf("version %d: %v", version, err)
+		}
+		got := frame.Payload.(*packets.ErrorPacket)
+		wantReason := errors.NotAMember
+		if version == packets.Version1 {
+			wantReason = 0
+		}
+		if got.Code != errors.Client || got.Reason != wantReason || got.Message != pkt.Message {
+			t.Fatalf("version %d: unexpected packet %v", version, got)
+		}
+	}
+}
+
+func TestCompressedFrames(t *testing.T) {
+	content := strings.Repeat("compressible text ", 25)
+	pkt := &packets.ResponseMessagePacket{AuthorID: 1, ConversationID: 2, MessageID: 3, ResContent: content}
+
+	var raw, compressed bytes.Buffer
+	if err := protocol.ConstructFrame(pkt).ForVersion(packets.Version2).EncodeFrame(&raw); err != nil {
+		t.Fatal(err)
+	}
+	frame := protocol.ConstructFrame(pkt).ForVersion(packets.Version2).WithCorrelation(9).WithCompression(protocol.DefaultCompressionThreshold)
+	if err := frame.EncodeFrame(&compressed); err != nil {
+		t.Fatal(err)
+	}
+	if compressed.Len() >= raw.Len() || compressed.Bytes()[2]&protocol.FlagCompressed == 0 {
+		t.Fatalf("expected a smaller compressed frame, got %d vs %d bytes", compressed.Len(), raw.Len())
+	}
+
+	decoded, err := protocol.DecodeFrameVersion(&compressed, packets.Version2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := decoded.Payload.(*packets.ResponseMessagePacket); got.ResContent != content || decoded.CorrelationID != 9 {
+		t.Fatalf("unexpected frame %+v", decoded)
+	}
+
+	// Payloads under the threshold, and Version1 frames, are left alone.
+	small := &packets.TypingPacket{ConversationID: 2, IsTyping: true}
+	for _, version := range []uint8{packets.Version1, packets.Version2} {
+		var buf bytes.Buffer
+		if err := protocol.ConstructFrame(small).ForVersion(version).WithCompression(1).EncodeFrame(&buf); err != nil {
+			t.Fatal(err)
+		}
+		if version == packets.Version2 && buf.Bytes()[2]&protocol.FlagCompressed != 0 {
+			t.Fatal("incompressible payload was sent compressed")
+		}
+	}
+}
+
+func TestCompressionBomb(t *testing.T) {
+	// A compressed payload that inflates past MaxPayloadLen is rejected.
+	var deflated bytes.Buffer
+	w, _ := flate.NewWriter(&deflated, flate.BestCompression)
+	w.Write(append([]byte{0, 0, 0, 1}, bytes.Repeat([]byte("a"), 64*1024)...))
+	w.Close()
+
+	frame := []byte{0x8A, packets.SendMessage, protocol.FlagCompressed, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(frame[3:], uint32(deflated.Len()))
+	frame = append(frame, deflated.Bytes()...)
+
+	_, err := protocol.DecodeFrameVersion(bytes.NewReader(frame), packets.Version2)
+	if errors.CodeOf(err) != errors.TooLarge {
+		t.Fatalf("expected too_large, got %v", err)
+	}
+}
+
+func TestPreparedFrameMatchesEncodeFrame(t *testing.T) {
+	pkt := &packets.ResponseMessagePacket{AuthorID: 1, ConversationID: 2, MessageID: 3, ResContent: strings.Repeat("fan-out ", 40)}
+	pf := protocol.Prepare(pkt, protocol.DefaultCompressionThreshold)
+	defer pf.Release()
+
+	for _, n := range []protocol.Negotiated{
+		protocol.Legacy,
+		{Version: packets.Version2},
+		{Version: packets.Version2, Features: protocol.SupportedFeatures},
+	} {
+		frame := protocol.ConstructFrame(pkt).ForVersion(n.Version)
+		if n.Has(packets.FeatureCompression) {
+			frame.WithCompression(protocol.DefaultCompressionThreshold)
+		}
+		var want bytes.Buffer
+		if err := frame.EncodeFrame(&want); err != nil {
+			t.Fatal(err)
+		}
+		for range 2 {
+			got, err := pf.Bytes(n)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want.Bytes()) {
+				t.Fatalf("prepared frame for %+v differs from EncodeFrame", n)
+			}
+		}
+	}
+}
+
+func TestDecoderReusesBuffers(t *testing.T) {
+	var buf bytes.Buffer
+	first := &packets.SendMessagePacket{ConversationID: 1, Content: "first message"}
+	second := &packets.SendMessagePacket{ConversationID: 2, Content: "second"}
+	for _, pkt := range []packets.BuildPayload{first, second} {
+		if err := protocol.ConstructFrame(pkt).EncodeFrame(&buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dec := protocol.NewDecoder(&buf)
+	f1, err := dec.Decode(packets.Version1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f2, err := dec.Decode(packets.Version1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The second frame overwrote the payload buffer, the first packet
+	// must not have kept a reference to it.
+	if got := f1.Payload.(*packets.SendMessagePacket).Content; got != first.Content {
+		t.Fatalf("first packet changed to %q", got)
+	}
+	if got := f2.Payload.(*packets.SendMessagePacket).Content; got != second.Content {
+		t.Fatalf("unexpected second packet %q", got)
+	}
+}
+
+// TestFragmentation sends a payload of several frames. Version3 peers
+// reassemble it, older ones can't be sent it, and a fragment sequence
+// interrupted by another frame breaks the stream.
+func TestFragmentation(t *testing.T) {
+	var content strings.Builder
+	for i := 0; content.Len() < 5000; i++ {
+		fmt.Fprintf(&content, "%d,", i*7919)
+	}
+	pkt := &packets.SendMessagePacket{ConversationID: 4, Content: content.String()}
+
+	var buf bytes.Buffer
+	if err := protocol.ConstructFrame(pkt).ForVersion(packets.Version3).WithCorrelation(9).EncodeFrame(&buf); err != nil {
+		t.Fatal(err)
+	}
+	raw := bytes.Clone(buf.Bytes())
+	if n, ok := protocol.FrameLen(raw); !ok || n != len(raw) {
+		t.Fatalf("FrameLen = %d, %v for %d bytes of fragments", n, ok, len(raw))
+	}
+	if _, ok := protocol.FrameLen(raw[:2*int(protocol.MaxPayloadLen)]); ok {
+		t.Fatal("FrameLen reported a frame before its last fragment")
+	}
+
+	frame, err := protocol.DecodeFrameVersion(bytes.NewReader(raw), packets.Version3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := frame.Payload.(*packets.SendMessagePacket)
+	if got.Content != pkt.Content || frame.CorrelationID != 9 || frame.Header.Flags&protocol.FlagFragmented != 0 {
+		t.Fatalf("reassembled %d bytes of content, correlation %d, flags %#x", len(got.Content), frame.CorrelationID, frame.Header.Flags)
+	}
+
+	if err := protocol.ConstructFrame(pkt).ForVersion(packets.Version2).EncodeFrame(io.Discard); errors.CodeOf(err) != errors.TooLarge {
+		t.Fatalf("version 2 encoding: expected %s, got %v", errors.TooLarge, err)
+	}
+	if _, err := protocol.DecodeFrameVersion(bytes.NewReader(raw), packets.Version2); !errors.Is(err, errors.Client) {
+		t.Fatalf("fragments on a version 2 connection: expected a client error, got %v", err)
+	}
+
+	// The second fragment starts right after the first frame.
+	first := 7 + int(binary.BigEndian.Uint32(raw[3:7]))
+	raw[first+1] = packets.Typing
+	if _, err := protocol.DecodeFrameVersion(bytes.NewReader(raw), packets.Version3); !errors.Is(err, errors.Client) {
+		t.Fatalf("interrupted fragments: expected a client error, got %v", err)
+	}
+}
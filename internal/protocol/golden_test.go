@@ -0,0 +1,175 @@
+package protocol_test
+
+import (
+	"bytes"
+	"encoding/hex"
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/iLeoon/realtime-gateway/internal/errors"
+	"github.com/iLeoon/realtime-gateway/internal/protocol"
+	"github.com/iLeoon/realtime-gateway/internal/protocol/packets"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden frames in testdata/golden")
+
+// goldenFrame is one checked-in wire sample. Changing how any of these
+// packets is encoded breaks deployed peers, the golden files catch it.
+type goldenFrame struct {
+	name          string
+	version       uint8
+	correlationID uint32
+	compressFrom  int
+	pkt           packets.BuildPayload
+	// decodeOnly skips the encoding check, DEFLATE output isn't stable
+	// across Go releases.
+	decodeOnly bool
+}
+
+func goldenFrames() []goldenFrame {
+	updatedAt := time.Unix(1767225600, 0).UTC()
+	long := strings.Repeat("golden corpus ", 30)
+	return []goldenFrame{
+		{name: "connect.v1", version: packets.Version1, pkt: &packets.ConnectPacket{ConnectionID: 7, UserID: 42}},
+		{name: "disconnect.v1", version: packets.Version1, pkt: &packets.DisconnectPacket{ConnectionID: 7, UserID: 42}},
+		{name: "ping.v1", version: packets.Version1, pkt: &packets.PingPacket{}},
+		{name: "pong.v1", version: packets.Version1, pkt: &packets.PongPacket{}},
+		{name: "send_message.v1", version: packets.Version1, pkt: &packets.SendMessagePacket{ConversationID: 3, Content: "hello"}},
+		{name: "response_message.v1", version: packets.Version1, pkt: &packets.ResponseMessagePacket{AuthorID: 42, ConversationID: 3, MessageID: 99, ResContent: "hello"}},
+		{name: "update_message.v1", version: packets.Version1, pkt: &packets.UpdateMessagePacket{MessageID: 99, ConversationID: 3, Content: "edited"}},
+		{name: "update_response.v1", version: packets.Version1, pkt: &packets.ResponseUpdateMessagePacket{ConversationID: 3, MessageID: 99, UpdatedAt: updatedAt, ResContent: "edited"}},
+		{name: "delete_message.v1", version: packets.Version1, pkt: &packets.DeleteMessagePacket{MessageID: 99, ConversationID: 3}},
+		{name: "delete_response.v1", version: packets.Version1, pkt: &packets.ResponseDeleteMessagePacket{MessageID: 99, ConversationID: 3, AuthorID: 42}},
+		{name: "error.v1", version: packets.Version1, pkt: &packets.ErrorPacket{Code: errors.Client, Message: "invalid packet"}},
+		{name: "typing.v1", version: packets.Version1, pkt: &packets.TypingPacket{ConversationID: 3, IsTyping: true}},
+		{name: "typing_response.v1", version: packets.Version1, pkt: &packets.ResponseTypingPacket{ConversationID: 3, UserID: 42, IsTyping: true}},
+		{name: "presence_response.v1", version: packets.Version1, pkt: &packets.ResponsePresencePacket{UserID: 42, IsOnline: true}},
+		{name: "added_to_conversation.v1", version: packets.Version1, pkt: &packets.AddedToConversationPacket{ConversationID: 3}},
+		{name: "rate_limited.v1", version: packets.Version1, pkt: &packets.RateLimitedPacket{ConversationID: 3, Action: packets.SendMessage, Scope: packets.LimitScopeUser, RetryAfter: 1500 * time.Millisecond}},
+		{name: "hello.v1", version: packets.Version1, pkt: &packets.HelloPacket{MinVersion: packets.Version1, MaxVersion: packets.Version2, Features: packets.FeatureRateLimited | packets.FeatureCorrelation}},
+		{name: "hello_ack.v1", version: packets.Version1, pkt: &packets.HelloAckPacket{Version: packets.Version2, Features: packets.FeatureRateLimited | packets.FeatureCorrelation}},
+		{name: "send_message.v2", version: packets.Version2, pkt: &packets.SendMessagePacket{ConversationID: 3, Content: "hello"}},
+		{name: "send_message.v2.correlated", version: packets.Version2, correlationID: 0x01020304, pkt: &packets.SendMessagePacket{ConversationID: 3, Content: "hello"}},
+		{name: "response_message.v2.compressed", version: packets.Version2, compressFrom: protocol.DefaultCompressionThreshold, decodeOnly: true, pkt: &packets.ResponseMessagePacket{AuthorID: 42, ConversationID: 3, MessageID: 99, ResContent: long}},
+		{name: "connect.v2.token", version: packets.Version2, pkt: &packets.ConnectPacket{ConnectionID: 7, UserID: 42, Token: "header.claims.signature"}},
+		{name: "ack.v2.correlated", version: packets.Version2, correlationID: 5, pkt: &packets.AckPacket{Action: packets.SendMessage}},
+		{name: "membership.v2.correlated", version: packets.Version2, correlationID: 5, pkt: &packets.MembershipPacket{UserID: 42, ConversationID: 3, Joined: true}},
+		{name: "gateway_auth.v2.correlated", version: packets.Version2, correlationID: 4, pkt: &packets.GatewayAuthPacket{Token: "header.claims.signature"}},
+		{name: "response_message.v3", version: packets.Version3, pkt: &packets.ResponseMessagePacket{AuthorID: 42, ConversationID: 3, MessageID: 99, CreatedAt: time.UnixMilli(1767225600123).UTC(), AuthorName: "leo", AuthorImage: "https://example.com/leo.png", ResContent: "hello"}},
+		{name: "send_message.v3.fragmented", version: packets.Version3, correlationID: 5, pkt: &packets.SendMessagePacket{ConversationID: 3, Content: strings.Repeat(long, 3)}},
+		{name: "relay.v3", version: packets.Version3, pkt: &packets.RelayPacket{Exclude: 42, Conversations: []uint32{3, 4}, Packet: &packets.ResponseTypingPacket{ConversationID: 3, UserID: 42, IsTyping: true}}},
+		{name: "error.v2.correlated", version: packets.Version2, correlationID: 5, pkt: &packets.ErrorPacket{Code: errors.Client, Reason: errors.NotAMember, Message: "request rejected"}},
+	}
+}
+
+func (g goldenFrame) encode() ([]byte, error) {
+	frame := protocol.ConstructFrame(g.pkt).ForVersion(g.version).WithCorrelation(g.correlationID).WithCompression(g.compressFrom)
+	var buf bytes.Buffer
+	err := frame.EncodeFrame(&buf)
+	return buf.Bytes(), err
+}
+
+func goldenPath(name string) string {
+	return filepath.Join("testdata", "golden", name+".hex")
+}
+
+// readGolden parses a golden file: hex digits, whitespace is ignored and
+// lines starting with '#' are comments.
+func readGolden(t testing.TB, name string) []byte {
+	raw, err := os.ReadFile(goldenPath(name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var digits strings.Builder
+	for _, line := range strings.Split(string(raw), "\n") {
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		digits.WriteString(strings.Join(strings.Fields(line), ""))
+	}
+	b, err := hex.DecodeString(digits.String())
+	if err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	return b
+}
+
+func writeGolden(t *testing.T, g goldenFrame, b []byte) {
+	var out strings.Builder
+	out.WriteString("# " + strings.TrimSpace(g.pkt.String()) + "\n")
+	enc := hex.EncodeToString(b)
+	for len(enc) > 64 {
+		out.WriteString(enc[:64] + "\n")
+		enc = enc[64:]
+	}
+	out.WriteString(enc + "\n")
+	if err := os.WriteFile(goldenPath(g.name), []byte(out.String()), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestGoldenFrames checks both directions against the corpus: encoding the
+// sample gives the checked-in bytes, and decoding the bytes gives the
+// sample back. Run with -update after an intended wire format change.
+func TestGoldenFrames(t *testing.T) {
+	for _, g := range goldenFrames() {
+		t.Run(g.name, func(t *testing.T) {
+			b, err := g.encode()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *update {
+				writeGolden(t, g, b)
+			}
+
+			want := readGolden(t, g.name)
+			if !g.decodeOnly && !bytes.Equal(b, want) {
+				t.Fatalf("wire format changed\n got %x\nwant %x", b, want)
+			}
+
+			frame, err := protocol.DecodeFrameVersion(bytes.NewReader(want), g.version)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if frame.CorrelationID != g.correlationID {
+				t.Fatalf("correlation ID %d, want %d", frame.CorrelationID, g.correlationID)
+			}
+			if !reflect.DeepEqual(frame.Payload, g.pkt) {
+				t.Fatalf("decoded %v, want %v", frame.Payload, g.pkt)
+			}
+		})
+	}
+}
+
+// FuzzDecodeFrame throws arbitrary bytes at the frame decoder, seeded with
+// the golden corpus. It must never panic, and whatever it accepts must
+// decode to the same frame once encoded again.
+func FuzzDecodeFrame(f *testing.F) {
+	for _, g := range goldenFrames() {
+		f.Add(g.version, readGolden(f, g.name))
+	}
+
+	f.Fuzz(func(t *testing.T, version uint8, b []byte) {
+		frame, err := protocol.DecodeFrameVersion(bytes.NewReader(b), version)
+		if err != nil {
+			return
+		}
+
+		var buf bytes.Buffer
+		if err := frame.EncodeFrame(&buf); err != nil {
+			t.Fatalf("%v decoded but doesn't encode: %v", frame.Payload, err)
+		}
+		again, err := protocol.DecodeFrameVersion(&buf, version)
+		if err != nil {
+			t.Fatalf("%v doesn't decode its own encoding: %v", frame.Payload, err)
+		}
+		if again.CorrelationID != frame.CorrelationID || !reflect.DeepEqual(again.Payload, frame.Payload) {
+			t.Fatalf("round trip changed the frame\n got %v\nwant %v", again.Payload, frame.Payload)
+		}
+	})
+}
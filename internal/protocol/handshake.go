@@ -0,0 +1,95 @@
+package protocol
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/iLeoon/realtime-gateway/internal/errors"
+	"github.com/iLeoon/realtime-gateway/internal/protocol/packets"
+)
+
+const handshakePath errors.PathName = "protocol/handshake"
+
+// SupportedFeatures is every feature bit this build implements.
+const SupportedFeatures = packets.FeatureRateLimited | packets.FeatureCorrelation | packets.FeatureCompression | packets.FeatureAuth | packets.FeatureMembership | packets.FeatureGatewayAuth | packets.FeatureRelay
+
+// ErrLegacyPeer is returned by ClientHandshake when the engine doesn't know
+// the Hello packet. Old engines close the connection after rejecting it,
+// the caller must redial and speak Version1.
+var ErrLegacyPeer = errors.New("peer doesn't support the protocol handshake")
+
+// Negotiated is the protocol version and feature set agreed on a connection.
+type Negotiated struct {
+	Version  uint8
+	Features uint32
+}
+
+// Legacy is what a connection speaks when no handshake happened.
+var Legacy = Negotiated{Version: packets.Version1}
+
+// Has reports whether both peers announced feature.
+func (n Negotiated) Has(feature uint32) bool {
+	return n.Features&feature == feature
+}
+
+// Hello is the packet a gateway opens every connection with.
+func Hello() *packets.HelloPacket {
+	return &packets.HelloPacket{
+		MinVersion: packets.MinVersion,
+		MaxVersion: packets.CurrentVersion,
+		Features:   SupportedFeatures,
+	}
+}
+
+// ClientHandshake sends Hello on rw and waits for the engine's HelloAck.
+// The caller sets the deadlines, a peer that never answers blocks until
+// they expire.
+func ClientHandshake(rw io.ReadWriter) (Negotiated, error) {
+	const op errors.Op = "protocol.ClientHandshake"
+	if err := ConstructFrame(Hello()).EncodeFrame(rw); err != nil {
+		return Legacy, errors.B(handshakePath, op, err)
+	}
+
+	for {
+		frame, err := DecodeFrame(rw)
+		if err != nil {
+			// An old engine may close the socket right after its error packet.
+			if errors.Is(err, io.EOF) {
+				return Legacy, errors.B(handshakePath, op, errors.Network, ErrLegacyPeer)
+			}
+			return Legacy, errors.B(handshakePath, op, err)
+		}
+
+		switch pkt := frame.Payload.(type) {
+		case *packets.HelloAckPacket:
+			if pkt.Version < packets.MinVersion || pkt.Version > packets.CurrentVersion {
+				return Legacy, errors.B(handshakePath, op, errors.Client, fmt.Errorf("engine picked unsupported version %d", pkt.Version))
+			}
+			return Negotiated{Version: pkt.Version, Features: pkt.Features & SupportedFeatures}, nil
+		case *packets.ErrorPacket:
+			return Legacy, errors.B(handshakePath, op, errors.Network, ErrLegacyPeer)
+		case *packets.PingPacket:
+			// The engine may ping before we are done, nothing to answer yet.
+		default:
+			return Legacy, errors.B(handshakePath, op, errors.Client, fmt.Errorf("unexpected %T during handshake", pkt))
+		}
+	}
+}
+
+// AcceptHello picks the highest version both sides support and the common
+// feature set, then writes the HelloAck. The connection switches to the
+// returned version right after.
+func AcceptHello(w io.Writer, hello *packets.HelloPacket) (Negotiated, error) {
+	const op errors.Op = "protocol.AcceptHello"
+	version := min(hello.MaxVersion, packets.CurrentVersion)
+	if version < hello.MinVersion || version < packets.MinVersion {
+		return Legacy, errors.B(handshakePath, op, errors.Client, fmt.Errorf("no common protocol version with %d-%d", hello.MinVersion, hello.MaxVersion))
+	}
+
+	n := Negotiated{Version: version, Features: hello.Features & SupportedFeatures}
+	ack := &packets.HelloAckPacket{Version: n.Version, Features: n.Features}
+	if err := ConstructFrame(ack).EncodeFrame(w); err != nil {
+		return Legacy, errors.B(handshakePath, op, err)
+	}
+	return n, nil
+}
@@ -0,0 +1,45 @@
+package packets
+
+import (
+	"fmt"
+
+	"github.com/iLeoon/realtime-gateway/internal/errors"
+)
+
+// AckPacket confirms that the engine processed a correlated packet. It's
+// only sent in reply to frames carrying a correlation ID, the frame that
+// carries the ack echoes it.
+//
+// Wire format: [0]=Action(opcode)
+type AckPacket struct {
+	Action uint8 // Opcode of the acknowledged packet.
+}
+
+func (a *AckPacket) String() string {
+	return fmt.Sprintf("AckPacket{Action: %d}", a.Action)
+}
+
+func (a *AckPacket) Type() uint8 {
+	return Ack
+}
+
+func (a *AckPacket) Encode() ([]byte, error) {
+	return []byte{a.Action}, nil
+}
+
+func (a *AckPacket) AppendEncode(b []byte) ([]byte, error) {
+	return append(b, a.Action), nil
+}
+
+func (a *AckPacket) Decode(b []byte) error {
+	const path errors.PathName = "packets/ack"
+	const op errors.Op = "AckPacket.Decode"
+	if len(b) < 1 {
+		return errors.B(path, op, errors.Client, "ack packet length can't be less than 1")
+	}
+	a.Action = b[0]
+	if a.Action == 0 {
+		return errors.B(path, op, errors.Client, "action field is empty or 0")
+	}
+	return nil
+}
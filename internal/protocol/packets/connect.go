@@ -7,14 +7,24 @@ import (
 	"github.com/iLeoon/realtime-gateway/internal/errors"
 )
 
+// MaxTokenSize bounds the assertion a ConnectPacket may carry.
+const MaxTokenSize = 1024
+
 // ConnectPacket represents a connection request sent by a client when it
 // initially joins the system.
 type ConnectPacket struct {
 	ConnectionID uint32 // ConnectionID is a unique identifier for the connecting client.
 	UserID       uint32 // UserID is the authenticated user who owns this connection.
+	// Token is the gateway's signed assertion that UserID is
+	// authenticated, only sent once FeatureAuth was negotiated.
+	Token string
 }
 
 func (c *ConnectPacket) String() string {
+	// The token is a credential, keep it out of the logs.
+	if c.Token != "" {
+		return fmt.Sprintf("ConnectPacket{ConnectionID: %d, UserID: %d, Token: <%d bytes>}", c.ConnectionID, c.UserID, len(c.Token))
+	}
 	return fmt.Sprintf("ConnectPacket{ConnectionID: %d, UserID: %d}", c.ConnectionID, c.UserID)
 }
 
@@ -24,23 +34,26 @@ func (c *ConnectPacket) Type() uint8 {
 }
 
 // Encode serializes the packet fields into a payload.
-// Layout: [4 bytes ConnectionID][4 bytes UserID]
+// Layout: [4 bytes ConnectionID][4 bytes UserID][N bytes Token]
 func (c *ConnectPacket) Encode() ([]byte, error) {
-	b := make([]byte, 8)
+	b := make([]byte, 8, 8+len(c.Token))
 
 	binary.BigEndian.PutUint32(b[:4], c.ConnectionID)
 	binary.BigEndian.PutUint32(b[4:8], c.UserID)
 
-	return b, nil
+	return append(b, c.Token...), nil
 }
 
 // Decode parses the payload and fills the struct.
 func (c *ConnectPacket) Decode(b []byte) error {
 	const path errors.PathName = "packets/connect"
 	const op errors.Op = "ConnectPacket.Decode"
-	if len(b) != 8 {
+	if len(b) < 8 {
 		return errors.B(path, op, errors.Internal, "invalid packet fields size")
 	}
+	if len(b[8:]) > MaxTokenSize {
+		return errors.B(path, op, errors.Client, errors.TooLarge, fmt.Errorf("token size(%v) hit the maximum size", len(b[8:])))
+	}
 	c.ConnectionID = binary.BigEndian.Uint32(b[:4])
 	if c.ConnectionID == 0 {
 		return errors.B(path, op, errors.Internal, "connectionID field is empty or 0")
@@ -49,6 +62,7 @@ func (c *ConnectPacket) Decode(b []byte) error {
 	if c.UserID == 0 {
 		return errors.B(path, op, errors.Internal, "userID field is empty or 0")
 	}
+	c.Token = string(b[8:])
 
 	return nil
 }
@@ -16,4 +16,11 @@ const (
 	TypingResponse
 	PresenceResponse
 	AddedToConversation
+	RateLimited
+	Hello
+	HelloAck
+	Ack
+	Membership
+	GatewayAuth
+	Relay
 )
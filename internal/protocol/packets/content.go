@@ -0,0 +1,46 @@
+package packets
+
+import (
+	"fmt"
+	"unicode/utf8"
+
+	"github.com/iLeoon/realtime-gateway/internal/errors"
+)
+
+// Message content bounds. MaxContentChars is the largest character limit
+// MESSAGE_MAX_CHARS may set, MaxContentSize the bytes such content takes
+// at most in UTF-8. Decoders only enforce the byte bound, the configured
+// character limit is applied with CheckContent.
+const (
+	MaxContentChars = 4096
+	MaxContentSize  = 4 * MaxContentChars
+)
+
+// DefaultContentChars is the character limit when none is configured.
+const DefaultContentChars = 2000
+
+// CheckContent applies the message-size policy the gateway and the engine
+// share: content holds at least one and at most maxChars Unicode
+// characters. A maxChars of 0 means DefaultContentChars, one beyond
+// MaxContentChars is capped to it.
+func CheckContent(content string, maxChars int) error {
+	const path errors.PathName = "packets/content"
+	const op errors.Op = "packets.CheckContent"
+	if maxChars <= 0 {
+		maxChars = DefaultContentChars
+	}
+	maxChars = min(maxChars, MaxContentChars)
+
+	if content == "" {
+		return errors.B(path, op, errors.Client, errors.InvalidPayload, "message size can't be empty")
+	}
+	// Fewer bytes than the limit can't be too many characters, skip the
+	// count for the usual short message.
+	if len(content) <= maxChars {
+		return nil
+	}
+	if n := utf8.RuneCountInString(content); n > maxChars {
+		return errors.B(path, op, errors.Client, errors.TooLarge, fmt.Errorf("message has %d characters, the limit is %d", n, maxChars))
+	}
+	return nil
+}
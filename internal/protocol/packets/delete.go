@@ -20,12 +20,12 @@ func (d *DeleteMessagePacket) Type() uint8 {
 }
 
 func (d *DeleteMessagePacket) Encode() ([]byte, error) {
-	b := make([]byte, 8)
-
-	binary.BigEndian.PutUint32(b[:4], d.MessageID)
-	binary.BigEndian.PutUint32(b[4:8], d.ConversationID)
+	return d.AppendEncode(make([]byte, 0, 8))
+}
 
-	return b, nil
+func (d *DeleteMessagePacket) AppendEncode(b []byte) ([]byte, error) {
+	b = binary.BigEndian.AppendUint32(b, d.MessageID)
+	return binary.BigEndian.AppendUint32(b, d.ConversationID), nil
 }
 
 func (d *DeleteMessagePacket) Decode(b []byte) error {
@@ -22,13 +22,13 @@ func (d *ResponseDeleteMessagePacket) Type() uint8 {
 }
 
 func (d *ResponseDeleteMessagePacket) Encode() ([]byte, error) {
-	b := make([]byte, 12)
-
-	binary.BigEndian.PutUint32(b[:4], d.MessageID)
-	binary.BigEndian.PutUint32(b[4:8], d.ConversationID)
-	binary.BigEndian.PutUint32(b[8:12], d.AuthorID)
+	return d.AppendEncode(make([]byte, 0, 12))
+}
 
-	return b, nil
+func (d *ResponseDeleteMessagePacket) AppendEncode(b []byte) ([]byte, error) {
+	b = binary.BigEndian.AppendUint32(b, d.MessageID)
+	b = binary.BigEndian.AppendUint32(b, d.ConversationID)
+	return binary.BigEndian.AppendUint32(b, d.AuthorID), nil
 }
 
 func (d *ResponseDeleteMessagePacket) Decode(b []byte) error {
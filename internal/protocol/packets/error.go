@@ -7,23 +7,40 @@ import (
 )
 
 // ErrorPacket carries a structured error back to the sender.
+//
+// Wire format: Version1 [0]=Code [1:]=Message
+//
+//	Version2 [0]=Code [1]=Reason [2:]=Message
 type ErrorPacket struct {
 	Code    errors.Kind
+	Reason  errors.Code // Dropped on Version1 connections.
 	Message string
+	version uint8
 }
 
 func (e *ErrorPacket) String() string {
-	return fmt.Sprintf("ErrorPacket{Code: %s, Message: %q}", e.Code, e.Message)
+	return fmt.Sprintf("ErrorPacket{Code: %s, Reason: %s, Message: %q}", e.Code, e.Reason, e.Message)
 }
 
 func (e *ErrorPacket) Type() uint8 {
 	return Error
 }
 
+func (e *ErrorPacket) SetVersion(v uint8) {
+	e.version = v
+}
+
 func (e *ErrorPacket) Encode() ([]byte, error) {
-	b := make([]byte, 1+len(e.Message))
+	if e.version < Version2 {
+		b := make([]byte, 1+len(e.Message))
+		b[0] = uint8(e.Code)
+		copy(b[1:], e.Message)
+		return b, nil
+	}
+	b := make([]byte, 2+len(e.Message))
 	b[0] = uint8(e.Code)
-	copy(b[1:], e.Message)
+	b[1] = uint8(e.Reason)
+	copy(b[2:], e.Message)
 	return b, nil
 }
 
@@ -37,12 +54,20 @@ func (e *ErrorPacket) Decode(b []byte) error {
 	if e.Code == 0 {
 		return errors.B(path, op, errors.Internal, "code field is empty or 0")
 	}
-	if len(b[1:]) > 100 {
-		return errors.B(path, op, fmt.Errorf("message size(%v) hit the maximum size", len(b[1:])))
+	b = b[1:]
+	if e.version >= Version2 {
+		if len(b) < 1 {
+			return errors.B(path, op, errors.Client, "error packet too short")
+		}
+		e.Reason = errors.Code(b[0])
+		b = b[1:]
+	}
+	if len(b) > 100 {
+		return errors.B(path, op, fmt.Errorf("message size(%v) hit the maximum size", len(b)))
 	}
-	if len(b[1:]) == 0 {
+	if len(b) == 0 {
 		return errors.B(path, op, "message size can't be empty")
 	}
-	e.Message = string(b[1:])
+	e.Message = string(b)
 	return nil
 }
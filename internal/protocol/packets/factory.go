@@ -1,6 +1,8 @@
 package packets
 
 import (
+	"fmt"
+
 	"github.com/iLeoon/realtime-gateway/internal/errors"
 )
 
@@ -8,9 +10,36 @@ import (
 // the given opcode. It acts as a factory that maps each opcode to its
 // corresponding concrete packet type. Internally, the function allocates
 // the specific packet struct and returns it as a BuildPayload interface.
-func ConstructPacket(ope uint8) (BuildPayload, error) {
+//
+// version is the protocol version negotiated on the connection. Opcodes
+// introduced after it are rejected and Versioned packets are told which
+// layout to decode.
+func ConstructPacket(ope uint8, version uint8) (BuildPayload, error) {
 	const path errors.PathName = "protocol/packets/factor"
 	const op errors.Op = "packets.ConstructPacket"
+	if since, ok := introducedIn[ope]; ok && version < since {
+		return nil, errors.B(path, op, errors.Internal, fmt.Errorf("packet type %d requires protocol version %d", ope, since))
+	}
+	pkt, err := newPacket(ope)
+	if err != nil {
+		return nil, errors.B(path, op, err)
+	}
+	if v, ok := pkt.(Versioned); ok {
+		v.SetVersion(version)
+	}
+	return pkt, nil
+}
+
+// introducedIn records the protocol version that added an opcode, opcodes
+// missing from it exist since Version1.
+var introducedIn = map[uint8]uint8{
+	Ack:         Version2,
+	Membership:  Version2,
+	GatewayAuth: Version2,
+	Relay:       Version3,
+}
+
+func newPacket(ope uint8) (BuildPayload, error) {
 	switch ope {
 	case SendMessage:
 		return &SendMessagePacket{}, nil
@@ -42,8 +71,22 @@ func ConstructPacket(ope uint8) (BuildPayload, error) {
 		return &ResponsePresencePacket{}, nil
 	case AddedToConversation:
 		return &AddedToConversationPacket{}, nil
+	case RateLimited:
+		return &RateLimitedPacket{}, nil
+	case Hello:
+		return &HelloPacket{}, nil
+	case HelloAck:
+		return &HelloAckPacket{}, nil
+	case Ack:
+		return &AckPacket{}, nil
+	case Membership:
+		return &MembershipPacket{}, nil
+	case GatewayAuth:
+		return &GatewayAuthPacket{}, nil
+	case Relay:
+		return &RelayPacket{}, nil
 	}
 
-	return nil, errors.B(path, op, errors.Internal, "unknown packet type")
+	return nil, errors.B(errors.Internal, "unknown packet type")
 
 }
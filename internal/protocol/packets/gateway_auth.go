@@ -0,0 +1,40 @@
+package packets
+
+import (
+	"fmt"
+
+	"github.com/iLeoon/realtime-gateway/internal/errors"
+)
+
+// GatewayAuthPacket proves that a connection belongs to a gateway. The
+// gateway's notifier sends it before any MembershipPacket, unless the
+// connection already authenticated with a client certificate. The token
+// is an engine assertion for the gateway rather than a user.
+//
+// Wire format: [0:]=Token
+type GatewayAuthPacket struct {
+	Token string
+}
+
+func (g *GatewayAuthPacket) String() string {
+	// The token is a credential, it stays out of the logs.
+	return fmt.Sprintf("GatewayAuthPacket{Token: %d bytes}", len(g.Token))
+}
+
+func (g *GatewayAuthPacket) Type() uint8 {
+	return GatewayAuth
+}
+
+func (g *GatewayAuthPacket) Encode() ([]byte, error) {
+	return []byte(g.Token), nil
+}
+
+func (g *GatewayAuthPacket) Decode(b []byte) error {
+	const path errors.PathName = "packets/gateway_auth"
+	const op errors.Op = "GatewayAuthPacket.Decode"
+	if len(b) == 0 {
+		return errors.B(path, op, errors.Client, "gateway auth packet without a token")
+	}
+	g.Token = string(b)
+	return nil
+}
@@ -0,0 +1,127 @@
+package packets
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/iLeoon/realtime-gateway/internal/errors"
+)
+
+// Protocol versions. A peer that never sent a Hello speaks Version1.
+const (
+	Version1 uint8 = iota + 1 // 6-byte header, no flags.
+	Version2                  // 7-byte header carrying a flags byte.
+	Version3                  // Version2 header, ResponseMessagePacket carries CreatedAt and the author.
+
+	MinVersion     = Version1
+	CurrentVersion = Version3
+)
+
+// Feature bits advertised in the handshake. A feature is only used on a
+// connection when both peers announced it.
+const (
+	// FeatureRateLimited lets the engine reply with RateLimitedPacket, peers
+	// without it get a non fatal ErrorPacket instead.
+	FeatureRateLimited uint32 = 1 << iota
+	// FeatureCorrelation lets the gateway tag packets with a correlation
+	// ID that the engine echoes in the matching Ack or ErrorPacket.
+	FeatureCorrelation
+	// FeatureCompression lets either peer send DEFLATE compressed payloads.
+	FeatureCompression
+	// FeatureAuth lets the gateway append a signed assertion to
+	// ConnectPacket, engines without it reject the longer payload.
+	FeatureAuth
+	// FeatureMembership lets the gateway report membership changes with
+	// MembershipPacket, see cmd/gateway.
+	FeatureMembership
+	// FeatureGatewayAuth lets the gateway authenticate a connection with
+	// GatewayAuthPacket. Engines with it only accept MembershipPacket from
+	// an authenticated gateway or a peer with a client certificate.
+	FeatureGatewayAuth
+	// FeatureRelay lets an engine relay fan-outs to another engine with
+	// RelayPacket, see ENGINE_PEERS.
+	FeatureRelay
+)
+
+// HelloPacket is the first packet a gateway sends on a new connection, it
+// always travels in a Version1 frame so that any engine can decode the
+// header. An engine that doesn't know the opcode rejects it, which tells
+// the gateway to fall back to Version1.
+//
+// Wire format: [0]=MinVersion [1]=MaxVersion [2:6]=Features
+type HelloPacket struct {
+	MinVersion uint8
+	MaxVersion uint8
+	Features   uint32
+}
+
+func (h *HelloPacket) String() string {
+	return fmt.Sprintf("HelloPacket{MinVersion: %d, MaxVersion: %d, Features: %#x}", h.MinVersion, h.MaxVersion, h.Features)
+}
+
+func (h *HelloPacket) Type() uint8 {
+	return Hello
+}
+
+func (h *HelloPacket) Encode() ([]byte, error) {
+	b := make([]byte, 6)
+	b[0] = h.MinVersion
+	b[1] = h.MaxVersion
+	binary.BigEndian.PutUint32(b[2:6], h.Features)
+	return b, nil
+}
+
+func (h *HelloPacket) Decode(b []byte) error {
+	const path errors.PathName = "packets/hello"
+	const op errors.Op = "HelloPacket.Decode"
+
+	if len(b) < 6 {
+		return errors.B(path, op, errors.Client, "hello packet length can't be less than 6")
+	}
+	h.MinVersion = b[0]
+	h.MaxVersion = b[1]
+	if h.MinVersion == 0 || h.MinVersion > h.MaxVersion {
+		return errors.B(path, op, errors.Client, fmt.Errorf("invalid version range %d-%d", h.MinVersion, h.MaxVersion))
+	}
+	h.Features = binary.BigEndian.Uint32(b[2:6])
+	return nil
+}
+
+// HelloAckPacket is the engine's answer to HelloPacket. Version and
+// Features are what both peers use from the next frame on.
+//
+// Wire format: [0]=Version [1:5]=Features
+type HelloAckPacket struct {
+	Version  uint8
+	Features uint32
+}
+
+func (h *HelloAckPacket) String() string {
+	return fmt.Sprintf("HelloAckPacket{Version: %d, Features: %#x}", h.Version, h.Features)
+}
+
+func (h *HelloAckPacket) Type() uint8 {
+	return HelloAck
+}
+
+func (h *HelloAckPacket) Encode() ([]byte, error) {
+	b := make([]byte, 5)
+	b[0] = h.Version
+	binary.BigEndian.PutUint32(b[1:5], h.Features)
+	return b, nil
+}
+
+func (h *HelloAckPacket) Decode(b []byte) error {
+	const path errors.PathName = "packets/hello"
+	const op errors.Op = "HelloAckPacket.Decode"
+
+	if len(b) < 5 {
+		return errors.B(path, op, errors.Client, "hello ack packet length can't be less than 5")
+	}
+	h.Version = b[0]
+	if h.Version == 0 {
+		return errors.B(path, op, errors.Client, "version field is empty or 0")
+	}
+	h.Features = binary.BigEndian.Uint32(b[1:5])
+	return nil
+}
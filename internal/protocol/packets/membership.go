@@ -0,0 +1,58 @@
+package packets
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/iLeoon/realtime-gateway/internal/errors"
+)
+
+// MembershipPacket tells the engine that a user joined or left a
+// conversation. A gateway running the REST API in its own process sends
+// it on a connection of its own, without a ConnectPacket, so the engine
+// updates its rooms just like an in-process AddToRoom would.
+//
+// Wire format: [0:4]=UserID [4:8]=ConversationID [8]=Joined
+// [9:]=ConversationType. The type is optional, gateways that predate it
+// send 9 bytes.
+type MembershipPacket struct {
+	UserID           uint32
+	ConversationID   uint32
+	Joined           bool   // false when the user left the conversation.
+	ConversationType string // "private-chat" or "group-chat", empty if unknown.
+}
+
+func (m *MembershipPacket) String() string {
+	return fmt.Sprintf("MembershipPacket{UserID: %d, ConversationID: %d, Joined: %t, ConversationType: %q}", m.UserID, m.ConversationID, m.Joined, m.ConversationType)
+}
+
+func (m *MembershipPacket) Type() uint8 {
+	return Membership
+}
+
+func (m *MembershipPacket) Encode() ([]byte, error) {
+	b := make([]byte, 9+len(m.ConversationType))
+	binary.BigEndian.PutUint32(b[0:4], m.UserID)
+	binary.BigEndian.PutUint32(b[4:8], m.ConversationID)
+	if m.Joined {
+		b[8] = 1
+	}
+	copy(b[9:], m.ConversationType)
+	return b, nil
+}
+
+func (m *MembershipPacket) Decode(b []byte) error {
+	const path errors.PathName = "packets/membership"
+	const op errors.Op = "MembershipPacket.Decode"
+	if len(b) < 9 {
+		return errors.B(path, op, errors.Client, "membership packet length can't be less than 9")
+	}
+	m.UserID = binary.BigEndian.Uint32(b[0:4])
+	m.ConversationID = binary.BigEndian.Uint32(b[4:8])
+	m.Joined = b[8] == 1
+	m.ConversationType = string(b[9:])
+	if m.UserID == 0 || m.ConversationID == 0 {
+		return errors.B(path, op, errors.Client, "userID or conversationID field is empty or 0")
+	}
+	return nil
+}
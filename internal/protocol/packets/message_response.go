@@ -3,20 +3,43 @@ package packets
 import (
 	"encoding/binary"
 	"fmt"
+	"time"
 
 	"github.com/iLeoon/realtime-gateway/internal/errors"
 )
 
+// Bounds of the author profile a Version3 ResponseMessagePacket carries.
+const (
+	MaxAuthorNameSize  = 0xFF
+	MaxAuthorImageSize = 1024
+)
+
 // ResponseMessagePacket represents a message delivered from the server
 // back to a client.
+//
+// Wire format: Version1 [0:4]=AuthorID [4:8]=ConversationID [8:12]=MessageID [12:]=Content
+//
+//	Version3 [0:4]=AuthorID [4:8]=ConversationID [8:12]=MessageID
+//	         [12:20]=CreatedAt in unix milliseconds [20]=len(AuthorName) AuthorName
+//	         [2 bytes]=len(AuthorImage) AuthorImage [..]=Content
 type ResponseMessagePacket struct {
 	AuthorID       uint32
 	ConversationID uint32
 	MessageID      uint32
-	ResContent     string
+	// CreatedAt, AuthorName and AuthorImage are dropped on connections
+	// older than Version3. CreatedAt is the time the engine accepted the
+	// message, the one it's stored with.
+	CreatedAt   time.Time
+	AuthorName  string
+	AuthorImage string
+	ResContent  string
+	version     uint8
 }
 
 func (r *ResponseMessagePacket) String() string {
+	if r.version >= Version3 {
+		return fmt.Sprintf("ResponseMessagePacket{AuthorID: %d, ConversationID: %d, MessageID: %d, CreatedAt: %v, AuthorName: %q, ResContent: %q}", r.AuthorID, r.ConversationID, r.MessageID, r.CreatedAt, r.AuthorName, r.ResContent)
+	}
 	return fmt.Sprintf("ResponseMessagePacket{AuthorID: %d, ConversationID: %d, MessageID: %d, ResContent: %q}", r.AuthorID, r.ConversationID, r.MessageID, r.ResContent)
 }
 
@@ -24,13 +47,39 @@ func (r *ResponseMessagePacket) Type() uint8 {
 	return ResponseMessage
 }
 
+func (r *ResponseMessagePacket) SetVersion(v uint8) {
+	r.version = v
+}
+
 func (r *ResponseMessagePacket) Encode() ([]byte, error) {
-	b := make([]byte, 12+len(r.ResContent))
-	binary.BigEndian.PutUint32(b[:4], r.AuthorID)
-	binary.BigEndian.PutUint32(b[4:8], r.ConversationID)
-	binary.BigEndian.PutUint32(b[8:12], r.MessageID)
-	copy(b[12:], r.ResContent)
-	return b, nil
+	return r.AppendEncode(make([]byte, 0, 23+len(r.AuthorName)+len(r.AuthorImage)+len(r.ResContent)))
+}
+
+func (r *ResponseMessagePacket) AppendEncode(b []byte) ([]byte, error) {
+	b = binary.BigEndian.AppendUint32(b, r.AuthorID)
+	b = binary.BigEndian.AppendUint32(b, r.ConversationID)
+	b = binary.BigEndian.AppendUint32(b, r.MessageID)
+	if r.version >= Version3 {
+		var createdAt int64
+		if !r.CreatedAt.IsZero() {
+			createdAt = r.CreatedAt.UnixMilli()
+		}
+		b = binary.BigEndian.AppendUint64(b, uint64(createdAt))
+		// A profile that doesn't fit the layout is left out, the message
+		// still goes through.
+		name, image := r.AuthorName, r.AuthorImage
+		if len(name) > MaxAuthorNameSize {
+			name = ""
+		}
+		if len(image) > MaxAuthorImageSize {
+			image = ""
+		}
+		b = append(b, uint8(len(name)))
+		b = append(b, name...)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(image)))
+		b = append(b, image...)
+	}
+	return append(b, r.ResContent...), nil
 }
 
 func (r *ResponseMessagePacket) Decode(b []byte) error {
@@ -55,14 +104,42 @@ func (r *ResponseMessagePacket) Decode(b []byte) error {
 	if r.MessageID == 0 {
 		return errors.B(path, op, errors.Client, "messageID field is empty or 0")
 	}
+	b = b[12:]
+
+	if r.version >= Version3 {
+		if len(b) < 9 {
+			return errors.B(path, op, errors.Client, "response message packet too short for its created at and author")
+		}
+		r.CreatedAt = time.Time{}
+		if ms := int64(binary.BigEndian.Uint64(b[:8])); ms != 0 {
+			r.CreatedAt = time.UnixMilli(ms).UTC()
+		}
+		n := int(b[8])
+		b = b[9:]
+		if len(b) < n+2 {
+			return errors.B(path, op, errors.Client, "author name field is truncated")
+		}
+		r.AuthorName = string(b[:n])
+		b = b[n:]
+		n = int(binary.BigEndian.Uint16(b[:2]))
+		b = b[2:]
+		if n > MaxAuthorImageSize {
+			return errors.B(path, op, errors.Client, fmt.Errorf("author image size(%v) hit the maximum size", n))
+		}
+		if len(b) < n {
+			return errors.B(path, op, errors.Client, "author image field is truncated")
+		}
+		r.AuthorImage = string(b[:n])
+		b = b[n:]
+	}
 
-	if len(b[12:]) > 512 {
-		return errors.B(path, op, errors.Client, fmt.Errorf("message size(%v) hit the maximum size", len(b[12:])))
+	if len(b) > MaxContentSize {
+		return errors.B(path, op, errors.Client, fmt.Errorf("message size(%v) hit the maximum size", len(b)))
 	}
-	if len(b[12:]) == 0 {
+	if len(b) == 0 {
 		return errors.B(path, op, errors.Client, "message field is empty")
 	}
 
-	r.ResContent = string(b[12:])
+	r.ResContent = string(b)
 	return nil
 }
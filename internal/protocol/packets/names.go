@@ -0,0 +1,47 @@
+package packets
+
+// opcodeNames are the names tools and logs use for each opcode. They match
+// the file names of the golden corpus in internal/protocol/testdata.
+var opcodeNames = map[uint8]string{
+	Connect:             "connect",
+	Disconnect:          "disconnect",
+	Ping:                "ping",
+	Pong:                "pong",
+	SendMessage:         "send_message",
+	ResponseMessage:     "response_message",
+	UpdateMessage:       "update_message",
+	UpdateResponse:      "update_response",
+	DeleteMessage:       "delete_message",
+	DeleteResponse:      "delete_response",
+	Error:               "error",
+	Typing:              "typing",
+	TypingResponse:      "typing_response",
+	PresenceResponse:    "presence_response",
+	AddedToConversation: "added_to_conversation",
+	RateLimited:         "rate_limited",
+	Hello:               "hello",
+	HelloAck:            "hello_ack",
+	Ack:                 "ack",
+	Membership:          "membership",
+	GatewayAuth:         "gateway_auth",
+	Relay:               "relay",
+}
+
+// Name returns the name of an opcode, "unknown" for opcodes this build
+// doesn't know.
+func Name(opcode uint8) string {
+	if name, ok := opcodeNames[opcode]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// Opcode is the reverse of Name.
+func Opcode(name string) (uint8, bool) {
+	for op, n := range opcodeNames {
+		if n == name {
+			return op, true
+		}
+	}
+	return 0, false
+}
@@ -14,6 +14,27 @@ package packets
 type BuildPayload interface {
 	Type() uint8             // Returns the packet’s opcode/type identifier.
 	Encode() ([]byte, error) // Serializes the packet’s fields into a payload byte slice.
-	Decode([]byte) error     // Populates the packet’s fields by parsing the provided payload.
+	Decode([]byte) error     // Populates the packet’s fields by parsing the provided payload, without retaining it.
 	String() string          // Returns a human-readable representation of the packet for logging and debugging
 }
+
+// Versioned is implemented by packets whose wire layout changed between
+// protocol versions. ConstructPacket hands them the negotiated version
+// before Decode, and the sender sets it before Encode.
+type Versioned interface {
+	SetVersion(v uint8)
+}
+
+// Appender is implemented by packets that can encode into a caller-owned
+// buffer. The frame encoder prefers it over Encode, hot packets use it to
+// avoid allocating a payload slice per write.
+type Appender interface {
+	AppendEncode(b []byte) ([]byte, error)
+}
+
+func boolByte(v bool) byte {
+	if v {
+		return 1
+	}
+	return 0
+}
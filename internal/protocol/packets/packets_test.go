@@ -0,0 +1,163 @@
+package packets_test
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/iLeoon/realtime-gateway/internal/errors"
+	"github.com/iLeoon/realtime-gateway/internal/protocol/packets"
+)
+
+// validPackets returns one populated packet per opcode, as a peer speaking
+// version would send it.
+func validPackets(version uint8) []packets.BuildPayload {
+	pkts := []packets.BuildPayload{
+		&packets.ConnectPacket{ConnectionID: 7, UserID: 42},
+		&packets.DisconnectPacket{ConnectionID: 7, UserID: 42},
+		&packets.PingPacket{},
+		&packets.PongPacket{},
+		&packets.SendMessagePacket{ConversationID: 3, Content: "hello"},
+		&packets.ResponseMessagePacket{AuthorID: 42, ConversationID: 3, MessageID: 99, ResContent: "hello"},
+		&packets.UpdateMessagePacket{MessageID: 99, ConversationID: 3, Content: "edited"},
+		&packets.ResponseUpdateMessagePacket{ConversationID: 3, MessageID: 99, UpdatedAt: time.Unix(1767225600, 0).UTC(), ResContent: "edited"},
+		&packets.DeleteMessagePacket{MessageID: 99, ConversationID: 3},
+		&packets.ResponseDeleteMessagePacket{MessageID: 99, ConversationID: 3, AuthorID: 42},
+		&packets.ErrorPacket{Code: errors.Client, Message: "request rejected"},
+		&packets.TypingPacket{ConversationID: 3, IsTyping: true},
+		&packets.ResponseTypingPacket{ConversationID: 3, UserID: 42, IsTyping: true},
+		&packets.ResponsePresencePacket{UserID: 42, IsOnline: true},
+		&packets.AddedToConversationPacket{ConversationID: 3},
+		&packets.RateLimitedPacket{ConversationID: 3, Action: packets.SendMessage, Scope: packets.LimitScopeConversation, RetryAfter: 1500 * time.Millisecond},
+		&packets.HelloPacket{MinVersion: packets.MinVersion, MaxVersion: packets.CurrentVersion, Features: packets.FeatureCorrelation},
+		&packets.HelloAckPacket{Version: packets.CurrentVersion, Features: packets.FeatureCorrelation},
+	}
+	if version >= packets.Version2 {
+		pkts = append(pkts,
+			&packets.AckPacket{Action: packets.SendMessage},
+			&packets.ConnectPacket{ConnectionID: 7, UserID: 42, Token: "header.claims.signature"},
+			&packets.ErrorPacket{Code: errors.Client, Reason: errors.NotAMember, Message: "request rejected"},
+			&packets.MembershipPacket{UserID: 42, ConversationID: 3, Joined: true},
+			&packets.MembershipPacket{UserID: 42, ConversationID: 3, Joined: true, ConversationType: "private-chat"},
+			&packets.GatewayAuthPacket{Token: "header.claims.signature"},
+		)
+	}
+	if version >= packets.Version3 {
+		pkts = append(pkts,
+			&packets.ResponseMessagePacket{AuthorID: 42, ConversationID: 3, MessageID: 99, CreatedAt: time.UnixMilli(1767225600123).UTC(), AuthorName: "leo", AuthorImage: "https://example.com/leo.png", ResContent: "hello"},
+			&packets.RelayPacket{Conversations: []uint32{3}, Packet: &packets.ResponseMessagePacket{AuthorID: 42, ConversationID: 3, MessageID: 99, CreatedAt: time.UnixMilli(1767225600123).UTC(), AuthorName: "leo", ResContent: "hello"}},
+			&packets.RelayPacket{Exclude: 42, Conversations: []uint32{3, 4}, Packet: &packets.ResponsePresencePacket{UserID: 42, IsOnline: true}},
+		)
+	}
+	for _, p := range pkts {
+		if v, ok := p.(packets.Versioned); ok {
+			v.SetVersion(version)
+		}
+	}
+	return pkts
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, version := range []uint8{packets.Version1, packets.Version2, packets.Version3} {
+		for _, want := range validPackets(version) {
+			b, err := want.Encode()
+			if err != nil {
+				t.Fatalf("v%d %T: encode: %v", version, want, err)
+			}
+			got, err := packets.ConstructPacket(want.Type(), version)
+			if err != nil {
+				t.Fatalf("v%d %T: %v", version, want, err)
+			}
+			if err := got.Decode(b); err != nil {
+				t.Fatalf("v%d %T: decode: %v", version, want, err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("v%d round trip changed the packet\n got %v\nwant %v", version, got, want)
+			}
+
+			// Encode and AppendEncode must agree, whatever is in the buffer.
+			if a, ok := want.(packets.Appender); ok {
+				prefix := []byte("prefix")
+				appended, err := a.AppendEncode(bytes.Clone(prefix))
+				if err != nil || !bytes.Equal(appended, append(prefix, b...)) {
+					t.Fatalf("v%d %T: AppendEncode differs from Encode", version, want)
+				}
+			}
+		}
+	}
+}
+
+func TestDecodeRejectsOversizedContent(t *testing.T) {
+	content := strings.Repeat("x", packets.MaxContentSize+1)
+	for _, p := range []packets.BuildPayload{
+		&packets.SendMessagePacket{ConversationID: 3, Content: content},
+		&packets.UpdateMessagePacket{MessageID: 99, ConversationID: 3, Content: content},
+	} {
+		b, _ := p.Encode()
+		got, _ := packets.ConstructPacket(p.Type(), packets.CurrentVersion)
+		if err := got.Decode(b); errors.CodeOf(err) != errors.TooLarge {
+			t.Fatalf("%T: expected too_large, got %v", p, err)
+		}
+	}
+}
+
+// TestCheckContent counts characters, not bytes.
+func TestCheckContent(t *testing.T) {
+	tests := []struct {
+		content  string
+		maxChars int
+		code     errors.Code
+	}{
+		{"", 10, errors.InvalidPayload},
+		{"hello", 5, 0},
+		{"hello!", 5, errors.TooLarge},
+		{strings.Repeat("é", 5), 5, 0},
+		{strings.Repeat("🙂", 6), 5, errors.TooLarge},
+		{strings.Repeat("a", packets.DefaultContentChars), 0, 0},
+		{strings.Repeat("a", packets.MaxContentChars+1), packets.MaxContentChars * 2, errors.TooLarge},
+	}
+	for _, tt := range tests {
+		if code := errors.CodeOf(packets.CheckContent(tt.content, tt.maxChars)); code != tt.code {
+			t.Errorf("%d bytes with a limit of %d: got %q, want %q", len(tt.content), tt.maxChars, code, tt.code)
+		}
+	}
+}
+
+// FuzzDecode feeds arbitrary payloads to every packet decoder. Decoding
+// must never panic, and a payload that decodes must survive a round trip
+// through its canonical encoding.
+func FuzzDecode(f *testing.F) {
+	for _, version := range []uint8{packets.Version1, packets.Version2, packets.Version3} {
+		for _, p := range validPackets(version) {
+			b, err := p.Encode()
+			if err != nil {
+				f.Fatal(err)
+			}
+			f.Add(p.Type(), version, b)
+		}
+	}
+
+	f.Fuzz(func(t *testing.T, opcode uint8, version uint8, b []byte) {
+		pkt, err := packets.ConstructPacket(opcode, version)
+		if err != nil {
+			return
+		}
+		if err := pkt.Decode(b); err != nil {
+			return
+		}
+
+		encoded, err := pkt.Encode()
+		if err != nil {
+			t.Fatalf("%v decoded but doesn't encode: %v", pkt, err)
+		}
+		again, _ := packets.ConstructPacket(opcode, version)
+		if err := again.Decode(encoded); err != nil {
+			t.Fatalf("%v doesn't decode its own encoding: %v", pkt, err)
+		}
+		if !reflect.DeepEqual(again, pkt) {
+			t.Fatalf("round trip changed the packet\n got %v\nwant %v", again, pkt)
+		}
+	})
+}
@@ -25,12 +25,12 @@ func (r *ResponsePresencePacket) Type() uint8 {
 }
 
 func (r *ResponsePresencePacket) Encode() ([]byte, error) {
-	b := make([]byte, 5)
-	binary.BigEndian.PutUint32(b[:4], r.UserID)
-	if r.IsOnline {
-		b[4] = 1
-	}
-	return b, nil
+	return r.AppendEncode(make([]byte, 0, 5))
+}
+
+func (r *ResponsePresencePacket) AppendEncode(b []byte) ([]byte, error) {
+	b = binary.BigEndian.AppendUint32(b, r.UserID)
+	return append(b, boolByte(r.IsOnline)), nil
 }
 
 func (r *ResponsePresencePacket) Decode(b []byte) error {
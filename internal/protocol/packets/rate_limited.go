@@ -0,0 +1,71 @@
+package packets
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/iLeoon/realtime-gateway/internal/errors"
+)
+
+const (
+	LimitScopeUser uint8 = iota + 1
+	LimitScopeConversation
+)
+
+// RateLimitedPacket is sent by the engine instead of fanning out a packet
+// that exceeded the sender's or the conversation's budget. The session
+// stays open, the client is expected to retry after RetryAfter.
+//
+// Wire format: [0:4]=ConversationID [4]=Action(opcode) [5]=Scope [6:10]=RetryAfter(ms)
+type RateLimitedPacket struct {
+	ConversationID uint32
+	Action         uint8 // Opcode of the rejected packet (SendMessage, UpdateMessage, DeleteMessage, Typing).
+	Scope          uint8 // LimitScopeUser or LimitScopeConversation.
+	RetryAfter     time.Duration
+}
+
+func (r *RateLimitedPacket) String() string {
+	return fmt.Sprintf("RateLimitedPacket{ConversationID: %d, Action: %d, Scope: %d, RetryAfter: %v}", r.ConversationID, r.Action, r.Scope, r.RetryAfter)
+}
+
+func (r *RateLimitedPacket) Type() uint8 {
+	return RateLimited
+}
+
+func (r *RateLimitedPacket) Encode() ([]byte, error) {
+	b := make([]byte, 10)
+	binary.BigEndian.PutUint32(b[:4], r.ConversationID)
+	b[4] = r.Action
+	b[5] = r.Scope
+
+	ms := r.RetryAfter.Milliseconds()
+	if ms > 0xFFFFFFFF {
+		ms = 0xFFFFFFFF
+	} else if ms < 0 {
+		ms = 0
+	}
+	binary.BigEndian.PutUint32(b[6:10], uint32(ms))
+	return b, nil
+}
+
+func (r *RateLimitedPacket) Decode(b []byte) error {
+	const path errors.PathName = "packets/rate_limited"
+	const op errors.Op = "RateLimitedPacket.Decode"
+
+	if len(b) < 10 {
+		return errors.B(path, op, errors.Client, "rate limited packet length can't be less than 10")
+	}
+
+	r.ConversationID = binary.BigEndian.Uint32(b[:4])
+	r.Action = b[4]
+	if r.Action == 0 {
+		return errors.B(path, op, errors.Client, "action field is empty or 0")
+	}
+	r.Scope = b[5]
+	if r.Scope != LimitScopeUser && r.Scope != LimitScopeConversation {
+		return errors.B(path, op, errors.Client, fmt.Errorf("unknown scope %d", r.Scope))
+	}
+	r.RetryAfter = time.Duration(binary.BigEndian.Uint32(b[6:10])) * time.Millisecond
+	return nil
+}
@@ -0,0 +1,114 @@
+package packets
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/iLeoon/realtime-gateway/internal/errors"
+)
+
+// MaxRelayConversations bounds the conversations a RelayPacket lists, so
+// that the packet fits a message along with them.
+const MaxRelayConversations = 1024
+
+// RelayPacket carries a fan-out packet from the engine its sender is
+// connected to, to the other engines of the cluster. The receiving engine
+// delivers Packet to its own online members of Conversations, except
+// Exclude, the way it delivers the fan-outs of its own users.
+//
+// Wire format: [0:4]=Exclude [4:6]=len(Conversations) [6:6+4n]=Conversations
+// [..]=Opcode of Packet [..:]=Packet in the layout of the connection
+type RelayPacket struct {
+	Exclude       uint32 // 0 when every member gets Packet.
+	Conversations []uint32
+	Packet        BuildPayload
+	version       uint8
+}
+
+// relayable are the packets one engine fans out on behalf of another.
+var relayable = map[uint8]bool{
+	ResponseMessage:  true,
+	UpdateResponse:   true,
+	DeleteResponse:   true,
+	TypingResponse:   true,
+	PresenceResponse: true,
+}
+
+func (r *RelayPacket) String() string {
+	return fmt.Sprintf("RelayPacket{Exclude: %d, Conversations: %v, Packet: %v}", r.Exclude, r.Conversations, r.Packet)
+}
+
+func (r *RelayPacket) Type() uint8 {
+	return Relay
+}
+
+// SetVersion sets the layout of the relayed packet along with its own.
+func (r *RelayPacket) SetVersion(v uint8) {
+	r.version = v
+	if p, ok := r.Packet.(Versioned); ok {
+		p.SetVersion(v)
+	}
+}
+
+func (r *RelayPacket) Encode() ([]byte, error) {
+	const path errors.PathName = "packets/relay"
+	const op errors.Op = "RelayPacket.Encode"
+	if r.Packet == nil || !relayable[r.Packet.Type()] {
+		return nil, errors.B(path, op, errors.Internal, fmt.Errorf("%v can't be relayed", r.Packet))
+	}
+	if len(r.Conversations) > MaxRelayConversations {
+		return nil, errors.B(path, op, errors.Internal, fmt.Errorf("%d conversations don't fit a relay packet", len(r.Conversations)))
+	}
+	if p, ok := r.Packet.(Versioned); ok {
+		p.SetVersion(r.version)
+	}
+	payload, err := r.Packet.Encode()
+	if err != nil {
+		return nil, errors.B(path, op, err)
+	}
+	b := make([]byte, 0, 7+4*len(r.Conversations)+len(payload))
+	b = binary.BigEndian.AppendUint32(b, r.Exclude)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(r.Conversations)))
+	for _, id := range r.Conversations {
+		b = binary.BigEndian.AppendUint32(b, id)
+	}
+	b = append(b, r.Packet.Type())
+	return append(b, payload...), nil
+}
+
+func (r *RelayPacket) Decode(b []byte) error {
+	const path errors.PathName = "packets/relay"
+	const op errors.Op = "RelayPacket.Decode"
+	if len(b) < 6 {
+		return errors.B(path, op, errors.Client, "relay packet length can't be less than 6")
+	}
+	r.Exclude = binary.BigEndian.Uint32(b[0:4])
+	n := int(binary.BigEndian.Uint16(b[4:6]))
+	b = b[6:]
+	if n == 0 || n > MaxRelayConversations {
+		return errors.B(path, op, errors.Client, fmt.Errorf("relay packet with %d conversations", n))
+	}
+	if len(b) < 4*n+1 {
+		return errors.B(path, op, errors.Client, "relay packet is shorter than its conversations")
+	}
+	r.Conversations = make([]uint32, n)
+	for i := range r.Conversations {
+		r.Conversations[i] = binary.BigEndian.Uint32(b[4*i:])
+		if r.Conversations[i] == 0 {
+			return errors.B(path, op, errors.Client, "conversationID field is empty or 0")
+		}
+	}
+	b = b[4*n:]
+	if !relayable[b[0]] {
+		return errors.B(path, op, errors.Client, fmt.Errorf("packet type %d can't be relayed", b[0]))
+	}
+	pkt, err := ConstructPacket(b[0], r.version)
+	if err != nil {
+		return errors.B(path, op, errors.Client, err)
+	}
+	if err := pkt.Decode(b[1:]); err != nil {
+		return errors.B(path, op, err)
+	}
+	r.Packet = pkt
+	return nil
+}
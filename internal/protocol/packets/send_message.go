@@ -23,20 +23,19 @@ func (s *SendMessagePacket) Type() uint8 {
 }
 
 func (s *SendMessagePacket) Encode() ([]byte, error) {
-	b := make([]byte, 4+len(s.Content))
-
-	binary.BigEndian.PutUint32(b[:4], s.ConversationID)
-
-	copy(b[4:], []byte(s.Content))
+	return s.AppendEncode(make([]byte, 0, 4+len(s.Content)))
+}
 
-	return b, nil
+func (s *SendMessagePacket) AppendEncode(b []byte) ([]byte, error) {
+	b = binary.BigEndian.AppendUint32(b, s.ConversationID)
+	return append(b, s.Content...), nil
 }
 
 func (s *SendMessagePacket) Decode(b []byte) error {
 	const path errors.PathName = "packets/send_message"
 	const op errors.Op = "SendMessagePacket.Decode"
 	if len(b) < 4 {
-		return errors.B(path, op, errors.Client, "send message packet length can't be less than 8")
+		return errors.B(path, op, errors.Client, "send message packet length can't be less than 4")
 	}
 
 	s.ConversationID = binary.BigEndian.Uint32(b[:4])
@@ -44,11 +43,11 @@ func (s *SendMessagePacket) Decode(b []byte) error {
 		return errors.B(path, op, "conversationID field is empty or 0")
 	}
 
-	if len(b[4:]) > 512 {
-		return errors.B(path, op, fmt.Errorf("message size(%v) hit the maximum size", len(b[8:])))
+	if len(b[4:]) > MaxContentSize {
+		return errors.B(path, op, errors.Client, errors.TooLarge, fmt.Errorf("message size(%v) hit the maximum size", len(b[4:])))
 	}
 	if len(b[4:]) == 0 {
-		return errors.B(path, op, "message size can't be empty")
+		return errors.B(path, op, errors.Client, errors.InvalidPayload, "message size can't be empty")
 	}
 	s.Content = string(b[4:])
 	return nil
@@ -23,12 +23,12 @@ func (t *TypingPacket) Type() uint8 {
 }
 
 func (t *TypingPacket) Encode() ([]byte, error) {
-	b := make([]byte, 5)
-	binary.BigEndian.PutUint32(b[:4], t.ConversationID)
-	if t.IsTyping {
-		b[4] = 1
-	}
-	return b, nil
+	return t.AppendEncode(make([]byte, 0, 5))
+}
+
+func (t *TypingPacket) AppendEncode(b []byte) ([]byte, error) {
+	b = binary.BigEndian.AppendUint32(b, t.ConversationID)
+	return append(b, boolByte(t.IsTyping)), nil
 }
 
 func (t *TypingPacket) Decode(b []byte) error {
@@ -26,13 +26,13 @@ func (r *ResponseTypingPacket) Type() uint8 {
 }
 
 func (r *ResponseTypingPacket) Encode() ([]byte, error) {
-	b := make([]byte, 9)
-	binary.BigEndian.PutUint32(b[:4], r.ConversationID)
-	binary.BigEndian.PutUint32(b[4:8], r.UserID)
-	if r.IsTyping {
-		b[8] = 1
-	}
-	return b, nil
+	return r.AppendEncode(make([]byte, 0, 9))
+}
+
+func (r *ResponseTypingPacket) AppendEncode(b []byte) ([]byte, error) {
+	b = binary.BigEndian.AppendUint32(b, r.ConversationID)
+	b = binary.BigEndian.AppendUint32(b, r.UserID)
+	return append(b, boolByte(r.IsTyping)), nil
 }
 
 func (r *ResponseTypingPacket) Decode(b []byte) error {
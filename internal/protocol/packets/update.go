@@ -21,13 +21,13 @@ func (u *UpdateMessagePacket) Type() uint8 {
 }
 
 func (u *UpdateMessagePacket) Encode() ([]byte, error) {
-	b := make([]byte, 8+len(u.Content))
-
-	binary.BigEndian.PutUint32(b[:4], u.MessageID)
-	binary.BigEndian.PutUint32(b[4:8], u.ConversationID)
+	return u.AppendEncode(make([]byte, 0, 8+len(u.Content)))
+}
 
-	copy(b[8:], []byte(u.Content))
-	return b, nil
+func (u *UpdateMessagePacket) AppendEncode(b []byte) ([]byte, error) {
+	b = binary.BigEndian.AppendUint32(b, u.MessageID)
+	b = binary.BigEndian.AppendUint32(b, u.ConversationID)
+	return append(b, u.Content...), nil
 }
 
 func (u *UpdateMessagePacket) Decode(b []byte) error {
@@ -40,7 +40,7 @@ func (u *UpdateMessagePacket) Decode(b []byte) error {
 
 	u.MessageID = binary.BigEndian.Uint32(b[:4])
 	if u.MessageID == 0 {
-		return errors.B(path, op, "connectionID field is empty or 0")
+		return errors.B(path, op, "messageID field is empty or 0")
 	}
 
 	u.ConversationID = binary.BigEndian.Uint32(b[4:8])
@@ -48,11 +48,11 @@ func (u *UpdateMessagePacket) Decode(b []byte) error {
 		return errors.B(path, op, "conversationID field is empty or 0")
 	}
 
-	if len(b[8:]) > 512 {
-		return errors.B(path, op, fmt.Errorf("message size(%v) hit the maximum size", len(b[8:])))
+	if len(b[8:]) > MaxContentSize {
+		return errors.B(path, op, errors.Client, errors.TooLarge, fmt.Errorf("message size(%v) hit the maximum size", len(b[8:])))
 	}
 	if len(b[8:]) == 0 {
-		return errors.B(path, op, "message size can't be empty")
+		return errors.B(path, op, errors.Client, errors.InvalidPayload, "message size can't be empty")
 	}
 	u.Content = string(b[8:])
 	return nil
@@ -26,9 +26,12 @@ func (r *ResponseUpdateMessagePacket) Type() uint8 {
 }
 
 func (r *ResponseUpdateMessagePacket) Encode() ([]byte, error) {
-	b := make([]byte, 12+len(r.ResContent))
-	binary.BigEndian.PutUint32(b[:4], r.ConversationID)
-	binary.BigEndian.PutUint32(b[4:8], r.MessageID)
+	return r.AppendEncode(make([]byte, 0, 12+len(r.ResContent)))
+}
+
+func (r *ResponseUpdateMessagePacket) AppendEncode(b []byte) ([]byte, error) {
+	b = binary.BigEndian.AppendUint32(b, r.ConversationID)
+	b = binary.BigEndian.AppendUint32(b, r.MessageID)
 	unixTime := r.UpdatedAt.UTC().Unix()
 
 	// A check so (gosec lint) stops yelling at me for using possible out of range type casting
@@ -37,9 +40,8 @@ func (r *ResponseUpdateMessagePacket) Encode() ([]byte, error) {
 	} else if unixTime < 0 {
 		unixTime = 0
 	}
-	binary.BigEndian.PutUint32(b[8:12], uint32(unixTime))
-	copy(b[12:], r.ResContent)
-	return b, nil
+	b = binary.BigEndian.AppendUint32(b, uint32(unixTime))
+	return append(b, r.ResContent...), nil
 }
 
 func (r *ResponseUpdateMessagePacket) Decode(b []byte) error {
@@ -64,7 +66,7 @@ func (r *ResponseUpdateMessagePacket) Decode(b []byte) error {
 
 	r.UpdatedAt = time.Unix(int64(ts), 0).UTC()
 
-	if len(b[12:]) > 512 {
+	if len(b[12:]) > MaxContentSize {
 		return errors.B(path, op, errors.Client, fmt.Errorf("message size(%v) hit the maximum size", len(b[12:])))
 	}
 	if len(b[12:]) == 0 {
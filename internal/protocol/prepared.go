@@ -0,0 +1,96 @@
+package protocol
+
+import (
+	"sync/atomic"
+
+	"github.com/iLeoon/realtime-gateway/internal/protocol/packets"
+)
+
+// Wire layouts a prepared packet may be encoded in.
+const (
+	layoutV1 = iota
+	layoutV2
+	layoutV2Compressed
+	layoutV3
+	layoutV3Compressed
+	layouts
+)
+
+// PreparedFrame encodes a packet once per wire layout, so a fan-out writes
+// the same bytes to every connection that negotiated that layout instead
+// of building a frame per recipient. Fan-out frames are never correlated.
+//
+// Bytes must be called from a single goroutine. Every holder of the frame,
+// its creator included, calls Release once and the buffers go back to the
+// pool with the last one, slices returned by Bytes are invalid after that.
+type PreparedFrame struct {
+	pkt          packets.BuildPayload
+	compressFrom int
+	encoded      [layouts]*[]byte
+	refs         atomic.Int32
+}
+
+// Prepare wraps pkt for fan-out. compressFrom is the compression threshold
+// used for connections that negotiated FeatureCompression.
+func Prepare(pkt packets.BuildPayload, compressFrom int) *PreparedFrame {
+	p := &PreparedFrame{pkt: pkt, compressFrom: compressFrom}
+	p.refs.Store(1)
+	return p
+}
+
+// Opcode is the type of the prepared packet.
+func (p *PreparedFrame) Opcode() uint8 {
+	return p.pkt.Type()
+}
+
+// Retain adds a holder, e.g. a queue the encoded bytes wait in.
+func (p *PreparedFrame) Retain() {
+	p.refs.Add(1)
+}
+
+// Bytes returns the frame encoded for a connection that negotiated n. The
+// first call per layout encodes it, the following ones are free.
+func (p *PreparedFrame) Bytes(n Negotiated) ([]byte, error) {
+	layout := layoutV1
+	switch {
+	case n.Version >= packets.Version3:
+		layout = layoutV3
+	case n.Version >= packets.Version2:
+		layout = layoutV2
+	}
+	// Every compressed layout follows its plain one.
+	if layout != layoutV1 && n.Has(packets.FeatureCompression) && p.compressFrom > 0 {
+		layout++
+	}
+	if buf := p.encoded[layout]; buf != nil {
+		return *buf, nil
+	}
+
+	frame := ConstructFrame(p.pkt).ForVersion(n.Version)
+	if layout == layoutV2Compressed || layout == layoutV3Compressed {
+		frame.WithCompression(p.compressFrom)
+	}
+	buf := bufferPool.Get().(*[]byte)
+	b, err := frame.AppendFrame((*buf)[:0])
+	if err != nil {
+		bufferPool.Put(buf)
+		return nil, err
+	}
+	*buf = b
+	p.encoded[layout] = buf
+	return b, nil
+}
+
+// Release drops a holder, the last one returns the encoded frames to the
+// pool.
+func (p *PreparedFrame) Release() {
+	if p.refs.Add(-1) > 0 {
+		return
+	}
+	for i, buf := range p.encoded {
+		if buf != nil {
+			bufferPool.Put(buf)
+			p.encoded[i] = nil
+		}
+	}
+}
@@ -0,0 +1,107 @@
+// Package ratelimit provides the token-bucket primitives shared by the
+// engine (per-user and per-conversation message limits) and the HTTP API.
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// sweepInterval controls how often idle buckets are evicted.
+const sweepInterval = time.Minute
+
+// TokenBucket is an in-memory keyed token-bucket limiter. Each key owns a
+// bucket holding up to burst tokens that refills at rate tokens per second.
+// A zero or negative rate disables the limiter.
+type TokenBucket[K comparable] struct {
+	rate      float64
+	burst     float64
+	mu        sync.Mutex
+	buckets   map[K]*bucket
+	lastSweep time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func NewTokenBucket[K comparable](rate float64, burst int) *TokenBucket[K] {
+	if burst < 1 {
+		burst = 1
+	}
+	return &TokenBucket[K]{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[K]*bucket),
+	}
+}
+
+// Allow takes one token from the bucket of key. When the bucket is empty it
+// reports false together with how long the caller has to wait for the next
+// token.
+func (t *TokenBucket[K]) Allow(key K, now time.Time) (bool, time.Duration) {
+	if t == nil || t.rate <= 0 {
+		return true, 0
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.sweepLocked(now)
+
+	b, ok := t.buckets[key]
+	if !ok {
+		b = &bucket{tokens: t.burst, last: now}
+		t.buckets[key] = b
+	}
+	t.refill(b, now)
+
+	if b.tokens < 1 {
+		wait := time.Duration((1 - b.tokens) / t.rate * float64(time.Second))
+		return false, wait
+	}
+	b.tokens--
+	return true, 0
+}
+
+// Refund gives back a token previously taken by Allow. It's used when a
+// request passes one limiter but is rejected by the next one, so the first
+// budget isn't charged for work that never happened.
+func (t *TokenBucket[K]) Refund(key K) {
+	if t == nil || t.rate <= 0 {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if b, ok := t.buckets[key]; ok && b.tokens+1 <= t.burst {
+		b.tokens++
+	}
+}
+
+func (t *TokenBucket[K]) refill(b *bucket, now time.Time) {
+	elapsed := now.Sub(b.last).Seconds()
+	if elapsed <= 0 {
+		return
+	}
+	b.tokens += elapsed * t.rate
+	if b.tokens > t.burst {
+		b.tokens = t.burst
+	}
+	b.last = now
+}
+
+// sweepLocked drops the buckets that have been idle long enough to be full
+// again, they are indistinguishable from a brand new bucket.
+func (t *TokenBucket[K]) sweepLocked(now time.Time) {
+	if now.Sub(t.lastSweep) < sweepInterval {
+		return
+	}
+	t.lastSweep = now
+	full := time.Duration(t.burst / t.rate * float64(time.Second))
+	for k, b := range t.buckets {
+		if now.Sub(b.last) > full {
+			delete(t.buckets, k)
+		}
+	}
+}
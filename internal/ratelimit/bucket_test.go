@@ -0,0 +1,53 @@
+package ratelimit_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/iLeoon/realtime-gateway/internal/ratelimit"
+)
+
+func TestTokenBucket(t *testing.T) {
+	tb := ratelimit.NewTokenBucket[uint32](2, 3)
+	now := time.Unix(1_000, 0)
+
+	// The burst is available straight away.
+	for i := 0; i < 3; i++ {
+		if ok, _ := tb.Allow(1, now); !ok {
+			t.Fatalf("request %d should pass within the burst", i)
+		}
+	}
+
+	ok, wait := tb.Allow(1, now)
+	if ok {
+		t.Fatal("request above the burst should be rejected")
+	}
+	if wait != 500*time.Millisecond {
+		t.Fatalf("expected retry after 500ms, got %v", wait)
+	}
+
+	// Other keys own their own bucket.
+	if ok, _ := tb.Allow(2, now); !ok {
+		t.Fatal("a different key must not share the bucket")
+	}
+
+	// Refill at 2 tokens per second.
+	if ok, _ := tb.Allow(1, now.Add(500*time.Millisecond)); !ok {
+		t.Fatal("a token should have been refilled after 500ms")
+	}
+
+	// Refund returns the token that was just taken.
+	tb.Refund(1)
+	if ok, _ := tb.Allow(1, now.Add(500*time.Millisecond)); !ok {
+		t.Fatal("refunded token should be available")
+	}
+}
+
+func TestTokenBucketDisabled(t *testing.T) {
+	tb := ratelimit.NewTokenBucket[string](0, 1)
+	for i := 0; i < 100; i++ {
+		if ok, _ := tb.Allow("k", time.Now()); !ok {
+			t.Fatal("a zero rate must disable the limiter")
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/iLeoon/realtime-gateway/internal/errors"
+)
+
+const path errors.PathName = "ratelimit/limiter"
+
+// Decision is the outcome of a single Allow call. Limit, Remaining and Reset
+// map directly onto the RateLimit-* response headers.
+type Decision struct {
+	Allowed    bool
+	Limit      int
+	Remaining  int
+	Reset      time.Duration // Time until the budget is fully restored.
+	RetryAfter time.Duration // Only set when Allowed is false.
+	Policy     string        // RateLimit-Policy value, e.g. "10;w=60".
+}
+
+// Limiter decides whether the request identified by key may proceed.
+// Implementations keep their state in a Store so several API instances can
+// share the same budgets.
+type Limiter interface {
+	Allow(ctx context.Context, key string) (Decision, error)
+}
+
+// tokenBucketLimiter implements a token bucket through the generic cell
+// rate algorithm: instead of a token count the store keeps the theoretical
+// arrival time (TAT) of the next request, which can be advanced with a
+// single conditional write.
+type tokenBucketLimiter struct {
+	store    Store
+	burst    int
+	interval time.Duration // Time to refill one token.
+	now      func() time.Time
+}
+
+// NewTokenBucketLimiter allows burst requests at once, refilled at rate
+// requests per second.
+func NewTokenBucketLimiter(s Store, rate float64, burst int) Limiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucketLimiter{
+		store:    s,
+		burst:    burst,
+		interval: time.Duration(float64(time.Second) / rate),
+		now:      time.Now,
+	}
+}
+
+func (t *tokenBucketLimiter) Allow(ctx context.Context, key string) (Decision, error) {
+	const op errors.Op = "tokenBucketLimiter.Allow"
+	now := t.now()
+	window := t.interval * time.Duration(t.burst)
+	tolerance := window - t.interval
+
+	tat, ok, err := t.store.AdvanceTAT(ctx, key, now, t.interval, tolerance)
+	if err != nil {
+		return Decision{}, errors.B(path, op, err)
+	}
+
+	d := Decision{
+		Allowed: ok,
+		Limit:   t.burst,
+		Reset:   max(tat.Sub(now), 0),
+		Policy:  fmt.Sprintf("%d;w=%d", t.burst, int(math.Ceil(window.Seconds()))),
+	}
+	// Every interval between now and the TAT is a token already spent.
+	d.Remaining = max(t.burst-int(math.Ceil(float64(tat.Sub(now))/float64(t.interval))), 0)
+	if !ok {
+		// The request would conform once the TAT drops within the tolerance.
+		d.RetryAfter = max(tat.Add(-tolerance).Sub(now), 0)
+	}
+	return d, nil
+}
+
+// slidingWindowLimiter implements the sliding window counter: the previous
+// fixed window is weighted by how much of it still overlaps the sliding
+// window. Rejected requests are counted too, so a client hammering a
+// limited route stays limited.
+type slidingWindowLimiter struct {
+	store  Store
+	limit  int
+	window time.Duration
+	now    func() time.Time
+}
+
+// NewSlidingWindowLimiter allows limit requests in any window of the given
+// duration.
+func NewSlidingWindowLimiter(s Store, limit int, window time.Duration) Limiter {
+	if limit < 1 {
+		limit = 1
+	}
+	return &slidingWindowLimiter{
+		store:  s,
+		limit:  limit,
+		window: window,
+		now:    time.Now,
+	}
+}
+
+func (sw *slidingWindowLimiter) Allow(ctx context.Context, key string) (Decision, error) {
+	const op errors.Op = "slidingWindowLimiter.Allow"
+	now := sw.now()
+	start := now.Truncate(sw.window)
+
+	curr, prev, err := sw.store.IncrWindow(ctx, key, start, sw.window)
+	if err != nil {
+		return Decision{}, errors.B(path, op, err)
+	}
+
+	elapsed := now.Sub(start)
+	weight := 1 - float64(elapsed)/float64(sw.window)
+	estimate := float64(prev)*weight + float64(curr)
+	windowEnd := start.Add(sw.window).Sub(now)
+
+	d := Decision{
+		Allowed:   estimate <= float64(sw.limit),
+		Limit:     sw.limit,
+		Remaining: max(sw.limit-int(math.Ceil(estimate)), 0),
+		Reset:     windowEnd,
+		Policy:    fmt.Sprintf("%d;w=%d", sw.limit, int(math.Ceil(sw.window.Seconds()))),
+	}
+	if !d.Allowed {
+		d.RetryAfter = windowEnd
+		// The previous window keeps sliding out, the estimate may drop under
+		// the limit before the current window ends.
+		if over := estimate - float64(sw.limit); prev > 0 && over < float64(prev) {
+			if wait := time.Duration(over / float64(prev) * float64(sw.window)); wait < windowEnd {
+				d.RetryAfter = wait
+			}
+		}
+	}
+	return d, nil
+}
@@ -0,0 +1,80 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+type clock struct{ t time.Time }
+
+func (c *clock) now() time.Time          { return c.t }
+func (c *clock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+func TestTokenBucketLimiter(t *testing.T) {
+	c := &clock{t: time.Unix(1_000, 0)}
+	l := NewTokenBucketLimiter(NewMemoryStore(), 1, 3).(*tokenBucketLimiter)
+	l.now = c.now
+	ctx := context.Background()
+
+	for i, remaining := range []int{2, 1, 0} {
+		d, err := l.Allow(ctx, "k")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !d.Allowed || d.Remaining != remaining || d.Limit != 3 {
+			t.Fatalf("request %d: got %+v, want allowed with %d remaining", i, d, remaining)
+		}
+	}
+
+	d, _ := l.Allow(ctx, "k")
+	if d.Allowed {
+		t.Fatal("request above the burst should be rejected")
+	}
+	if d.RetryAfter != time.Second {
+		t.Fatalf("expected retry after 1s, got %v", d.RetryAfter)
+	}
+	if d.Reset != 3*time.Second {
+		t.Fatalf("expected full reset in 3s, got %v", d.Reset)
+	}
+
+	c.advance(time.Second)
+	if d, _ := l.Allow(ctx, "k"); !d.Allowed {
+		t.Fatal("a token should be refilled after 1s")
+	}
+}
+
+func TestSlidingWindowLimiter(t *testing.T) {
+	c := &clock{t: time.Unix(6_000, 0)} // aligned on a minute
+	l := NewSlidingWindowLimiter(NewMemoryStore(), 4, time.Minute).(*slidingWindowLimiter)
+	l.now = c.now
+	ctx := context.Background()
+
+	for i := 0; i < 4; i++ {
+		if d, _ := l.Allow(ctx, "k"); !d.Allowed {
+			t.Fatalf("request %d should pass", i)
+		}
+	}
+	if d, _ := l.Allow(ctx, "k"); d.Allowed {
+		t.Fatal("5th request in the window should be rejected")
+	}
+
+	// Half way into the next window the previous one (5 hits) still weighs 2.5.
+	c.advance(90 * time.Second)
+	if d, _ := l.Allow(ctx, "k"); !d.Allowed || d.Remaining != 0 {
+		t.Fatalf("expected allowed with 0 remaining, got %+v", d)
+	}
+	d, _ := l.Allow(ctx, "k")
+	if d.Allowed {
+		t.Fatal("estimate above the limit should be rejected")
+	}
+	if d.RetryAfter <= 0 || d.RetryAfter > 30*time.Second {
+		t.Fatalf("retry after should be within the current window, got %v", d.RetryAfter)
+	}
+
+	// A full window later the old hits have slid out.
+	c.advance(time.Minute)
+	if d, _ := l.Allow(ctx, "k"); !d.Allowed {
+		t.Fatal("request should pass once the window slid")
+	}
+}
@@ -0,0 +1,101 @@
+package ratelimit
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/iLeoon/realtime-gateway/internal/errors"
+	"github.com/iLeoon/realtime-gateway/pkg/log"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const pgPath errors.PathName = "ratelimit/postgres"
+
+// postgresStore shares the limiter state between API instances through the
+// rate_limit_tat and rate_limit_windows tables (see internal/db/sql). Each
+// operation is a single statement, so row locks give us atomicity per key.
+type postgresStore struct {
+	db        *pgxpool.Pool
+	lastPrune atomic.Int64
+}
+
+func NewPostgresStore(db *pgxpool.Pool) Store {
+	return &postgresStore{db: db}
+}
+
+func (p *postgresStore) AdvanceTAT(ctx context.Context, key string, now time.Time, interval, tolerance time.Duration) (time.Time, bool, error) {
+	const op errors.Op = "postgresStore.AdvanceTAT"
+	p.maybePrune(now)
+
+	// The conditional upsert only advances the TAT when the request
+	// conforms, no row is returned otherwise.
+	var tat time.Time
+	err := p.db.QueryRow(ctx, `
+		INSERT INTO rate_limit_tat AS r (key, tat)
+		VALUES ($1, $2::timestamptz + $3::interval)
+		ON CONFLICT (key) DO UPDATE
+		SET tat = GREATEST(r.tat, $2::timestamptz) + $3::interval
+		WHERE GREATEST(r.tat, $2::timestamptz) - $2::timestamptz <= $4::interval
+		RETURNING tat`,
+		key, now, interval, tolerance,
+	).Scan(&tat)
+	if err == nil {
+		return tat, true, nil
+	}
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return time.Time{}, false, errors.B(pgPath, op, errors.Internal, err)
+	}
+
+	if err := p.db.QueryRow(ctx, `SELECT tat FROM rate_limit_tat WHERE key = $1`, key).Scan(&tat); err != nil {
+		return time.Time{}, false, errors.B(pgPath, op, errors.Internal, err)
+	}
+	return tat, false, nil
+}
+
+func (p *postgresStore) IncrWindow(ctx context.Context, key string, windowStart time.Time, window time.Duration) (int64, int64, error) {
+	const op errors.Op = "postgresStore.IncrWindow"
+	p.maybePrune(windowStart)
+
+	var curr, prev int64
+	err := p.db.QueryRow(ctx, `
+		WITH curr AS (
+			INSERT INTO rate_limit_windows AS w (key, window_start, count)
+			VALUES ($1, $2, 1)
+			ON CONFLICT (key, window_start) DO UPDATE SET count = w.count + 1
+			RETURNING count
+		)
+		SELECT curr.count, COALESCE((
+			SELECT count FROM rate_limit_windows
+			WHERE key = $1 AND window_start = $2::timestamptz - $3::interval
+		), 0)
+		FROM curr`,
+		key, windowStart, window,
+	).Scan(&curr, &prev)
+	if err != nil {
+		return 0, 0, errors.B(pgPath, op, errors.Internal, err)
+	}
+	return curr, prev, nil
+}
+
+// maybePrune deletes expired rows at most once per sweepInterval per
+// instance. It runs in the background so requests never wait on it.
+func (p *postgresStore) maybePrune(now time.Time) {
+	const op errors.Op = "postgresStore.maybePrune"
+	last := p.lastPrune.Load()
+	if now.UnixNano()-last < int64(sweepInterval) || !p.lastPrune.CompareAndSwap(last, now.UnixNano()) {
+		return
+	}
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if _, err := p.db.Exec(ctx, `DELETE FROM rate_limit_tat WHERE tat < $1`, now); err != nil {
+			log.Error.Println(errors.B(pgPath, op, err))
+		}
+		if _, err := p.db.Exec(ctx, `DELETE FROM rate_limit_windows WHERE window_start < $1`, now.Add(-maxWindowAge)); err != nil {
+			log.Error.Println(errors.B(pgPath, op, err))
+		}
+	}()
+}
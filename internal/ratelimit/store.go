@@ -0,0 +1,95 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Store holds the limiter state. Every method must be atomic for a given
+// key, that's what allows several instances to share one Store.
+type Store interface {
+	// AdvanceTAT loads the theoretical arrival time of key (now when
+	// unknown). If it's no further than tolerance ahead of now the TAT is
+	// advanced by interval and ok is true. The returned time is the TAT
+	// after the call.
+	AdvanceTAT(ctx context.Context, key string, now time.Time, interval, tolerance time.Duration) (tat time.Time, ok bool, err error)
+
+	// IncrWindow increments the counter of key for the fixed window that
+	// starts at windowStart and returns it alongside the counter of the
+	// previous window.
+	IncrWindow(ctx context.Context, key string, windowStart time.Time, window time.Duration) (curr, prev int64, err error)
+}
+
+type windowKey struct {
+	key   string
+	start int64
+}
+
+// memoryStore keeps the state in process, it's the default for a single
+// instance deployment.
+type memoryStore struct {
+	mu        sync.Mutex
+	tats      map[string]time.Time
+	windows   map[windowKey]int64
+	lastSweep time.Time
+}
+
+func NewMemoryStore() Store {
+	return &memoryStore{
+		tats:    make(map[string]time.Time),
+		windows: make(map[windowKey]int64),
+	}
+}
+
+func (m *memoryStore) AdvanceTAT(_ context.Context, key string, now time.Time, interval, tolerance time.Duration) (time.Time, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sweepLocked(now)
+
+	tat, ok := m.tats[key]
+	if !ok || tat.Before(now) {
+		tat = now
+	}
+	if tat.Sub(now) > tolerance {
+		return tat, false, nil
+	}
+	tat = tat.Add(interval)
+	m.tats[key] = tat
+	return tat, true, nil
+}
+
+func (m *memoryStore) IncrWindow(_ context.Context, key string, windowStart time.Time, window time.Duration) (int64, int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sweepLocked(windowStart)
+
+	curr := windowKey{key, windowStart.UnixNano()}
+	m.windows[curr]++
+	prev := m.windows[windowKey{key, windowStart.Add(-window).UnixNano()}]
+	return m.windows[curr], prev, nil
+}
+
+// sweepLocked drops TATs in the past and window counters older than
+// maxWindowAge, both behave exactly like missing entries.
+func (m *memoryStore) sweepLocked(now time.Time) {
+	if now.Sub(m.lastSweep) < sweepInterval {
+		return
+	}
+	m.lastSweep = now
+	for k, tat := range m.tats {
+		if tat.Before(now) {
+			delete(m.tats, k)
+		}
+	}
+	cutoff := now.Add(-maxWindowAge).UnixNano()
+	for k := range m.windows {
+		if k.start < cutoff {
+			delete(m.windows, k)
+		}
+	}
+}
+
+// maxWindowAge bounds how long window counters are kept around. Windows
+// longer than this aren't supported by the stores.
+const maxWindowAge = 2 * time.Hour
@@ -6,7 +6,18 @@ type ResponseMessage struct {
 	AuthorID       uint32 `json:"authorID"`
 	ConversationID uint32 `json:"conversationID"`
 	MessageID      uint32 `json:"messageID"`
-	Content        string `json:"content"`
+	// CreatedAt is the server time the message is stored with, Author the
+	// sender's profile. Engines older than protocol version 3 send neither.
+	CreatedAt time.Time `json:"createdAt,omitzero"`
+	Author    *Author   `json:"author,omitempty"`
+	Content   string    `json:"content"`
+}
+
+// Author is the profile of a message's sender, named like the REST
+// participants.
+type Author struct {
+	DisplayName  string `json:"displayName"`
+	DisplayImage string `json:"displayImage"`
 }
 
 type ResponseUpdateMessage struct {
@@ -36,3 +47,29 @@ type ResponsePresence struct {
 type AddedToConversation struct {
 	ConversationID uint32 `json:"conversationID"`
 }
+
+// RateLimited tells the client that an action was rejected by the engine
+// budgets. The session stays open, the action can be retried after
+// RetryAfter milliseconds.
+type RateLimited struct {
+	Error          string `json:"error"`
+	Action         string `json:"action"`
+	Scope          string `json:"scope"`
+	ConversationID uint32 `json:"conversationID"`
+	RetryAfter     int64  `json:"retryAfterMs"`
+	ID             string `json:"id,omitempty"`
+}
+
+// Ack confirms that the engine processed the action the browser tagged
+// with ID.
+type Ack struct {
+	Ack string `json:"ack"`
+	ID  string `json:"id,omitempty"`
+}
+
+// Link tells the client whether the gateway can currently reach the
+// engine. While it's "degraded" actions are held and sent once it's
+// "restored".
+type Link struct {
+	Link string `json:"link"`
+}
@@ -1,10 +1,11 @@
 package router
 
 import (
-	"encoding/json"
 	"fmt"
 
+	"github.com/iLeoon/realtime-gateway/internal/errors"
 	"github.com/iLeoon/realtime-gateway/internal/protocol/packets"
+	"github.com/iLeoon/realtime-gateway/pkg/codec"
 	"github.com/iLeoon/realtime-gateway/pkg/log"
 )
 
@@ -15,6 +16,8 @@ import (
 
 type Sender interface {
 	Send(userID string, connectionID uint32, message []byte) (err error)
+	// Codec is the codec the client negotiated.
+	Codec(userID string, connectionID uint32) codec.Codec
 }
 
 type router struct {
@@ -46,10 +49,77 @@ func (r *router) Route(pkt packets.BuildPayload, userID string, connectionID uin
 		r.handleResponsePresence(p, userID, connectionID)
 	case *packets.AddedToConversationPacket:
 		r.handleAddedToConversation(p, userID, connectionID)
+	case *packets.RateLimitedPacket:
+		r.handleRateLimited(p, "", userID, connectionID)
+	case *packets.ErrorPacket:
+		r.handleError(p, "", "", userID, connectionID)
 	default:
 	}
 }
 
+// Reply delivers the engine's answer to one browser action, identified by
+// the requestID the browser tagged it with.
+func (r *router) Reply(pkt packets.BuildPayload, requestID, action string, userID string, connectionID uint32) {
+	var res any
+	switch p := pkt.(type) {
+	case *packets.AckPacket:
+		res = Ack{Ack: action, ID: requestID}
+	case *packets.ErrorPacket:
+		r.handleError(p, requestID, action, userID, connectionID)
+		return
+	case *packets.RateLimitedPacket:
+		r.handleRateLimited(p, requestID, userID, connectionID)
+		return
+	default:
+		// Anything else isn't tied to the request, deliver it as usual.
+		r.Route(pkt, userID, connectionID)
+		return
+	}
+
+	payload, err := r.encode(res, userID, connectionID)
+	if err != nil {
+		log.Error.Printf("failed to encode reply packet: %v", pkt)
+		return
+	}
+
+	if err := r.router.Send(userID, connectionID, payload); err != nil {
+		log.Error.Println("couldn't find the client", "error", err)
+		return
+	}
+}
+
+// handleError turns an engine error into an error event, the session
+// stays open.
+func (r *router) handleError(pkt *packets.ErrorPacket, requestID, action string, userID string, connectionID uint32) {
+	payload, err := r.encode(errorCode(pkt).Event(action, requestID), userID, connectionID)
+	if err != nil {
+		log.Error.Printf("failed to encode error packet: %v", pkt)
+		return
+	}
+
+	if err := r.router.Send(userID, connectionID, payload); err != nil {
+		log.Error.Println("couldn't find the client", "error", err)
+		return
+	}
+}
+
+// encode marshals an event with the codec of the client it's for.
+func (r *router) encode(v any, userID string, connectionID uint32) ([]byte, error) {
+	return r.router.Codec(userID, connectionID).Marshal(v)
+}
+
+// errorCode picks the most precise code the engine gave for a failure.
+func errorCode(p *packets.ErrorPacket) errors.Code {
+	switch {
+	case p.Reason != 0:
+		return p.Reason
+	case p.Code == errors.Client:
+		return errors.InvalidRequest
+	default:
+		return errors.InternalFailure
+	}
+}
+
 // handleResponseMessage delivers a ResponseMessagePacket to its intended
 // WebSocket recipient.
 func (r *router) handleResponseMessage(pkt *packets.ResponseMessagePacket, userID string, connectionID uint32) {
@@ -57,11 +127,15 @@ func (r *router) handleResponseMessage(pkt *packets.ResponseMessagePacket, userI
 		AuthorID:       pkt.AuthorID,
 		ConversationID: pkt.ConversationID,
 		MessageID:      pkt.MessageID,
+		CreatedAt:      pkt.CreatedAt,
 		Content:        pkt.ResContent,
 	}
-	payload, err := json.Marshal(res)
+	if pkt.AuthorName != "" || pkt.AuthorImage != "" {
+		res.Author = &Author{DisplayName: pkt.AuthorName, DisplayImage: pkt.AuthorImage}
+	}
+	payload, err := r.encode(res, userID, connectionID)
 	if err != nil {
-		log.Error.Printf("failed to encode packet frame: %v to json", pkt)
+		log.Error.Printf("failed to encode packet frame: %v", pkt)
 		return
 	}
 
@@ -80,9 +154,9 @@ func (r *router) handleResponseUpdateMessage(pkt *packets.ResponseUpdateMessageP
 		UpdatedAt:      pkt.UpdatedAt,
 		Content:        pkt.ResContent,
 	}
-	payload, err := json.Marshal(res)
+	payload, err := r.encode(res, userID, connectionID)
 	if err != nil {
-		log.Error.Printf("failed to encode packet frame: %v to json", pkt)
+		log.Error.Printf("failed to encode packet frame: %v", pkt)
 		return
 	}
 
@@ -99,9 +173,9 @@ func (r *router) handleResponseTyping(pkt *packets.ResponseTypingPacket, userID
 		UserID:         fmt.Sprintf("%d", pkt.UserID),
 		IsTyping:       pkt.IsTyping,
 	}
-	payload, err := json.Marshal(res)
+	payload, err := r.encode(res, userID, connectionID)
 	if err != nil {
-		log.Error.Printf("failed to encode typing packet: %v to json", pkt)
+		log.Error.Printf("failed to encode typing packet: %v", pkt)
 		return
 	}
 
@@ -118,9 +192,9 @@ func (r *router) handleResponseDeleteMessage(pkt *packets.ResponseDeleteMessageP
 		ConversationID: pkt.ConversationID,
 		AuthorID:       pkt.AuthorID,
 	}
-	payload, err := json.Marshal(res)
+	payload, err := r.encode(res, userID, connectionID)
 	if err != nil {
-		log.Error.Printf("failed to encode packet frame: %v to json", pkt)
+		log.Error.Printf("failed to encode packet frame: %v", pkt)
 		return
 	}
 
@@ -136,9 +210,9 @@ func (r *router) handleAddedToConversation(pkt *packets.AddedToConversationPacke
 	res := AddedToConversation{
 		ConversationID: pkt.ConversationID,
 	}
-	payload, err := json.Marshal(res)
+	payload, err := r.encode(res, userID, connectionID)
 	if err != nil {
-		log.Error.Printf("failed to encode added_to_conversation packet: %v to json", pkt)
+		log.Error.Printf("failed to encode added_to_conversation packet: %v", pkt)
 		return
 	}
 
@@ -152,9 +226,54 @@ func (r *router) handleResponsePresence(pkt *packets.ResponsePresencePacket, use
 		UserID:   fmt.Sprintf("%d", pkt.UserID),
 		IsOnline: pkt.IsOnline,
 	}
-	payload, err := json.Marshal(res)
+	payload, err := r.encode(res, userID, connectionID)
+	if err != nil {
+		log.Error.Printf("failed to encode presence packet: %v", pkt)
+		return
+	}
+
+	if err := r.router.Send(userID, connectionID, payload); err != nil {
+		log.Error.Println("couldn't find the client", "error", err)
+		return
+	}
+}
+
+// handleRateLimited tells the WebSocket client which action was throttled
+// and when it can be retried.
+func (r *router) handleRateLimited(pkt *packets.RateLimitedPacket, requestID string, userID string, connectionID uint32) {
+	// send_message, update_message, delete_message or typing.
+	action := packets.Name(pkt.Action)
+	scope := "user"
+	if pkt.Scope == packets.LimitScopeConversation {
+		scope = "conversation"
+	}
+
+	res := RateLimited{
+		Error:          "rate_limited",
+		Action:         action,
+		Scope:          scope,
+		ConversationID: pkt.ConversationID,
+		RetryAfter:     pkt.RetryAfter.Milliseconds(),
+		ID:             requestID,
+	}
+	payload, err := r.encode(res, userID, connectionID)
+	if err != nil {
+		log.Error.Printf("failed to encode rate_limited packet: %v", pkt)
+		return
+	}
+
+	if err := r.router.Send(userID, connectionID, payload); err != nil {
+		log.Error.Println("couldn't find the client", "error", err)
+		return
+	}
+}
+
+// LinkStatus tells the WebSocket client that the gateway lost or got back
+// its link to the engine.
+func (r *router) LinkStatus(userID string, connectionID uint32, status string) {
+	payload, err := r.encode(Link{Link: status}, userID, connectionID)
 	if err != nil {
-		log.Error.Printf("failed to encode presence packet: %v to json", pkt)
+		log.Error.Printf("failed to encode link status: %s", status)
 		return
 	}
 
@@ -0,0 +1,60 @@
+package router
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/iLeoon/realtime-gateway/internal/errors"
+	"github.com/iLeoon/realtime-gateway/internal/protocol/packets"
+	"github.com/iLeoon/realtime-gateway/pkg/codec"
+)
+
+// codecSender is a connection per codec, connection i speaks codecs[i].
+type codecSender struct {
+	codecs []codec.Codec
+	sent   [][]byte
+}
+
+func (s *codecSender) Send(_ string, connectionID uint32, message []byte) error {
+	s.sent[connectionID] = message
+	return nil
+}
+
+func (s *codecSender) Codec(_ string, connectionID uint32) codec.Codec {
+	return s.codecs[connectionID]
+}
+
+// TestCodecsAgree routes every event to a JSON and a MessagePack client,
+// both decode to the same event.
+func TestCodecsAgree(t *testing.T) {
+	s := &codecSender{codecs: []codec.Codec{codec.JSON, codec.MsgPack}}
+	r := New(s)
+	for _, pkt := range []packets.BuildPayload{
+		&packets.ResponseMessagePacket{AuthorID: 7, ConversationID: 1, MessageID: 1 << 31, CreatedAt: time.Date(2026, 10, 19, 9, 0, 0, 0, time.UTC), AuthorName: "Zoë", ResContent: "héllo"},
+		&packets.ResponseUpdateMessagePacket{ConversationID: 1, MessageID: 2, UpdatedAt: time.Unix(1, 0).UTC(), ResContent: "edited"},
+		&packets.ResponseDeleteMessagePacket{MessageID: 2, ConversationID: 1, AuthorID: 7},
+		&packets.ResponseTypingPacket{ConversationID: 1, UserID: 7, IsTyping: true},
+		&packets.ResponsePresencePacket{UserID: 7},
+		&packets.AddedToConversationPacket{ConversationID: 3},
+		&packets.RateLimitedPacket{Action: packets.Typing, ConversationID: 1, RetryAfter: 1500 * time.Millisecond},
+		&packets.ErrorPacket{Code: errors.Client, Reason: errors.NotAMember},
+	} {
+		s.sent = make([][]byte, len(s.codecs))
+		for id := range s.codecs {
+			r.Route(pkt, "7", uint32(id))
+		}
+
+		var events []any
+		for id, c := range s.codecs {
+			var event any
+			if err := c.Unmarshal(s.sent[id], &event); err != nil {
+				t.Fatalf("%v over %s: %v", pkt, c.Subprotocol(), err)
+			}
+			events = append(events, event)
+		}
+		if !reflect.DeepEqual(events[0], events[1]) {
+			t.Fatalf("%v: JSON gives %v, MessagePack %v", pkt, events[0], events[1])
+		}
+	}
+}
@@ -2,23 +2,220 @@ package middleware
 
 import (
 	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
 
 	"github.com/iLeoon/realtime-gateway/internal/config"
+	"github.com/iLeoon/realtime-gateway/pkg/log"
 )
 
-func Cors(next http.Handler, c *config.Config) http.Handler {
+// CorsRule describes what a browser may do cross-origin on a group of routes.
+type CorsRule struct {
+	Methods []string
+	Headers []string
+}
+
+var defaultCorsRule = CorsRule{
+	Methods: []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete, http.MethodOptions},
+	Headers: []string{"Content-Type", "Authorization", CSRFHeader},
+}
+
+// exposedHeaders lets frontend code read the rate limit state.
+const exposedHeaders = "RateLimit-Policy, RateLimit-Limit, RateLimit-Remaining, RateLimit-Reset, Retry-After, Location"
+
+type originMatcher struct {
+	scheme string
+	host   string // exact host[:port], or the suffix after "*." for wildcards
+	wild   bool
+}
+
+type corsRoute struct {
+	prefix string
+	rule   CorsRule
+}
+
+// CorsPolicy is the single source of truth for which origins may talk to
+// the gateway. It drives the CORS middleware on the REST API and the
+// origin check of the WebSocket upgrader.
+type CorsPolicy struct {
+	origins     []originMatcher
+	routes      []corsRoute
+	stripPrefix string
+	maxAge      int
+}
+
+// NewCorsPolicy builds a policy from the configured allowlist. Entries are
+// either exact origins ("https://app.example.com") or wildcard subdomains
+// ("https://*.example.com"). A bare "*" is refused because every route
+// is called with credentials.
+func NewCorsPolicy(c *config.Config) *CorsPolicy {
+	p := &CorsPolicy{maxAge: 600}
+	for _, o := range c.AllowedOrigins {
+		m, ok := parseOrigin(o)
+		if !ok {
+			log.Error.Printf("ignoring invalid cors origin %q", o)
+			continue
+		}
+		p.origins = append(p.origins, m)
+	}
+	return p
+}
+
+func parseOrigin(raw string) (originMatcher, bool) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" || raw == "*" {
+		return originMatcher{}, false
+	}
+	u, err := url.Parse(raw)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return originMatcher{}, false
+	}
+	host := strings.ToLower(u.Host)
+	if suffix, ok := strings.CutPrefix(host, "*."); ok {
+		if suffix == "" || strings.Contains(suffix, "*") {
+			return originMatcher{}, false
+		}
+		return originMatcher{scheme: u.Scheme, host: suffix, wild: true}, true
+	}
+	if strings.Contains(host, "*") {
+		return originMatcher{}, false
+	}
+	return originMatcher{scheme: u.Scheme, host: host}, true
+}
+
+// Route overrides the allowed methods and headers for prefix and the
+// paths below it: "/conversations" covers "/conversations/1" but not
+// "/conversationsX". The longest matching prefix wins.
+func (p *CorsPolicy) Route(prefix string, rule CorsRule) *CorsPolicy {
+	p.routes = append(p.routes, corsRoute{prefix: prefix, rule: rule})
+	sort.SliceStable(p.routes, func(i, j int) bool {
+		return len(p.routes[i].prefix) > len(p.routes[j].prefix)
+	})
+	return p
+}
+
+// StripPrefix makes route lookup ignore a versioned mount point such as
+// "/api/v1.0", so one rule covers both the bare and the versioned path.
+func (p *CorsPolicy) StripPrefix(prefix string) *CorsPolicy {
+	p.stripPrefix = prefix
+	return p
+}
+
+// AllowOrigin reports whether origin is part of the allowlist.
+func (p *CorsPolicy) AllowOrigin(origin string) bool {
+	if origin == "" {
+		return false
+	}
+	u, err := url.Parse(origin)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return false
+	}
+	host := strings.ToLower(u.Host)
+	for _, m := range p.origins {
+		if m.scheme != u.Scheme {
+			continue
+		}
+		if !m.wild && m.host == host {
+			return true
+		}
+		if m.wild && strings.HasSuffix(host, "."+m.host) {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckOrigin satisfies websocket.Upgrader.CheckOrigin.
+func (p *CorsPolicy) CheckOrigin(r *http.Request) bool {
+	return p.AllowOrigin(r.Header.Get("Origin"))
+}
+
+func (p *CorsPolicy) ruleFor(path string) CorsRule {
+	if p.stripPrefix != "" {
+		if underPrefix(path, p.stripPrefix) {
+			path = strings.TrimPrefix(path, p.stripPrefix)
+		}
+	}
+	for _, route := range p.routes {
+		if underPrefix(path, route.prefix) {
+			return route.rule
+		}
+	}
+	return defaultCorsRule
+}
+
+// underPrefix reports whether path is prefix or one of the paths below
+// it. A prefix ending in "/" already marks the boundary.
+func underPrefix(path, prefix string) bool {
+	if !strings.HasPrefix(path, prefix) {
+		return false
+	}
+	rest := path[len(prefix):]
+	return rest == "" || strings.HasSuffix(prefix, "/") || rest[0] == '/'
+}
+
+func Cors(next http.Handler, p *CorsPolicy) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", c.Cors)
+		// The response depends on the Origin header whether or not it is
+		// allowed, caches must never share it across origins.
+		w.Header().Add("Vary", "Origin")
+
+		origin := r.Header.Get("Origin")
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if !p.AllowOrigin(origin) {
+			if preflight {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			// Without the allow headers the browser hides the response.
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("Access-Control-Allow-Origin", origin)
 		w.Header().Set("Access-Control-Allow-Credentials", "true")
 
-		if r.Method == http.MethodOptions {
-			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS, PATCH")
-			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-CSRF-Token")
-			w.Header().Set("Access-Control-Max-Age", "600")
-			w.WriteHeader(http.StatusOK)
+		if !preflight {
+			w.Header().Set("Access-Control-Expose-Headers", exposedHeaders)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Add("Vary", "Access-Control-Request-Method")
+		w.Header().Add("Vary", "Access-Control-Request-Headers")
+
+		rule := p.ruleFor(r.URL.Path)
+		if !containsFold(rule.Methods, r.Header.Get("Access-Control-Request-Method")) {
+			w.WriteHeader(http.StatusForbidden)
 			return
 		}
+		for _, h := range strings.Split(r.Header.Get("Access-Control-Request-Headers"), ",") {
+			if h = strings.TrimSpace(h); h != "" && !containsFold(rule.Headers, h) {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+		}
 
-		next.ServeHTTP(w, r)
+		w.Header().Set("Access-Control-Allow-Methods", strings.Join(rule.Methods, ", "))
+		w.Header().Set("Access-Control-Allow-Headers", strings.Join(rule.Headers, ", "))
+		w.Header().Set("Access-Control-Max-Age", strconv.Itoa(p.maxAge))
+		w.WriteHeader(http.StatusNoContent)
 	})
 }
+
+func containsFold(list []string, v string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, v) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,124 @@
+package middleware_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/iLeoon/realtime-gateway/internal/config"
+	"github.com/iLeoon/realtime-gateway/internal/transport/http/middleware"
+	"github.com/iLeoon/realtime-gateway/pkg/log"
+)
+
+func newCorsPolicy(t *testing.T) *middleware.CorsPolicy {
+	t.Helper()
+	_ = log.SetLevel("disabled")
+	conf := &config.Config{CORS: config.CORS{AllowedOrigins: []string{
+		"https://app.example.com",
+		"https://*.admin.example.com",
+		"capacitor://localhost",
+		"*",
+	}}}
+	return middleware.NewCorsPolicy(conf).
+		StripPrefix("/api/v1.0").
+		Route("/conversations", middleware.CorsRule{
+			Methods: []string{http.MethodGet, http.MethodPost},
+			Headers: []string{"Content-Type", middleware.CSRFHeader},
+		})
+}
+
+func TestCorsPolicyAllowOrigin(t *testing.T) {
+	p := newCorsPolicy(t)
+
+	tests := []struct {
+		origin string
+		want   bool
+	}{
+		{"https://app.example.com", true},
+		{"https://eu.admin.example.com", true},
+		{"https://a.b.admin.example.com", true},
+		{"capacitor://localhost", true},
+		{"https://admin.example.com", false}, // wildcard requires a subdomain
+		{"http://app.example.com", false},    // scheme must match
+		{"https://app.example.com.evil", false},
+		{"https://evil-admin.example.com", false},
+		{"https://anything.else", false}, // "*" is refused
+		{"", false},
+	}
+
+	for _, tt := range tests {
+		if got := p.AllowOrigin(tt.origin); got != tt.want {
+			t.Errorf("AllowOrigin(%q) = %v, want %v", tt.origin, got, tt.want)
+		}
+	}
+}
+
+func TestCorsPreflight(t *testing.T) {
+	handler := middleware.Cors(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}), newCorsPolicy(t))
+
+	tests := []struct {
+		name    string
+		origin  string
+		path    string
+		method  string
+		headers string
+		want    int
+	}{
+		{"allowed route method", "https://app.example.com", "/conversations", http.MethodPost, "content-type, x-csrf-token", http.StatusNoContent},
+		{"versioned path", "https://eu.admin.example.com", "/api/v1.0/conversations/1", http.MethodGet, "", http.StatusNoContent},
+		{"method not allowed on route", "https://app.example.com", "/conversations", http.MethodDelete, "", http.StatusForbidden},
+		{"header not allowed on route", "https://app.example.com", "/conversations", http.MethodPost, "X-Custom", http.StatusForbidden},
+		{"default rule", "https://app.example.com", "/friendrequests", http.MethodDelete, "", http.StatusNoContent},
+		{"route prefix without a path boundary", "https://app.example.com", "/conversationsX", http.MethodDelete, "", http.StatusNoContent},
+		{"strip prefix without a path boundary", "https://app.example.com", "/api/v1.0conversations", http.MethodDelete, "", http.StatusNoContent},
+		{"unknown origin", "https://evil.example", "/conversations", http.MethodPost, "", http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodOptions, tt.path, nil)
+			r.Header.Set("Origin", tt.origin)
+			r.Header.Set("Access-Control-Request-Method", tt.method)
+			if tt.headers != "" {
+				r.Header.Set("Access-Control-Request-Headers", tt.headers)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			if w.Code != tt.want {
+				t.Fatalf("expected %d, got %d", tt.want, w.Code)
+			}
+			if tt.want == http.StatusNoContent && w.Header().Get("Access-Control-Allow-Origin") != tt.origin {
+				t.Fatalf("expected allow origin %q, got %q", tt.origin, w.Header().Get("Access-Control-Allow-Origin"))
+			}
+		})
+	}
+}
+
+func TestCorsActualRequest(t *testing.T) {
+	handler := middleware.Cors(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}), newCorsPolicy(t))
+
+	for _, origin := range []string{"https://app.example.com", "https://evil.example", ""} {
+		r := httptest.NewRequest(http.MethodGet, "/conversations", nil)
+		if origin != "" {
+			r.Header.Set("Origin", origin)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		if w.Header().Get("Vary") != "Origin" {
+			t.Errorf("origin %q: expected Vary: Origin, got %q", origin, w.Header().Get("Vary"))
+		}
+		allowed := w.Header().Get("Access-Control-Allow-Origin")
+		if origin == "https://app.example.com" && allowed != origin {
+			t.Errorf("expected allow origin %q, got %q", origin, allowed)
+		}
+		if origin != "https://app.example.com" && allowed != "" {
+			t.Errorf("origin %q must not be echoed, got %q", origin, allowed)
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package middleware
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"github.com/iLeoon/realtime-gateway/internal/ctx"
+	"github.com/iLeoon/realtime-gateway/pkg/log"
+)
+
+// TrustedProxies is the set of peers whose forwarding headers are believed.
+// Anything else talking to the API is treated as the client itself.
+type TrustedProxies struct {
+	prefixes []netip.Prefix
+}
+
+// NewTrustedProxies parses a list of CIDRs or bare IPs. Invalid entries are
+// logged and skipped.
+func NewTrustedProxies(cidrs []string) *TrustedProxies {
+	t := &TrustedProxies{}
+	for _, raw := range cidrs {
+		raw = strings.TrimSpace(raw)
+		if raw == "" {
+			continue
+		}
+		if !strings.Contains(raw, "/") {
+			addr, err := netip.ParseAddr(raw)
+			if err != nil {
+				log.Error.Printf("ignoring invalid trusted proxy %q", raw)
+				continue
+			}
+			raw = netip.PrefixFrom(addr, addr.BitLen()).String()
+		}
+		prefix, err := netip.ParsePrefix(raw)
+		if err != nil {
+			log.Error.Printf("ignoring invalid trusted proxy %q", raw)
+			continue
+		}
+		t.prefixes = append(t.prefixes, prefix.Masked())
+	}
+	return t
+}
+
+func (t *TrustedProxies) trusted(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, p := range t.prefixes {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedHop is one proxy hop: the address it received the request from
+// and the scheme/host the request had at that point.
+type forwardedHop struct {
+	ip    string
+	proto string
+	host  string
+}
+
+// ResolveClient stores the real client address, scheme and host in the
+// request context. Forwarding headers (RFC 7239 Forwarded first, then the
+// X-Forwarded-* family) are only read when the direct peer is a trusted
+// proxy, and the chain is walked from the right so a client can't spoof
+// its way in by prepending entries.
+func ResolveClient(next http.Handler, t *TrustedProxies) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(ctx.SetClient(r.Context(), t.resolve(r))))
+	})
+}
+
+func (t *TrustedProxies) resolve(r *http.Request) ctx.Client {
+	client := ctx.Client{IP: remoteIP(r), Scheme: "http", Host: r.Host}
+	if r.TLS != nil {
+		client.Scheme = "https"
+	}
+	if !t.trusted(client.IP) {
+		return client
+	}
+
+	hops := parseForwarded(r.Header.Values("Forwarded"))
+	if hops == nil {
+		hops = parseXForwarded(r.Header)
+	}
+
+	// Every hop to the right of the client was appended by one of our
+	// proxies. The first untrusted address is the client, its hop carries
+	// the scheme and host the client used.
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := hops[i]
+		if hop.ip == "" {
+			break
+		}
+		client.IP = hop.ip
+		if validScheme(hop.proto) {
+			client.Scheme = strings.ToLower(hop.proto)
+		}
+		if validHost(hop.host) {
+			client.Host = hop.host
+		}
+		if !t.trusted(hop.ip) {
+			break
+		}
+	}
+	return client
+}
+
+// parseForwarded reads RFC 7239 headers. It returns nil when none is set.
+func parseForwarded(values []string) []forwardedHop {
+	var hops []forwardedHop
+	for _, v := range values {
+		for _, elem := range strings.Split(v, ",") {
+			var hop forwardedHop
+			for _, pair := range strings.Split(elem, ";") {
+				k, val, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if !ok {
+					continue
+				}
+				val = strings.Trim(val, `"`)
+				switch strings.ToLower(k) {
+				case "for":
+					hop.ip = forwardedNode(val)
+				case "proto":
+					hop.proto = val
+				case "host":
+					hop.host = val
+				}
+			}
+			hops = append(hops, hop)
+		}
+	}
+	return hops
+}
+
+// forwardedNode extracts the IP of a Forwarded "for" node, which may be
+// "1.2.3.4", "1.2.3.4:80", "[2001:db8::1]:80" or an obfuscated identifier.
+func forwardedNode(node string) string {
+	if host, _, err := net.SplitHostPort(node); err == nil {
+		node = host
+	}
+	node = strings.TrimSuffix(strings.TrimPrefix(node, "["), "]")
+	if _, err := netip.ParseAddr(node); err != nil {
+		return ""
+	}
+	return node
+}
+
+// parseXForwarded reads X-Forwarded-For, the scheme and host headers are
+// single valued in practice and apply to the client hop.
+func parseXForwarded(h http.Header) []forwardedHop {
+	var hops []forwardedHop
+	for _, v := range h.Values("X-Forwarded-For") {
+		for _, ip := range strings.Split(v, ",") {
+			hops = append(hops, forwardedHop{ip: forwardedNode(strings.TrimSpace(ip))})
+		}
+	}
+	if len(hops) == 0 {
+		return nil
+	}
+	proto := lastValue(h.Get("X-Forwarded-Proto"))
+	host := lastValue(h.Get("X-Forwarded-Host"))
+	for i := range hops {
+		hops[i].proto, hops[i].host = proto, host
+	}
+	return hops
+}
+
+func lastValue(v string) string {
+	if i := strings.LastIndex(v, ","); i >= 0 {
+		v = v[i+1:]
+	}
+	return strings.TrimSpace(v)
+}
+
+func validScheme(s string) bool {
+	return strings.EqualFold(s, "http") || strings.EqualFold(s, "https")
+}
+
+// validHost accepts a bare host[:port], anything that could smuggle a path
+// or credentials into a generated URL is rejected.
+func validHost(h string) bool {
+	if h == "" || strings.ContainsAny(h, "/\\@?# \t") {
+		return false
+	}
+	if host, _, err := net.SplitHostPort(h); err == nil {
+		h = host
+	}
+	return h != ""
+}
+
+func remoteIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return ip
+}
+
+// ClientIP is the resolved client address, the socket peer when
+// ResolveClient didn't run.
+func ClientIP(r *http.Request) string {
+	if c, ok := ctx.ClientInfo(r.Context()); ok {
+		return c.IP
+	}
+	return remoteIP(r)
+}
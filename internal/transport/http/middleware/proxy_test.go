@@ -0,0 +1,75 @@
+package middleware_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/iLeoon/realtime-gateway/internal/ctx"
+	"github.com/iLeoon/realtime-gateway/internal/transport/http/middleware"
+)
+
+func TestResolveClient(t *testing.T) {
+	proxies := middleware.NewTrustedProxies([]string{"10.0.0.0/8", "192.168.1.1", "not-a-cidr"})
+
+	tests := []struct {
+		name    string
+		remote  string
+		headers map[string]string
+		want    ctx.Client
+	}{
+		{
+			name:    "untrusted peer headers are ignored",
+			remote:  "203.0.113.9:5000",
+			headers: map[string]string{"X-Forwarded-For": "1.1.1.1", "X-Forwarded-Proto": "https", "X-Forwarded-Host": "evil.com"},
+			want:    ctx.Client{IP: "203.0.113.9", Scheme: "http", Host: "api.local"},
+		},
+		{
+			name:    "x-forwarded chain through trusted proxies",
+			remote:  "10.0.0.2:5000",
+			headers: map[string]string{"X-Forwarded-For": "6.6.6.6, 198.51.100.7, 192.168.1.1", "X-Forwarded-Proto": "https", "X-Forwarded-Host": "api.example.com"},
+			want:    ctx.Client{IP: "198.51.100.7", Scheme: "https", Host: "api.example.com"},
+		},
+		{
+			name:   "forwarded takes precedence",
+			remote: "10.0.0.2:5000",
+			headers: map[string]string{
+				"Forwarded":       `for="[2001:db8::1]:4711";proto=https;host=chat.example.com, for=10.1.1.1;proto=http`,
+				"X-Forwarded-For": "1.1.1.1",
+			},
+			want: ctx.Client{IP: "2001:db8::1", Scheme: "https", Host: "chat.example.com"},
+		},
+		{
+			name:    "invalid scheme and host fall back",
+			remote:  "10.0.0.2:5000",
+			headers: map[string]string{"X-Forwarded-For": "198.51.100.7", "X-Forwarded-Proto": "javascript", "X-Forwarded-Host": "evil.com/path"},
+			want:    ctx.Client{IP: "198.51.100.7", Scheme: "http", Host: "api.local"},
+		},
+		{
+			name:    "obfuscated node stops the walk",
+			remote:  "10.0.0.2:5000",
+			headers: map[string]string{"Forwarded": "for=_hidden, for=10.9.9.9"},
+			want:    ctx.Client{IP: "10.9.9.9", Scheme: "http", Host: "api.local"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got ctx.Client
+			h := middleware.ResolveClient(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got, _ = ctx.ClientInfo(r.Context())
+			}), proxies)
+
+			r := httptest.NewRequest(http.MethodGet, "http://api.local/conversations", nil)
+			r.RemoteAddr = tt.remote
+			for k, v := range tt.headers {
+				r.Header.Set(k, v)
+			}
+			h.ServeHTTP(httptest.NewRecorder(), r)
+
+			if got != tt.want {
+				t.Fatalf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,139 +1,52 @@
 package middleware
 
-// It is inspired by the rate limiter implementation in the Upspin project.
-// See: github.com/upspin/upspin
 import (
-	"net"
+	"math"
 	"net/http"
-	"strings"
-	"sync"
+	"strconv"
 	"time"
 
+	"github.com/iLeoon/realtime-gateway/internal/ctx"
+	"github.com/iLeoon/realtime-gateway/internal/errors"
+	"github.com/iLeoon/realtime-gateway/internal/ratelimit"
 	"github.com/iLeoon/realtime-gateway/internal/transport/http/services/apierror"
 	"github.com/iLeoon/realtime-gateway/internal/transport/http/services/apiresponse"
+	"github.com/iLeoon/realtime-gateway/pkg/log"
 )
 
-const maxEntries = 100000
-
-type rateLimiter struct {
-	backoff     time.Duration
-	mu          sync.Mutex
-	m           map[string]*request
-	max         time.Duration
-	first, last *request
-}
-
-type request struct {
-	ipAdd      string
-	seen       time.Time
-	backoff    time.Duration
-	prev, next *request
+// RateLimitPolicy applies one limiter to a group of routes. Requests are
+// bucketed by group, not by path, so /conversations/1 and /conversations/2
+// share the same budget.
+type RateLimitPolicy struct {
+	Group   string
+	Limiter ratelimit.Limiter
 }
 
-func NewRateLimiter() *rateLimiter {
-	return &rateLimiter{
-		backoff: 1 * time.Second,
-		max:     24 * time.Hour,
-	}
-
-}
-
-func (r *rateLimiter) pass(now time.Time, key string) (bool, time.Duration) {
-	r.mu.Lock()
-	defer r.mu.Unlock()
-
-	if r.m == nil {
-		r.m = make(map[string]*request)
-	}
-
-	req, ok := r.m[key]
-	if !ok {
-		req = &request{
-			ipAdd:   key,
-			seen:    now,
-			backoff: r.backoff,
-		}
-		r.m[key] = req
-
-		if r.last != nil {
-			r.last.next = req
-			req.prev = r.last
-		}
-
-		r.last = req
-		// if no elements in the list add the first element
-		if r.first == nil {
-			r.first = req
-		}
-
-		// if there is an element just push them to the end
-	} else {
-		reset := req.seen.Add(r.max)
-
-		if now.After(reset) {
-			req.backoff = r.backoff
-		} else {
-			passTime := req.seen.Add(r.backoff)
-			if now.After(passTime) {
-				req.backoff *= 2
-				if req.backoff > r.max {
-					req.backoff = r.backoff
-				}
-			} else {
-				return false, passTime.Sub(now)
-			}
-
+// RateLimiter enforces the policy and advertises it with the standard
+// RateLimit-* response headers. The key is the authenticated user when the
+// route sits behind AuthGuard, the client IP otherwise. A failing store
+// doesn't take the API down, the request is let through and logged.
+func RateLimiter(next http.Handler, p RateLimitPolicy) http.Handler {
+	const path errors.PathName = "middleware/rate"
+	const op errors.Op = "middleware.RateLimiter"
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		d, err := p.Limiter.Allow(r.Context(), p.Group+":"+rateLimitKey(r))
+		if err != nil {
+			log.Error.Println(errors.B(path, op, err))
+			next.ServeHTTP(w, r)
+			return
 		}
-		req.seen = now
 
-		if r.last != req {
-			if req.prev != nil {
-				req.prev.next = req.next
-			} else {
-				r.first = req.next
-				req.next.prev = nil
-			}
-			if req.next != nil {
-				req.next.prev = req.prev
-			}
-			r.last.next = req
-			req.prev = r.last
-			req.next = nil
-			r.last = req
-		}
-	}
-
-	r.rateCleaner(now)
-	return true, 0
-}
-
-func (r *rateLimiter) rateCleaner(now time.Time) {
-	cut := 0
-	if len(r.m) > maxEntries {
-		cut = len(r.m) - maxEntries
-	}
+		w.Header().Set("RateLimit-Policy", d.Policy)
+		w.Header().Set("RateLimit-Limit", strconv.Itoa(d.Limit))
+		w.Header().Set("RateLimit-Remaining", strconv.Itoa(d.Remaining))
+		w.Header().Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(d.Reset)))
 
-	for req, i := r.first, 0; req != nil; req, i = req.next, i+1 {
-		if !now.After(req.seen.Add(r.max)) && i >= cut {
-			break
-		}
-		delete(r.m, req.ipAdd)
-		// jump to the next element in the list
-		r.first = req.next
-		if req.next != nil {
-			req.next.prev = nil
-		}
-	}
-}
-
-func RateLimiter(next http.Handler, rl *rateLimiter) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		ok, retryAfter := rl.pass(time.Now(), getKey(r))
-		if !ok {
-			w.Header().Set("Retry-After", retryAfter.String())
+		if !d.Allowed {
+			w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(d.RetryAfter)))
 			apiErr := apierror.Build(apierror.RateLimitCode,
 				"too many requests",
-				apierror.WithTarget("ip"),
+				apierror.WithTarget(p.Group),
 				apierror.WithInnerError("RateLimitExceeded"),
 			)
 			apiresponse.Send(w, http.StatusTooManyRequests, apiErr)
@@ -143,14 +56,16 @@ func RateLimiter(next http.Handler, rl *rateLimiter) http.Handler {
 	})
 }
 
-func getKey(r *http.Request) string {
-	forwarded := r.Header.Get("X-Forwarded-For")
-	var ip string
-	if forwarded != "" {
-		ips := strings.Split(forwarded, ",")
-		ip = strings.TrimSpace(ips[0])
-	} else {
-		ip, _, _ = net.SplitHostPort(r.RemoteAddr)
+// rateLimitKey prefers the authenticated user so the budget follows the
+// account across networks, anonymous routes fall back to the client IP
+// resolved by ResolveClient.
+func rateLimitKey(r *http.Request) string {
+	if userID, ok := ctx.UserID(r.Context()); ok && userID != "" {
+		return "user:" + userID
 	}
-	return ip + r.URL.Path
+	return "ip:" + ClientIP(r)
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
 }
@@ -0,0 +1,62 @@
+package middleware_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/iLeoon/realtime-gateway/internal/ctx"
+	"github.com/iLeoon/realtime-gateway/internal/ratelimit"
+	"github.com/iLeoon/realtime-gateway/internal/transport/http/middleware"
+)
+
+func TestRateLimiterKeysByUserAcrossPaths(t *testing.T) {
+	policy := middleware.RateLimitPolicy{
+		Group:   "conversations",
+		Limiter: ratelimit.NewTokenBucketLimiter(ratelimit.NewMemoryStore(), 0.001, 2),
+	}
+	handler := middleware.RateLimiter(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}), policy)
+
+	send := func(target, userID, xff string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, target, nil)
+		if userID != "" {
+			r = r.WithContext(ctx.SetUserID(r.Context(), userID))
+		}
+		if xff != "" {
+			r.Header.Set("X-Forwarded-For", xff)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	// Different paths of the same group share the user's bucket.
+	if w := send("/conversations/1", "7", ""); w.Code != http.StatusOK || w.Header().Get("RateLimit-Remaining") != "1" {
+		t.Fatalf("first request: code %d remaining %q", w.Code, w.Header().Get("RateLimit-Remaining"))
+	}
+	if w := send("/conversations/2", "7", ""); w.Code != http.StatusOK {
+		t.Fatalf("second request: code %d", w.Code)
+	}
+	w := send("/conversations/3", "7", "")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("third request: expected 429, got %d", w.Code)
+	}
+	if w.Header().Get("Retry-After") == "" || w.Header().Get("RateLimit-Policy") != "2;w=2000" {
+		t.Fatalf("missing rate limit headers: %v", w.Header())
+	}
+
+	// Another user has its own budget.
+	if w := send("/conversations/1", "8", ""); w.Code != http.StatusOK {
+		t.Fatalf("other user: code %d", w.Code)
+	}
+
+	// Anonymous requests fall back to the socket IP, a spoofed
+	// X-Forwarded-For doesn't buy a fresh bucket.
+	send("/conversations", "", "1.1.1.1")
+	send("/conversations", "", "2.2.2.2")
+	if w := send("/conversations", "", "3.3.3.3"); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("spoofed header: expected 429, got %d", w.Code)
+	}
+}
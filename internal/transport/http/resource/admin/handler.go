@@ -0,0 +1,83 @@
+package admin
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/iLeoon/realtime-gateway/internal/config"
+	"github.com/iLeoon/realtime-gateway/internal/transport/http/services/apierror"
+	"github.com/iLeoon/realtime-gateway/internal/transport/http/services/apiresponse"
+	"github.com/iLeoon/realtime-gateway/internal/transport/tcp"
+)
+
+// Ring is the gateway's view of the engines it routes sessions to.
+type Ring interface {
+	Ring() tcp.RingState
+	OwnerOfUser(userID uint32) string
+	OwnerOfConversation(conversationID uint32) string
+}
+
+type ringResponse struct {
+	tcp.RingState
+	// Owner is the engine of the user or conversation asked about.
+	Owner string `json:"owner,omitempty"`
+}
+
+type Handler struct {
+	ring  Ring
+	token string
+}
+
+// NewHandler serves the admin endpoints, guarded by ADMIN_TOKEN. They
+// answer 404 when it isn't set.
+func NewHandler(ring Ring, conf *config.Config) *Handler {
+	return &Handler{ring: ring, token: conf.AdminToken}
+}
+
+func (h *Handler) RegisterRoutes() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /admin/ring", h.guard(h.GetRing))
+	return mux
+}
+
+// guard only lets requests with the admin bearer token through.
+func (h *Handler) guard(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if h.token == "" {
+			http.NotFound(w, r)
+			return
+		}
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(h.token)) != 1 {
+			apiresponse.Send(w, http.StatusUnauthorized, apierror.Build(apierror.UnAuthorizedRequestCode, "invalid admin token", apierror.WithTarget("Authorization")))
+			return
+		}
+		next(w, r)
+	}
+}
+
+// GetRing returns the engines of the consistent-hash ring. ?user=ID or
+// ?conversation=ID also names the engine that key belongs to.
+func (h *Handler) GetRing(w http.ResponseWriter, r *http.Request) {
+	res := ringResponse{RingState: h.ring.Ring()}
+	for _, key := range []string{"user", "conversation"} {
+		raw := r.URL.Query().Get(key)
+		if raw == "" {
+			continue
+		}
+		id, err := strconv.ParseUint(raw, 10, 32)
+		if err != nil {
+			apiErr := apierror.Build(apierror.BadRequestCode, "invalid "+key+" id", apierror.WithTarget(key))
+			apiresponse.Send(w, http.StatusBadRequest, apiErr)
+			return
+		}
+		if key == "user" {
+			res.Owner = h.ring.OwnerOfUser(uint32(id))
+		} else {
+			res.Owner = h.ring.OwnerOfConversation(uint32(id))
+		}
+	}
+	apiresponse.Send(w, http.StatusOK, res)
+}
@@ -8,6 +8,7 @@ import (
 
 	"github.com/iLeoon/realtime-gateway/internal/config"
 	"github.com/iLeoon/realtime-gateway/internal/errors"
+	"github.com/iLeoon/realtime-gateway/internal/transport/http/middleware"
 	"github.com/iLeoon/realtime-gateway/internal/transport/http/resource/models"
 	"github.com/iLeoon/realtime-gateway/internal/transport/http/services/apierror"
 	"github.com/iLeoon/realtime-gateway/internal/transport/http/services/apiresponse"
@@ -27,6 +28,8 @@ type Service interface {
 type TokenService interface {
 	GenerateHTTPToken(userID string) (httpToken string, err error)
 	DecodeGoogleToken(jwtToken string, reqContext context.Context) (*models.GoogleClaims, error)
+	DecodeToken(jwtToken string) (userID string, err error)
+	GenerateCSRFToken(session string) (csrfToken string, err error)
 }
 
 type Handler struct {
@@ -56,6 +59,7 @@ func (h *Handler) RegisterRoutes() *http.ServeMux {
 	authMux.HandleFunc("GET /auth/login", h.Login)
 	authMux.HandleFunc("GET /auth/redirect/oauth/google/callback", h.RedirectURL)
 	authMux.HandleFunc("POST /auth/logout", h.Logout)
+	authMux.HandleFunc("GET /auth/csrf", h.CSRF)
 	return authMux
 
 }
@@ -75,6 +79,33 @@ func (h *Handler) Logout(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// CSRF issues a fresh double-submit token for the caller's session. The
+// cookie is readable by scripts on purpose, the token is also returned in
+// the body because the frontend may live on a different origin than the API.
+func (h *Handler) CSRF(w http.ResponseWriter, r *http.Request) {
+	csrfToken, err := h.token.GenerateCSRFToken(middleware.CSRFSession(r, h.token))
+	if err != nil {
+		log.Error.Println("error on generating the csrf token", err)
+		apiresponse.Send(w, http.StatusInternalServerError, apierror.FaildToGenerateToken("GeneratingCSRFTokenFailed"))
+		return
+	}
+
+	sameSite, domain, secure := h.cookieOpts()
+	//nolint:gosec // the double-submit pattern requires the cookie to be readable by the frontend.
+	http.SetCookie(w, &http.Cookie{
+		Name:     middleware.CSRFCookie,
+		Domain:   domain,
+		Value:    csrfToken,
+		HttpOnly: false,
+		Secure:   secure,
+		SameSite: sameSite,
+		Path:     "/",
+		MaxAge:   3600 * 24,
+	})
+	w.Header().Set("Cache-Control", "no-store")
+	apiresponse.Send(w, http.StatusOK, CSRFToken{Token: csrfToken})
+}
+
 func (h *Handler) Login(w http.ResponseWriter, r *http.Request) {
 	verifier := oauth2.GenerateVerifier()
 	stateString := rand.Text()
@@ -144,7 +175,7 @@ func (h *Handler) RedirectURL(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if stateCookie.Value != state {
-		log.Error.Println("invalid state cookie is being used", "state_cookie", stateCookie.Value, "used_state", state)
+		log.Error.Println("invalid state cookie is being used", "client_ip", middleware.ClientIP(r), "state_cookie", stateCookie.Value, "used_state", state)
 		apiErr := apierror.Build(apierror.ForbiddenRequestCode,
 			"using invalid parameters",
 			apierror.WithTarget("state"),
@@ -13,3 +13,7 @@ type User struct {
 	Email    string
 	UserName string
 }
+
+type CSRFToken struct {
+	Token string `json:"csrfToken"`
+}
@@ -3,7 +3,6 @@ package conversation
 import (
 	"context"
 	"encoding/json"
-	"fmt"
 	"net/http"
 	"strconv"
 
@@ -29,7 +28,7 @@ type MessageService interface {
 }
 
 type Notifier interface {
-	AddToRoom(userID, conversationID uint32) error
+	AddToRoom(userID, conversationID uint32, conversationType string) error
 	RemoveFromRoom(userID, conversationID uint32) error
 }
 
@@ -98,24 +97,19 @@ func (h *Handler) Create(w http.ResponseWriter, r *http.Request) {
 
 	convID, _ := strconv.ParseUint(conversation.ConversationID, 10, 32)
 	creatorID, _ := strconv.ParseUint(authenticatedID, 10, 32)
-	if err := h.notifier.AddToRoom(uint32(creatorID), uint32(convID)); err != nil {
+	if err := h.notifier.AddToRoom(uint32(creatorID), uint32(convID), body.ConversationType); err != nil {
 		log.Error.Printf("failed to add creator %d to room %d: %v", creatorID, convID, err)
 	}
 	for _, id := range body.ParticipantIDs {
 		if id < 0 {
 			continue
 		}
-		if err := h.notifier.AddToRoom(uint32(id), uint32(convID)); err != nil { //nolint:gosec // participantIDs are validated positive by the request validator
+		if err := h.notifier.AddToRoom(uint32(id), uint32(convID), body.ConversationType); err != nil { //nolint:gosec // participantIDs are validated positive by the request validator
 			log.Error.Printf("failed to add userID %d to room %d: %v", id, convID, err)
 		}
 	}
 
-	scheme := r.Header.Get("X-Forwarded-Proto")
-	if scheme == "" {
-		scheme = "http"
-	}
-	path := fmt.Sprintf("%s://%s/api/v1.0%s", scheme, r.Host, r.URL.Path)
-	w.Header().Set("Location", path+"/"+conversation.ConversationID)
+	w.Header().Set("Location", apiresponse.Location(r, conversation.ConversationID))
 	apiresponse.Send(w, http.StatusCreated, conversation)
 }
 
@@ -238,7 +232,7 @@ func (h *Handler) UpdateMembers(w http.ResponseWriter, r *http.Request) {
 		if id < 0 {
 			continue
 		}
-		if err := h.notifier.AddToRoom(uint32(id), uint32(convID)); err != nil { //nolint:gosec // participantIDs are validated positive by the request validator
+		if err := h.notifier.AddToRoom(uint32(id), uint32(convID), "group-chat"); err != nil { //nolint:gosec // participantIDs are validated positive by the request validator
 			log.Error.Printf("failed to add userID %d to room %d: %v", id, convID, err)
 		}
 	}
@@ -3,7 +3,6 @@ package friendrequest
 import (
 	"context"
 	"encoding/json"
-	"fmt"
 	"net/http"
 	"strconv"
 
@@ -77,12 +76,7 @@ func (h *Handler) Create(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	scheme := r.Header.Get("X-Forwarded-Proto")
-	if scheme == "" {
-		scheme = "http"
-	}
-	path := fmt.Sprintf("%s://%s/api/v1.0%s", scheme, r.Host, r.URL.Path)
-	w.Header().Set("Location", path+"/"+fr.RecipientID)
+	w.Header().Set("Location", apiresponse.Location(r, fr.RecipientID))
 	apiresponse.Send(w, http.StatusCreated, fr)
 }
 func (h *Handler) Sent(w http.ResponseWriter, r *http.Request) {
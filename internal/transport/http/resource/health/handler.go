@@ -2,11 +2,12 @@ package health
 
 import (
 	"context"
-	"net"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/iLeoon/realtime-gateway/internal/config"
+	"github.com/iLeoon/realtime-gateway/internal/transport/tcp"
 	"github.com/iLeoon/realtime-gateway/internal/transport/http/services/apiresponse"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
@@ -24,10 +25,15 @@ type healthResponse struct {
 type Handler struct {
 	db   *pgxpool.Pool
 	conf *config.Config
+	// engines are the transports to the TCP engines, engineErr why they
+	// couldn't be built from the config.
+	engines   []tcp.Transport
+	engineErr error
 }
 
 func NewHandler(db *pgxpool.Pool, conf *config.Config) *Handler {
-	return &Handler{db: db, conf: conf}
+	engines, err := tcp.EngineTransports(conf)
+	return &Handler{db: db, conf: conf, engines: engines, engineErr: err}
 }
 
 func (h *Handler) RegisterRoutes() *http.ServeMux {
@@ -54,13 +60,30 @@ func (h *Handler) Check(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	// Check TCP server
-	conn, err := net.DialTimeout("tcp", h.conf.TCPPort, 2*time.Second)
-	if err != nil {
+	// Check the TCP engines, sessions of an engine that is down move to
+	// the others so one of them is enough.
+	err := h.engineErr
+	var down []string
+	if err == nil {
+		engineCtx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+		defer cancel()
+		for _, engine := range h.engines {
+			conn, dialErr := engine.Dial(engineCtx)
+			if dialErr != nil {
+				err = dialErr
+				down = append(down, engine.String())
+				continue
+			}
+			conn.Close()
+		}
+	}
+	switch {
+	case h.engineErr != nil || len(down) == len(h.engines):
 		components["tcp_server"] = componentStatus{Status: "unhealthy", Message: err.Error()}
 		healthy = false
-	} else {
-		conn.Close()
+	case len(down) > 0:
+		components["tcp_server"] = componentStatus{Status: "degraded", Message: "down: " + strings.Join(down, ", ")}
+	default:
 		components["tcp_server"] = componentStatus{Status: "healthy"}
 	}
 
@@ -2,10 +2,15 @@ package token
 
 import (
 	"context"
+	"crypto/hmac"
+	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strings"
 	"sync"
 	"time"
 
@@ -21,9 +26,18 @@ var googleHTTPClient = &http.Client{
 	Timeout: 5 * time.Second,
 }
 
+// Engine assertions carry their own audience so that an API or WebSocket
+// token can't be passed off as one. They only have to survive the trip
+// from the gateway to the engine.
+const (
+	engineAudience = "engine"
+	engineTokenTTL = 30 * time.Second
+)
+
 type service struct {
 	config       *config.Config
 	parser       *jwt.Parser
+	engineParser *jwt.Parser
 	googleParser *jwt.Parser
 	signedKey    []byte
 	mu           sync.RWMutex
@@ -38,6 +52,13 @@ func NewService(c *config.Config) *service {
 		jwt.WithIssuedAt(),
 		jwt.WithIssuer(c.JwtIssuer),
 	)
+	engineParser := jwt.NewParser(
+		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+		jwt.WithIssuer(c.JwtIssuer),
+		jwt.WithAudience(engineAudience),
+	)
 	googleParser := jwt.NewParser(
 		jwt.WithValidMethods([]string{jwt.SigningMethodRS256.Alg()}),
 		jwt.WithIssuer("https://accounts.google.com"),
@@ -46,6 +67,7 @@ func NewService(c *config.Config) *service {
 	return &service{
 		config:       c,
 		parser:       parser,
+		engineParser: engineParser,
 		googleParser: googleParser,
 		cachedKeys:   make(map[string]*rsa.PublicKey),
 		signedKey:    []byte(c.JwtSecretKey),
@@ -102,9 +124,99 @@ func (s *service) DecodeToken(jwtToken string) (string, error) {
 		return "", errors.B(path, op, errors.Client, "missing subject in claims")
 	}
 
+	// API and WebSocket tokens carry no audience, one that does was made
+	// for someone else, like the engine.
+	if len(claims.Audience) > 0 {
+		return "", errors.B(path, op, errors.Client, fmt.Errorf("token for audience %v", claims.Audience))
+	}
+
+	return claims.Subject, nil
+}
+
+// GenerateEngineToken signs the assertion the gateway attaches to a
+// connect packet, vouching that userID authenticated the WebSocket.
+func (s *service) GenerateEngineToken(userID string) (string, error) {
+	const op errors.Op = "service.GenerateEngineToken"
+	claims := &jwt.RegisteredClaims{
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(engineTokenTTL)),
+		IssuedAt:  jwt.NewNumericDate(time.Now()),
+		Issuer:    s.config.JwtIssuer,
+		Subject:   userID,
+		Audience:  jwt.ClaimStrings{engineAudience},
+	}
+
+	jwtToken, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(s.signedKey)
+	if err != nil {
+		return "", errors.B(path, op, errors.Internal, err)
+	}
+	return jwtToken, nil
+}
+
+// DecodeEngineToken verifies an assertion made by GenerateEngineToken and
+// returns the user it was issued for.
+func (s *service) DecodeEngineToken(jwtToken string) (string, error) {
+	const op errors.Op = "service.DecodeEngineToken"
+	claims := &jwt.RegisteredClaims{}
+
+	if s.signedKey == nil {
+		return "", errors.B(path, op, errors.Internal, "missing singed key")
+	}
+	_, err := s.engineParser.ParseWithClaims(jwtToken, claims, func(t *jwt.Token) (any, error) {
+		return s.signedKey, nil
+	})
+	if err != nil {
+		return "", errors.B(path, op, errors.Client, "invalid engine token", err)
+	}
+	if claims.Subject == "" {
+		return "", errors.B(path, op, errors.Client, "missing subject in claims")
+	}
 	return claims.Subject, nil
 }
 
+// GenerateCSRFToken issues a signed double-submit token bound to session,
+// the user of the token cookie or "" before login.
+// Layout: base64(nonce) + "." + base64(HMAC-SHA256(nonce, session)).
+// The signature stops an attacker who can plant cookies on a sibling
+// subdomain from forging a pair that passes the double-submit check, the
+// session stops them from planting a pair issued to their own account.
+func (s *service) GenerateCSRFToken(session string) (string, error) {
+	const op errors.Op = "service.GenerateCSRFToken"
+	if s.signedKey == nil {
+		return "", errors.B(path, op, errors.Internal, "missing singed key")
+	}
+
+	nonce := make([]byte, 32)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", errors.B(path, op, errors.Internal, err)
+	}
+
+	encoded := base64.RawURLEncoding.EncodeToString(nonce)
+	return encoded + "." + s.signCSRF(encoded, session), nil
+}
+
+// VerifyCSRFToken checks that the token was issued by GenerateCSRFToken
+// for session.
+func (s *service) VerifyCSRFToken(csrfToken string, session string) error {
+	const op errors.Op = "service.VerifyCSRFToken"
+	nonce, sig, ok := strings.Cut(csrfToken, ".")
+	if !ok || nonce == "" || sig == "" {
+		return errors.B(path, op, errors.Client, "malformed csrf token")
+	}
+
+	if !hmac.Equal([]byte(sig), []byte(s.signCSRF(nonce, session))) {
+		return errors.B(path, op, errors.Client, "invalid csrf token signature")
+	}
+	return nil
+}
+
+// signCSRF signs the nonce along with the session. The nonce is base64url,
+// it never holds the ":" that separates the two.
+func (s *service) signCSRF(nonce string, session string) string {
+	mac := hmac.New(sha256.New, s.signedKey)
+	mac.Write([]byte("csrf:" + nonce + ":" + session))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
 func (s *service) DecodeGoogleToken(jwtToken string, ctx context.Context) (*models.GoogleClaims, error) {
 	const op errors.Op = "service.DecodeGoogleToken"
 	claims := &models.GoogleClaims{}
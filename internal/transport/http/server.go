@@ -7,7 +7,9 @@ import (
 
 	"github.com/go-playground/validator/v10"
 	"github.com/iLeoon/realtime-gateway/internal/config"
+	"github.com/iLeoon/realtime-gateway/internal/ratelimit"
 	"github.com/iLeoon/realtime-gateway/internal/transport/http/middleware"
+	"github.com/iLeoon/realtime-gateway/internal/transport/http/resource/admin"
 	"github.com/iLeoon/realtime-gateway/internal/transport/http/resource/auth"
 	"github.com/iLeoon/realtime-gateway/internal/transport/http/resource/conversation"
 	"github.com/iLeoon/realtime-gateway/internal/transport/http/resource/friendrequest"
@@ -22,27 +24,91 @@ import (
 )
 
 type Notifier interface {
-	AddToRoom(userID, conversationID uint32) error
+	AddToRoom(userID, conversationID uint32, conversationType string) error
 	RemoveFromRoom(userID, conversationID uint32) error
 }
 
-func Start(conf *config.Config, db *pgxpool.Pool, ws http.Handler, tcpServer Notifier) {
+func Start(conf *config.Config, db *pgxpool.Pool, ws http.Handler, tcpServer Notifier, ring admin.Ring, cors *middleware.CorsPolicy) {
+	// Custom http server configurations
+	server := &http.Server{
+		Addr:              conf.HTTPPort,
+		ReadTimeout:       15 * time.Second,
+		ReadHeaderTimeout: 5 * time.Second,
+		WriteTimeout:      0,
+		IdleTimeout:       60 * time.Second,
+		ErrorLog:          log.NewStdLogger(log.Info),
+		Handler:           NewHandler(conf, db, ws, tcpServer, ring, cors),
+	}
+
+	log.Info.Println("http server is up and running...")
+
+	err := server.ListenAndServe()
+	if err != nil {
+		log.Fatal("coudln't connect to the http server", "error", err)
+		os.Exit(1)
+	}
+}
+
+// NewHandler builds the API: every route behind the middleware chain.
+func NewHandler(conf *config.Config, db *pgxpool.Pool, ws http.Handler, tcpServer Notifier, ring admin.Ring, cors *middleware.CorsPolicy) http.Handler {
 	rootMux := http.NewServeMux()
 
 	// Initializing the validator
 	validator := validator.New(validator.WithRequiredStructEnabled())
 	validation.Init(validator)
 
-	// Init Rate limiter
-	rl := middleware.NewRateLimiter()
+	// Init Rate limiter policies, the store decides whether budgets are
+	// shared between instances.
+	var rlStore ratelimit.Store
+	switch conf.RateLimitStore {
+	case "postgres":
+		rlStore = ratelimit.NewPostgresStore(db)
+	default:
+		rlStore = ratelimit.NewMemoryStore()
+	}
+	authLimit := middleware.RateLimitPolicy{Group: "auth", Limiter: ratelimit.NewTokenBucketLimiter(rlStore, 1.0/6, 10)}
+	frLimit := middleware.RateLimitPolicy{Group: "friendrequests", Limiter: ratelimit.NewSlidingWindowLimiter(rlStore, 30, time.Minute)}
+	wsLimit := middleware.RateLimitPolicy{Group: "ws", Limiter: ratelimit.NewTokenBucketLimiter(rlStore, 1.0/10, 5)}
 
 	// Wraping the api mux with ValidateHeader.
 	handler := middleware.ValidateHeaders(rootMux)
 
+	jwtService := token.NewService(conf)
+
+	// Every POST/PATCH/DELETE must carry a valid double-submit csrf token.
+	handler = middleware.CSRF(handler, jwtService)
+
+	// Per-route CORS rules, everything else falls back to the default rule.
+	cors.StripPrefix("/api/v1.0").
+		Route("/auth/", middleware.CorsRule{
+			Methods: []string{http.MethodGet, http.MethodPost},
+			Headers: []string{"Content-Type", middleware.CSRFHeader},
+		}).
+		Route("/users/", middleware.CorsRule{
+			Methods: []string{http.MethodGet, http.MethodDelete},
+			Headers: []string{"Content-Type", middleware.CSRFHeader},
+		}).
+		Route("/conversations", middleware.CorsRule{
+			Methods: []string{http.MethodGet, http.MethodPost, http.MethodPatch},
+			Headers: []string{"Content-Type", middleware.CSRFHeader},
+		}).
+		Route("/friendrequests", middleware.CorsRule{
+			Methods: []string{http.MethodGet, http.MethodPost, http.MethodPatch, http.MethodDelete},
+			Headers: []string{"Content-Type", middleware.CSRFHeader},
+		}).
+		Route("/ws", middleware.CorsRule{
+			Methods: []string{http.MethodGet},
+			Headers: []string{"Content-Type"},
+		}).
+		Route("/health", middleware.CorsRule{
+			Methods: []string{http.MethodGet},
+		})
+
 	// Wraping the api mux with CORS.
-	handler = middleware.Cors(handler, conf)
+	handler = middleware.Cors(handler, cors)
 
-	jwtService := token.NewService(conf)
+	// Resolve the real client IP, scheme and host before anything reads them.
+	handler = middleware.ResolveClient(handler, middleware.NewTrustedProxies(conf.TrustedProxies))
 
 	authRepo := auth.NewRepo(db)
 	authService := auth.NewService(conf, authRepo)
@@ -67,6 +133,8 @@ func Start(conf *config.Config, db *pgxpool.Pool, ws http.Handler, tcpServer Not
 
 	healthHandler := health.NewHandler(db, conf)
 
+	adminHandler := admin.NewHandler(ring, conf)
+
 	userMux := userHandler.RegisterRoutes()
 	authMux := authHandler.RegisterRoutes()
 	convMux := convHandler.RegisterRoutes()
@@ -75,42 +143,28 @@ func Start(conf *config.Config, db *pgxpool.Pool, ws http.Handler, tcpServer Not
 
 	healthMux := healthHandler.RegisterRoutes()
 
-	rootMux.Handle("/auth/", middleware.RateLimiter(authMux, rl))
+	rootMux.Handle("/auth/", middleware.RateLimiter(authMux, authLimit))
 	rootMux.Handle("/users/", middleware.AuthGuard(userMux, jwtService))
 
 	rootMux.Handle("/conversations/", middleware.AuthGuard(convMux, jwtService))
 	rootMux.Handle("/conversations", middleware.AuthGuard(convMux, jwtService))
 
-	rootMux.Handle("/friendrequests/", middleware.AuthGuard(middleware.RateLimiter(frMux, rl), jwtService))
-	rootMux.Handle("/friendrequests", middleware.AuthGuard(middleware.RateLimiter(frMux, rl), jwtService))
+	rootMux.Handle("/friendrequests/", middleware.AuthGuard(middleware.RateLimiter(frMux, frLimit), jwtService))
+	rootMux.Handle("/friendrequests", middleware.AuthGuard(middleware.RateLimiter(frMux, frLimit), jwtService))
 
 	// Generate a ws ticket to authenticate before establishing a ws connection
 	rootMux.Handle("/ws/", middleware.AuthGuard(wsMux, jwtService))
 
 	// Authenticate the ws connection through the ws ticket
-	rootMux.Handle("/ws", middleware.ValidateWsTicket(middleware.RateLimiter(ws, rl), jwtService))
+	rootMux.Handle("/ws", middleware.ValidateWsTicket(middleware.RateLimiter(ws, wsLimit), jwtService))
 
 	rootMux.Handle("/health", healthMux)
 
-	// Custom http server configurations
-	server := &http.Server{
-		Addr:              conf.HTTPPort,
-		ReadTimeout:       15 * time.Second,
-		ReadHeaderTimeout: 5 * time.Second,
-		WriteTimeout:      0,
-		IdleTimeout:       60 * time.Second,
-		ErrorLog:          log.NewStdLogger(log.Info),
-		Handler:           handler,
-	}
+	// Operator endpoints, guarded by ADMIN_TOKEN rather than a user session.
+	rootMux.Handle("/admin/", adminHandler.RegisterRoutes())
 
 	// Register versioned prefix after handler is built so middleware is preserved.
 	rootMux.Handle("/api/v1.0/", http.StripPrefix("/api/v1.0", rootMux))
 
-	log.Info.Println("http server is up and running...")
-
-	err := server.ListenAndServe()
-	if err != nil {
-		log.Fatal("coudln't connect to the http server", "error", err)
-		os.Exit(1)
-	}
+	return handler
 }
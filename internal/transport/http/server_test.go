@@ -0,0 +1,226 @@
+package http_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/iLeoon/realtime-gateway/internal/config"
+	apihttp "github.com/iLeoon/realtime-gateway/internal/transport/http"
+	"github.com/iLeoon/realtime-gateway/internal/transport/http/middleware"
+	"github.com/iLeoon/realtime-gateway/internal/transport/http/resource/token"
+	"github.com/iLeoon/realtime-gateway/pkg/log"
+)
+
+// mutatingRoutes are the unsafe routes registered in server.go.
+var mutatingRoutes = []struct{ method, target string }{
+	{http.MethodPost, "/auth/logout"},
+	{http.MethodDelete, "/users/friends/2"},
+	{http.MethodPost, "/conversations"},
+	{http.MethodPatch, "/conversations/1/participants"},
+	{http.MethodPost, "/friendrequests"},
+	{http.MethodPatch, "/friendrequests/received/2"},
+	{http.MethodDelete, "/friendrequests/sent/2"},
+	{http.MethodDelete, "/friendrequests/received/2"},
+}
+
+// newAPI builds the real API handler. Nothing here reaches the database:
+// requests either fail the CSRF check or the auth guard behind it.
+func newAPI(t *testing.T) http.Handler {
+	t.Helper()
+	_ = log.SetLevel("disabled")
+	return apihttp.NewHandler(testConf, nil, http.NotFoundHandler(), nil, nil, middleware.NewCorsPolicy(testConf))
+}
+
+var testConf = &config.Config{
+	JWT:  config.JWT{JwtSecretKey: "test-secret", JwtIssuer: "test"},
+	CORS: config.CORS{Cors: "https://app.example"},
+}
+
+// sessionCookie is the token cookie of a logged in userID.
+func sessionCookie(t *testing.T, userID string) *http.Cookie {
+	t.Helper()
+	jwtToken, err := token.NewService(testConf).GenerateHTTPToken(userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &http.Cookie{Name: "token", Value: jwtToken}
+}
+
+// fetchCSRF gets a token from GET /auth/csrf, the way the frontend does
+// before its first mutating request, with the cookies of the session.
+func fetchCSRF(t *testing.T, api http.Handler, target string, cookies ...*http.Cookie) string {
+	t.Helper()
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, target, nil)
+	for _, c := range cookies {
+		r.AddCookie(c)
+	}
+	api.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET %s without a token: %d", target, w.Code)
+	}
+	var body struct {
+		Token string `json:"csrfToken"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range w.Result().Cookies() {
+		if c.Name == middleware.CSRFCookie && c.Value == body.Token && body.Token != "" {
+			return body.Token
+		}
+	}
+	t.Fatalf("GET %s didn't set the csrf cookie to the token it returned", target)
+	return ""
+}
+
+// csrfRejected reports whether the CSRF middleware answered the request.
+func csrfRejected(w *httptest.ResponseRecorder) bool {
+	var body struct {
+		Error struct {
+			Target string `json:"target"`
+		} `json:"error"`
+	}
+	_ = json.Unmarshal(w.Body.Bytes(), &body)
+	return w.Code == http.StatusForbidden && body.Error.Target == "csrf"
+}
+
+func TestCSRFEndpointNeedsNoToken(t *testing.T) {
+	api := newAPI(t)
+	fetchCSRF(t, api, "/auth/csrf")
+	fetchCSRF(t, api, "/api/v1.0/auth/csrf")
+}
+
+// TestCSRFRejectsCrossSiteFormPosts sends what a third-party page
+// auto-submitting a <form> at the API sends: the session cookie, maybe the
+// csrf cookie, but no header since the attacker can't read the cookie.
+func TestCSRFRejectsCrossSiteFormPosts(t *testing.T) {
+	api := newAPI(t)
+	csrfToken := fetchCSRF(t, api, "/auth/csrf")
+
+	for _, route := range mutatingRoutes {
+		for _, cookie := range []string{"", csrfToken} {
+			form := url.Values{"participantIDs": {"2"}}
+			r := httptest.NewRequest(route.method, route.target, strings.NewReader(form.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			r.Header.Set("Origin", "https://evil.example")
+			r.AddCookie(&http.Cookie{Name: "token", Value: "victim-session"})
+			if cookie != "" {
+				r.AddCookie(&http.Cookie{Name: middleware.CSRFCookie, Value: cookie})
+			}
+			w := httptest.NewRecorder()
+			api.ServeHTTP(w, r)
+			if !csrfRejected(w) {
+				t.Errorf("%s %s with csrf cookie %q: %d %s", route.method, route.target, cookie, w.Code, w.Body)
+			}
+		}
+	}
+}
+
+func TestCSRFRejectsForgedTokens(t *testing.T) {
+	api := newAPI(t)
+	csrfToken := fetchCSRF(t, api, "/auth/csrf")
+
+	tests := []struct {
+		name   string
+		cookie string
+		header string
+	}{
+		{"mismatched pair", csrfToken, csrfToken + "x"},
+		{"unsigned pair", "nonce.sig", "nonce.sig"},
+		{"malformed pair", "garbage", "garbage"},
+	}
+	for _, tt := range tests {
+		for _, route := range mutatingRoutes {
+			r := httptest.NewRequest(route.method, "/api/v1.0"+route.target, strings.NewReader(`{}`))
+			r.AddCookie(&http.Cookie{Name: middleware.CSRFCookie, Value: tt.cookie})
+			r.Header.Set(middleware.CSRFHeader, tt.header)
+			w := httptest.NewRecorder()
+			api.ServeHTTP(w, r)
+			if !csrfRejected(w) {
+				t.Errorf("%s: %s %s: %d %s", tt.name, route.method, route.target, w.Code, w.Body)
+			}
+		}
+	}
+}
+
+// TestCSRFAllowsSameSiteRequests echoes the token of GET /auth/csrf, the
+// requests get past the CSRF check to the auth guard.
+func TestCSRFAllowsSameSiteRequests(t *testing.T) {
+	api := newAPI(t)
+	csrfToken := fetchCSRF(t, api, "/auth/csrf")
+
+	for _, route := range mutatingRoutes {
+		r := httptest.NewRequest(route.method, route.target, strings.NewReader(`{}`))
+		r.AddCookie(&http.Cookie{Name: middleware.CSRFCookie, Value: csrfToken})
+		r.Header.Set(middleware.CSRFHeader, csrfToken)
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, r)
+		if csrfRejected(w) {
+			t.Errorf("%s %s was rejected: %s", route.method, route.target, w.Body)
+		}
+	}
+}
+
+// TestCSRFBindsTokensToSessions replays the pair issued to userID 1 with
+// the session of userID 2, as an attacker who planted their own pair in a
+// victim's browser would. Only the session it was issued to may use it.
+// Logging out needs no database, the accepted request runs to completion.
+func TestCSRFBindsTokensToSessions(t *testing.T) {
+	api := newAPI(t)
+	attacker := sessionCookie(t, "1")
+	csrfToken := fetchCSRF(t, api, "/auth/csrf", attacker)
+
+	tests := []struct {
+		name    string
+		session *http.Cookie
+		ok      bool
+	}{
+		{"issuing session", attacker, true},
+		{"another session", sessionCookie(t, "2"), false},
+		{"no session", nil, false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/auth/logout", nil)
+		if tt.session != nil {
+			r.AddCookie(tt.session)
+		}
+		r.AddCookie(&http.Cookie{Name: middleware.CSRFCookie, Value: csrfToken})
+		r.Header.Set(middleware.CSRFHeader, csrfToken)
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, r)
+		if csrfRejected(w) == tt.ok || tt.ok && w.Code != http.StatusNoContent {
+			t.Errorf("%s: %d %s", tt.name, w.Code, w.Body)
+		}
+	}
+}
+
+func TestCSRFSkipsSafeMethods(t *testing.T) {
+	api := newAPI(t)
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/conversations", nil))
+	if csrfRejected(w) {
+		t.Fatalf("GET /conversations was rejected: %s", w.Body)
+	}
+}
+
+// TestEngineTokensAreNoSessions presents an engine assertion, signed with
+// the same key, as the session cookie. The API only takes its own tokens.
+func TestEngineTokensAreNoSessions(t *testing.T) {
+	api := newAPI(t)
+	assertion, err := token.NewService(testConf).GenerateEngineToken("1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodGet, "/conversations", nil)
+	r.AddCookie(&http.Cookie{Name: "token", Value: assertion})
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("GET /conversations with an engine assertion: %d %s", w.Code, w.Body)
+	}
+}
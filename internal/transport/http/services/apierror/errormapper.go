@@ -102,3 +102,11 @@ func TimeOutError(target string) *APIError {
                 WithInnerError("TimeOutHasBeenExceeded"),
         )
 }
+
+func InvalidCSRFToken(code string) *APIError {
+        return Build(ForbiddenRequestCode,
+                "missing or invalid csrf token",
+                WithTarget("csrf"),
+                WithInnerError(code),
+        )
+}
@@ -0,0 +1,21 @@
+package apiresponse
+
+import (
+	"net/http"
+
+	"github.com/iLeoon/realtime-gateway/internal/ctx"
+)
+
+// Location builds the absolute URL of a newly created resource under the
+// requested collection. Scheme and host come from the resolved client info,
+// forwarding headers are never read directly.
+func Location(r *http.Request, id string) string {
+	client, ok := ctx.ClientInfo(r.Context())
+	if !ok {
+		client = ctx.Client{Scheme: "http", Host: r.Host}
+		if r.TLS != nil {
+			client.Scheme = "https"
+		}
+	}
+	return client.BaseURL() + "/api/v1.0" + r.URL.Path + "/" + id
+}
@@ -0,0 +1,111 @@
+package tcp
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/iLeoon/realtime-gateway/internal/errors"
+	"github.com/iLeoon/realtime-gateway/internal/protocol/capture"
+	"github.com/iLeoon/realtime-gateway/internal/protocol/packets"
+)
+
+// gatewaySubject is the subject of the assertion a gateway authenticates
+// its own connections with. User assertions name a numeric userID, the
+// two can't be mistaken for each other.
+const gatewaySubject = "gateway"
+
+// Assertions vouch for the user behind a connect packet. The gateway signs
+// one after authenticating the WebSocket and the engine verifies it, both
+// with the keys of the token service.
+type Assertions interface {
+	GenerateEngineToken(userID string) (string, error)
+	DecodeEngineToken(token string) (string, error)
+}
+
+// authenticate checks the gateway's assertion for the user of pkt. Over a
+// plain tcp link it's required unless ENGINE_INSECURE_CONNECT is set,
+// over a unix socket or a verified tls link only with ENGINE_REQUIRE_TOKEN.
+func (s *server) authenticate(pkt *packets.ConnectPacket, conn net.Conn) error {
+	const op errors.Op = "server.authenticate"
+	if !s.conf.EngineRequireToken && (s.conf.EngineInsecureConnect || trustedLink(conn)) {
+		return nil
+	}
+	if pkt.Token == "" {
+		return errors.B(path, op, errors.Client, errors.Unauthenticated, "connect packet without a token")
+	}
+	if s.assertions == nil {
+		return errors.B(path, op, errors.Internal, errors.Unauthenticated, "no key to verify tokens with")
+	}
+	userID, err := s.assertions.DecodeEngineToken(pkt.Token)
+	if err != nil {
+		return errors.B(path, op, errors.Client, errors.Unauthenticated, err)
+	}
+	if userID != strconv.FormatUint(uint64(pkt.UserID), 10) {
+		return errors.B(path, op, errors.Client, errors.Unauthenticated, fmt.Errorf("token of userID %s used to connect userID %d", userID, pkt.UserID))
+	}
+	return nil
+}
+
+// authenticateGateway checks the assertion of a GatewayAuthPacket and
+// trusts conn with membership and relay packets from then on.
+func (s *server) authenticateGateway(pkt *packets.GatewayAuthPacket, conn net.Conn) error {
+	const op errors.Op = "server.authenticateGateway"
+	pc, ok := conn.(*peerConn)
+	if !ok {
+		return errors.B(path, op, errors.Internal, errors.Unauthenticated, "connection can't be authenticated")
+	}
+	if s.assertions == nil {
+		return errors.B(path, op, errors.Internal, errors.Unauthenticated, "no key to verify tokens with")
+	}
+	subject, err := s.assertions.DecodeEngineToken(pkt.Token)
+	if err != nil {
+		return errors.B(path, op, errors.Client, errors.Unauthenticated, err)
+	}
+	if subject != gatewaySubject {
+		return errors.B(path, op, errors.Client, errors.Unauthenticated, fmt.Errorf("token of %q used to authenticate a gateway", subject))
+	}
+	pc.gateway.Store(true)
+	return nil
+}
+
+// authorizeGateway lets conn send membership and relay packets if it
+// authenticated with a GatewayAuthPacket or a client certificate.
+func authorizeGateway(conn net.Conn, pkt packets.BuildPayload) error {
+	const op errors.Op = "server.authorizeGateway"
+	if pc, ok := conn.(*peerConn); ok && (pc.gateway.Load() || verifiedPeer(pc.Conn)) {
+		return nil
+	}
+	return errors.B(path, op, errors.Client, errors.Unauthenticated, fmt.Errorf("%s packet from an unauthenticated peer", packets.Name(pkt.Type())))
+}
+
+// trustedLink reports whether conn came through a unix socket, which only
+// the engine's user and group can reach, or is a verifiedPeer.
+func trustedLink(conn net.Conn) bool {
+	if pc, ok := conn.(*peerConn); ok {
+		conn = pc.Conn
+	}
+	if verifiedPeer(conn) {
+		return true
+	}
+	if c, ok := conn.(*capture.Conn); ok {
+		conn = c.Conn
+	}
+	_, unix := conn.(*net.UnixConn)
+	return unix
+}
+
+// verifiedPeer reports whether conn is a TLS connection whose peer
+// presented a certificate. Engine listeners require client certificates
+// signed by ENGINE_TLS_CA, so any completed handshake has one.
+func verifiedPeer(conn net.Conn) bool {
+	if c, ok := conn.(*capture.Conn); ok {
+		conn = c.Conn
+	}
+	tc, ok := conn.(*tls.Conn)
+	if !ok {
+		return false
+	}
+	return len(tc.ConnectionState().PeerCertificates) > 0
+}
@@ -0,0 +1,210 @@
+package tcp
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/iLeoon/realtime-gateway/internal/config"
+	"github.com/iLeoon/realtime-gateway/internal/errors"
+	"github.com/iLeoon/realtime-gateway/internal/protocol"
+	"github.com/iLeoon/realtime-gateway/internal/protocol/packets"
+	"github.com/iLeoon/realtime-gateway/internal/transport/http/resource/token"
+	"github.com/iLeoon/realtime-gateway/pkg/log"
+)
+
+func TestConnectRequiresToken(t *testing.T) {
+	log.SetLevel("disabled")
+	tokens := token.NewService(&config.Config{JWT: config.JWT{JwtSecretKey: "test-secret", JwtIssuer: "test"}})
+	sign := func(userID string, ws bool) string {
+		t.Helper()
+		generate := tokens.GenerateEngineToken
+		if ws {
+			generate = tokens.GenerateWsToken
+		}
+		tok, err := generate(userID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tok
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		ok    bool
+	}{
+		{"valid", sign("10", false), true},
+		{"missing", "", false},
+		{"another user", sign("20", false), false},
+		{"websocket token", sign("10", true), false},
+		{"garbage", "not.a.token", false},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := New()
+			s.db = newReplayDB(fixtureSetup)
+			s.conf.EngineRequireToken = true
+			s.assertions = tokens
+
+			out := &memConn{}
+			pc := newPeerConn(out, 8, overflowDisconnect)
+			var userID uint32
+			frame := &protocol.Frame{Payload: &packets.ConnectPacket{ConnectionID: uint32(i + 1), UserID: 10, Token: tt.token}}
+			if got := s.packetsDispatcher(frame, pc, &userID, context.Background()); got != tt.ok {
+				t.Fatalf("dispatcher kept the connection = %v, want %v", got, tt.ok)
+			}
+			pc.stop()
+
+			if online := len(s.registry.appendConns(nil, 10)) > 0; online != tt.ok {
+				t.Fatalf("user registered = %v, want %v", online, tt.ok)
+			}
+			if got := countFrames(t, out, packets.Error); (got == 1) == tt.ok {
+				t.Fatalf("got %d error packets", got)
+			}
+		})
+	}
+}
+
+// TestConnectOverTCPRequiresToken connects userID 10 without an assertion
+// to an engine in its default config. Over plain tcp anyone could claim to
+// be the gateway, the connect is refused there unless it's signed.
+func TestConnectOverTCPRequiresToken(t *testing.T) {
+	log.SetLevel("disabled")
+	dir := t.TempDir()
+	auth := writeTestPKI(t, dir)
+	signed, err := testAssertions.GenerateEngineToken("10")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		scheme string
+		token  string
+		ok     bool
+	}{
+		{"tcp", "tcp", "", false},
+		{"tcp with an assertion", "tcp", signed, true},
+		{"unix", "unix", "", true},
+		{"client certificate", "tls", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := New()
+			s.conf = &config.Config{}
+			s.db = newReplayDB(fixtureSetup)
+			s.assertions = testAssertions
+			l, _, transport := listenTransport(t, tt.scheme, t.TempDir(), auth)
+			serve(s, l)
+
+			conn, err := transport.Dial(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(time.Second))
+			proto, err := protocol.ClientHandshake(conn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			connect := &packets.ConnectPacket{ConnectionID: 1, UserID: 10, Token: tt.token}
+			if err := protocol.ConstructFrame(connect).ForVersion(proto.Version).WithCorrelation(1).EncodeFrame(conn); err != nil {
+				t.Fatal(err)
+			}
+			frame, err := protocol.NewDecoder(conn).Decode(proto.Version)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, acked := frame.Payload.(*packets.AckPacket); acked != tt.ok {
+				t.Fatalf("connect answered with %v", frame.Payload)
+			}
+			if refused, ok := frame.Payload.(*packets.ErrorPacket); ok && refused.Reason != errors.Unauthenticated {
+				t.Fatalf("connect refused with %v", frame.Payload)
+			}
+			if online := len(s.registry.appendConns(nil, 10)) > 0; online != tt.ok {
+				t.Fatalf("userID 10 registered = %v, want %v", online, tt.ok)
+			}
+		})
+	}
+}
+
+// TestMembershipRequiresGateway sends a membership packet to an engine
+// over unix and tls. It's applied once the peer proved to be a gateway,
+// with its assertion or a client certificate.
+func TestMembershipRequiresGateway(t *testing.T) {
+	log.SetLevel("disabled")
+	dir := t.TempDir()
+	auth := writeTestPKI(t, dir)
+	sign := func(subject string) *packets.GatewayAuthPacket {
+		t.Helper()
+		tok, err := testAssertions.GenerateEngineToken(subject)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &packets.GatewayAuthPacket{Token: tok}
+	}
+
+	tests := []struct {
+		name   string
+		scheme string
+		auth   *packets.GatewayAuthPacket
+		ok     bool
+	}{
+		{"unauthenticated", "unix", nil, false},
+		{"user assertion", "unix", sign("10"), false},
+		{"forged assertion", "unix", &packets.GatewayAuthPacket{Token: "not.a.token"}, false},
+		{"gateway assertion", "unix", sign(gatewaySubject), true},
+		{"client certificate", "tls", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := New()
+			s.assertions = testAssertions
+			l, _, transport := listenTransport(t, tt.scheme, t.TempDir(), auth)
+			serve(s, l)
+
+			conn, err := transport.Dial(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(time.Second))
+			proto, err := protocol.ClientHandshake(conn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			dec := protocol.NewDecoder(conn)
+			send := func(pkt packets.BuildPayload, id uint32) packets.BuildPayload {
+				t.Helper()
+				if err := protocol.ConstructFrame(pkt).ForVersion(proto.Version).WithCorrelation(id).EncodeFrame(conn); err != nil {
+					t.Fatal(err)
+				}
+				frame, err := dec.Decode(proto.Version)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return frame.Payload
+			}
+
+			if tt.auth != nil {
+				if _, acked := send(tt.auth, 1).(*packets.AckPacket); acked != tt.ok {
+					t.Fatalf("gateway auth acked = %v, want %v", acked, tt.ok)
+				}
+				if !tt.ok {
+					return
+				}
+			}
+			answer := send(&packets.MembershipPacket{UserID: 10, ConversationID: 7, Joined: true}, 2)
+			if _, acked := answer.(*packets.AckPacket); acked != tt.ok {
+				t.Fatalf("membership answered with %v", answer)
+			}
+			if refused, ok := answer.(*packets.ErrorPacket); ok && refused.Reason != errors.Unauthenticated {
+				t.Fatalf("membership refused with %v", answer)
+			}
+			if _, joined := s.registry.member(10, 7); joined != tt.ok {
+				t.Fatalf("userID 10 joined = %v, want %v", joined, tt.ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,67 @@
+package tcp
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/iLeoon/realtime-gateway/internal/errors"
+	"github.com/iLeoon/realtime-gateway/pkg/log"
+)
+
+// Author is the profile recipients see next to a message, so they don't
+// look up every new sender over REST.
+type Author struct {
+	Name  string
+	Image string
+}
+
+// authorCache keeps the profiles of message authors for authorTTL, a
+// conversation's messages don't each query the database. The zero value
+// is ready to use.
+type authorCache struct {
+	mu    sync.Mutex
+	m     map[uint32]cachedAuthor
+	swept time.Time
+}
+
+type cachedAuthor struct {
+	Author
+	until time.Time
+}
+
+// get returns the profile of userID. The profile is optional, a failed
+// lookup is logged and the message goes out without it.
+func (c *authorCache) get(ctx context.Context, db DBConnection, userID uint32) Author {
+	const op errors.Op = "authorCache.get"
+	now := time.Now()
+	c.mu.Lock()
+	if a, ok := c.m[userID]; ok && now.Before(a.until) {
+		c.mu.Unlock()
+		return a.Author
+	}
+	c.mu.Unlock()
+
+	a, err := db.FetchAuthor(userID, ctx)
+	if err != nil {
+		log.Error.Println("sending the message without its author's profile", errors.B(path, op, err))
+		return Author{}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.m == nil {
+		c.m = make(map[uint32]cachedAuthor)
+	}
+	// Authors that stopped writing are dropped once per authorTTL.
+	if now.Sub(c.swept) > authorTTL {
+		for id, cached := range c.m {
+			if now.After(cached.until) {
+				delete(c.m, id)
+			}
+		}
+		c.swept = now
+	}
+	c.m[userID] = cachedAuthor{a, now.Add(authorTTL)}
+	return a
+}
@@ -1,17 +1,22 @@
 package tcp
 
 import (
+	"context"
 	"encoding/json"
 	"io"
+	"math/rand/v2"
 	"net"
 	"os"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/iLeoon/realtime-gateway/internal/config"
 	"github.com/iLeoon/realtime-gateway/internal/errors"
 	"github.com/iLeoon/realtime-gateway/internal/protocol"
 	"github.com/iLeoon/realtime-gateway/internal/protocol/packets"
+	"github.com/iLeoon/realtime-gateway/pkg/codec"
 	"github.com/iLeoon/realtime-gateway/pkg/log"
 	"github.com/iLeoon/realtime-gateway/pkg/session"
 )
@@ -20,8 +25,19 @@ const clientPath errors.PathName = "tcp/client"
 
 type Router interface {
 	Route(p packets.BuildPayload, userID string, connectionID uint32)
+	// Reply delivers the engine's answer to one browser action.
+	Reply(p packets.BuildPayload, requestID, action string, userID string, connectionID uint32)
+	// LinkStatus tells the browser the engine was lost or is back, status
+	// is linkDegraded or linkRestored.
+	LinkStatus(userID string, connectionID uint32, status string)
 }
 
+// Link statuses sent to the browser while the engine is redialed.
+const (
+	linkDegraded = "degraded"
+	linkRestored = "restored"
+)
+
 type Signaler interface {
 	Signal(userID string, connectionID uint32, code int, reason string)
 }
@@ -40,57 +56,158 @@ type Signaler interface {
 //
 //	Browser JSON → ReadFromGateway → ConstructPacket → EncodeFrame → TCP Engine
 //	TCP Engine  → DecodeFrame → Route Packet → Handle Response → WebSocket Client
+//
+// When the engine goes away the client dials it again and registers the
+// session anew, the WebSocket is only closed if that fails. Browser
+// actions that arrive meanwhile are held and sent once the engine is back.
 type tcpClient struct {
+	mu           sync.Mutex // guards conn and proto, which change on reconnect
 	conn         net.Conn
 	config       *config.Config
 	router       Router
 	connectionID uint32 // the requester connection ID
 	userID       string // the requester user ID
 	signal       Signaler
+	codec        codec.Codec         // decodes the browser's actions
+	proto        protocol.Negotiated // version and features agreed with the engine
+	pending      correlations        // browser requests awaiting an ack or error
+	assertions   Assertions          // signs the connect packet, nil to send none
+	engine       string              // URL of the engine conn leads to, guarded by mu
+	dial         func() (string, net.Conn, protocol.Negotiated, error)
+	factory      *tcpClientFactory
+	closing      atomic.Bool  // set once the browser left, the link isn't redialed
+	degraded     bool         // the engine is being redialed, guarded by mu
+	held         []heldAction // actions waiting for the engine, guarded by mu
+}
+
+// heldAction is a browser action the client couldn't send yet.
+type heldAction struct {
+	pkt    packets.BuildPayload
+	id     string // the browser's request ID
+	action string
 }
 
 type tcpClientFactory struct {
 	config *config.Config
 	router Router // Router routes the data coming from Tcp server to websocket gateway.
 	signal Signaler
+	// engines are the engines of ENGINE_URLS by URL, in the order they're
+	// listed. Sessions are placed on them by consistent hashing of the
+	// user, see ring.
+	engines map[string]*engineNode
+	order   []string
+
+	mu       sync.Mutex
+	ring     *ring                   // the engines that are up
+	sessions map[*tcpClient]struct{} // moved when the ring changes
+	// assertions vouch for the user of each connect packet.
+	assertions Assertions
+	// legacyUntil holds off the handshake for a while once the engine
+	// turned out to predate it, saving a dial per connection during a rollout.
+	legacyUntil atomic.Int64
 }
 
-func NewFactory(c *config.Config, r Router, s Signaler) *tcpClientFactory {
-	return &tcpClientFactory{
-		config: c,
-		router: r,
-		signal: s,
-	}
+func NewFactory(c *config.Config, r Router, s Signaler, a Assertions) (*tcpClientFactory, error) {
+	const op errors.Op = "tcp.NewFactory"
+	transports, err := EngineTransports(c)
+	if err != nil {
+		return nil, errors.B(clientPath, op, err)
+	}
+	f := &tcpClientFactory{
+		config:     c,
+		router:     r,
+		signal:     s,
+		engines:    make(map[string]*engineNode, len(transports)),
+		sessions:   make(map[*tcpClient]struct{}),
+		assertions: a,
+	}
+	// Engines count as up until a check finds otherwise.
+	for _, transport := range transports {
+		f.engines[transport.String()] = &engineNode{transport: transport, up: true}
+		f.order = append(f.order, transport.String())
+	}
+	f.ring = f.buildRing()
+	if len(transports) > 1 {
+		go f.watchEngines()
+	}
+	return f, nil
 }
 
 // NewTCPClient establishes the TCP connection between the WebSocket
 // gateway and the TCP engine. This function create the bridge
 // between the websocket gateway and tcp server
 // to send/receive messages.
-func (t *tcpClientFactory) NewClient(userID string, connectionID uint32) (session.Session, error) {
-	conn, err := net.Dial("tcp", t.config.TCPPort)
+func (t *tcpClientFactory) NewClient(userID string, connectionID uint32, c codec.Codec) (session.Session, error) {
+	engine, conn, proto, err := t.dialUser(userID)
 	if err != nil {
 		return nil, err
 	}
 
-	log.Info.Println("The tcp client successfully established a connection between websocket gateway and tcp server")
+	log.Info.Println("The tcp client successfully established a connection between websocket gateway and tcp server", "protocol_version", proto.Version)
 
 	client := &tcpClient{
 		conn:         conn,
 		config:       t.config,
 		router:       t.router,
 		signal:       t.signal,
+		codec:        c,
 		userID:       userID,
 		connectionID: connectionID,
+		proto:        proto,
+		assertions:   t.assertions,
+		engine:       engine,
+		dial:         func() (string, net.Conn, protocol.Negotiated, error) { return t.dialUser(userID) },
+		factory:      t,
 	}
+	t.track(client)
 	go client.ReadFromServer()
 	return client, nil
 }
 
+// dial connects to an engine and negotiates the protocol version. An
+// engine that rejects the handshake closes the socket, so the connection
+// is dialed again and used as Version1.
+func (t *tcpClientFactory) dial(transport Transport) (net.Conn, protocol.Negotiated, error) {
+	const op errors.Op = "tcpClientFactory.dial"
+	conn, err := transport.Dial(context.Background())
+	if err != nil {
+		return nil, protocol.Legacy, err
+	}
+	if time.Now().UnixNano() < t.legacyUntil.Load() {
+		return conn, protocol.Legacy, nil
+	}
+
+	if err := conn.SetDeadline(time.Now().Add(writeDuration)); err != nil {
+		conn.Close()
+		return nil, protocol.Legacy, errors.B(clientPath, op, err)
+	}
+	proto, err := protocol.ClientHandshake(conn)
+	if err == nil {
+		if err := conn.SetDeadline(time.Time{}); err != nil {
+			conn.Close()
+			return nil, protocol.Legacy, errors.B(clientPath, op, err)
+		}
+		return conn, proto, nil
+	}
+	conn.Close()
+	if !errors.Is(err, protocol.ErrLegacyPeer) {
+		return nil, protocol.Legacy, errors.B(clientPath, op, err)
+	}
+
+	log.Info.Println("tcp engine doesn't support the protocol handshake, falling back to version 1")
+	t.legacyUntil.Store(time.Now().Add(legacyRetry).UnixNano())
+	conn, err = transport.Dial(context.Background())
+	if err != nil {
+		return nil, protocol.Legacy, err
+	}
+	return conn, protocol.Legacy, nil
+}
+
 // ReadFromGateway handles incoming messages from the browser/WebSocket gateway
-// client. It receives raw JSON payloads, unmarshals them into the
-// ClientPayload structure, and uses the opcode to determine which internal
-// packet type to construct.
+// client. It receives raw payloads, unmarshals them with the negotiated
+// codec into the ClientPayload structure, and uses the opcode to determine
+// which internal packet type to construct. Whatever the codec, the payload
+// it leaves in ClientPayload is JSON.
 //
 // Based on the opcode, the method builds the appropriate packet
 // encodes it into a protocol frame, and transmits it
@@ -101,8 +218,12 @@ func (t *tcpClient) WriteToServer(data []byte) error {
 	cp := &ClientPayload{}
 
 	// Unmarshal the incmoing byets from the gateway to the client payload struct
-	if err := json.Unmarshal(data, cp); err != nil {
-		return errors.B(clientPath, op, errors.Client, err)
+	if err := t.codec.Unmarshal(data, cp); err != nil {
+		code := errors.InvalidJSON
+		if t.codec == codec.MsgPack {
+			code = errors.InvalidMsgPack
+		}
+		return errors.B(clientPath, op, errors.Client, code, err)
 	}
 
 	// Check the message type (opcode) based on the ClientPayload.Opcode
@@ -111,41 +232,109 @@ func (t *tcpClient) WriteToServer(data []byte) error {
 	var err error
 	switch cp.Opcode {
 	case "send_message":
-		pkt, err = buildSendMessage(cp, op)
+		pkt, err = buildSendMessage(cp, t.config.MessageMaxChars, op)
 	case "update_message":
-		pkt, err = buildUpdateMessage(cp, op)
+		pkt, err = buildUpdateMessage(cp, t.config.MessageMaxChars, op)
 	case "delete_message":
 		pkt, err = buildDeleteMessage(cp, op)
 	case "typing":
 		pkt, err = buildTyping(cp, op)
 	default:
-		return errors.B(clientPath, op, errors.Client, errors.Errorf("Invalid packet type %T", cp.Opcode))
+		return errors.B(clientPath, op, errors.Client, errors.UnknownType, errors.Errorf("Invalid packet type %q", cp.Opcode))
 	}
 	if err != nil {
 		return errors.B(clientPath, op, "processing the packet to write it to the tcp server failed", err)
 	}
 
-	if err := t.writePacket(pkt); err != nil {
+	if err := t.send(heldAction{pkt: pkt, id: cp.ID, action: cp.Opcode}); err != nil {
 		return errors.B(clientPath, op, err)
 	}
 	return nil
 }
 
+// send writes a browser action to the engine. A write that fails because
+// the link broke doesn't end the session, the action is held and the
+// reader redials the engine, see reconnect. Actions that can't be held
+// are answered with engine_unavailable.
+func (t *tcpClient) send(a heldAction) error {
+	const op errors.Op = "tcpClient.send"
+	t.mu.Lock()
+	lost := false
+	if !t.degraded {
+		err := t.writeAction(a)
+		if err == nil || errors.Is(err, errors.Client) {
+			t.mu.Unlock()
+			return err
+		}
+		log.Error.Println("writing to the engine failed, holding the action", errors.B(clientPath, op, err))
+		// The reader finds out on its next read, closing the connection
+		// gets it redialing right away.
+		t.degraded, lost = true, true
+		t.conn.Close()
+	}
+	held := t.hold(a)
+	t.mu.Unlock()
+
+	if lost {
+		t.router.LinkStatus(t.userID, t.connectionID, linkDegraded)
+	}
+	if !held {
+		pkt := &packets.ErrorPacket{Code: errors.Internal, Reason: errors.EngineUnavailable, Message: "the engine is unreachable"}
+		t.router.Reply(pkt, a.id, a.action, t.userID, t.connectionID)
+	}
+	return nil
+}
+
+// hold queues a for the reconnected engine. Typing indicators are stale by
+// then and aren't held. The caller holds mu.
+func (t *tcpClient) hold(a heldAction) bool {
+	limit := t.config.EngineReconnectBuffer
+	if limit == 0 {
+		limit = reconnectBuffer
+	}
+	if _, typing := a.pkt.(*packets.TypingPacket); typing || len(t.held) >= limit {
+		return false
+	}
+	t.held = append(t.held, a)
+	return true
+}
+
+// writeAction writes a, tracking its request ID when the engine acks
+// actions. The caller holds mu.
+func (t *tcpClient) writeAction(a heldAction) error {
+	var correlationID uint32
+	if t.proto.Has(packets.FeatureCorrelation) {
+		correlationID = t.pending.track(a.id, a.action)
+	}
+	if err := t.write(a.pkt, correlationID); err != nil {
+		// It's held or refused instead, the engine never saw it.
+		if correlationID != 0 {
+			t.pending.resolve(correlationID)
+		}
+		return err
+	}
+	return nil
+}
+
 func toUint32(str string) (uint32, error) {
 	value, err := strconv.ParseUint(str, 10, 32)
 	return uint32(value), err
 }
 
-func buildSendMessage(cp *ClientPayload, op errors.Op) (*packets.SendMessagePacket, error) {
+func buildSendMessage(cp *ClientPayload, maxChars int, op errors.Op) (*packets.SendMessagePacket, error) {
 	// Build the readable packet.
 	var data SendMessagePayload
 	err := json.Unmarshal(cp.Payload, &data)
 	if err != nil {
-		return nil, errors.B(clientPath, op, err, errors.Client)
+		return nil, errors.B(clientPath, op, err, errors.Client, errors.InvalidPayload)
 	}
 	convID, err := toUint32(data.ConversationID)
 	if err != nil {
-		return nil, errors.B(clientPath, op, errors.Client, err)
+		return nil, errors.B(clientPath, op, errors.Client, errors.InvalidPayload, err)
+	}
+	// Refused here, a message over the limit never reaches the engine.
+	if err := packets.CheckContent(data.Content, maxChars); err != nil {
+		return nil, errors.B(clientPath, op, err)
 	}
 
 	pkt := &packets.SendMessagePacket{
@@ -155,20 +344,23 @@ func buildSendMessage(cp *ClientPayload, op errors.Op) (*packets.SendMessagePack
 	return pkt, nil
 }
 
-func buildUpdateMessage(cp *ClientPayload, op errors.Op) (*packets.UpdateMessagePacket, error) {
+func buildUpdateMessage(cp *ClientPayload, maxChars int, op errors.Op) (*packets.UpdateMessagePacket, error) {
 	var data UpdateMessagePayload
 	err := json.Unmarshal(cp.Payload, &data)
 	if err != nil {
-		return nil, errors.B(clientPath, op, err, errors.Client)
+		return nil, errors.B(clientPath, op, err, errors.Client, errors.InvalidPayload)
 	}
 	convID, err := toUint32(data.ConversationID)
 	if err != nil {
-		return nil, errors.B(clientPath, op, errors.Client, err)
+		return nil, errors.B(clientPath, op, errors.Client, errors.InvalidPayload, err)
+	}
+	if err := packets.CheckContent(data.Content, maxChars); err != nil {
+		return nil, errors.B(clientPath, op, err)
 	}
 
 	messageID, err := toUint32(data.MessageID)
 	if err != nil {
-		return nil, errors.B(clientPath, op, errors.Client, err)
+		return nil, errors.B(clientPath, op, errors.Client, errors.InvalidPayload, err)
 	}
 	pkt := &packets.UpdateMessagePacket{
 		ConversationID: convID,
@@ -182,17 +374,17 @@ func buildDeleteMessage(cp *ClientPayload, op errors.Op) (*packets.DeleteMessage
 	var data DeleteMessagePayload
 	err := json.Unmarshal(cp.Payload, &data)
 	if err != nil {
-		return nil, errors.B(clientPath, op, err, errors.Client)
+		return nil, errors.B(clientPath, op, err, errors.Client, errors.InvalidPayload)
 	}
 
 	convID, err := toUint32(data.ConversationID)
 	if err != nil {
-		return nil, errors.B(clientPath, op, errors.Client, err)
+		return nil, errors.B(clientPath, op, errors.Client, errors.InvalidPayload, err)
 	}
 
 	messageID, err := toUint32(data.MessageID)
 	if err != nil {
-		return nil, errors.B(clientPath, op, errors.Client, err)
+		return nil, errors.B(clientPath, op, errors.Client, errors.InvalidPayload, err)
 	}
 	pkt := &packets.DeleteMessagePacket{
 		MessageID:      messageID,
@@ -205,12 +397,12 @@ func buildTyping(cp *ClientPayload, op errors.Op) (*packets.TypingPacket, error)
 	var data TypingPayload
 	err := json.Unmarshal(cp.Payload, &data)
 	if err != nil {
-		return nil, errors.B(clientPath, op, err, errors.Client)
+		return nil, errors.B(clientPath, op, err, errors.Client, errors.InvalidPayload)
 	}
 
 	convID, err := toUint32(data.ConversationID)
 	if err != nil {
-		return nil, errors.B(clientPath, op, errors.Client, err)
+		return nil, errors.B(clientPath, op, errors.Client, errors.InvalidPayload, err)
 	}
 	pkt := &packets.TypingPacket{
 		ConversationID: convID,
@@ -228,29 +420,79 @@ func buildTyping(cp *ClientPayload, op errors.Op) (*packets.TypingPacket, error)
 // blocking I/O while waiting for incoming data from the TCP connection.
 func (t *tcpClient) ReadFromServer() {
 	const op errors.Op = "tcpClient.ReadFromServer"
-	wsCode := 1011 // default: internal server error
-	var reason string
+	var (
+		wsCode int
+		reason string
+	)
 	defer func() {
+		t.factory.forget(t)
 		t.signal.Signal(t.userID, t.connectionID, wsCode, reason)
-		t.conn.Close()
+		conn, _ := t.link()
+		conn.Close()
 		log.Info.Printf("%q: %q: tcp client terminated it's connection", clientPath, op)
 	}()
 
+	for {
+		conn, proto := t.link()
+		var linkErr error
+		wsCode, reason, linkErr = t.readFrames(conn, proto)
+		if linkErr == nil || t.closing.Load() {
+			return
+		}
+		if t.degrade() {
+			t.router.LinkStatus(t.userID, t.connectionID, linkDegraded)
+		}
+		if !t.reconnect() {
+			wsCode, reason = 1013, errors.EngineUnavailable.Message()
+			return
+		}
+		t.router.LinkStatus(t.userID, t.connectionID, linkRestored)
+	}
+}
+
+// degrade starts holding browser actions, it reports whether the link was
+// healthy until now.
+func (t *tcpClient) degrade() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	was := t.degraded
+	t.degraded = true
+	return !was
+}
+
+// readFrames routes the frames of one engine connection until it ends.
+// linkErr is set when the connection failed and dialing again may help,
+// wsCode and reason are what the WebSocket is closed with otherwise.
+func (t *tcpClient) readFrames(conn net.Conn, proto protocol.Negotiated) (wsCode int, reason string, linkErr error) {
+	const op errors.Op = "tcpClient.readFrames"
+	dec := protocol.NewDecoder(conn)
 	for {
 		// Decode the frame.
-		if err := t.conn.SetReadDeadline(time.Now().Add(readDuration)); err != nil {
+		if err := conn.SetReadDeadline(time.Now().Add(readDuration)); err != nil {
 			wrappedErr := errors.B(clientPath, op, err)
 			log.Error.Println("failed to read the packet from the peer", wrappedErr)
-			return
+			return 1011, "", wrappedErr
 		}
-		frame, err := protocol.DecodeFrame(t.conn)
+		frame, err := dec.Decode(proto.Version)
 		if err != nil {
 			var readErr error
 			// wrap error for more context
 			wrappedErr := errors.B(clientPath, op, err)
 			reason, wsCode, readErr = handleDecodeErr(err, op)
 			log.Error.Println(wrappedErr, readErr)
-			return
+			if linkLost(err) {
+				return wsCode, reason, wrappedErr
+			}
+			return wsCode, reason, nil
+		}
+
+		// Correlated frames answer one browser action, errors among them
+		// only fail that action and the session stays open.
+		if frame.CorrelationID != 0 {
+			req, _ := t.pending.resolve(frame.CorrelationID)
+			t.router.Reply(frame.Payload, req.id, req.action, t.userID, t.connectionID)
+			log.Info.Println("Decode packet", "packet", frame.Payload.String())
+			continue
 		}
 
 		switch pkt := frame.Payload.(type) {
@@ -258,16 +500,17 @@ func (t *tcpClient) ReadFromServer() {
 			if err := t.pongRes(); err != nil {
 				errorWrapper := errors.B(clientPath, op, err)
 				log.Error.Println("pong packet failed", errorWrapper)
-				wsCode = 1006
-				reason = "unexpected failure"
-				return
+				return 1006, "unexpected failure", errorWrapper
 			}
 		case *packets.ErrorPacket:
-			if pkt.Code == errors.Client {
-				wsCode = 1008
-				reason = pkt.Message
-				return
+			// Engines that predate reason codes can't tell a protocol
+			// violation from a rejected request, their client errors
+			// still end the session.
+			legacy := proto.Version < packets.Version2 && pkt.Code == errors.Client
+			if legacy || pkt.Reason.Fatal() {
+				return 1008, pkt.Message, nil
 			}
+			t.router.Route(pkt, t.userID, t.connectionID)
 
 		case *packets.ResponseMessagePacket:
 			t.router.Route(pkt, t.userID, t.connectionID)
@@ -281,11 +524,126 @@ func (t *tcpClient) ReadFromServer() {
 			t.router.Route(pkt, t.userID, t.connectionID)
 		case *packets.AddedToConversationPacket:
 			t.router.Route(pkt, t.userID, t.connectionID)
+		case *packets.RateLimitedPacket:
+			t.router.Route(pkt, t.userID, t.connectionID)
 		}
 		log.Info.Println("Decode packet", "packet", frame.Payload.String())
 	}
 }
 
+// linkLost reports whether a read failed because the connection to the
+// engine broke, as opposed to the engine sending something invalid. A
+// connection closed by a failed write counts, the browser leaving is told
+// apart by closing.
+func linkLost(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.As(err, &netErr)
+}
+
+// reconnect dials the engine again after the link dropped, registers the
+// session on the new connection and sends the held actions. The wait
+// between attempts doubles and is jittered, so the sessions of a gateway
+// don't redial a restarted engine all at once. It gives up after
+// ENGINE_RECONNECT_WINDOW or once the browser left.
+func (t *tcpClient) reconnect() bool {
+	const op errors.Op = "tcpClient.reconnect"
+	window := t.config.EngineReconnectWindow
+	if window == 0 {
+		window = reconnectWindow
+	}
+	backoff := reconnectMinBackoff
+	for deadline := time.Now().Add(window); time.Now().Before(deadline); {
+		time.Sleep(backoff/2 + rand.N(backoff/2+1))
+		backoff = min(2*backoff, reconnectMaxBackoff)
+		if t.closing.Load() {
+			return false
+		}
+
+		engine, conn, proto, err := t.dial()
+		if err != nil {
+			log.Error.Println("reconnecting to the engine failed", errors.B(clientPath, op, err))
+			continue
+		}
+		t.mu.Lock()
+		old := t.conn
+		t.conn, t.proto, t.engine = conn, proto, engine
+		t.mu.Unlock()
+		old.Close()
+
+		if err := t.OnConnect(); err != nil {
+			log.Error.Println("registering the session again failed", errors.B(clientPath, op, err))
+			continue
+		}
+		t.failPending()
+		if err := t.flush(); err != nil {
+			log.Error.Println("sending the held actions failed", errors.B(clientPath, op, err))
+			continue
+		}
+		log.Info.Println("reconnected to the engine", "connection_id", t.connectionID, "protocol_version", proto.Version)
+		return true
+	}
+	return false
+}
+
+// failPending answers the browser requests the old connection took with
+// it, their outcome is unknown.
+func (t *tcpClient) failPending() {
+	for _, req := range t.pending.drain() {
+		pkt := &packets.ErrorPacket{Code: errors.Internal, Reason: errors.InternalFailure, Message: "the request was interrupted, try again"}
+		t.router.Reply(pkt, req.id, req.action, t.userID, t.connectionID)
+	}
+}
+
+// flush sends the held actions in the order they arrived and stops
+// holding new ones. Actions it couldn't send stay held.
+func (t *tcpClient) flush() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for len(t.held) > 0 {
+		if err := t.writeAction(t.held[0]); err != nil {
+			return err
+		}
+		t.held = t.held[1:]
+	}
+	t.held = nil
+	t.degraded = false
+	return nil
+}
+
+// engineURL returns the URL of the engine the session is connected to.
+func (t *tcpClient) engineURL() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.engine
+}
+
+// moveTo leaves the current engine when the ring gave the user to another
+// one. The session is disconnected there and the reader redials, which
+// reaches the new owner and registers the session again.
+func (t *tcpClient) moveTo(engine string) {
+	const op errors.Op = "tcpClient.moveTo"
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.engine == engine || t.degraded {
+		return
+	}
+	if userID, err := strconv.ParseUint(t.userID, 10, 32); err == nil {
+		pkt := &packets.DisconnectPacket{ConnectionID: t.connectionID, UserID: uint32(userID)}
+		if err := t.write(pkt, 0); err != nil {
+			log.Error.Println("disconnecting from the previous engine failed", errors.B(clientPath, op, err))
+		}
+	}
+	log.Info.Println("moving the session to another engine", "from", t.engine, "to", engine)
+	t.conn.Close()
+}
+
+// link returns the current connection to the engine and its protocol.
+func (t *tcpClient) link() (net.Conn, protocol.Negotiated) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.conn, t.proto
+}
+
 func handleDecodeErr(err error, op errors.Op) (string, int, error) {
 	var readErr error
 	// reason is a readable message to the websocket consumer
@@ -332,6 +690,13 @@ func (t *tcpClient) OnConnect() error {
 		ConnectionID: t.connectionID,
 		UserID:       uint32(userIDToInt),
 	}
+	// Engines without FeatureAuth can't decode the longer payload.
+	if _, proto := t.link(); t.assertions != nil && proto.Has(packets.FeatureAuth) {
+		pkt.Token, err = t.assertions.GenerateEngineToken(t.userID)
+		if err != nil {
+			return errors.B(clientPath, op, err)
+		}
+	}
 	if err := t.writePacket(pkt); err != nil {
 		return errors.B(clientPath, op, err)
 	}
@@ -341,6 +706,7 @@ func (t *tcpClient) OnConnect() error {
 // DisConnect is basically the inverse of OnConnect.
 func (t *tcpClient) OnDisConnect() error {
 	const op errors.Op = "tcpClient.onDisconnect"
+	t.closing.Store(true)
 
 	userIDToInt, err := strconv.ParseUint(t.userID, 10, 32)
 	if err != nil {
@@ -368,13 +734,28 @@ func (t *tcpClient) pongRes() error {
 // writePacket constructs the frame and write it
 // into the raw tcp connection
 func (t *tcpClient) writePacket(pkt packets.BuildPayload) error {
+	return t.writeCorrelated(pkt, 0)
+}
+
+// writeCorrelated is writePacket for a packet tagged with a correlation ID.
+func (t *tcpClient) writeCorrelated(pkt packets.BuildPayload, correlationID uint32) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.write(pkt, correlationID)
+}
+
+// write is writeCorrelated for callers already holding mu.
+func (t *tcpClient) write(pkt packets.BuildPayload, correlationID uint32) error {
 	const op errors.Op = "tcpClient.writePacket"
 	if err := t.conn.SetWriteDeadline(time.Now().Add(writeDuration)); err != nil {
 		return errors.B(clientPath, op, "connection is unhealthy", err)
 	}
 
 	// Construct the frame, encode it, and then send it to the TCP server.
-	frame := protocol.ConstructFrame(pkt)
+	frame := protocol.ConstructFrame(pkt).ForVersion(t.proto.Version).WithCorrelation(correlationID)
+	if t.proto.Has(packets.FeatureCompression) {
+		frame.WithCompression(t.config.FrameCompressionThreshold)
+	}
 	err := frame.EncodeFrame(t.conn)
 	if err != nil {
 		return errors.B(clientPath, op, err)
@@ -0,0 +1,514 @@
+package tcp
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/iLeoon/realtime-gateway/internal/config"
+	"github.com/iLeoon/realtime-gateway/internal/errors"
+	"github.com/iLeoon/realtime-gateway/internal/protocol/packets"
+	"github.com/iLeoon/realtime-gateway/internal/transport/http/resource/token"
+	"github.com/iLeoon/realtime-gateway/pkg/codec"
+	"github.com/iLeoon/realtime-gateway/pkg/log"
+	"github.com/iLeoon/realtime-gateway/pkg/session"
+)
+
+type nopRouter struct{}
+
+func (nopRouter) Route(packets.BuildPayload, string, uint32)                 {}
+func (nopRouter) Reply(packets.BuildPayload, string, string, string, uint32) {}
+func (nopRouter) LinkStatus(string, uint32, string)                          {}
+
+// recordingRouter keeps the replies, messages and link statuses a session
+// delivers.
+type recordingRouter struct {
+	nopRouter
+	mu       sync.Mutex
+	replies  map[string]packets.BuildPayload // by request ID
+	messages map[string]int                  // by userID
+	statuses []string
+}
+
+func (r *recordingRouter) Route(p packets.BuildPayload, userID string, _ uint32) {
+	if _, ok := p.(*packets.ResponseMessagePacket); !ok {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.messages == nil {
+		r.messages = make(map[string]int)
+	}
+	r.messages[userID]++
+}
+
+func (r *recordingRouter) received(userID string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.messages[userID]
+}
+
+func (r *recordingRouter) Reply(p packets.BuildPayload, requestID, _ string, _ string, _ uint32) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.replies == nil {
+		r.replies = make(map[string]packets.BuildPayload)
+	}
+	r.replies[requestID] = p
+}
+
+func (r *recordingRouter) LinkStatus(_ string, _ uint32, status string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.statuses = append(r.statuses, status)
+}
+
+func (r *recordingRouter) reply(requestID string) packets.BuildPayload {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.replies[requestID]
+}
+
+func (r *recordingRouter) status() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return slices.Clone(r.statuses)
+}
+
+// closeSignaler records the WebSocket closes the client asks for.
+type closeSignaler chan int
+
+func (s closeSignaler) Signal(_ string, _ uint32, code int, _ string) { s <- code }
+
+// engine is an engine process the tests can stop and start again on the
+// same socket.
+type engine struct {
+	*server
+	l     net.Listener
+	url   string // what gateways dial
+	mu    sync.Mutex
+	conns []net.Conn
+}
+
+func startEngine(t *testing.T, conf *config.Config) *engine {
+	t.Helper()
+	transport, err := EngineTransport(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return startEngineAt(t, conf, transport)
+}
+
+// startEngineAt starts an engine listening on transport, tcp:// on port 0
+// picks a free loopback port.
+func startEngineAt(t *testing.T, conf *config.Config, transport Transport) *engine {
+	t.Helper()
+	s := New()
+	s.conf = conf
+	s.db = newReplayDB(fixtureSetup)
+	s.assertions = testAssertions
+	e := &engine{server: s, url: transport.String()}
+	var err error
+	if e.l, err = transport.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	if addr, ok := e.l.Addr().(*net.TCPAddr); ok {
+		e.url = "tcp://" + addr.String()
+	}
+	go func() {
+		for {
+			conn, err := e.l.Accept()
+			if err != nil {
+				return
+			}
+			e.mu.Lock()
+			e.conns = append(e.conns, conn)
+			e.mu.Unlock()
+			go s.handleConn(conn)
+		}
+	}()
+	t.Cleanup(e.stop)
+	return e
+}
+
+// stop kills the engine and every gateway connection with it.
+func (e *engine) stop() {
+	e.l.Close()
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, c := range e.conns {
+		c.Close()
+	}
+}
+
+func (e *engine) online(userID uint32) bool {
+	return len(e.registry.appendConns(nil, userID)) > 0
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if cond() {
+			return
+		}
+	}
+	t.Fatalf("timed out waiting until %s", what)
+}
+
+// testAssertions signs and verifies the assertions of the test engines and
+// their gateways.
+var testAssertions = token.NewService(&config.Config{JWT: config.JWT{JwtSecretKey: "test-secret", JwtIssuer: "test"}})
+
+func engineConfig(t *testing.T) *config.Config {
+	conf := &config.Config{}
+	conf.EngineURL = "unix://" + filepath.Join(t.TempDir(), "engine.sock")
+	return conf
+}
+
+// TestReconnectAfterEngineRestart restarts the engine under a live
+// session. The WebSocket stays open and the session is registered with
+// the new engine.
+func TestReconnectAfterEngineRestart(t *testing.T) {
+	log.SetLevel("disabled")
+	conf := engineConfig(t)
+	first := startEngine(t, conf)
+
+	closed := make(closeSignaler, 1)
+	f, err := NewFactory(conf, nopRouter{}, closed, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess, err := f.NewClient("10", 1, codec.JSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sess.OnConnect(); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the first engine registered the session", func() bool { return first.online(10) })
+
+	first.stop()
+	second := startEngine(t, conf)
+	waitFor(t, "the restarted engine registered the session", func() bool { return second.online(10) })
+	select {
+	case code := <-closed:
+		t.Fatalf("the WebSocket was closed with %d during the restart", code)
+	default:
+	}
+
+	if err := sess.OnDisConnect(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the session didn't end after the browser left")
+	}
+	waitFor(t, "the engine dropped the session", func() bool { return !second.online(10) })
+}
+
+// TestReconnectAfterLinkDrop drops the link of one session while the
+// engine keeps running. The session redials and the engine fans out over
+// the new link, not the dead one.
+func TestReconnectAfterLinkDrop(t *testing.T) {
+	log.SetLevel("disabled")
+	conf := engineConfig(t)
+	e := startEngine(t, conf)
+
+	r := &recordingRouter{}
+	f, err := NewFactory(conf, r, make(closeSignaler, 2), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessions := make(map[uint32]session.Session)
+	for _, userID := range []uint32{10, 20} {
+		sess, err := f.NewClient(fmt.Sprint(userID), userID, codec.JSON)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := sess.OnConnect(); err != nil {
+			t.Fatal(err)
+		}
+		sessions[userID] = sess
+		waitFor(t, "the engine registered the session", func() bool { return e.online(userID) })
+	}
+
+	dead := e.registry.appendConns(nil, 10)[0].rawConn
+	dead.Close()
+	waitFor(t, "the session redialed", func() bool {
+		conns := e.registry.appendConns(nil, 10)
+		return len(conns) == 1 && conns[0].rawConn != dead
+	})
+	waitFor(t, "the session reported the link back", func() bool { return slices.Contains(r.status(), linkRestored) })
+
+	if err := sessions[20].WriteToServer(sendMessage("after the drop")); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "userID 10 got the message", func() bool { return r.received("10") == 1 })
+}
+
+func sendMessage(id string) []byte {
+	return []byte(fmt.Sprintf(`{"id":%q,"type":"send_message","payload":{"conversationID":"1","content":"hello"}}`, id))
+}
+
+// TestHoldActionsWhileReconnecting sends browser actions while the engine
+// is down. The session reports the outage, holds what fits and sends it to
+// the restarted engine.
+func TestHoldActionsWhileReconnecting(t *testing.T) {
+	log.SetLevel("disabled")
+	conf := engineConfig(t)
+	conf.EngineReconnectBuffer = 1
+	first := startEngine(t, conf)
+
+	r := &recordingRouter{}
+	f, err := NewFactory(conf, r, make(closeSignaler, 1), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess, err := f.NewClient("10", 1, codec.JSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sess.OnConnect(); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the first engine registered the session", func() bool { return first.online(10) })
+
+	first.stop()
+	waitFor(t, "the session reported the outage", func() bool { return slices.Equal(r.status(), []string{linkDegraded}) })
+	for _, id := range []string{"held", "refused"} {
+		if err := sess.WriteToServer(sendMessage(id)); err != nil {
+			t.Fatalf("writing %q while the engine is down: %v", id, err)
+		}
+	}
+	refused, ok := r.reply("refused").(*packets.ErrorPacket)
+	if !ok || refused.Reason != errors.EngineUnavailable {
+		t.Fatalf("the action past the buffer got %v, want engine_unavailable", r.reply("refused"))
+	}
+
+	startEngine(t, conf)
+	waitFor(t, "the held action was acked", func() bool {
+		_, ok := r.reply("held").(*packets.AckPacket)
+		return ok
+	})
+	if got := r.status(); !slices.Equal(got, []string{linkDegraded, linkRestored}) {
+		t.Fatalf("link statuses %v", got)
+	}
+}
+
+// TestMsgPackActions sends a browser action encoded with MessagePack, it's
+// acked like its JSON twin. JSON is refused once MessagePack was
+// negotiated.
+func TestMsgPackActions(t *testing.T) {
+	log.SetLevel("disabled")
+	conf := engineConfig(t)
+	e := startEngine(t, conf)
+
+	r := &recordingRouter{}
+	f, err := NewFactory(conf, r, make(closeSignaler, 1), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess, err := f.NewClient("10", 1, codec.MsgPack)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sess.OnConnect(); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the engine registered the session", func() bool { return e.online(10) })
+
+	var action any
+	if err := json.Unmarshal(sendMessage("packed"), &action); err != nil {
+		t.Fatal(err)
+	}
+	packed, err := codec.MsgPack.Marshal(action)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sess.WriteToServer(packed); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the action was acked", func() bool {
+		_, ok := r.reply("packed").(*packets.AckPacket)
+		return ok
+	})
+
+	if err := sess.WriteToServer(sendMessage("json")); errors.CodeOf(err) != errors.InvalidMsgPack {
+		t.Fatalf("writing JSON: %v, want invalid_msgpack", err)
+	}
+	if err := sess.OnDisConnect(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestReconnectGivesUp closes the WebSocket once the engine stays away
+// for longer than the reconnect window.
+func TestReconnectGivesUp(t *testing.T) {
+	log.SetLevel("disabled")
+	conf := engineConfig(t)
+	conf.EngineReconnectWindow = 300 * time.Millisecond
+	first := startEngine(t, conf)
+
+	closed := make(closeSignaler, 1)
+	f, err := NewFactory(conf, nopRouter{}, closed, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess, err := f.NewClient("10", 1, codec.JSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sess.OnConnect(); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the engine registered the session", func() bool { return first.online(10) })
+
+	first.stop()
+	select {
+	case code := <-closed:
+		if code != 1013 {
+			t.Fatalf("the WebSocket was closed with %d, want 1013", code)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the session kept redialing past its window")
+	}
+}
+
+// TestRingRouting spreads sessions over three engines on loopback ports.
+// Each user is registered on the engine the ring names, an engine that
+// goes away hands its users to the others and gets them back when it
+// returns. Users of the other engines stay where they are.
+func TestRingRouting(t *testing.T) {
+	log.SetLevel("disabled")
+	conf := &config.Config{}
+	engines := make(map[string]*engine)
+	for range 3 {
+		transport, err := ParseTransport("tcp://127.0.0.1:0", config.EngineAuth{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		e := startEngineAt(t, conf, transport)
+		engines[e.url] = e
+		conf.EngineURLs = append(conf.EngineURLs, e.url)
+	}
+
+	// The engines listen on plain tcp, the gateway signs its connects.
+	f, err := NewFactory(conf, nopRouter{}, make(closeSignaler, 64), testAssertions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	users := []uint32{10, 20, 30, 40, 50, 60, 70, 80, 90}
+	owners := make(map[uint32]string)
+	for i, u := range users {
+		sess, err := f.NewClient(fmt.Sprint(u), uint32(i+1), codec.JSON)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := sess.OnConnect(); err != nil {
+			t.Fatal(err)
+		}
+		owners[u] = f.OwnerOfUser(u)
+	}
+	// The stopped engine keeps its registry, it isn't asked.
+	var down string
+	placed := func(u uint32, url string) func() bool {
+		return func() bool {
+			for other, e := range engines {
+				if other != down && e.online(u) != (other == url) {
+					return false
+				}
+			}
+			return true
+		}
+	}
+	for _, u := range users {
+		waitFor(t, fmt.Sprintf("userID %d is on its engine only", u), placed(u, owners[u]))
+	}
+
+	// Take down the engine with the most users.
+	counts := make(map[string]int)
+	for _, url := range owners {
+		counts[url]++
+	}
+	for url, n := range counts {
+		if down == "" || n > counts[down] {
+			down = url
+		}
+	}
+	engines[down].stop()
+	f.checkEngines()
+	for _, e := range f.Ring().Engines {
+		if e.Up == (e.URL == down) {
+			t.Fatalf("ring state %+v after %s went down", f.Ring(), down)
+		}
+	}
+	for _, u := range users {
+		owner := f.OwnerOfUser(u)
+		if owners[u] != down && owner != owners[u] {
+			t.Fatalf("userID %d moved from %s to %s", u, owners[u], owner)
+		}
+		if owner == down {
+			t.Fatalf("userID %d is still routed to the engine that went down", u)
+		}
+		waitFor(t, fmt.Sprintf("userID %d moved off the stopped engine", u), placed(u, owner))
+	}
+
+	transport, err := ParseTransport(down, config.EngineAuth{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	engines[down] = startEngineAt(t, conf, transport)
+	f.checkEngines()
+	down = ""
+	for _, u := range users {
+		waitFor(t, fmt.Sprintf("userID %d is back on its engine", u), placed(u, owners[u]))
+	}
+	sessions := 0
+	for _, e := range f.Ring().Engines {
+		sessions += e.Sessions
+	}
+	if sessions != len(users) {
+		t.Fatalf("the ring counts %d sessions, want %d", sessions, len(users))
+	}
+}
+
+// TestNotifier sends membership changes to an engine in another process,
+// across an engine restart.
+func TestNotifier(t *testing.T) {
+	log.SetLevel("disabled")
+	conf := engineConfig(t)
+	first := startEngine(t, conf)
+
+	f, err := NewFactory(conf, nopRouter{}, make(closeSignaler, 1), testAssertions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := NewNotifier(f)
+	if err := n.AddToRoom(10, 7, privateChat); err != nil {
+		t.Fatal(err)
+	}
+	if convType, ok := first.registry.member(10, 7); !ok || convType != privateChat {
+		t.Fatalf("userID 10 in conversation 7: %v, type %q", ok, convType)
+	}
+	if err := n.RemoveFromRoom(10, 7); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := first.registry.member(10, 7); ok {
+		t.Fatal("userID 10 is still in conversation 7")
+	}
+
+	first.stop()
+	second := startEngine(t, conf)
+	if err := n.AddToRoom(20, 7, privateChat); err != nil {
+		t.Fatalf("the notifier didn't redial the restarted engine: %v", err)
+	}
+	if _, ok := second.registry.member(20, 7); !ok {
+		t.Fatal("userID 20 isn't in conversation 7")
+	}
+}
@@ -0,0 +1,203 @@
+package tcp
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/iLeoon/realtime-gateway/internal/config"
+	"github.com/iLeoon/realtime-gateway/internal/errors"
+	"github.com/iLeoon/realtime-gateway/internal/protocol"
+	"github.com/iLeoon/realtime-gateway/pkg/log"
+)
+
+const clusterPath errors.PathName = "tcp/cluster"
+
+// engineNode is one of the engines a gateway spreads its sessions over.
+type engineNode struct {
+	transport Transport
+	up        bool // guarded by the factory's mu
+}
+
+// RingState is what the admin endpoint shows of the engines a gateway
+// routes to.
+type RingState struct {
+	VirtualNodes int           `json:"virtualNodes"`
+	Engines      []EngineState `json:"engines"`
+}
+
+// EngineState is one engine of RingState. Share is the fraction of users
+// that hash to it, Sessions the sessions of this gateway connected to it.
+type EngineState struct {
+	URL      string  `json:"url"`
+	Up       bool    `json:"up"`
+	Share    float64 `json:"share"`
+	Sessions int     `json:"sessions"`
+}
+
+// EngineTransports returns the transports of ENGINE_URLS, or the single
+// one of EngineTransport when it's empty.
+func EngineTransports(c *config.Config) ([]Transport, error) {
+	const op errors.Op = "tcp.EngineTransports"
+	if len(c.EngineURLs) == 0 {
+		transport, err := EngineTransport(c)
+		if err != nil {
+			return nil, errors.B(clusterPath, op, err)
+		}
+		return []Transport{transport}, nil
+	}
+	transports := make([]Transport, 0, len(c.EngineURLs))
+	for _, rawURL := range c.EngineURLs {
+		transport, err := ParseTransport(rawURL, c.EngineAuth)
+		if err != nil {
+			return nil, errors.B(clusterPath, op, err)
+		}
+		if slices.ContainsFunc(transports, func(t Transport) bool { return t.String() == rawURL }) {
+			return nil, errors.B(clusterPath, op, errors.Internal, fmt.Errorf("%q is listed twice", rawURL))
+		}
+		transports = append(transports, transport)
+	}
+	return transports, nil
+}
+
+// route returns the engine key belongs to among the ones that are up.
+func (t *tcpClientFactory) route(key string) (Transport, error) {
+	const op errors.Op = "tcpClientFactory.route"
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	url, ok := t.ring.owner(key)
+	if !ok {
+		return nil, errors.B(clusterPath, op, errors.Internal, "no engine is up")
+	}
+	return t.engines[url].transport, nil
+}
+
+// dialUser connects to the engine that owns userID.
+func (t *tcpClientFactory) dialUser(userID string) (string, net.Conn, protocol.Negotiated, error) {
+	transport, err := t.route(userKey(userID))
+	if err != nil {
+		return "", nil, protocol.Legacy, err
+	}
+	conn, proto, err := t.dial(transport)
+	return transport.String(), conn, proto, err
+}
+
+// OwnerOfUser returns the URL of the engine userID's sessions go to.
+func (t *tcpClientFactory) OwnerOfUser(userID uint32) string {
+	return t.owner(userKey(strconv.FormatUint(uint64(userID), 10)))
+}
+
+// OwnerOfConversation returns the URL of the engine conversationID hashes
+// to.
+func (t *tcpClientFactory) OwnerOfConversation(conversationID uint32) string {
+	return t.owner(conversationKey(conversationID))
+}
+
+func (t *tcpClientFactory) owner(key string) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	url, _ := t.ring.owner(key)
+	return url
+}
+
+// Ring returns the engines, whether they're up and how users and sessions
+// are spread over them.
+func (t *tcpClientFactory) Ring() RingState {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	shares := t.ring.shares()
+	sessions := make(map[string]int)
+	for s := range t.sessions {
+		sessions[s.engineURL()]++
+	}
+	state := RingState{VirtualNodes: ringVirtualNodes}
+	for _, url := range t.order {
+		state.Engines = append(state.Engines, EngineState{
+			URL:      url,
+			Up:       t.engines[url].up,
+			Share:    shares[url],
+			Sessions: sessions[url],
+		})
+	}
+	return state
+}
+
+// watchEngines checks the engines every engineCheckInterval. Only a
+// gateway with more than one engine runs it, a single engine owns every
+// user whether it's up or not.
+func (t *tcpClientFactory) watchEngines() {
+	ticker := time.NewTicker(engineCheckInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		t.checkEngines()
+	}
+}
+
+// checkEngines dials every engine, rebuilds the ring from the ones that
+// answered and moves the sessions whose owner changed. Sessions are
+// checked on every round, also catching one that redialed while the ring
+// was changing.
+func (t *tcpClientFactory) checkEngines() {
+	up := make(map[string]bool, len(t.order))
+	for _, url := range t.order {
+		ctx, cancel := context.WithTimeout(context.Background(), engineCheckTimeout)
+		conn, err := t.engines[url].transport.Dial(ctx)
+		cancel()
+		if err == nil {
+			conn.Close()
+		}
+		up[url] = err == nil
+	}
+
+	t.mu.Lock()
+	changed := false
+	for url, node := range t.engines {
+		if node.up != up[url] {
+			node.up, changed = up[url], true
+			log.Info.Println("engine availability changed", "engine", url, "up", node.up)
+		}
+	}
+	if changed {
+		t.ring = t.buildRing()
+	}
+	sessions := make([]*tcpClient, 0, len(t.sessions))
+	for s := range t.sessions {
+		sessions = append(sessions, s)
+	}
+	r := t.ring
+	t.mu.Unlock()
+
+	for _, s := range sessions {
+		if owner, ok := r.owner(userKey(s.userID)); ok {
+			s.moveTo(owner)
+		}
+	}
+}
+
+// buildRing returns the ring of the engines that are up, the caller holds
+// mu.
+func (t *tcpClientFactory) buildRing() *ring {
+	var up []string
+	for _, url := range t.order {
+		if t.engines[url].up {
+			up = append(up, url)
+		}
+	}
+	return newRing(up)
+}
+
+// track adds s to the sessions that move when the ring changes.
+func (t *tcpClientFactory) track(s *tcpClient) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.sessions[s] = struct{}{}
+}
+
+func (t *tcpClientFactory) forget(s *tcpClient) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.sessions, s)
+}
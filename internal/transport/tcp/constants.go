@@ -7,4 +7,55 @@ const (
 	readDuration  = 60 * time.Second
 	pingTime      = 20 * time.Second
 	pongWait      = 60 * time.Second
+	legacyRetry   = time.Minute
+
+	// A gateway session redials a lost engine for reconnectWindow, waiting
+	// from reconnectMinBackoff up to reconnectMaxBackoff between attempts.
+	// It holds up to reconnectBuffer browser actions meanwhile. The window
+	// and buffer apply when the config doesn't say.
+	reconnectWindow     = 30 * time.Second
+	reconnectMinBackoff = 100 * time.Millisecond
+	reconnectMaxBackoff = 5 * time.Second
+	reconnectBuffer     = 32
+
+	// Per connection buffers on the engine, both hold a full frame.
+	readBufferSize  = 4096
+	writeBufferSize = 4096
+
+	// Frames queued per connection when the config doesn't say.
+	defaultOutboundQueue = 256
+
+	// Shards of the connection and room registry.
+	registryShards = 64
+
+	// How often the TLS transport looks for renewed credentials.
+	certCheckInterval = 10 * time.Second
+
+	// Memberships of users connecting within memberBatchWindow are
+	// fetched in one query, up to memberFetches queries run at once.
+	defaultMemberBatch = 200
+	memberBatchWindow  = 5 * time.Millisecond
+	memberFetches      = 4
+	memberFetchTimeout = 10 * time.Second
+
+	// Memberships prefetched on a warm start are used for warmTTL, users
+	// returning later are fetched again.
+	warmTTL = 2 * time.Minute
+
+	// Points each engine gets on the consistent-hash ring.
+	ringVirtualNodes = 160
+
+	// With several engines the gateway dials each of them every
+	// engineCheckInterval, one that doesn't answer within
+	// engineCheckTimeout is taken off the ring.
+	engineCheckInterval = 2 * time.Second
+	engineCheckTimeout  = time.Second
+
+	// Author profiles sent along messages are looked up again after
+	// authorTTL, a renamed user shows up under the new name by then.
+	authorTTL = 5 * time.Minute
+
+	// Fan-outs queued per peer engine, later ones are dropped while the
+	// peer can't keep up or is being redialed.
+	relayQueue = 1024
 )
@@ -0,0 +1,62 @@
+package tcp
+
+import "sync"
+
+// maxPending bounds the requests awaiting an ack on one connection. Past
+// it new requests are sent uncorrelated, they still work but their
+// failures aren't reported back to the browser.
+const maxPending = 256
+
+// request is a browser action waiting for the engine's answer.
+type request struct {
+	id     string // ID the browser tagged the action with.
+	action string // JSON type of the action, e.g. "send_message".
+}
+
+// correlations maps the correlation IDs sent to the engine back to the
+// browser requests they were created for.
+type correlations struct {
+	mu      sync.Mutex
+	next    uint32
+	pending map[uint32]request
+}
+
+// track registers the request and returns the correlation ID to send, 0
+// when it can't be tracked.
+func (c *correlations) track(requestID, action string) uint32 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if requestID == "" || len(c.pending) >= maxPending {
+		return 0
+	}
+	if c.pending == nil {
+		c.pending = make(map[uint32]request)
+	}
+	c.next++
+	if c.next == 0 {
+		c.next++
+	}
+	c.pending[c.next] = request{id: requestID, action: action}
+	return c.next
+}
+
+// resolve returns the request a correlation ID was created for and forgets it.
+func (c *correlations) resolve(id uint32) (request, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	req, ok := c.pending[id]
+	delete(c.pending, id)
+	return req, ok
+}
+
+// drain forgets every pending request and returns them.
+func (c *correlations) drain() []request {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	reqs := make([]request, 0, len(c.pending))
+	for id, req := range c.pending {
+		reqs = append(reqs, req)
+		delete(c.pending, id)
+	}
+	return reqs
+}
@@ -0,0 +1,100 @@
+package tcp
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/iLeoon/realtime-gateway/internal/config"
+	"github.com/iLeoon/realtime-gateway/internal/errors"
+	"github.com/iLeoon/realtime-gateway/internal/protocol/packets"
+	"github.com/iLeoon/realtime-gateway/internal/ratelimit"
+)
+
+const (
+	privateChat = "private-chat"
+	groupChat   = "group-chat"
+)
+
+// conversationLimits holds the per-conversation buckets for one
+// conversation type.
+type conversationLimits struct {
+	messages *ratelimit.TokenBucket[uint32]
+	typing   *ratelimit.TokenBucket[uint32]
+}
+
+// limiter enforces the engine budgets. User buckets are keyed by userID so
+// every tab of the same user shares a single budget, conversation buckets
+// protect a room from being flooded by all of its members together.
+type limiter struct {
+	userMessages  *ratelimit.TokenBucket[uint32]
+	userTyping    *ratelimit.TokenBucket[uint32]
+	conversations map[string]conversationLimits // conversation type → buckets
+}
+
+// rateLimitError carries the packet the dispatcher sends back to the
+// gateway in place of the generic error packet.
+type rateLimitError struct {
+	pkt *packets.RateLimitedPacket
+}
+
+func (e *rateLimitError) Error() string {
+	return fmt.Sprintf("rate limited: conversationID %d, retry after %v", e.pkt.ConversationID, e.pkt.RetryAfter)
+}
+
+func newLimiter(c config.EngineLimits) *limiter {
+	return &limiter{
+		userMessages: ratelimit.NewTokenBucket[uint32](c.UserMessageRate, c.UserMessageBurst),
+		userTyping:   ratelimit.NewTokenBucket[uint32](c.UserTypingRate, c.UserTypingBurst),
+		conversations: map[string]conversationLimits{
+			privateChat: {
+				messages: ratelimit.NewTokenBucket[uint32](c.PrivateMessageRate, c.PrivateMessageBurst),
+				typing:   ratelimit.NewTokenBucket[uint32](c.PrivateTypingRate, c.PrivateTypingBurst),
+			},
+			groupChat: {
+				messages: ratelimit.NewTokenBucket[uint32](c.GroupMessageRate, c.GroupMessageBurst),
+				typing:   ratelimit.NewTokenBucket[uint32](c.GroupTypingRate, c.GroupTypingBurst),
+			},
+		},
+	}
+}
+
+// allow charges one token from the user bucket and one from the
+// conversation bucket of the given action. Typing has buckets of its own,
+// sending, editing and deleting messages share the message buckets.
+// Conversations of an unknown type use the group budget.
+func (l *limiter) allow(action uint8, userID, conversationID uint32, convType string) error {
+	const op errors.Op = "limiter.allow"
+	if l == nil {
+		return nil
+	}
+
+	conv, ok := l.conversations[convType]
+	if !ok {
+		conv = l.conversations[groupChat]
+	}
+
+	userBucket, convBucket := l.userMessages, conv.messages
+	if action == packets.Typing {
+		userBucket, convBucket = l.userTyping, conv.typing
+	}
+
+	now := time.Now()
+	if ok, wait := userBucket.Allow(userID, now); !ok {
+		return errors.B(path, op, errors.RateLimited, &rateLimitError{&packets.RateLimitedPacket{
+			ConversationID: conversationID,
+			Action:         action,
+			Scope:          packets.LimitScopeUser,
+			RetryAfter:     wait,
+		}})
+	}
+	if ok, wait := convBucket.Allow(conversationID, now); !ok {
+		userBucket.Refund(userID)
+		return errors.B(path, op, errors.RateLimited, &rateLimitError{&packets.RateLimitedPacket{
+			ConversationID: conversationID,
+			Action:         action,
+			Scope:          packets.LimitScopeConversation,
+			RetryAfter:     wait,
+		}})
+	}
+	return nil
+}
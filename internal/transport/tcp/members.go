@@ -0,0 +1,122 @@
+package tcp
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/iLeoon/realtime-gateway/internal/errors"
+)
+
+// memberLoader fetches the memberships of connecting users. Users asked
+// for within memberBatchWindow share one query of up to batch users, and
+// a user that is already being fetched joins that query instead of
+// starting another. At most memberFetches queries run at once, so a
+// restarted engine doesn't meet every reconnecting gateway with a query
+// of its own. The zero value is ready to use.
+type memberLoader struct {
+	mu      sync.Mutex
+	calls   map[uint32]*memberCall // pending and in flight, by user
+	pending []uint32
+	timer   *time.Timer
+	slots   chan struct{}
+}
+
+// memberCall is one user's share of a batch query.
+type memberCall struct {
+	done chan struct{}
+	rows []MemberShip
+	err  error
+}
+
+// load returns the memberships of userID.
+func (l *memberLoader) load(ctx context.Context, db DBConnection, batch int, userID uint32) ([]MemberShip, error) {
+	rows, err := l.loadAll(ctx, db, batch, []uint32{userID})
+	return rows[userID], err
+}
+
+// loadAll returns the memberships of userIDs. It fails with the first
+// batch that did.
+func (l *memberLoader) loadAll(ctx context.Context, db DBConnection, batch int, userIDs []uint32) (map[uint32][]MemberShip, error) {
+	const op errors.Op = "memberLoader.loadAll"
+	calls := make([]*memberCall, len(userIDs))
+	l.mu.Lock()
+	for i, id := range userIDs {
+		calls[i] = l.enqueue(db, batch, id)
+	}
+	l.mu.Unlock()
+
+	rows := make(map[uint32][]MemberShip, len(userIDs))
+	for i, c := range calls {
+		select {
+		case <-c.done:
+		case <-ctx.Done():
+			return rows, errors.B(path, op, errors.Internal, ctx.Err())
+		}
+		if c.err != nil {
+			return rows, errors.B(path, op, c.err)
+		}
+		rows[userIDs[i]] = c.rows
+	}
+	return rows, nil
+}
+
+// enqueue returns the call userID's memberships arrive with, the caller
+// holds mu.
+func (l *memberLoader) enqueue(db DBConnection, batch int, userID uint32) *memberCall {
+	if l.calls == nil {
+		l.calls = make(map[uint32]*memberCall)
+		l.slots = make(chan struct{}, memberFetches)
+	}
+	if c, ok := l.calls[userID]; ok {
+		return c
+	}
+	c := &memberCall{done: make(chan struct{})}
+	l.calls[userID] = c
+	l.pending = append(l.pending, userID)
+	if batch <= 0 {
+		batch = defaultMemberBatch
+	}
+	switch {
+	case len(l.pending) >= batch:
+		l.flush(db)
+	case len(l.pending) == 1:
+		l.timer = time.AfterFunc(memberBatchWindow, func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			l.flush(db)
+		})
+	}
+	return c
+}
+
+// flush starts the query of the pending users, the caller holds mu.
+func (l *memberLoader) flush(db DBConnection) {
+	if len(l.pending) == 0 {
+		return
+	}
+	if l.timer != nil {
+		l.timer.Stop()
+		l.timer = nil
+	}
+	userIDs := l.pending
+	l.pending = nil
+	go l.fetch(db, userIDs)
+}
+
+func (l *memberLoader) fetch(db DBConnection, userIDs []uint32) {
+	l.slots <- struct{}{}
+	ctx, cancel := context.WithTimeout(context.Background(), memberFetchTimeout)
+	rows, err := db.FetchMembers(userIDs, ctx)
+	cancel()
+	<-l.slots
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, id := range userIDs {
+		c := l.calls[id]
+		delete(l.calls, id)
+		c.rows, c.err = rows[id], err
+		close(c.done)
+	}
+}
@@ -0,0 +1,156 @@
+package tcp
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/iLeoon/realtime-gateway/internal/errors"
+	"github.com/iLeoon/realtime-gateway/internal/protocol/packets"
+	"github.com/iLeoon/realtime-gateway/pkg/log"
+)
+
+// membershipChannel is the channel internal/db/sql/membership_notify.sql
+// notifies on.
+const membershipChannel = "membership"
+
+// MembershipChange is a row of users_conversations that was inserted or
+// deleted, an update arrives as both.
+type MembershipChange struct {
+	UserID           uint32 `json:"user"`
+	ConversationID   uint32 `json:"conversation"`
+	Joined           bool   `json:"joined"`
+	ConversationType string `json:"type"`
+}
+
+// ListenMemberships listens on membershipChannel with a connection of its
+// own. The connection is closed rather than put back, it would otherwise
+// keep receiving notifications nobody reads.
+func (d *dbConn) ListenMemberships(ctx context.Context, apply func(MembershipChange)) error {
+	const op errors.Op = "dbConn.ListenMemberships"
+	pooled, err := d.db.Acquire(ctx)
+	if err != nil {
+		return errors.B(path, op, errors.Internal, err)
+	}
+	conn := pooled.Hijack()
+	defer conn.Close(context.Background())
+
+	if _, err := conn.Exec(ctx, "LISTEN "+membershipChannel); err != nil {
+		return errors.B(path, op, errors.Internal, err)
+	}
+	for {
+		n, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return errors.B(path, op, errors.Internal, err)
+		}
+		var change MembershipChange
+		if err := json.Unmarshal([]byte(n.Payload), &change); err != nil {
+			log.Error.Println("dropping a malformed membership notification", errors.B(path, op, errors.Internal, err), "payload", n.Payload)
+			continue
+		}
+		apply(change)
+	}
+}
+
+// watchMemberships applies the membership changes the database notifies
+// of until the engine shuts down. Notifications sent while the listening
+// connection was down are lost, every reconnect reconciles the online
+// users to catch up on them.
+func (s *server) watchMemberships() {
+	const op errors.Op = "server.watchMemberships"
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-s.done
+		cancel()
+	}()
+
+	backoff := reconnectMinBackoff
+	for first := true; ; first = false {
+		if !first {
+			s.reconcile(ctx)
+		}
+		started := time.Now()
+		err := s.db.ListenMemberships(ctx, s.applyMembership)
+		if ctx.Err() != nil {
+			return
+		}
+		log.Error.Println("lost the membership notifications, listening again", errors.B(path, op, err))
+		// A connection that held up for a while starts the backoff over.
+		if time.Since(started) > reconnectMaxBackoff {
+			backoff = reconnectMinBackoff
+		}
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+		backoff = min(backoff*2, reconnectMaxBackoff)
+	}
+}
+
+// applyMembership updates the rooms with change. Changes of users that
+// aren't online, in rooms nobody online is in, are of no concern to the
+// engine: the user's memberships are fetched when they connect.
+func (s *server) applyMembership(change MembershipChange) {
+	if !s.registry.tracks(change.UserID, change.ConversationID) {
+		return
+	}
+	if change.Joined {
+		s.AddToRoom(change.UserID, change.ConversationID, change.ConversationType)
+		return
+	}
+	s.RemoveFromRoom(change.UserID, change.ConversationID)
+}
+
+// reconcileEvery reconciles the online users every interval.
+func (s *server) reconcileEvery(interval time.Duration) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.reconcile(ctx)
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// reconcile fetches the memberships of every online user in batches and
+// replaces what the registry knows of them.
+func (s *server) reconcile(ctx context.Context) {
+	const op errors.Op = "server.reconcile"
+	batch := s.conf.EngineMemberBatch
+	if batch <= 0 {
+		batch = defaultMemberBatch
+	}
+	online := s.registry.online()
+	for start := 0; start < len(online); start += batch {
+		ids := online[start:min(start+batch, len(online))]
+		rows, err := s.members.loadAll(ctx, s.db, batch, ids)
+		if err != nil {
+			log.Error.Println("reconciling memberships failed", errors.B(path, op, err))
+			return
+		}
+		for _, id := range ids {
+			s.refresh(id, rows[id])
+		}
+	}
+}
+
+// refresh replaces the rooms of an online user with memberships and tells
+// their connections about the conversations they weren't in.
+func (s *server) refresh(userID uint32, memberships []MemberShip) {
+	added, conns := s.registry.refresh(userID, memberships)
+	for _, convID := range added {
+		pkt := &packets.AddedToConversationPacket{ConversationID: convID}
+		for _, conn := range conns {
+			if err := s.writePacket(pkt, conn); err != nil {
+				log.Error.Printf("failed to notify userID %d of new conversation %d: %v", userID, convID, err)
+			}
+		}
+	}
+}
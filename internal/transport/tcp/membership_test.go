@@ -0,0 +1,62 @@
+package tcp
+
+import (
+	"context"
+	"testing"
+
+	"github.com/iLeoon/realtime-gateway/internal/protocol/packets"
+	"github.com/iLeoon/realtime-gateway/pkg/log"
+)
+
+// TestMembershipChanges applies notified membership changes to an engine
+// with userID 30 online, then reconciles it with a database that missed
+// some of them.
+func TestMembershipChanges(t *testing.T) {
+	log.SetLevel("disabled")
+	ctx := context.Background()
+	s := New()
+	db := newReplayDB(fixtureSetup)
+	s.db = db
+	out := &memConn{}
+	if err := s.register(&packets.ConnectPacket{ConnectionID: 30, UserID: 30}, out, ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// Notified twice, e.g. by the trigger and the gateway, told once.
+	s.applyMembership(MembershipChange{UserID: 30, ConversationID: 2, Joined: true})
+	s.applyMembership(MembershipChange{UserID: 30, ConversationID: 2, Joined: true})
+	if _, ok := s.registry.member(30, 2); !ok {
+		t.Fatal("userID 30 didn't join conversation 2")
+	}
+	if got := countFrames(t, out, packets.AddedToConversation); got != 1 {
+		t.Fatalf("%d added to conversation packets, want 1", got)
+	}
+
+	// Nobody online is in conversation 5.
+	s.applyMembership(MembershipChange{UserID: 40, ConversationID: 5, Joined: true})
+	if _, ok := s.registry.member(40, 5); ok {
+		t.Fatal("conversation 5 was tracked")
+	}
+	// Conversation 1 is, an offline member is still fanned out to.
+	s.applyMembership(MembershipChange{UserID: 40, ConversationID: 1, Joined: true})
+	if _, ok := s.registry.member(40, 1); !ok {
+		t.Fatal("userID 40 didn't join conversation 1")
+	}
+
+	s.applyMembership(MembershipChange{UserID: 30, ConversationID: 1, Joined: false})
+	if _, ok := s.registry.member(30, 1); ok {
+		t.Fatal("userID 30 is still in conversation 1")
+	}
+
+	// The database has userID 30 in conversations 1 and 3 only.
+	db.members = append(db.members, MemberShip{3, 30, groupChat}, MemberShip{3, 10, groupChat})
+	s.reconcile(ctx)
+	for conv, want := range map[uint32]bool{1: true, 2: false, 3: true} {
+		if _, ok := s.registry.member(30, conv); ok != want {
+			t.Errorf("userID 30 in conversation %d = %v, want %v", conv, ok, want)
+		}
+	}
+	if got := countFrames(t, out, packets.AddedToConversation); got != 3 {
+		t.Fatalf("%d added to conversation packets, want 3", got)
+	}
+}
@@ -0,0 +1,161 @@
+package tcp
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/iLeoon/realtime-gateway/internal/errors"
+	"github.com/iLeoon/realtime-gateway/internal/protocol"
+	"github.com/iLeoon/realtime-gateway/internal/protocol/packets"
+)
+
+const notifierPath errors.PathName = "tcp/notifier"
+
+// engineNotifier hands the REST API's membership changes to an engine
+// running in another process, it stands in for the server's own
+// AddToRoom and RemoveFromRoom. A change goes to the engine that owns the
+// user. The notifier keeps one connection per engine, authenticated with
+// a gateway assertion unless its client certificate speaks for it, and
+// sends one MembershipPacket at a time, waiting for the engine's answer.
+type engineNotifier struct {
+	factory *tcpClientFactory
+
+	mu    sync.Mutex
+	links map[string]*notifierLink // by engine URL
+}
+
+// notifierLink is the notifier's connection to one engine.
+type notifierLink struct {
+	conn   net.Conn
+	dec    *protocol.Decoder
+	proto  protocol.Negotiated
+	nextID uint32
+}
+
+// NewNotifier returns a notifier that reaches the engines the way the
+// factory's sessions do.
+func NewNotifier(f *tcpClientFactory) *engineNotifier {
+	return &engineNotifier{factory: f, links: make(map[string]*notifierLink)}
+}
+
+// AddToRoom tells the engine that userID joined conversationID.
+func (n *engineNotifier) AddToRoom(userID, conversationID uint32, conversationType string) error {
+	return n.send(&packets.MembershipPacket{UserID: userID, ConversationID: conversationID, Joined: true, ConversationType: conversationType})
+}
+
+// RemoveFromRoom tells the engine that userID left conversationID.
+func (n *engineNotifier) RemoveFromRoom(userID, conversationID uint32) error {
+	return n.send(&packets.MembershipPacket{UserID: userID, ConversationID: conversationID})
+}
+
+// send delivers pkt to the engine of its user. The engine closes idle
+// connections, a connection that turns out to be gone is dialed again
+// once.
+func (n *engineNotifier) send(pkt *packets.MembershipPacket) error {
+	const op errors.Op = "engineNotifier.send"
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	transport, err := n.factory.route(userKey(strconv.FormatUint(uint64(pkt.UserID), 10)))
+	if err != nil {
+		return errors.B(notifierPath, op, err)
+	}
+	engine := transport.String()
+	for attempt := 0; ; attempt++ {
+		link, reused := n.links[engine]
+		if !reused {
+			if link, err = n.connect(transport); err != nil {
+				return errors.B(notifierPath, op, err)
+			}
+			n.links[engine] = link
+		}
+		retry, err := link.roundTrip(pkt)
+		if err == nil {
+			return nil
+		}
+		if !retry {
+			return errors.B(notifierPath, op, err)
+		}
+		link.conn.Close()
+		delete(n.links, engine)
+		if !reused || attempt > 0 {
+			return errors.B(notifierPath, op, err)
+		}
+	}
+}
+
+func (n *engineNotifier) connect(transport Transport) (*notifierLink, error) {
+	const op errors.Op = "engineNotifier.connect"
+	conn, proto, err := n.factory.dial(transport)
+	if err != nil {
+		return nil, errors.B(notifierPath, op, err)
+	}
+	if !proto.Has(packets.FeatureMembership) {
+		conn.Close()
+		return nil, errors.B(notifierPath, op, errors.Internal, "the engine doesn't accept membership packets, it's older than the gateway")
+	}
+	link := &notifierLink{conn: conn, proto: proto, dec: protocol.NewDecoder(conn)}
+	// A client certificate already proves who we are, older engines
+	// accept membership packets from anyone.
+	if !proto.Has(packets.FeatureGatewayAuth) || verifiedPeer(conn) {
+		return link, nil
+	}
+	if n.factory.assertions == nil {
+		conn.Close()
+		return nil, errors.B(notifierPath, op, errors.Internal, errors.Unauthenticated, "the engine wants a gateway assertion, there's no key to sign one")
+	}
+	token, err := n.factory.assertions.GenerateEngineToken(gatewaySubject)
+	if err != nil {
+		conn.Close()
+		return nil, errors.B(notifierPath, op, err)
+	}
+	if _, err := link.roundTrip(&packets.GatewayAuthPacket{Token: token}); err != nil {
+		conn.Close()
+		return nil, errors.B(notifierPath, op, err)
+	}
+	return link, nil
+}
+
+// roundTrip writes pkt and reads until the engine answers it. retry is
+// true when the connection failed rather than the engine refusing.
+func (n *notifierLink) roundTrip(pkt packets.BuildPayload) (retry bool, err error) {
+	const op errors.Op = "engineNotifier.roundTrip"
+	n.nextID++
+	if n.nextID == 0 {
+		n.nextID++
+	}
+	id := n.nextID
+
+	if err := n.conn.SetDeadline(time.Now().Add(writeDuration)); err != nil {
+		return true, errors.B(notifierPath, op, err)
+	}
+	if err := protocol.ConstructFrame(pkt).ForVersion(n.proto.Version).WithCorrelation(id).EncodeFrame(n.conn); err != nil {
+		return true, errors.B(notifierPath, op, err)
+	}
+	for {
+		frame, err := n.dec.Decode(n.proto.Version)
+		if err != nil {
+			return true, errors.B(notifierPath, op, err)
+		}
+		if frame.CorrelationID != id {
+			// Pings that arrived while the connection sat idle.
+			if _, ok := frame.Payload.(*packets.PingPacket); ok {
+				err := protocol.ConstructFrame(&packets.PongPacket{}).ForVersion(n.proto.Version).EncodeFrame(n.conn)
+				if err != nil {
+					return true, errors.B(notifierPath, op, err)
+				}
+			}
+			continue
+		}
+		switch p := frame.Payload.(type) {
+		case *packets.AckPacket:
+			return false, nil
+		case *packets.ErrorPacket:
+			return false, errors.B(notifierPath, op, p.Code, p.Reason, p.Message)
+		default:
+			return false, errors.B(notifierPath, op, errors.Internal, errors.Errorf("unexpected answer %s", p))
+		}
+	}
+}
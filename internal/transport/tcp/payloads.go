@@ -9,17 +9,23 @@ import "encoding/json"
 //
 // The `payload` field is intentionally typed as json.RawMessage to allow
 // flexible decoding into different data structures depending on the opcode.
+// Clients that negotiated MessagePack send the same structure, the codec
+// hands the payload over as JSON.
 //
 // Typical client message format:
 //
 //	{
 //	  "type": "send_message",
+//	  "id": "c1f4",
 //	  "payload": {
 //	    "content": "Hi"
 //	  }
 //	}
+//
+// The optional `id` is echoed in the ack or error the action produces.
 type ClientPayload struct {
 	Opcode  string          `json:"type"`
+	ID      string          `json:"id,omitempty"`
 	Payload json.RawMessage `json:"payload"`
 }
 
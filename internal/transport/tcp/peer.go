@@ -0,0 +1,216 @@
+package tcp
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/iLeoon/realtime-gateway/internal/errors"
+	"github.com/iLeoon/realtime-gateway/internal/protocol"
+	"github.com/iLeoon/realtime-gateway/internal/protocol/capture"
+	"github.com/iLeoon/realtime-gateway/internal/protocol/packets"
+)
+
+// peerConn is a gateway connection along with the protocol version and
+// features it negotiated. Every writer goes through writePacket, which
+// reads them to pick the frame layout.
+//
+// Writers don't touch the socket, they queue encoded frames and a writer
+// goroutine per connection drains the queue into a buffered writer. A
+// stalled gateway only backs up its own queue, the handler fanning out to
+// it moves on. What happens once the queue is full is up to overflow.
+type peerConn struct {
+	net.Conn
+	proto    atomic.Pointer[protocol.Negotiated]
+	wmu      sync.Mutex // the writer goroutine and the handshake
+	w        *bufio.Writer
+	queue    chan outbound
+	overflow string
+	dropped  atomic.Uint64
+	quit     chan struct{}
+	qmu      sync.RWMutex // held by send while queueing, stop waits for it
+	stopped  chan struct{}
+	stopOnce sync.Once
+	gateway  atomic.Bool // authenticated with a GatewayAuthPacket
+	// sessions are the connections registered over this link, connectionID
+	// to userID. Only the read loop touches them.
+	sessions map[uint32]uint32
+}
+
+// outbound is a frame waiting in a connection's queue.
+type outbound struct {
+	b  []byte
+	pf *protocol.PreparedFrame // released once b is written, nil if b is owned
+}
+
+// Overflow policies, see config.TCP.OutboundOverflow.
+const (
+	overflowDisconnect = "disconnect"
+	overflowDrop       = "drop"
+)
+
+// newPeerConn wraps conn and starts its writer goroutine, stop ends it.
+func newPeerConn(conn net.Conn, queue int, overflow string) *peerConn {
+	if queue <= 0 {
+		queue = defaultOutboundQueue
+	}
+	if overflow != overflowDrop {
+		overflow = overflowDisconnect
+	}
+	pc := &peerConn{
+		Conn:     conn,
+		w:        bufio.NewWriterSize(conn, writeBufferSize),
+		queue:    make(chan outbound, queue),
+		overflow: overflow,
+		quit:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+		sessions: make(map[uint32]uint32),
+	}
+	pc.proto.Store(&protocol.Legacy)
+	go pc.writeLoop()
+	return pc
+}
+
+// send queues b, retaining pf until it's written. Typing indicators are
+// dropped once the queue is half full so they never crowd out messages, a
+// frame that doesn't fit at all is handled according to the overflow
+// policy. After stop frames are refused, pf isn't retained for them.
+func (pc *peerConn) send(b []byte, pf *protocol.PreparedFrame) error {
+	const op errors.Op = "peerConn.send"
+	// Whatever is queued under qmu is queued before stop closes quit, the
+	// writer drains and releases it.
+	pc.qmu.RLock()
+	defer pc.qmu.RUnlock()
+	select {
+	case <-pc.quit:
+		return errors.B(path, op, errors.Network, "connection is closed")
+	default:
+	}
+	if pf != nil && pf.Opcode() == packets.TypingResponse && len(pc.queue) >= cap(pc.queue)/2 {
+		pc.dropped.Add(1)
+		return nil
+	}
+	if pf != nil {
+		pf.Retain()
+	}
+	select {
+	case pc.queue <- outbound{b: b, pf: pf}:
+		return nil
+	default:
+	}
+	if pf != nil {
+		pf.Release()
+	}
+	pc.dropped.Add(1)
+	if pc.overflow == overflowDrop {
+		return errors.B(path, op, errors.Network, "outbound queue is full, frame dropped")
+	}
+	// Closing the socket fails the handler's read, it tears the
+	// connection down like any other network error.
+	pc.Conn.Close()
+	return errors.B(path, op, errors.Network, fmt.Errorf("outbound queue is full, closing the connection after %d dropped frames", pc.dropped.Load()))
+}
+
+// writeLoop writes queued frames, flushing once the queue is empty so a
+// burst goes out in as few writes as possible. After a write error it
+// closes the connection and discards the rest.
+func (pc *peerConn) writeLoop() {
+	defer close(pc.stopped)
+	var failed bool
+	write := func(f outbound) {
+		if !failed {
+			if err := pc.writeQueued(f.b); err != nil {
+				failed = true
+				pc.Conn.Close()
+			}
+		}
+		if f.pf != nil {
+			f.pf.Release()
+		}
+	}
+	for {
+		select {
+		case f := <-pc.queue:
+			write(f)
+		case <-pc.quit:
+			// Drain what the handler queued before stopping.
+			for {
+				select {
+				case f := <-pc.queue:
+					write(f)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (pc *peerConn) writeQueued(b []byte) error {
+	pc.wmu.Lock()
+	defer pc.wmu.Unlock()
+	if err := pc.SetWriteDeadline(time.Now().Add(writeDuration)); err != nil {
+		return err
+	}
+	if _, err := pc.w.Write(b); err != nil {
+		return err
+	}
+	if len(pc.queue) > 0 {
+		return nil
+	}
+	return pc.w.Flush()
+}
+
+// stop writes what's left in the queue and ends the writer goroutine.
+// Frames queued afterwards are refused.
+func (pc *peerConn) stop() {
+	pc.stopOnce.Do(func() {
+		pc.qmu.Lock()
+		close(pc.quit)
+		pc.qmu.Unlock()
+	})
+	<-pc.stopped
+}
+
+// negotiated returns what conn agreed on, Legacy for a connection that
+// never completed a handshake.
+func negotiated(conn net.Conn) protocol.Negotiated {
+	if pc, ok := conn.(*peerConn); ok {
+		return *pc.proto.Load()
+	}
+	return protocol.Legacy
+}
+
+// handshake answers the gateway's Hello. It's only valid as the first
+// packet on a connection.
+func (s *server) handshake(pkt *packets.HelloPacket, conn net.Conn, userID uint32) error {
+	const op errors.Op = "server.handshake"
+	pc, ok := conn.(*peerConn)
+	if !ok || userID != 0 || pc.proto.Load().Version != packets.Version1 {
+		return errors.B(path, op, errors.Client, "hello is only allowed as the first packet")
+	}
+
+	// The ack goes through the buffered writer like every other frame, and
+	// out before the version changes: the frames queued after it are
+	// encoded for the new one, and a recording conn reads it as Version1.
+	pc.wmu.Lock()
+	defer pc.wmu.Unlock()
+	if err := conn.SetWriteDeadline(time.Now().Add(writeDuration)); err != nil {
+		return errors.B(path, op, "connection is unhealthy", err, errors.Network)
+	}
+	n, err := protocol.AcceptHello(pc.w, pkt)
+	if err != nil {
+		return errors.B(path, op, err)
+	}
+	if err := pc.w.Flush(); err != nil {
+		return errors.B(path, op, errors.Network, err)
+	}
+	pc.proto.Store(&n)
+	if rec, ok := pc.Conn.(*capture.Conn); ok {
+		rec.SetVersion(n.Version)
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+package tcp
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/iLeoon/realtime-gateway/internal/protocol"
+	"github.com/iLeoon/realtime-gateway/internal/protocol/packets"
+	"github.com/iLeoon/realtime-gateway/pkg/log"
+)
+
+// stalledConn is a gateway that stopped reading, writes block until the
+// test lets them through or the connection is closed.
+type stalledConn struct {
+	memConn
+	release   chan struct{}
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newStalledConn() *stalledConn {
+	return &stalledConn{release: make(chan struct{}), closed: make(chan struct{})}
+}
+
+func (c *stalledConn) Write(b []byte) (int, error) {
+	select {
+	case <-c.release:
+		return c.memConn.Write(b)
+	case <-c.closed:
+		return 0, net.ErrClosed
+	}
+}
+
+func (c *stalledConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return nil
+}
+
+// connectAll registers one connection per user in the room of
+// fixtureSetup, conversation 1 holds users 10, 20 and 30.
+func connectAll(t *testing.T, s *server, conns map[uint32]*peerConn) {
+	t.Helper()
+	for userID, pc := range conns {
+		var id uint32
+		frame := &protocol.Frame{Payload: &packets.ConnectPacket{ConnectionID: userID, UserID: userID}}
+		if !s.packetsDispatcher(frame, pc, &id, context.Background()) {
+			t.Fatalf("connect of user %d failed", userID)
+		}
+	}
+}
+
+func countFrames(t *testing.T, c *memConn, opcode uint8) int {
+	t.Helper()
+	var n int
+	for _, f := range splitFrames(t, c.out.Bytes()) {
+		if f.Header.Opcode == opcode {
+			n++
+		}
+	}
+	return n
+}
+
+// TestSlowConnDoesNotDelayFanOut fans messages out to a room where one
+// gateway stopped reading. The handler never waits for it, the healthy
+// gateway gets every message and the stalled one is disconnected once its
+// queue overflows.
+func TestSlowConnDoesNotDelayFanOut(t *testing.T) {
+	log.SetLevel("disabled")
+	s := New()
+	s.db = newReplayDB(fixtureSetup)
+
+	// Only the stalled gateway has a queue smaller than the burst.
+	const queue, messages = 8, 24
+	fast, slow := &memConn{}, newStalledConn()
+	sender := newPeerConn(&memConn{}, 2*messages, overflowDisconnect)
+	conns := map[uint32]*peerConn{
+		10: newPeerConn(fast, 2*messages, overflowDisconnect),
+		20: newPeerConn(slow, queue, overflowDisconnect),
+		30: sender,
+	}
+	connectAll(t, s, conns)
+
+	start := time.Now()
+	userID := uint32(30)
+	for range messages {
+		frame := &protocol.Frame{Payload: &packets.SendMessagePacket{ConversationID: 1, Content: "hello"}}
+		s.packetsDispatcher(frame, sender, &userID, context.Background())
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("fan-out took %s with a stalled recipient", elapsed)
+	}
+
+	select {
+	case <-slow.closed:
+	case <-time.After(time.Second):
+		t.Fatal("the stalled connection wasn't closed after its queue overflowed")
+	}
+	for _, pc := range conns {
+		pc.stop()
+	}
+	if got := countFrames(t, fast, packets.ResponseMessage); got != messages {
+		t.Fatalf("healthy connection got %d messages, want %d", got, messages)
+	}
+}
+
+// TestTypingDroppedBeforeMessages backs up a queue with typing indicators
+// and expects them to give way to messages without a disconnect.
+func TestTypingDroppedBeforeMessages(t *testing.T) {
+	log.SetLevel("disabled")
+	s := New()
+	s.db = newReplayDB(fixtureSetup)
+
+	const queue = 8
+	slow := newStalledConn()
+	typist := newPeerConn(&memConn{}, 4*queue, overflowDisconnect)
+	stalled := newPeerConn(slow, queue, overflowDisconnect)
+	conns := map[uint32]*peerConn{
+		10: typist,
+		20: stalled,
+	}
+	connectAll(t, s, conns)
+
+	userID := uint32(10)
+	for range 2 * queue {
+		frame := &protocol.Frame{Payload: &packets.TypingPacket{ConversationID: 1, IsTyping: true}}
+		s.packetsDispatcher(frame, typist, &userID, context.Background())
+	}
+	for range queue / 2 {
+		frame := &protocol.Frame{Payload: &packets.SendMessagePacket{ConversationID: 1, Content: "hello"}}
+		s.packetsDispatcher(frame, typist, &userID, context.Background())
+	}
+
+	close(slow.release)
+	for _, pc := range conns {
+		pc.stop()
+	}
+	select {
+	case <-slow.closed:
+		t.Fatal("typing indicators disconnected the connection")
+	default:
+	}
+	if got := countFrames(t, &slow.memConn, packets.ResponseMessage); got != queue/2 {
+		t.Fatalf("got %d messages, want %d", got, queue/2)
+	}
+	typing := countFrames(t, &slow.memConn, packets.TypingResponse)
+	if typing == 0 || typing > queue/2+1 {
+		t.Fatalf("got %d typing indicators, want at most half the queue", typing)
+	}
+	if dropped := stalled.dropped.Load(); typing+int(dropped) != 2*queue {
+		t.Fatalf("%d typing indicators delivered and %d dropped, want %d in total", typing, dropped, 2*queue)
+	}
+}
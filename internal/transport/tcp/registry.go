@@ -0,0 +1,457 @@
+package tcp
+
+import (
+	"net"
+	"sync"
+)
+
+// registry is the engine's view of who is online and which rooms they
+// are in. It's split in shards by ID so connects, disconnects and
+// fan-outs in unrelated rooms don't wait on each other:
+//
+//   - conns:  connectionID   → userID owning it
+//   - users:  userID         → live connections and conversations
+//   - rooms:  conversationID → members and conversation type
+//
+// register and unregister lock a conn shard and then a user shard, so a
+// connectionID can't change hands while its user's entry is updated. No
+// method takes them the other way round, or holds a room shard along with
+// another lock, so shards can't deadlock each other. Rooms know all
+// members of a conversation, online or not, users only exist while they
+// have a connection.
+type registry struct {
+	conns []connShard
+	users []userShard
+	rooms []roomShard
+}
+
+type connShard struct {
+	mu sync.RWMutex
+	m  map[uint32]uint32
+}
+
+type userShard struct {
+	mu sync.RWMutex
+	m  map[uint32]*user
+}
+
+type roomShard struct {
+	mu sync.RWMutex
+	m  map[uint32]*room
+}
+
+// user is an online user.
+type user struct {
+	conns         []FanOut
+	conversations map[uint32]struct{}
+}
+
+// room is a conversation known to the engine.
+type room struct {
+	members  map[uint32]struct{}
+	convType string
+}
+
+func newRegistry(shards int) *registry {
+	if shards <= 0 {
+		shards = registryShards
+	}
+	r := &registry{
+		conns: make([]connShard, shards),
+		users: make([]userShard, shards),
+		rooms: make([]roomShard, shards),
+	}
+	for i := range shards {
+		r.conns[i].m = make(map[uint32]uint32)
+		r.users[i].m = make(map[uint32]*user)
+		r.rooms[i].m = make(map[uint32]*room)
+	}
+	return r
+}
+
+func (r *registry) connShard(connectionID uint32) *connShard {
+	return &r.conns[connectionID%uint32(len(r.conns))]
+}
+
+func (r *registry) userShard(userID uint32) *userShard {
+	return &r.users[userID%uint32(len(r.users))]
+}
+
+func (r *registry) roomShard(conversationID uint32) *roomShard {
+	return &r.rooms[conversationID%uint32(len(r.rooms))]
+}
+
+// register adds conn as connectionID of userID and the conversations
+// memberships describes. ok is false if another user holds connectionID.
+// announce lists the user's conversations when this is their first
+// connection, their presence goes out to those rooms.
+//
+// A connectionID the user already holds moves to conn: the gateway
+// redialed before the engine noticed its old link was gone.
+func (r *registry) register(connectionID, userID uint32, conn net.Conn, memberships []MemberShip) (announce []uint32, ok bool) {
+	cs := r.connShard(connectionID)
+	cs.mu.Lock()
+	if owner, taken := cs.m[connectionID]; taken {
+		defer cs.mu.Unlock()
+		if owner != userID {
+			return nil, false
+		}
+		us := r.userShard(userID)
+		us.mu.Lock()
+		defer us.mu.Unlock()
+		u, online := us.m[userID]
+		if !online {
+			return nil, false
+		}
+		for i := range u.conns {
+			if u.conns[i].connectionID == connectionID {
+				u.conns[i].rawConn = conn
+				return nil, true
+			}
+		}
+		return nil, false
+	}
+	cs.m[connectionID] = userID
+	cs.mu.Unlock()
+
+	us := r.userShard(userID)
+	us.mu.Lock()
+	u, online := us.m[userID]
+	if !online {
+		u = &user{conversations: make(map[uint32]struct{})}
+		us.m[userID] = u
+	}
+	u.conns = append(u.conns, FanOut{conn, connectionID, userID})
+	for _, m := range memberships {
+		u.conversations[m.conversationID] = struct{}{}
+	}
+	if len(u.conns) == 1 {
+		announce = make([]uint32, 0, len(u.conversations))
+		for convID := range u.conversations {
+			announce = append(announce, convID)
+		}
+	}
+	us.mu.Unlock()
+
+	for _, m := range memberships {
+		rs := r.roomShard(m.conversationID)
+		rs.mu.Lock()
+		rm, ok := rs.m[m.conversationID]
+		if !ok {
+			rm = &room{members: make(map[uint32]struct{})}
+			rs.m[m.conversationID] = rm
+		}
+		rm.members[m.memberID] = struct{}{}
+		if m.conversationType != "" {
+			rm.convType = m.conversationType
+		}
+		rs.mu.Unlock()
+	}
+	return announce, true
+}
+
+// unregister removes connectionID of userID, as long as it's still
+// served by conn: a connection that moved to a new link stays. A nil conn
+// removes it whatever link it's on. With the user's last connection they
+// leave their rooms, announce lists the conversations to tell they went
+// offline.
+func (r *registry) unregister(connectionID, userID uint32, conn net.Conn) (announce []uint32) {
+	cs := r.connShard(connectionID)
+	cs.mu.Lock()
+	us := r.userShard(userID)
+	us.mu.Lock()
+	u, ok := us.m[userID]
+	if !ok {
+		us.mu.Unlock()
+		cs.mu.Unlock()
+		return nil
+	}
+	for _, c := range u.conns {
+		if c.connectionID == connectionID && conn != nil && c.rawConn != conn {
+			us.mu.Unlock()
+			cs.mu.Unlock()
+			return nil
+		}
+	}
+	filtered := u.conns[:0]
+	for _, c := range u.conns {
+		if c.connectionID != connectionID {
+			filtered = append(filtered, c)
+		}
+	}
+	u.conns = filtered
+	if cs.m[connectionID] == userID {
+		delete(cs.m, connectionID)
+	}
+	cs.mu.Unlock()
+	if len(u.conns) > 0 {
+		us.mu.Unlock()
+		return nil
+	}
+	delete(us.m, userID)
+	us.mu.Unlock()
+
+	announce = make([]uint32, 0, len(u.conversations))
+	for convID := range u.conversations {
+		announce = append(announce, convID)
+		rs := r.roomShard(convID)
+		rs.mu.Lock()
+		if rm, ok := rs.m[convID]; ok {
+			delete(rm.members, userID)
+			if len(rm.members) == 0 {
+				delete(rs.m, convID)
+			}
+		}
+		rs.mu.Unlock()
+	}
+	return announce
+}
+
+// member reports whether userID is in conversationID, along with the
+// conversation's type.
+func (r *registry) member(userID, conversationID uint32) (convType string, ok bool) {
+	rs := r.roomShard(conversationID)
+	rs.mu.RLock()
+	defer rs.mu.RUnlock()
+	rm, found := rs.m[conversationID]
+	if !found {
+		return "", false
+	}
+	_, ok = rm.members[userID]
+	return rm.convType, ok
+}
+
+// targets appends the connections of every online member of
+// conversationID to dst. The sender's membership is checked under the
+// same lock the member list is copied under, ok is false if they aren't
+// in the room at that point. excludeSender leaves their connections out.
+func (r *registry) targets(dst []FanOut, conversationID, sender uint32, excludeSender bool) ([]FanOut, bool) {
+	rs := r.roomShard(conversationID)
+	rs.mu.RLock()
+	rm, found := rs.m[conversationID]
+	if !found {
+		rs.mu.RUnlock()
+		return dst, false
+	}
+	if _, member := rm.members[sender]; !member {
+		rs.mu.RUnlock()
+		return dst, false
+	}
+	members := make([]uint32, 0, len(rm.members))
+	for m := range rm.members {
+		if excludeSender && m == sender {
+			continue
+		}
+		members = append(members, m)
+	}
+	rs.mu.RUnlock()
+
+	for _, m := range members {
+		dst = r.appendConns(dst, m)
+	}
+	return dst, true
+}
+
+// presenceTargets returns the connections of the members userID shares
+// conversations with, once per shared conversation.
+func (r *registry) presenceTargets(conversations []uint32, userID uint32) []net.Conn {
+	var members []uint32
+	for _, convID := range conversations {
+		rs := r.roomShard(convID)
+		rs.mu.RLock()
+		if rm, ok := rs.m[convID]; ok {
+			for m := range rm.members {
+				if m != userID {
+					members = append(members, m)
+				}
+			}
+		}
+		rs.mu.RUnlock()
+	}
+
+	var conns []FanOut
+	for _, m := range members {
+		conns = r.appendConns(conns, m)
+	}
+	out := make([]net.Conn, len(conns))
+	for i, c := range conns {
+		out[i] = c.rawConn
+	}
+	return out
+}
+
+func (r *registry) appendConns(dst []FanOut, userID uint32) []FanOut {
+	us := r.userShard(userID)
+	us.mu.RLock()
+	if u, ok := us.m[userID]; ok {
+		dst = append(dst, u.conns...)
+	}
+	us.mu.RUnlock()
+	return dst
+}
+
+// join adds userID to conversationID and returns their connections, if
+// they're online and weren't in it yet, so they can be told. convType
+// sets the room's type, an empty one leaves it as it is.
+func (r *registry) join(userID, conversationID uint32, convType string) []net.Conn {
+	rs := r.roomShard(conversationID)
+	rs.mu.Lock()
+	rm, ok := rs.m[conversationID]
+	if !ok {
+		rm = &room{members: make(map[uint32]struct{})}
+		rs.m[conversationID] = rm
+	}
+	rm.members[userID] = struct{}{}
+	if convType != "" {
+		rm.convType = convType
+	}
+	rs.mu.Unlock()
+
+	us := r.userShard(userID)
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	u, ok := us.m[userID]
+	if !ok {
+		return nil
+	}
+	if _, in := u.conversations[conversationID]; in {
+		return nil
+	}
+	u.conversations[conversationID] = struct{}{}
+	conns := make([]net.Conn, len(u.conns))
+	for i, c := range u.conns {
+		conns[i] = c.rawConn
+	}
+	return conns
+}
+
+// tracks reports whether the registry holds anything a change of userID's
+// membership in conversationID affects: the user is online or the room is
+// known.
+func (r *registry) tracks(userID, conversationID uint32) bool {
+	rs := r.roomShard(conversationID)
+	rs.mu.RLock()
+	_, known := rs.m[conversationID]
+	rs.mu.RUnlock()
+	if known {
+		return true
+	}
+	us := r.userShard(userID)
+	us.mu.RLock()
+	defer us.mu.RUnlock()
+	_, online := us.m[userID]
+	return online
+}
+
+// leave removes userID from conversationID.
+func (r *registry) leave(userID, conversationID uint32) {
+	us := r.userShard(userID)
+	us.mu.Lock()
+	if u, ok := us.m[userID]; ok {
+		delete(u.conversations, conversationID)
+	}
+	us.mu.Unlock()
+	r.leaveRoom(userID, conversationID)
+}
+
+// leaveRoom removes userID from the members of conversationID.
+func (r *registry) leaveRoom(userID, conversationID uint32) {
+	rs := r.roomShard(conversationID)
+	rs.mu.Lock()
+	if rm, ok := rs.m[conversationID]; ok {
+		delete(rm.members, userID)
+		if len(rm.members) == 0 {
+			delete(rs.m, conversationID)
+		}
+	}
+	rs.mu.Unlock()
+}
+
+// snapshotRoom is a room of the registry as written to a snapshot.
+type snapshotRoom struct {
+	ID      uint32
+	Type    string
+	Members []uint32
+}
+
+// snapshot returns the room index and the users that are online.
+func (r *registry) snapshot() (rooms []snapshotRoom, online []uint32) {
+	for i := range r.rooms {
+		rs := &r.rooms[i]
+		rs.mu.RLock()
+		for id, rm := range rs.m {
+			room := snapshotRoom{ID: id, Type: rm.convType, Members: make([]uint32, 0, len(rm.members))}
+			for m := range rm.members {
+				room.Members = append(room.Members, m)
+			}
+			rooms = append(rooms, room)
+		}
+		rs.mu.RUnlock()
+	}
+	return rooms, r.online()
+}
+
+// online returns the users that are online.
+func (r *registry) online() []uint32 {
+	var online []uint32
+	for i := range r.users {
+		us := &r.users[i]
+		us.mu.RLock()
+		for id := range us.m {
+			online = append(online, id)
+		}
+		us.mu.RUnlock()
+	}
+	return online
+}
+
+// refresh replaces what the registry knows of an online user's rooms with
+// memberships fresh from the database. Their rooms get the member lists
+// of memberships, conversations they're no longer in are left. added are
+// the conversations the user wasn't in, conns their connections.
+func (r *registry) refresh(userID uint32, memberships []MemberShip) (added []uint32, conns []net.Conn) {
+	fresh := make(map[uint32]*room)
+	for _, m := range memberships {
+		rm, ok := fresh[m.conversationID]
+		if !ok {
+			rm = &room{members: make(map[uint32]struct{}), convType: m.conversationType}
+			fresh[m.conversationID] = rm
+		}
+		rm.members[m.memberID] = struct{}{}
+	}
+
+	us := r.userShard(userID)
+	us.mu.Lock()
+	u, ok := us.m[userID]
+	if !ok {
+		us.mu.Unlock()
+		return nil, nil
+	}
+	stale := u.conversations
+	u.conversations = make(map[uint32]struct{}, len(fresh))
+	for convID := range fresh {
+		u.conversations[convID] = struct{}{}
+		if _, was := stale[convID]; !was {
+			added = append(added, convID)
+		}
+	}
+	if len(added) > 0 {
+		for _, c := range u.conns {
+			conns = append(conns, c.rawConn)
+		}
+	}
+	us.mu.Unlock()
+
+	for convID, rm := range fresh {
+		rs := r.roomShard(convID)
+		rs.mu.Lock()
+		rs.m[convID] = rm
+		rs.mu.Unlock()
+	}
+	for convID := range stale {
+		if _, ok := fresh[convID]; !ok {
+			r.leaveRoom(userID, convID)
+		}
+	}
+	return added, conns
+}
@@ -0,0 +1,221 @@
+package tcp
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/iLeoon/realtime-gateway/internal/config"
+	"github.com/iLeoon/realtime-gateway/internal/errors"
+	"github.com/iLeoon/realtime-gateway/internal/protocol"
+	"github.com/iLeoon/realtime-gateway/internal/protocol/packets"
+	"github.com/iLeoon/realtime-gateway/pkg/log"
+)
+
+const relayPath errors.PathName = "tcp/relay"
+
+// peerRelay hands the fan-outs of this engine's users to the engines of
+// ENGINE_PEERS. Gateways place each user on one engine, the other members
+// of a conversation may be on any of them. A peer delivers what it's
+// relayed to its own online members, see server.deliverRelayed.
+//
+// Relaying is best effort, like the engine's own fan-out: a peer that is
+// down or can't keep up misses the packets meanwhile, its users catch up
+// through the REST API.
+type peerRelay struct {
+	peers []*relayPeer
+}
+
+// relayPeer is the connection to one peer engine, it's dialed on start
+// and again whenever it fails.
+type relayPeer struct {
+	transport  Transport
+	assertions Assertions
+	queue      chan []byte // encoded frames
+	done       <-chan struct{}
+}
+
+// newPeerRelay returns the relay to the engines of c.EnginePeers.
+func newPeerRelay(c *config.Config, a Assertions, done <-chan struct{}) (*peerRelay, error) {
+	const op errors.Op = "tcp.newPeerRelay"
+	r := &peerRelay{}
+	for _, rawURL := range c.EnginePeers {
+		transport, err := ParseTransport(rawURL, c.EngineAuth)
+		if err != nil {
+			return nil, errors.B(relayPath, op, err)
+		}
+		r.peers = append(r.peers, &relayPeer{
+			transport:  transport,
+			assertions: a,
+			queue:      make(chan []byte, relayQueue),
+			done:       done,
+		})
+	}
+	return r, nil
+}
+
+func (r *peerRelay) start() {
+	for _, p := range r.peers {
+		go p.run()
+	}
+}
+
+// relay queues pkt for every peer, to be delivered to their members of
+// conversations other than exclude. A nil relay has no peers.
+func (r *peerRelay) relay(pkt packets.BuildPayload, exclude uint32, conversations []uint32) {
+	const op errors.Op = "peerRelay.relay"
+	if r == nil || len(r.peers) == 0 {
+		return
+	}
+	for len(conversations) > 0 {
+		n := min(len(conversations), packets.MaxRelayConversations)
+		// Peers only take relays over Version3, the frame is encoded once
+		// for all of them.
+		frame := protocol.ConstructFrame(&packets.RelayPacket{Exclude: exclude, Conversations: conversations[:n], Packet: pkt}).ForVersion(packets.Version3)
+		b, err := frame.AppendFrame(nil)
+		if err != nil {
+			log.Error.Println(errors.B(relayPath, op, err))
+			return
+		}
+		for _, p := range r.peers {
+			select {
+			case p.queue <- b:
+			default:
+				log.Error.Println("relay dropped", "engine", p.transport.String(), errors.B(relayPath, op, errors.ServiceUnavailable, "the peer queue is full"))
+			}
+		}
+		conversations = conversations[n:]
+	}
+}
+
+// run keeps a connection to the peer and writes the queued frames to it
+// until the engine shuts down.
+func (p *relayPeer) run() {
+	const op errors.Op = "relayPeer.run"
+	backoff := reconnectMinBackoff
+	for {
+		link, err := p.connect()
+		if err != nil {
+			log.Error.Println("peer engine unreachable", "engine", p.transport.String(), errors.B(relayPath, op, err))
+			select {
+			case <-time.After(backoff):
+			case <-p.done:
+				return
+			}
+			backoff = min(2*backoff, reconnectMaxBackoff)
+			continue
+		}
+		backoff = reconnectMinBackoff
+		log.Info.Println("relaying to peer engine", "engine", p.transport.String())
+		if err := p.serve(link); err != nil {
+			log.Error.Println("lost the peer engine", "engine", p.transport.String(), errors.B(relayPath, op, err))
+		}
+		select {
+		case <-p.done:
+			return
+		default:
+		}
+	}
+}
+
+// connect dials the peer and authenticates the connection the way the
+// gateway's notifier does.
+func (p *relayPeer) connect() (*notifierLink, error) {
+	const op errors.Op = "relayPeer.connect"
+	ctx, cancel := context.WithTimeout(context.Background(), writeDuration)
+	defer cancel()
+	conn, err := p.transport.Dial(ctx)
+	if err != nil {
+		return nil, errors.B(relayPath, op, errors.Network, err)
+	}
+	if err := conn.SetDeadline(time.Now().Add(writeDuration)); err != nil {
+		conn.Close()
+		return nil, errors.B(relayPath, op, errors.Network, err)
+	}
+	proto, err := protocol.ClientHandshake(conn)
+	if err != nil {
+		conn.Close()
+		return nil, errors.B(relayPath, op, err)
+	}
+	if proto.Version < packets.Version3 || !proto.Has(packets.FeatureRelay) {
+		conn.Close()
+		return nil, errors.B(relayPath, op, errors.Internal, "the peer engine doesn't accept relay packets, it's older than this one")
+	}
+	link := &notifierLink{conn: conn, proto: proto, dec: protocol.NewDecoder(conn)}
+	if !verifiedPeer(conn) {
+		if p.assertions == nil {
+			conn.Close()
+			return nil, errors.B(relayPath, op, errors.Internal, errors.Unauthenticated, "the peer engine wants a gateway assertion, there's no key to sign one")
+		}
+		token, err := p.assertions.GenerateEngineToken(gatewaySubject)
+		if err != nil {
+			conn.Close()
+			return nil, errors.B(relayPath, op, err)
+		}
+		if _, err := link.roundTrip(&packets.GatewayAuthPacket{Token: token}); err != nil {
+			conn.Close()
+			return nil, errors.B(relayPath, op, err)
+		}
+	}
+	return link, nil
+}
+
+// serve writes the queued frames to link until it fails or the engine
+// shuts down. The peer pings the link like any gateway connection, the
+// pongs are written from the read loop.
+func (p *relayPeer) serve(link *notifierLink) error {
+	const op errors.Op = "relayPeer.serve"
+	defer link.conn.Close()
+	var wmu sync.Mutex
+	write := func(b []byte) error {
+		wmu.Lock()
+		defer wmu.Unlock()
+		if err := link.conn.SetWriteDeadline(time.Now().Add(writeDuration)); err != nil {
+			return err
+		}
+		_, err := link.conn.Write(b)
+		return err
+	}
+
+	failed := make(chan error, 1)
+	go func() {
+		pong, err := protocol.ConstructFrame(&packets.PongPacket{}).ForVersion(link.proto.Version).AppendFrame(nil)
+		if err != nil {
+			failed <- err
+			return
+		}
+		for {
+			if err := link.conn.SetReadDeadline(time.Now().Add(pongWait)); err != nil {
+				failed <- err
+				return
+			}
+			frame, err := link.dec.Decode(link.proto.Version)
+			if err != nil {
+				failed <- err
+				return
+			}
+			switch pkt := frame.Payload.(type) {
+			case *packets.PingPacket:
+				if err := write(pong); err != nil {
+					failed <- err
+					return
+				}
+			case *packets.ErrorPacket:
+				log.Error.Println("the peer engine refused a relay", errors.B(relayPath, op, pkt.Code, pkt.Reason, pkt.Message))
+			}
+		}
+	}()
+
+	for {
+		select {
+		case b := <-p.queue:
+			if err := write(b); err != nil {
+				return errors.B(relayPath, op, errors.Network, err)
+			}
+		case err := <-failed:
+			return errors.B(relayPath, op, err)
+		case <-p.done:
+			return nil
+		}
+	}
+}
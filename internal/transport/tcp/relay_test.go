@@ -0,0 +1,97 @@
+package tcp
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/iLeoon/realtime-gateway/internal/config"
+	"github.com/iLeoon/realtime-gateway/internal/protocol"
+	"github.com/iLeoon/realtime-gateway/internal/protocol/packets"
+	"github.com/iLeoon/realtime-gateway/internal/transport/tcp/worker"
+	"github.com/iLeoon/realtime-gateway/pkg/codec"
+	"github.com/iLeoon/realtime-gateway/pkg/log"
+	"github.com/iLeoon/realtime-gateway/pkg/session"
+)
+
+// TestRelayBetweenEngines runs two engines that relay to each other, with
+// userID 10 on one and userID 20 on the other. Messages between them cross
+// engines both ways, and the sender's own sessions get them once.
+func TestRelayBetweenEngines(t *testing.T) {
+	log.SetLevel("disabled")
+	confs := []*config.Config{engineConfig(t), engineConfig(t)}
+	confs[0].EnginePeers = []string{confs[1].EngineURL}
+	confs[1].EnginePeers = []string{confs[0].EngineURL}
+	engines := make([]*engine, len(confs))
+	for i, conf := range confs {
+		engines[i] = startEngine(t, conf)
+		engines[i].messagesCh = make(chan worker.Message, 4)
+		if err := engines[i].startRelay(); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { close(engines[i].done) })
+	}
+
+	// A gateway per engine, as if the ring had placed the users apart.
+	r := &recordingRouter{}
+	sessions := make(map[uint32]session.Session)
+	for i, userID := range []uint32{10, 20} {
+		f, err := NewFactory(confs[i], r, make(closeSignaler, 1), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sess, err := f.NewClient(fmt.Sprint(userID), userID, codec.JSON)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := sess.OnConnect(); err != nil {
+			t.Fatal(err)
+		}
+		sessions[userID] = sess
+		waitFor(t, fmt.Sprintf("userID %d is on engine %d only", userID, i), func() bool {
+			return engines[i].online(userID) && !engines[1-i].online(userID)
+		})
+	}
+
+	if err := sessions[20].WriteToServer(sendMessage("from 20")); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "userID 10 got the message of the other engine", func() bool { return r.received("10") == 1 })
+	if err := sessions[10].WriteToServer(sendMessage("from 10")); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "userID 20 got the message of the other engine", func() bool { return r.received("20") == 2 })
+	if got := r.received("10"); got != 2 {
+		t.Fatalf("userID 10 got %d messages, want 2", got)
+	}
+}
+
+// TestRelayRequiresGateway sends a relay packet over a connection that
+// didn't authenticate, the engine refuses it and closes the connection.
+func TestRelayRequiresGateway(t *testing.T) {
+	log.SetLevel("disabled")
+	s := New()
+	s.db = newReplayDB(fixtureSetup)
+
+	out := &memConn{}
+	recipient := newPeerConn(out, 8, overflowDisconnect)
+	connectAll(t, s, map[uint32]*peerConn{10: recipient})
+
+	relay := &packets.RelayPacket{Conversations: []uint32{1}, Packet: &packets.ResponseTypingPacket{ConversationID: 1, UserID: 20, IsTyping: true}}
+	stranger := newPeerConn(&memConn{}, 8, overflowDisconnect)
+	var id uint32
+	if s.packetsDispatcher(&protocol.Frame{Payload: relay}, stranger, &id, context.Background()) {
+		t.Fatal("an unauthenticated peer relayed a packet")
+	}
+	peer := newPeerConn(&memConn{}, 8, overflowDisconnect)
+	peer.gateway.Store(true)
+	if !s.packetsDispatcher(&protocol.Frame{Payload: relay}, peer, &id, context.Background()) {
+		t.Fatal("the peer engine's relay packet was refused")
+	}
+	for _, pc := range []*peerConn{recipient, stranger, peer} {
+		pc.stop()
+	}
+	if got := countFrames(t, out, packets.TypingResponse); got != 1 {
+		t.Fatalf("userID 10 got %d typing indicators, want the relayed one", got)
+	}
+}
@@ -0,0 +1,424 @@
+package tcp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/iLeoon/realtime-gateway/internal/errors"
+	"github.com/iLeoon/realtime-gateway/internal/protocol"
+	"github.com/iLeoon/realtime-gateway/internal/protocol/capture"
+	"github.com/iLeoon/realtime-gateway/internal/protocol/packets"
+	"github.com/iLeoon/realtime-gateway/pkg/log"
+)
+
+var update = flag.Bool("update", false, "rewrite the recordings in testdata/recordings")
+
+// recordingSetup is the state of the database a recording was made
+// against, stored next to it as <name>.json.
+type recordingSetup struct {
+	Memberships []struct {
+		Conversation uint32 `json:"conversation"`
+		Member       uint32 `json:"member"`
+		Type         string `json:"type"`
+	} `json:"memberships"`
+}
+
+// replayDB is the DBConnection of a replayed engine. Every author check
+// passes and message IDs are handed out from 1.
+type replayDB struct {
+	noDBConn
+	members []MemberShip
+	nextMsg uint32
+}
+
+func newReplayDB(setup recordingSetup) *replayDB {
+	db := &replayDB{}
+	for _, m := range setup.Memberships {
+		db.members = append(db.members, MemberShip{m.Conversation, m.Member, m.Type})
+	}
+	return db
+}
+
+func (d *replayDB) FetchMembers(userIDs []uint32, ctx context.Context) (map[uint32][]MemberShip, error) {
+	rows := make(map[uint32][]MemberShip, len(userIDs))
+	for _, id := range userIDs {
+		rows[id] = d.membersOf(id)
+	}
+	return rows, nil
+}
+
+func (d *replayDB) membersOf(userID uint32) []MemberShip {
+	mine := map[uint32]bool{}
+	for _, m := range d.members {
+		if m.memberID == userID {
+			mine[m.conversationID] = true
+		}
+	}
+	var rows []MemberShip
+	for _, m := range d.members {
+		if mine[m.conversationID] {
+			rows = append(rows, m)
+		}
+	}
+	return rows
+}
+
+func (d *replayDB) FetchMsgAuthor(messageID uint32, userID uint32, ctx context.Context) error {
+	return nil
+}
+
+func (d *replayDB) FetchMsg(ctx context.Context) (uint32, error) {
+	d.nextMsg++
+	return d.nextMsg, nil
+}
+
+// memConn keeps everything the engine writes to it.
+type memConn struct {
+	noOpConn
+	out bytes.Buffer
+}
+
+func (c *memConn) Write(b []byte) (int, error) {
+	return c.out.Write(b)
+}
+
+func (c *memConn) Close() error { return nil }
+
+// replay feeds the inbound frames of records to a fresh engine, one at a
+// time and in capture order, and returns what it wrote per connection.
+// Packets are dispatched synchronously so the output doesn't depend on
+// scheduling.
+func replay(t *testing.T, records []capture.Record, db DBConnection) map[uint32][]*protocol.Frame {
+	t.Helper()
+	s := New()
+	s.db = db
+	ctx := context.Background()
+
+	type replayConn struct {
+		mem    *memConn
+		pc     *peerConn
+		userID uint32
+		closed bool
+	}
+	conns := map[uint32]*replayConn{}
+	for _, rec := range records {
+		if rec.Direction != capture.Inbound {
+			continue
+		}
+		c, ok := conns[rec.Conn]
+		if !ok {
+			mem := &memConn{}
+			c = &replayConn{mem: mem, pc: newPeerConn(mem, 0, overflowDisconnect)}
+			conns[rec.Conn] = c
+		}
+		if c.closed {
+			t.Fatalf("conn %d: frame after the engine closed the connection", rec.Conn)
+		}
+
+		frame, err := protocol.DecodeFrameVersion(bytes.NewReader(rec.Frame), negotiated(c.pc).Version)
+		var pktErr *protocol.PacketError
+		if errors.As(err, &pktErr) && pktErr.CorrelationID != 0 {
+			s.handleErrorPacket(err, c.pc, pktErr.CorrelationID)
+			continue
+		}
+		if err != nil {
+			t.Fatalf("conn %d: recorded frame doesn't decode: %v", rec.Conn, err)
+		}
+		c.closed = !s.packetsDispatcher(frame, c.pc, &c.userID, ctx)
+	}
+
+	out := map[uint32][]*protocol.Frame{}
+	for id, c := range conns {
+		c.pc.stop()
+		out[id] = splitFrames(t, c.mem.out.Bytes())
+	}
+	return out
+}
+
+// splitFrames decodes what the engine wrote, switching to the negotiated
+// version after the HelloAck like the gateway does.
+func splitFrames(t *testing.T, b []byte) []*protocol.Frame {
+	t.Helper()
+	var frames []*protocol.Frame
+	dec := protocol.NewDecoder(bytes.NewReader(b))
+	version := packets.Version1
+	for {
+		frame, err := dec.Decode(version)
+		if errors.Is(err, errors.Internal) && strings.Contains(err.Error(), "EOF") {
+			return frames
+		}
+		if err != nil {
+			t.Fatalf("engine wrote an invalid frame: %v", err)
+		}
+		if ack, ok := frame.Payload.(*packets.HelloAckPacket); ok {
+			version = ack.Version
+		}
+		frames = append(frames, frame)
+	}
+}
+
+// recorded returns the outbound frames of a capture per connection.
+func recorded(t *testing.T, records []capture.Record) map[uint32][]*protocol.Frame {
+	t.Helper()
+	out := map[uint32][]*protocol.Frame{}
+	for _, rec := range records {
+		if rec.Direction != capture.Outbound {
+			continue
+		}
+		frame, err := rec.Decode()
+		if err != nil {
+			t.Fatalf("conn %d: recorded frame doesn't decode: %v", rec.Conn, err)
+		}
+		out[rec.Conn] = append(out[rec.Conn], frame)
+	}
+	return out
+}
+
+// describeFrame renders a frame for the diff. Heartbeats are left out and
+// the fields the database or the clock decide are blanked.
+func describeFrame(f *protocol.Frame) (string, bool) {
+	switch p := f.Payload.(type) {
+	case *packets.PingPacket, *packets.PongPacket:
+		return "", false
+	case *packets.ResponseMessagePacket:
+		c := *p
+		c.MessageID = 0
+		c.CreatedAt = time.Time{}
+		return fmt.Sprintf("id=%d %s", f.CorrelationID, c.String()), true
+	case *packets.ResponseUpdateMessagePacket:
+		c := *p
+		c.UpdatedAt = time.Time{}
+		return fmt.Sprintf("id=%d %s", f.CorrelationID, c.String()), true
+	}
+	return fmt.Sprintf("id=%d %s", f.CorrelationID, strings.TrimSpace(f.Payload.String())), true
+}
+
+// diffOutput compares the frames per connection, in order.
+func diffOutput(want, got map[uint32][]*protocol.Frame) []string {
+	lines := func(frames []*protocol.Frame) []string {
+		var out []string
+		for _, f := range frames {
+			if s, ok := describeFrame(f); ok {
+				out = append(out, s)
+			}
+		}
+		return out
+	}
+
+	var diff []string
+	ids := map[uint32]bool{}
+	for id := range want {
+		ids[id] = true
+	}
+	for id := range got {
+		ids[id] = true
+	}
+	for id := range ids {
+		w, g := lines(want[id]), lines(got[id])
+		for i := 0; i < max(len(w), len(g)); i++ {
+			switch {
+			case i >= len(g):
+				diff = append(diff, fmt.Sprintf("conn %d frame %d: missing %s", id, i, w[i]))
+			case i >= len(w):
+				diff = append(diff, fmt.Sprintf("conn %d frame %d: unexpected %s", id, i, g[i]))
+			case w[i] != g[i]:
+				diff = append(diff, fmt.Sprintf("conn %d frame %d:\n  got  %s\n  want %s", id, i, g[i], w[i]))
+			}
+		}
+	}
+	return diff
+}
+
+var fixtureSetup = recordingSetup{Memberships: []struct {
+	Conversation uint32 `json:"conversation"`
+	Member       uint32 `json:"member"`
+	Type         string `json:"type"`
+}{
+	{1, 10, groupChat}, {1, 20, groupChat}, {1, 30, groupChat},
+	{2, 10, privateChat}, {2, 20, privateChat},
+}}
+
+// gateway is a scripted gateway connection of TestRecordAndReplay.
+type gateway struct {
+	t      *testing.T
+	conn   net.Conn
+	proto  protocol.Negotiated
+	frames chan *protocol.Frame
+	nextID uint32
+}
+
+func dialEngine(t *testing.T, s *server, wg *sync.WaitGroup) *gateway {
+	engine, client := net.Pipe()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		s.handleConn(engine)
+	}()
+
+	proto, err := protocol.ClientHandshake(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := &gateway{t: t, conn: client, proto: proto, frames: make(chan *protocol.Frame, 64)}
+	go func() {
+		defer close(g.frames)
+		dec := protocol.NewDecoder(client)
+		for {
+			frame, err := dec.Decode(proto.Version)
+			if err != nil {
+				return
+			}
+			g.frames <- frame
+		}
+	}()
+	return g
+}
+
+// send writes a correlated packet and waits for its ack or error.
+func (g *gateway) send(pkt packets.BuildPayload) {
+	g.t.Helper()
+	g.nextID++
+	if err := protocol.ConstructFrame(pkt).ForVersion(g.proto.Version).WithCorrelation(g.nextID).EncodeFrame(g.conn); err != nil {
+		g.t.Fatal(err)
+	}
+	g.expect(packets.Ack, packets.Error)
+}
+
+// expect waits for the next frame of one of the given types, skipping the
+// others.
+func (g *gateway) expect(opcodes ...uint8) {
+	g.t.Helper()
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case f, ok := <-g.frames:
+			if !ok {
+				g.t.Fatalf("connection closed while waiting for %s", packets.Name(opcodes[0]))
+			}
+			for _, op := range opcodes {
+				if f.Header.Opcode == op {
+					return
+				}
+			}
+		case <-timeout:
+			g.t.Fatalf("timed out waiting for %s", packets.Name(opcodes[0]))
+		}
+	}
+}
+
+// TestRecordAndReplay records a scripted session through the real
+// connection handler, then replays it into a fresh engine and expects the
+// same output. With -update the recording becomes a fixture for
+// TestReplayRecordings.
+func TestRecordAndReplay(t *testing.T) {
+	log.SetLevel("disabled")
+	var file bytes.Buffer
+	w, err := capture.NewWriter(&file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := New()
+	s.db = newReplayDB(fixtureSetup)
+	s.recorder = w
+
+	var engines sync.WaitGroup
+	a, b, c := dialEngine(t, s, &engines), dialEngine(t, s, &engines), dialEngine(t, s, &engines)
+	a.send(&packets.ConnectPacket{ConnectionID: 1, UserID: 10})
+	b.send(&packets.ConnectPacket{ConnectionID: 2, UserID: 20})
+	c.send(&packets.ConnectPacket{ConnectionID: 3, UserID: 30})
+	a.send(&packets.SendMessagePacket{ConversationID: 1, Content: "hello group"})
+	b.send(&packets.TypingPacket{ConversationID: 2, IsTyping: true})
+	b.send(&packets.UpdateMessagePacket{MessageID: 1, ConversationID: 1, Content: "edited"})
+	c.send(&packets.SendMessagePacket{ConversationID: 2, Content: "not a member"})
+	if err := protocol.ConstructFrame(&packets.DisconnectPacket{ConnectionID: 3, UserID: 30}).ForVersion(c.proto.Version).EncodeFrame(c.conn); err != nil {
+		t.Fatal(err)
+	}
+	a.expect(packets.PresenceResponse)
+	b.expect(packets.PresenceResponse)
+	for _, g := range []*gateway{a, b, c} {
+		g.conn.Close()
+	}
+	engines.Wait()
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if *update {
+		writeRecording(t, "fanout_presence", file.Bytes(), fixtureSetup)
+	}
+	records := readRecording(t, bytes.NewReader(file.Bytes()))
+	if diff := diffOutput(recorded(t, records), replay(t, records, newReplayDB(fixtureSetup))); len(diff) > 0 {
+		t.Fatalf("replay differs from the recording:\n%s", strings.Join(diff, "\n"))
+	}
+}
+
+// TestReplayRecordings replays every capture in testdata/recordings. To
+// reproduce a bug, record the engine with ENGINE_RECORD_FILE, drop the
+// file here with a <name>.json describing the memberships it needs and
+// run this test.
+func TestReplayRecordings(t *testing.T) {
+	log.SetLevel("disabled")
+	files, _ := filepath.Glob(filepath.Join("testdata", "recordings", "*.cap"))
+	for _, file := range files {
+		name := strings.TrimSuffix(filepath.Base(file), ".cap")
+		t.Run(name, func(t *testing.T) {
+			var setup recordingSetup
+			if raw, err := os.ReadFile(strings.TrimSuffix(file, ".cap") + ".json"); err == nil {
+				if err := json.Unmarshal(raw, &setup); err != nil {
+					t.Fatal(err)
+				}
+			}
+			f, err := os.Open(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			records := readRecording(t, f)
+			if diff := diffOutput(recorded(t, records), replay(t, records, newReplayDB(setup))); len(diff) > 0 {
+				t.Fatalf("replay differs from the recording:\n%s", strings.Join(diff, "\n"))
+			}
+		})
+	}
+}
+
+func readRecording(t *testing.T, r io.Reader) []capture.Record {
+	t.Helper()
+	cr, err := capture.NewReader(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records, err := cr.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return records
+}
+
+func writeRecording(t *testing.T, name string, b []byte, setup recordingSetup) {
+	t.Helper()
+	dir := filepath.Join("testdata", "recordings")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	raw, err := json.MarshalIndent(setup, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, name+".json"), append(raw, '\n'), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, name+".cap"), b, 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
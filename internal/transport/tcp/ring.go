@@ -0,0 +1,98 @@
+package tcp
+
+import (
+	"hash/fnv"
+	"slices"
+	"strconv"
+)
+
+// ring assigns users to engines by consistent hashing. Every engine is
+// placed on the ring ringVirtualNodes times, a key belongs to the engine
+// of the first point at or after its hash. Adding or removing an engine
+// only moves the keys of that engine's points, the rest stay put.
+//
+// The hash doesn't depend on the process, every gateway builds the same
+// ring from the same engine URLs.
+type ring struct {
+	points []ringPoint // sorted by hash
+}
+
+type ringPoint struct {
+	hash   uint64
+	engine string
+}
+
+func newRing(engines []string) *ring {
+	r := &ring{points: make([]ringPoint, 0, len(engines)*ringVirtualNodes)}
+	for _, e := range engines {
+		for i := 0; i < ringVirtualNodes; i++ {
+			r.points = append(r.points, ringPoint{ringHash(e + "#" + strconv.Itoa(i)), e})
+		}
+	}
+	slices.SortFunc(r.points, func(a, b ringPoint) int {
+		switch {
+		case a.hash < b.hash:
+			return -1
+		case a.hash > b.hash:
+			return 1
+		}
+		// Ties are vanishingly rare, break them the same way everywhere.
+		if a.engine < b.engine {
+			return -1
+		}
+		return 1
+	})
+	return r
+}
+
+// owner returns the engine key belongs to, false when the ring is empty.
+func (r *ring) owner(key string) (string, bool) {
+	if len(r.points) == 0 {
+		return "", false
+	}
+	h := ringHash(key)
+	i, _ := slices.BinarySearchFunc(r.points, h, func(p ringPoint, h uint64) int {
+		switch {
+		case p.hash < h:
+			return -1
+		case p.hash > h:
+			return 1
+		}
+		return 0
+	})
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.points[i].engine, true
+}
+
+// shares returns the fraction of the ring each engine owns.
+func (r *ring) shares() map[string]float64 {
+	shares := make(map[string]float64)
+	for i, p := range r.points {
+		// A point owns the arc from its predecessor up to itself.
+		prev := r.points[(i+len(r.points)-1)%len(r.points)].hash
+		shares[p.engine] += float64(p.hash-prev) / (1 << 64)
+	}
+	return shares
+}
+
+// ringHash is FNV-1a with a final mix, FNV alone clusters keys that only
+// differ in their last characters.
+func ringHash(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+func userKey(userID string) string { return "user:" + userID }
+
+func conversationKey(conversationID uint32) string {
+	return "conversation:" + strconv.FormatUint(uint64(conversationID), 10)
+}
@@ -0,0 +1,54 @@
+package tcp
+
+import (
+	"fmt"
+	"math"
+	"testing"
+)
+
+// TestRing checks that users are spread evenly and that taking an engine
+// off the ring only moves the users it owned.
+func TestRing(t *testing.T) {
+	engines := []string{"tcp://10.0.0.1:9000", "tcp://10.0.0.2:9000", "tcp://10.0.0.3:9000", "tcp://10.0.0.4:9000"}
+	full := newRing(engines)
+	const users = 100_000
+
+	owners := make(map[string]string, users)
+	counts := make(map[string]int)
+	for u := 1; u <= users; u++ {
+		key := userKey(fmt.Sprint(u))
+		owner, ok := full.owner(key)
+		if !ok {
+			t.Fatal("a full ring has no owner")
+		}
+		owners[key] = owner
+		counts[owner]++
+	}
+	for _, e := range engines {
+		share := float64(counts[e]) / users
+		if math.Abs(share-0.25) > 0.05 {
+			t.Errorf("%s owns %.3f of the users", e, share)
+		}
+		if math.Abs(full.shares()[e]-share) > 0.02 {
+			t.Errorf("%s has a ring share of %.3f but owns %.3f of the users", e, full.shares()[e], share)
+		}
+	}
+
+	partial := newRing(engines[1:])
+	for key, was := range owners {
+		now, _ := partial.owner(key)
+		if was != engines[0] && now != was {
+			t.Fatalf("%s moved from %s to %s though its engine stayed", key, was, now)
+		}
+		if now == engines[0] {
+			t.Fatalf("%s is still on the removed engine", key)
+		}
+	}
+
+	if _, ok := newRing(nil).owner("user:1"); ok {
+		t.Fatal("an empty ring has an owner")
+	}
+	if got := newRing(engines[:1]).shares()[engines[0]]; math.Abs(got-1) > 1e-9 {
+		t.Fatalf("a single engine owns %.3f of the ring", got)
+	}
+}
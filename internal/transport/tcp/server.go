@@ -1,17 +1,19 @@
 package tcp
 
 import (
+	"bufio"
 	"context"
 	"fmt"
 	"io"
 	"net"
 	"os"
-	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/iLeoon/realtime-gateway/internal/config"
 	"github.com/iLeoon/realtime-gateway/internal/errors"
 	"github.com/iLeoon/realtime-gateway/internal/protocol"
+	"github.com/iLeoon/realtime-gateway/internal/protocol/capture"
 	"github.com/iLeoon/realtime-gateway/internal/protocol/packets"
 	"github.com/iLeoon/realtime-gateway/internal/transport/tcp/worker"
 	"github.com/iLeoon/realtime-gateway/pkg/log"
@@ -22,8 +24,12 @@ import (
 const path errors.PathName = "tcp/server"
 
 type DBConnection interface {
-	FetchMembers(userID uint32, ctx context.Context) ([]MemberShip, error)
+	FetchMembers(userIDs []uint32, ctx context.Context) (map[uint32][]MemberShip, error)
+	// ListenMemberships calls apply for every change of users_conversations
+	// until ctx ends or the connection fails.
+	ListenMemberships(ctx context.Context, apply func(MembershipChange)) error
 	FetchMsgAuthor(messageID uint32, userID uint32, ctx context.Context) error
+	FetchAuthor(userID uint32, ctx context.Context) (Author, error)
 	FetchMsg(context.Context) (uint32, error)
 	GetPool() *pgxpool.Pool
 }
@@ -33,22 +39,27 @@ type DBConnection interface {
 // the gateway, applying server-side logic, and routing messages to the
 // appropriate clients.
 type server struct {
-	conf              *config.Config
-	db                DBConnection
-	connections       map[uint32]net.Conn            // connectionID  → raw TCP conn
-	clients           map[uint32][]uint32            // userID        → []connectionID
-	userConversations map[uint32]map[uint32]struct{} // userID        → set of conversationIDs
-	roomManager       map[uint32]map[uint32]struct{} // conversationID → set of memberIDs
-	ready             chan<- struct{}
-	mu                sync.RWMutex
-	messagesCh        chan worker.Message
-	done              chan struct{}
+	conf       *config.Config
+	db         DBConnection
+	registry   *registry // connections, users and rooms
+	limits     *limiter
+	ready      chan<- struct{}
+	messagesCh chan worker.Message
+	done       chan struct{}
+	recorder   *capture.Writer // nil unless recording is enabled
+	connSeq    atomic.Uint32   // numbers the recorded connections
+	assertions Assertions      // verifies the gateway's connect tokens
+	members    memberLoader    // batches the membership queries of connects
+	warm       *warmStart      // nil unless started from a snapshot
+	authors    authorCache     // profiles sent along messages
+	peers      *peerRelay      // nil unless ENGINE_PEERS is set
 }
 
 // MemberShip represents the rows returned from a DB query
 type MemberShip struct {
-	conversationID uint32
-	memberID       uint32
+	conversationID   uint32
+	memberID         uint32
+	conversationType string
 }
 
 // FanOut sends the messages to all the users within a conversation
@@ -66,32 +77,39 @@ func (d *dbConn) GetPool() *pgxpool.Pool {
 	return d.db
 }
 
-// FetchMembers queries every conversation the user belongs to and all
-// members of those conversations in a single round-trip. Must be called
-// outside the mutex — it performs I/O.
-func (d *dbConn) FetchMembers(userID uint32, ctx context.Context) ([]MemberShip, error) {
+// FetchMembers queries every conversation each of the users belongs to
+// and all members of those conversations in a single round-trip, keyed
+// by user. Must be called outside the mutex — it performs I/O.
+func (d *dbConn) FetchMembers(userIDs []uint32, ctx context.Context) (map[uint32][]MemberShip, error) {
 
 	const op errors.Op = "dbConn.FetchMembers"
 
+	// Sent as bigint[], pgx has no array type for uint32.
+	ids := make([]int64, len(userIDs))
+	for i, id := range userIDs {
+		ids[i] = int64(id)
+	}
 	rows, err := d.db.Query(ctx, `
-		SELECT uc1.conversation_id, uc2.user_id
+		SELECT uc1.user_id, uc1.conversation_id, uc2.user_id, c.conversation_type
 		FROM users_conversations uc1
 		JOIN users_conversations uc2 ON uc1.conversation_id = uc2.conversation_id
-		WHERE uc1.user_id = $1`,
-		userID,
+		JOIN conversations c ON c.conversation_id = uc1.conversation_id
+		WHERE uc1.user_id = ANY($1)`,
+		ids,
 	)
 	if err != nil {
 		return nil, errors.B(path, op, errors.Internal, err)
 	}
 	defer rows.Close()
 
-	var memberships []MemberShip
+	memberships := make(map[uint32][]MemberShip, len(userIDs))
 	for rows.Next() {
+		var userID uint32
 		var m MemberShip
-		if err := rows.Scan(&m.conversationID, &m.memberID); err != nil {
+		if err := rows.Scan(&userID, &m.conversationID, &m.memberID, &m.conversationType); err != nil {
 			return nil, errors.B(path, op, errors.Internal, err)
 		}
-		memberships = append(memberships, m)
+		memberships[userID] = append(memberships[userID], m)
 	}
 	if err := rows.Err(); err != nil {
 		return nil, errors.B(path, op, errors.Internal, err)
@@ -111,17 +129,34 @@ func (d *dbConn) FetchMsgAuthor(messageID uint32, userID uint32, ctx context.Con
 	).Scan(&authorID)
 	if err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
-			return errors.B(path, op, errors.Client, fmt.Errorf("messageID %v does not exist", messageID))
+			return errors.B(path, op, errors.Client, errors.MessageNotFound, fmt.Errorf("messageID %v does not exist", messageID))
 		}
 		return errors.B(path, op, errors.Internal, fmt.Errorf("failed to verify message author: %w", err))
 	}
 	if authorID != userID {
-		return errors.B(path, op, errors.Client, fmt.Errorf("userID %v is not the author of messageID %v", userID, messageID))
+		return errors.B(path, op, errors.Client, errors.NotAuthor, fmt.Errorf("userID %v is not the author of messageID %v", userID, messageID))
 	}
 	return nil
 
 }
 
+// FetchAuthor returns the profile of userID shown next to their messages.
+func (d *dbConn) FetchAuthor(userID uint32, ctx context.Context) (Author, error) {
+	const op errors.Op = "dbConn.FetchAuthor"
+	var a Author
+	err := d.db.QueryRow(ctx,
+		`SELECT username, COALESCE(avatar_url, '') FROM users WHERE user_id = $1`,
+		userID,
+	).Scan(&a.Name, &a.Image)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return Author{}, errors.B(path, op, errors.Client, fmt.Errorf("userID %v does not exist", userID))
+		}
+		return Author{}, errors.B(path, op, errors.Internal, err)
+	}
+	return a, nil
+}
+
 // FetchMsg fecthes the next message_id from Postgres sequence before fan-out.
 // This is a lightweight counter read that lets us
 // include the real DB-assigned ID in the ResponseMessagePacket immediately.
@@ -138,17 +173,16 @@ func (d *dbConn) FetchMsg(ctx context.Context) (uint32, error) {
 }
 
 // NewServer creates a new tcp server instance
-func NewServer(c *config.Config, db *pgxpool.Pool, ready chan<- struct{}) *server {
+func NewServer(c *config.Config, db *pgxpool.Pool, ready chan<- struct{}, a Assertions) *server {
 	server := &server{
-		conf:              c,
-		db:                &dbConn{db: db},
-		connections:       make(map[uint32]net.Conn),
-		clients:           make(map[uint32][]uint32),
-		userConversations: make(map[uint32]map[uint32]struct{}),
-		roomManager:       make(map[uint32]map[uint32]struct{}),
-		ready:             ready,
-		done:              make(chan struct{}, 1),
-		messagesCh:        make(chan worker.Message, 200),
+		assertions: a,
+		conf:       c,
+		db:         &dbConn{db: db},
+		registry:   newRegistry(registryShards),
+		limits:     newLimiter(c.EngineLimits),
+		ready:      ready,
+		done:       make(chan struct{}, 1),
+		messagesCh: make(chan worker.Message, 200),
 	}
 
 	return server
@@ -157,18 +191,87 @@ func NewServer(c *config.Config, db *pgxpool.Pool, ready chan<- struct{}) *serve
 // Start starts a new instance of the TCP server.
 func (s *server) Start() {
 	worker.New(s.done, s.messagesCh, s.db.GetPool())
+	if s.conf.EngineRecordFile != "" {
+		s.startRecorder(s.conf.EngineRecordFile)
+	}
+	if s.conf.EngineSnapshotFile != "" {
+		s.restore()
+	}
+	if len(s.conf.EnginePeers) > 0 {
+		if err := s.startRelay(); err != nil {
+			log.Error.Fatal("invalid engine peers", err)
+		}
+	}
+	go s.watchMemberships()
+	if s.conf.EngineReconcileInterval > 0 {
+		go s.reconcileEvery(s.conf.EngineReconcileInterval)
+	}
 	s.listen()
 }
 
+// startRecorder records the traffic of every connection to file, see
+// internal/protocol/capture. Records are flushed every second.
+func (s *server) startRecorder(file string) {
+	const op errors.Op = "server.startRecorder"
+	f, err := os.OpenFile(file, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		log.Error.Println(errors.B(path, op, "traffic recording is disabled", err))
+		return
+	}
+	w, err := capture.NewWriter(f)
+	if err != nil {
+		f.Close()
+		log.Error.Println(errors.B(path, op, "traffic recording is disabled", err))
+		return
+	}
+	s.recorder = w
+	log.Info.Printf("recording engine traffic to %s", file)
+
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		defer f.Close()
+		for {
+			select {
+			case <-ticker.C:
+				if err := w.Flush(); err != nil {
+					log.Error.Println(errors.B(path, op, err))
+				}
+			case <-s.done:
+				w.Flush()
+				return
+			}
+		}
+	}()
+}
+
+// startRelay connects to the engines of ENGINE_PEERS, the fan-outs of
+// this engine's users are relayed to them from then on.
+func (s *server) startRelay() error {
+	const op errors.Op = "server.startRelay"
+	peers, err := newPeerRelay(s.conf, s.assertions, s.done)
+	if err != nil {
+		return errors.B(path, op, err)
+	}
+	s.peers = peers
+	s.peers.start()
+	return nil
+}
+
 // Lanunches the server, this method must be invoked inside a separate
 // goroutine because it blocks while listening for incoming packets.
 func (s *server) listen() {
-	listner, err := net.Listen("tcp", s.conf.TCPPort)
+	transport, err := EngineTransport(s.conf)
+	if err != nil {
+		log.Error.Fatal("invalid engine transport", err)
+		os.Exit(1)
+	}
+	listner, err := transport.Listen()
 	if err != nil {
 		log.Error.Fatal("an error occurred on creating tcp server", err)
 		os.Exit(1)
 	}
-	log.Info.Println("TCP server is up and running...")
+	log.Info.Println("TCP server is up and running...", "transport", transport)
 	defer listner.Close()
 
 	close(s.ready)
@@ -190,18 +293,28 @@ func (s *server) listen() {
 //
 // It uses type assertion to convert the generic BuildPayload
 // its concrete SendMessagePacket type.
-func (s *server) handleConn(conn net.Conn) {
+func (s *server) handleConn(raw net.Conn) {
 	const op errors.Op = "server.handleConn"
+	if s.recorder != nil {
+		raw = capture.NewConn(raw, s.recorder, s.connSeq.Add(1), capture.Inbound)
+	}
+	conn := newPeerConn(raw, s.conf.OutboundQueue, s.conf.OutboundOverflow)
 	stopPing := make(chan struct{})
 	ctx, cancel := context.WithCancel(context.Background())
 	defer func() {
 		cancel()
 		close(stopPing)
 		log.Info.Printf("%q: %q: tcp server terminated it's connection", path, op)
+		// A link that died without a disconnect packet takes its
+		// sessions with it, the gateway registers them again when it
+		// redials.
+		s.dropSessions(conn)
+		conn.stop()
 		conn.Close()
 	}()
 	go s.pingReq(conn, stopPing)
 
+	dec := protocol.NewDecoder(bufio.NewReaderSize(conn, readBufferSize))
 	var userID uint32
 	for {
 		if err := conn.SetReadDeadline(time.Now().Add(pongWait)); err != nil {
@@ -211,8 +324,15 @@ func (s *server) handleConn(conn net.Conn) {
 		}
 		// Call the decoder function on the connection to read
 		// the incoming raw bytes and return the actual human-readable frame.
-		frame, err := protocol.DecodeFrame(conn)
+		frame, err := dec.Decode(negotiated(conn).Version)
 		if err != nil {
+			// A correlated packet that didn't decode only fails that request.
+			var pktErr *protocol.PacketError
+			if errors.As(err, &pktErr) && pktErr.CorrelationID != 0 {
+				log.Error.Println("decoding correlated packet failed", errors.B(path, op, err))
+				s.handleErrorPacket(err, conn, pktErr.CorrelationID)
+				continue
+			}
 			readErr := s.handleDecodeErr(err, op, conn)
 			wrappedErr := errors.B(path, op, readErr, err)
 			log.Error.Println(wrappedErr)
@@ -229,25 +349,38 @@ func (s *server) handleConn(conn net.Conn) {
 }
 
 func (s *server) packetsDispatcher(frame *protocol.Frame, conn net.Conn, userID *uint32, ctx context.Context) bool {
+	// Handlers that fail return early, reaching the end means the packet
+	// was processed and a correlated request gets its ack.
 	switch p := frame.Payload.(type) {
+	case *packets.HelloPacket:
+		if err := s.handshake(p, conn, *userID); err != nil {
+			log.Error.Println("protocol handshake failed", err)
+			s.handleErrorPacket(err, conn, frame.CorrelationID)
+			return false
+		}
 	case *packets.ConnectPacket:
+		if err := s.authenticate(p, conn); err != nil {
+			log.Error.Println("rejected connect packet", err)
+			s.handleErrorPacket(err, conn, frame.CorrelationID)
+			return false
+		}
 		*userID = p.UserID
 		err := s.register(p, conn, ctx)
 		if err != nil {
 			log.Error.Println("processing connect packet failed", err)
-			s.handleErrorPacket(err, conn)
+			s.handleErrorPacket(err, conn, frame.CorrelationID)
 			return true
 		}
 	case *packets.DisconnectPacket:
 		log.Info.Println("Decode packet", "packet", p.String())
-		s.unregister(p)
+		s.unregister(p, conn)
 		return false // signal handleConn to exit and fire its defer
 
 	case *packets.SendMessagePacket:
 		err := s.handleSendMessageReq(p, *userID, ctx)
 		if err != nil {
 			log.Error.Println("processing send message packet", err)
-			s.handleErrorPacket(err, conn)
+			s.handleErrorPacket(err, conn, frame.CorrelationID)
 			return true
 		}
 	case *packets.PongPacket:
@@ -256,14 +389,14 @@ func (s *server) packetsDispatcher(frame *protocol.Frame, conn net.Conn, userID
 		err := s.handleUpdateMessagePacket(p, *userID, ctx)
 		if err != nil {
 			log.Error.Println("processing update message packet failed", err)
-			s.handleErrorPacket(err, conn)
+			s.handleErrorPacket(err, conn, frame.CorrelationID)
 			return true
 		}
 	case *packets.DeleteMessagePacket:
 		err := s.handleDeleteMessagePacket(p, *userID, ctx)
 		if err != nil {
 			log.Error.Println("processing update message packet failed", err)
-			s.handleErrorPacket(err, conn)
+			s.handleErrorPacket(err, conn, frame.CorrelationID)
 			return true
 		}
 
@@ -271,14 +404,47 @@ func (s *server) packetsDispatcher(frame *protocol.Frame, conn net.Conn, userID
 		err := s.handleTypingPacket(p, *userID)
 		if err != nil {
 			log.Error.Println("processing typing packet failed", err)
-			s.handleErrorPacket(err, conn)
+			s.handleErrorPacket(err, conn, frame.CorrelationID)
 			return true
 		}
+	case *packets.GatewayAuthPacket:
+		if err := s.authenticateGateway(p, conn); err != nil {
+			log.Error.Println("rejected gateway auth packet", err)
+			s.handleErrorPacket(err, conn, frame.CorrelationID)
+			return false
+		}
+	case *packets.MembershipPacket:
+		// Sent by a gateway whose REST API runs in another process, only
+		// once it proved to be one.
+		if err := authorizeGateway(conn, p); err != nil {
+			log.Error.Println("rejected membership packet", err)
+			s.handleErrorPacket(err, conn, frame.CorrelationID)
+			return false
+		}
+		if p.Joined {
+			s.AddToRoom(p.UserID, p.ConversationID, p.ConversationType)
+		} else {
+			s.RemoveFromRoom(p.UserID, p.ConversationID)
+		}
+	case *packets.RelayPacket:
+		// Fan-outs of the users of a peer engine, see ENGINE_PEERS. Peers
+		// authenticate like gateways.
+		if err := authorizeGateway(conn, p); err != nil {
+			log.Error.Println("rejected relay packet", err)
+			s.handleErrorPacket(err, conn, frame.CorrelationID)
+			return false
+		}
+		s.deliverRelayed(p)
 	default:
 		log.Error.Printf("invalid packet type from gateway: %T", p)
 		return true
 	}
 	log.Info.Println("Decode packet", "packet", frame.Payload.String())
+	if frame.CorrelationID != 0 {
+		if err := s.reply(&packets.AckPacket{Action: frame.Header.Opcode}, conn, frame.CorrelationID); err != nil {
+			log.Error.Println("failed to send the ack packet", err)
+		}
+	}
 	return true
 }
 
@@ -294,6 +460,7 @@ func (s *server) handleDecodeErr(err error, op errors.Op, conn net.Conn) error {
 	case errors.Is(err, errors.Client):
 		if err := s.writePacket(&packets.ErrorPacket{
 			Code:    errors.Client,
+			Reason:  errors.ProtocolViolation,
 			Message: "invalid packet",
 		}, conn); err != nil {
 			readErr = errors.B(path, op, "failed to write the error packet to the gateway", err)
@@ -305,13 +472,37 @@ func (s *server) handleDecodeErr(err error, op errors.Op, conn net.Conn) error {
 }
 
 func (s *server) writePacket(pkt packets.BuildPayload, conn net.Conn) error {
+	return s.reply(pkt, conn, 0)
+}
+
+// reply is writePacket for an answer to a correlated request, the ID is
+// echoed when the connection negotiated correlation.
+func (s *server) reply(pkt packets.BuildPayload, conn net.Conn, correlationID uint32) error {
 	const op errors.Op = "server.writePacket"
+	// Construct the frame, encode it, and then send it to the TCP client
+	// using the layout the connection negotiated.
+	proto := negotiated(conn)
+	frame := protocol.ConstructFrame(pkt).ForVersion(proto.Version)
+	if proto.Has(packets.FeatureCorrelation) {
+		frame.WithCorrelation(correlationID)
+	}
+	if proto.Has(packets.FeatureCompression) {
+		frame.WithCompression(s.conf.FrameCompressionThreshold)
+	}
+
+	if pc, ok := conn.(*peerConn); ok {
+		b, err := frame.AppendFrame(nil)
+		if err != nil {
+			return errors.B(path, op, errors.Internal, err)
+		}
+		if err := pc.send(b, nil); err != nil {
+			return errors.B(path, op, err)
+		}
+		return nil
+	}
 	if err := conn.SetWriteDeadline(time.Now().Add(writeDuration)); err != nil {
 		return errors.B(path, op, "connection is unhealthy", err, errors.Network)
 	}
-
-	// Construct the frame, encode it, and then send it to the TCP client.
-	frame := protocol.ConstructFrame(pkt)
 	err := frame.EncodeFrame(conn)
 	if err != nil {
 		return errors.B(path, op, errors.Internal, err)
@@ -319,6 +510,35 @@ func (s *server) writePacket(pkt packets.BuildPayload, conn net.Conn) error {
 	return nil
 }
 
+// prepare wraps a fan-out packet so it's encoded once per wire layout
+// rather than once per recipient. The caller must Release it.
+func (s *server) prepare(pkt packets.BuildPayload) *protocol.PreparedFrame {
+	return protocol.Prepare(pkt, s.conf.FrameCompressionThreshold)
+}
+
+// writePrepared is writePacket for a fan-out packet, it only queues the
+// frame so a slow recipient doesn't hold up the others.
+func (s *server) writePrepared(pf *protocol.PreparedFrame, conn net.Conn) error {
+	const op errors.Op = "server.writePrepared"
+	b, err := pf.Bytes(negotiated(conn))
+	if err != nil {
+		return errors.B(path, op, errors.Internal, err)
+	}
+	if pc, ok := conn.(*peerConn); ok {
+		if err := pc.send(b, pf); err != nil {
+			return errors.B(path, op, err)
+		}
+		return nil
+	}
+	if err := conn.SetWriteDeadline(time.Now().Add(writeDuration)); err != nil {
+		return errors.B(path, op, "connection is unhealthy", err, errors.Network)
+	}
+	if _, err := conn.Write(b); err != nil {
+		return errors.B(path, op, errors.Network, err)
+	}
+	return nil
+}
+
 // handleSendMessage processes an inbound SendMessage packet
 // it fans-out the messages to all the participants in a single conversation
 // wether it was direct or group conversation.
@@ -331,8 +551,17 @@ func (s *server) handleSendMessageReq(pkt *packets.SendMessagePacket, userID uin
 		return errors.B(path, op, errors.Client, "userID is nonexistent")
 	}
 
-	if allowed := s.isAllowed(userID, pkt.ConversationID); !allowed {
-		return errors.B(path, op, errors.Client, fmt.Errorf("the userID %v is not allowed to send messages in conversationID %v", userID, pkt.ConversationID))
+	convType, allowed := s.registry.member(userID, pkt.ConversationID)
+	if !allowed {
+		return errors.B(path, op, errors.Client, errors.NotAMember, fmt.Errorf("the userID %v is not allowed to send messages in conversationID %v", userID, pkt.ConversationID))
+	}
+	if err := packets.CheckContent(pkt.Content, s.conf.MessageMaxChars); err != nil {
+		return errors.B(path, op, err)
+	}
+
+	// Enforce the budgets before reserving a message ID or fanning out.
+	if err := s.limits.allow(packets.SendMessage, userID, pkt.ConversationID, convType); err != nil {
+		return errors.B(path, op, err)
 	}
 
 	messageID, err := s.db.FetchMsg(ctx)
@@ -340,43 +569,45 @@ func (s *server) handleSendMessageReq(pkt *packets.SendMessagePacket, userID uin
 		return errors.B(path, op, errors.Internal, err)
 	}
 
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-
-	// room is the a map that holds all the online users in the packet conversationID
-	room, ok := s.roomManager[pkt.ConversationID]
+	// Membership is checked again along with the snapshot, the user may
+	// have left while the ID was fetched.
+	fanOutTo, ok := s.registry.targets(nil, pkt.ConversationID, userID, false)
 	if !ok {
-		return errors.B(path, op, errors.Client, fmt.Errorf("conversationID %v doesn't exit", pkt.ConversationID))
+		return errors.B(path, op, errors.Client, errors.NotAMember, fmt.Errorf("the userID %v is no longer in conversationID %v", userID, pkt.ConversationID))
 	}
 
-	var fanOutTo []FanOut
-
-	for m := range room {
-		// members is all the users inside a conversation
-		members := s.clients[m]
-		for _, v := range members {
-			fanOutTo = append(fanOutTo, FanOut{s.connections[v], v, m})
-		}
-	}
+	// Recipients and the stored row get the same time, at the precision
+	// the packet carries it with.
+	createdAt := time.Now().UTC().Truncate(time.Millisecond)
+	author := s.authors.get(ctx, s.db, userID)
 
+	// Every recipient gets the same bytes, encode them once.
+	message := &packets.ResponseMessagePacket{
+		AuthorID:       userID,
+		ConversationID: pkt.ConversationID,
+		MessageID:      messageID,
+		CreatedAt:      createdAt,
+		AuthorName:     author.Name,
+		AuthorImage:    author.Image,
+		ResContent:     pkt.Content,
+	}
+	resPkt := s.prepare(message)
+	defer resPkt.Release()
 	for _, item := range fanOutTo {
-		resPkt := &packets.ResponseMessagePacket{
-			AuthorID:       userID,
-			ConversationID: pkt.ConversationID,
-			MessageID:      messageID,
-			ResContent:     pkt.Content,
-		}
-		if err := s.writePacket(resPkt, item.rawConn); err != nil {
+		if err := s.writePrepared(resPkt, item.rawConn); err != nil {
 			writeErr := errors.B(path, op, err)
 			log.Error.Printf("failed to send to connection: %d due to: %v", item.connectionID, writeErr)
 		}
 	}
+	// Members connected to other engines get it from them.
+	s.peers.relay(message, 0, []uint32{pkt.ConversationID})
 
 	s.batchMessages(worker.Message{
 		ID:             messageID,
 		AuthorID:       userID,
 		ConversationID: pkt.ConversationID,
 		Content:        pkt.Content,
+		CreatedAt:      createdAt,
 		Task:           worker.Insert,
 	})
 
@@ -392,43 +623,42 @@ func (s *server) handleUpdateMessagePacket(pkt *packets.UpdateMessagePacket, use
 	if userID == 0 {
 		return errors.B(path, op, errors.Client, "userID is nonexistent")
 	}
-	if allowed := s.isAllowed(userID, pkt.ConversationID); !allowed {
-		return errors.B(path, op, errors.Client, fmt.Errorf("the userID %v is not allowed to send messages in conversationID %v", userID, pkt.ConversationID))
+	convType, allowed := s.registry.member(userID, pkt.ConversationID)
+	if !allowed {
+		return errors.B(path, op, errors.Client, errors.NotAMember, fmt.Errorf("the userID %v is not allowed to send messages in conversationID %v", userID, pkt.ConversationID))
+	}
+	if err := packets.CheckContent(pkt.Content, s.conf.MessageMaxChars); err != nil {
+		return errors.B(path, op, err)
+	}
+	// Edits share the message budgets, they cost a query and a write too.
+	if err := s.limits.allow(packets.UpdateMessage, userID, pkt.ConversationID, convType); err != nil {
+		return errors.B(path, op, err)
 	}
 	if err := s.db.FetchMsgAuthor(pkt.MessageID, userID, ctx); err != nil {
 		return errors.B(path, op, err)
 	}
 
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-
-	room, ok := s.roomManager[pkt.ConversationID]
+	fanOutTo, ok := s.registry.targets(nil, pkt.ConversationID, userID, false)
 	if !ok {
-		return errors.B(path, op, errors.Client, fmt.Errorf("conversationID %v doesn't exit", pkt.ConversationID))
-	}
-
-	var fanOutTo []FanOut
-
-	for m := range room {
-		members := s.clients[m]
-		for _, v := range members {
-			fanOutTo = append(fanOutTo, FanOut{s.connections[v], v, m})
-		}
+		return errors.B(path, op, errors.Client, errors.NotAMember, fmt.Errorf("the userID %v is no longer in conversationID %v", userID, pkt.ConversationID))
 	}
 
 	now := time.Now().UTC()
+	update := &packets.ResponseUpdateMessagePacket{
+		MessageID:      pkt.MessageID,
+		ConversationID: pkt.ConversationID,
+		UpdatedAt:      now,
+		ResContent:     pkt.Content,
+	}
+	resPkt := s.prepare(update)
+	defer resPkt.Release()
 	for _, item := range fanOutTo {
-		resPkt := &packets.ResponseUpdateMessagePacket{
-			MessageID:      pkt.MessageID,
-			ConversationID: pkt.ConversationID,
-			UpdatedAt:      now,
-			ResContent:     pkt.Content,
-		}
-		if err := s.writePacket(resPkt, item.rawConn); err != nil {
+		if err := s.writePrepared(resPkt, item.rawConn); err != nil {
 			writeErr := errors.B(path, op, err)
 			log.Error.Printf("failed to update the message of connection: %d due to: %v", item.connectionID, writeErr)
 		}
 	}
+	s.peers.relay(update, 0, []uint32{pkt.ConversationID})
 
 	s.batchMessages(worker.Message{
 		ID:             pkt.MessageID,
@@ -450,41 +680,37 @@ func (s *server) handleDeleteMessagePacket(pkt *packets.DeleteMessagePacket, use
 	if userID == 0 {
 		return errors.B(path, op, errors.Client, "userID is nonexistent")
 	}
-	if allowed := s.isAllowed(userID, pkt.ConversationID); !allowed {
-		return errors.B(path, op, errors.Client, fmt.Errorf("the userID %v is not allowed to send messages in conversationID %v", userID, pkt.ConversationID))
+	convType, allowed := s.registry.member(userID, pkt.ConversationID)
+	if !allowed {
+		return errors.B(path, op, errors.Client, errors.NotAMember, fmt.Errorf("the userID %v is not allowed to send messages in conversationID %v", userID, pkt.ConversationID))
+	}
+	// Deletions share the message budgets like edits.
+	if err := s.limits.allow(packets.DeleteMessage, userID, pkt.ConversationID, convType); err != nil {
+		return errors.B(path, op, err)
 	}
 	if err := s.db.FetchMsgAuthor(pkt.MessageID, userID, ctx); err != nil {
 		return errors.B(path, op, err)
 	}
 
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-
-	room, ok := s.roomManager[pkt.ConversationID]
+	fanOutTo, ok := s.registry.targets(nil, pkt.ConversationID, userID, false)
 	if !ok {
-		return errors.B(path, op, errors.Client, fmt.Errorf("conversationID %v doesn't exit", pkt.ConversationID))
+		return errors.B(path, op, errors.Client, errors.NotAMember, fmt.Errorf("the userID %v is no longer in conversationID %v", userID, pkt.ConversationID))
 	}
 
-	var fanOutTo []FanOut
-
-	for m := range room {
-		members := s.clients[m]
-		for _, v := range members {
-			fanOutTo = append(fanOutTo, FanOut{s.connections[v], v, m})
-		}
+	deleted := &packets.ResponseDeleteMessagePacket{
+		MessageID:      pkt.MessageID,
+		ConversationID: pkt.ConversationID,
+		AuthorID:       userID,
 	}
-
+	resPkt := s.prepare(deleted)
+	defer resPkt.Release()
 	for _, item := range fanOutTo {
-		resPkt := &packets.ResponseDeleteMessagePacket{
-			MessageID:      pkt.MessageID,
-			ConversationID: pkt.ConversationID,
-			AuthorID:       userID,
-		}
-		if err := s.writePacket(resPkt, item.rawConn); err != nil {
+		if err := s.writePrepared(resPkt, item.rawConn); err != nil {
 			writeErr := errors.B(path, op, err)
 			log.Error.Printf("failed to delete the message of connection: %d due to: %v", item.connectionID, writeErr)
 		}
 	}
+	s.peers.relay(deleted, 0, []uint32{pkt.ConversationID})
 
 	s.batchMessages(worker.Message{
 		ID:             pkt.MessageID,
@@ -504,72 +730,43 @@ func (s *server) handleTypingPacket(pkt *packets.TypingPacket, userID uint32) er
 		return errors.B(path, op, errors.Client, "userID is nonexistent")
 	}
 
-	if allowed := s.isAllowed(userID, pkt.ConversationID); !allowed {
-		return errors.B(path, op, errors.Client, fmt.Errorf("userID %v is not a member of conversationID %v", userID, pkt.ConversationID))
+	convType, allowed := s.registry.member(userID, pkt.ConversationID)
+	if !allowed {
+		return errors.B(path, op, errors.Client, errors.NotAMember, fmt.Errorf("userID %v is not a member of conversationID %v", userID, pkt.ConversationID))
 	}
 
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+	if err := s.limits.allow(packets.Typing, userID, pkt.ConversationID, convType); err != nil {
+		return errors.B(path, op, err)
+	}
 
-	room, ok := s.roomManager[pkt.ConversationID]
+	fanOutTo, ok := s.registry.targets(nil, pkt.ConversationID, userID, true)
 	if !ok {
-		return errors.B(path, op, errors.Client, fmt.Errorf("conversationID %v doesn't exist", pkt.ConversationID))
+		return errors.B(path, op, errors.Client, errors.NotAMember, fmt.Errorf("userID %v is no longer in conversationID %v", userID, pkt.ConversationID))
 	}
 
-	resPkt := &packets.ResponseTypingPacket{
+	typing := &packets.ResponseTypingPacket{
 		ConversationID: pkt.ConversationID,
 		UserID:         userID,
 		IsTyping:       pkt.IsTyping,
 	}
+	resPkt := s.prepare(typing)
+	defer resPkt.Release()
 
-	for memberID := range room {
-		if memberID == userID {
-			continue
-		}
-		for _, connID := range s.clients[memberID] {
-			conn := s.connections[connID]
-			if err := s.writePacket(resPkt, conn); err != nil {
-				log.Error.Printf("failed to send typing indicator to connectionID %d: %v", connID, err)
-			}
+	for _, item := range fanOutTo {
+		if err := s.writePrepared(resPkt, item.rawConn); err != nil {
+			log.Error.Printf("failed to send typing indicator to connectionID %d: %v", item.connectionID, err)
 		}
 	}
+	s.peers.relay(typing, userID, []uint32{pkt.ConversationID})
 
 	return nil
 }
 
-func (s *server) isAllowed(userID uint32, conversationID uint32) bool {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-
-	if convs, ok := s.userConversations[userID]; ok {
-		_, allowed := convs[conversationID]
-		return allowed
-	}
-	return false
-}
-
 // AddToRoom updates the in-memory maps so a user immediately starts
 // receiving messages for the conversation they were just added to.
-func (s *server) AddToRoom(userID, conversationID uint32) error {
-	s.mu.Lock()
-
-	if s.userConversations[userID] == nil {
-		s.userConversations[userID] = make(map[uint32]struct{})
-	}
-	s.userConversations[userID][conversationID] = struct{}{}
-	if s.roomManager[conversationID] == nil {
-		s.roomManager[conversationID] = make(map[uint32]struct{})
-	}
-	s.roomManager[conversationID][userID] = struct{}{}
-
-	// Collect the user's active connections while still under the lock.
-	var conns []net.Conn
-	for _, connID := range s.clients[userID] {
-		if conn, ok := s.connections[connID]; ok {
-			conns = append(conns, conn)
-		}
-	}
-	s.mu.Unlock()
+// conversationType picks the rate limits of a room the engine didn't know.
+func (s *server) AddToRoom(userID, conversationID uint32, conversationType string) error {
+	conns := s.registry.join(userID, conversationID, conversationType)
 
 	pkt := &packets.AddedToConversationPacket{ConversationID: conversationID}
 	for _, conn := range conns {
@@ -582,18 +779,7 @@ func (s *server) AddToRoom(userID, conversationID uint32) error {
 
 // RemoveFromRoom removes a user from the in-memory maps for a conversation.
 func (s *server) RemoveFromRoom(userID, conversationID uint32) error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	if convs, ok := s.userConversations[userID]; ok {
-		delete(convs, conversationID)
-	}
-	if members, ok := s.roomManager[conversationID]; ok {
-		delete(members, userID)
-		if len(members) == 0 {
-			delete(s.roomManager, conversationID)
-		}
-	}
+	s.registry.leave(userID, conversationID)
 	return nil
 }
 
@@ -626,124 +812,89 @@ func (s *server) register(pkt *packets.ConnectPacket, conn net.Conn, ctx context
 	defer cancel()
 	const op errors.Op = "server.register"
 
-	memberships, err := s.db.FetchMembers(pkt.UserID, ctx)
-	if err != nil {
-		return errors.B(path, op, err)
-	}
-
-	s.mu.Lock()
-	// To prevent overwriting existing connections.
-	_, ok := s.connections[pkt.ConnectionID]
-	if ok {
-		s.mu.Unlock()
-		if err := s.writePacket(&packets.ErrorPacket{Code: errors.Client, Message: "connection already exists in the entry"}, conn); err != nil {
+	// After a restart the user's memberships may already be known, see
+	// warmStart.
+	memberships, fresh, warm := s.warm.take(pkt.UserID)
+	if !warm {
+		var err error
+		memberships, err = s.members.load(ctx, s.db, s.conf.EngineMemberBatch, pkt.UserID)
+		if err != nil {
 			return errors.B(path, op, err)
 		}
-		return errors.B(path, op, errors.Client, errors.Errorf("ConnectionID: %d already exists in the map", pkt.ConnectionID))
 	}
 
-	// Set the raw connection for every connectionID
-	s.connections[pkt.ConnectionID] = conn
-	// Map every connectionID to their authuenticated userID
-	s.clients[pkt.UserID] = append(s.clients[pkt.UserID], pkt.ConnectionID)
-
-	// Populate Map2 and Map3.
-	if _, ok := s.userConversations[pkt.UserID]; !ok {
-		s.userConversations[pkt.UserID] = make(map[uint32]struct{})
+	// To prevent overwriting existing connections.
+	announce, ok := s.registry.register(pkt.ConnectionID, pkt.UserID, conn, memberships)
+	if !ok {
+		return errors.B(path, op, errors.Client, errors.Errorf("ConnectionID: %d already exists in the map", pkt.ConnectionID))
 	}
-	for _, m := range memberships {
-		s.userConversations[pkt.UserID][m.conversationID] = struct{}{}
-		if _, ok := s.roomManager[m.conversationID]; !ok {
-			s.roomManager[m.conversationID] = make(map[uint32]struct{})
+	// Registered from the snapshot, the database may have answered since.
+	if warm && !fresh {
+		if rows, ok := s.warm.registered(pkt.UserID); ok {
+			s.refresh(pkt.UserID, rows)
 		}
-		s.roomManager[m.conversationID][m.memberID] = struct{}{}
 	}
 
-	// Collect presence targets while still under write lock.
-	// Only fan-out online on the first connection for this user.
-	var onlineTargets = s.collectOnlineUsers(pkt.UserID)
-	s.mu.Unlock()
+	if pc, ok := conn.(*peerConn); ok {
+		pc.sessions[pkt.ConnectionID] = pkt.UserID
+	}
 
-	s.updatePresene(onlineTargets, pkt.UserID, true)
+	// Only fan-out online on the first connection for this user.
+	s.updatePresene(announce, pkt.UserID, true)
 	return nil
 }
 
-func (s *server) collectOnlineUsers(userID uint32) []net.Conn {
-	var onlineTargets []net.Conn
-	if len(s.clients[userID]) == 1 {
-		for convID := range s.userConversations[userID] {
-			for memberID := range s.roomManager[convID] {
-				if memberID == userID {
-					continue
-				}
-				for _, connID := range s.clients[memberID] {
-					onlineTargets = append(onlineTargets, s.connections[connID])
-				}
-			}
-		}
+// unRegisterConnectionIDs removes the connectionIDs and userIDs from the map
+func (s *server) unregister(pkt *packets.DisconnectPacket, conn net.Conn) {
+	if pc, ok := conn.(*peerConn); ok {
+		delete(pc.sessions, pkt.ConnectionID)
 	}
-	return onlineTargets
+	// Offline only fans out once the user's last connection is gone.
+	announce := s.registry.unregister(pkt.ConnectionID, pkt.UserID, conn)
+	s.updatePresene(announce, pkt.UserID, false)
 }
 
-// unRegisterConnectionIDs removes the connectionIDs and userIDs from the map
-func (s *server) unregister(pkt *packets.DisconnectPacket) {
-	s.mu.Lock()
-
-	delete(s.connections, pkt.ConnectionID)
-
-	clients := s.clients[pkt.UserID]
-	filtered := make([]uint32, 0, len(clients))
-	for _, client := range clients {
-		if client != pkt.ConnectionID {
-			filtered = append(filtered, client)
-		}
+// dropSessions unregisters the connections still registered over conn.
+// The ones that moved to another link in the meantime stay.
+func (s *server) dropSessions(conn *peerConn) {
+	for connectionID, userID := range conn.sessions {
+		s.unregister(&packets.DisconnectPacket{ConnectionID: connectionID, UserID: userID}, conn)
 	}
+}
 
-	var offlineTargets []net.Conn
-	if len(filtered) == 0 {
-		offlineTargets = s.removeAndCollectOfflineUsers(pkt.UserID)
-	} else {
-		s.clients[pkt.UserID] = filtered
+// updatePresene tells the members of the announce conversations, here
+// and on the peer engines, that userID came online or went offline.
+func (s *server) updatePresene(announce []uint32, userID uint32, isOnline bool) {
+	if len(announce) == 0 {
+		return
 	}
+	pkt := &packets.ResponsePresencePacket{UserID: userID, IsOnline: isOnline}
+	if targets := s.registry.presenceTargets(announce, userID); len(targets) > 0 {
+		log.Info.Println("Decode packet", "packet", pkt.String())
 
-	s.mu.Unlock()
-	s.updatePresene(offlineTargets, pkt.UserID, false)
-
-}
-
-func (s *server) removeAndCollectOfflineUsers(userID uint32) []net.Conn {
-	// Last connection for this user — collect presence targets before cleanup.
-	var offlineTargets []net.Conn
-	for convID := range s.userConversations[userID] {
-		for memberID := range s.roomManager[convID] {
-			if memberID == userID {
-				continue
-			}
-			for _, connID := range s.clients[memberID] {
-				offlineTargets = append(offlineTargets, s.connections[connID])
+		resPkt := s.prepare(pkt)
+		defer resPkt.Release()
+		for _, conn := range targets {
+			if err := s.writePrepared(resPkt, conn); err != nil {
+				log.Error.Printf("failed to send presence for userID %d: %v", userID, err)
 			}
 		}
 	}
-	delete(s.clients, userID)
-	for convID := range s.userConversations[userID] {
-		delete(s.roomManager[convID], userID)
-		if len(s.roomManager[convID]) == 0 {
-			delete(s.roomManager, convID)
-		}
-	}
-	delete(s.userConversations, userID)
-	return offlineTargets
+	s.peers.relay(pkt, userID, announce)
 }
 
-func (s *server) updatePresene(targets []net.Conn, userID uint32, isOnline bool) {
-	if len(targets) > 0 {
-		resPkt := &packets.ResponsePresencePacket{UserID: userID, IsOnline: isOnline}
-		log.Info.Println("Decode packet", "packet", resPkt.String())
-
-		for _, conn := range targets {
-			if err := s.writePacket(resPkt, conn); err != nil {
-				log.Error.Printf("failed to send presence for userID %d: %v", userID, err)
-			}
+// deliverRelayed fans out a packet a peer engine relayed to the members
+// of its conversations connected here, the way presence is fanned out.
+func (s *server) deliverRelayed(pkt *packets.RelayPacket) {
+	targets := s.registry.presenceTargets(pkt.Conversations, pkt.Exclude)
+	if len(targets) == 0 {
+		return
+	}
+	resPkt := s.prepare(pkt.Packet)
+	defer resPkt.Release()
+	for _, conn := range targets {
+		if err := s.writePrepared(resPkt, conn); err != nil {
+			log.Error.Printf("failed to deliver the relayed %s: %v", packets.Name(pkt.Packet.Type()), err)
 		}
 	}
 }
@@ -759,15 +910,52 @@ func (s *server) batchMessages(message worker.Message) {
 	}
 }
 
-func (s *server) handleErrorPacket(err error, conn net.Conn) {
-	if errors.Is(err, errors.Client) {
-		errWrite := s.writePacket(&packets.ErrorPacket{
-			Code:    errors.Client,
-			Message: "unexpected error try refreshing the page",
-		}, conn)
+func (s *server) handleErrorPacket(err error, conn net.Conn, correlationID uint32) {
+	// Rate limited packets aren't fatal, tell the gateway when to retry.
+	// Gateways that predate the packet get an error packet they ignore.
+	var rlErr *rateLimitError
+	if errors.As(err, &rlErr) {
+		var pkt packets.BuildPayload = rlErr.pkt
+		if !negotiated(conn).Has(packets.FeatureRateLimited) {
+			pkt = &packets.ErrorPacket{Code: errors.RateLimited, Message: "too many requests"}
+		}
+		if errWrite := s.reply(pkt, conn, correlationID); errWrite != nil {
+			log.Error.Println("failed to send 'rate limited' packet to client:", errWrite)
+		}
+		return
+	}
 
-		if errWrite != nil {
+	// A correlated request always gets an answer, the gateway reports it
+	// against the failed action and keeps the session.
+	if correlationID != 0 && negotiated(conn).Has(packets.FeatureCorrelation) {
+		pkt := &packets.ErrorPacket{
+			Code:    errors.Internal,
+			Reason:  errors.CodeOf(err),
+			Message: "request failed",
+		}
+		if errors.Is(err, errors.Client) {
+			pkt.Code = errors.Client
+			pkt.Message = "request rejected"
+		}
+		if errWrite := s.reply(pkt, conn, correlationID); errWrite != nil {
 			log.Error.Println("failed to send 'error packet' alert to client:", errWrite)
 		}
+		return
+	}
+
+	// Gateways that predate reason codes close the session on client
+	// errors and ignore the others.
+	pkt := &packets.ErrorPacket{
+		Code:    errors.Internal,
+		Reason:  errors.InternalFailure,
+		Message: "request failed",
+	}
+	if errors.Is(err, errors.Client) {
+		pkt.Code = errors.Client
+		pkt.Reason = errors.CodeOf(err)
+		pkt.Message = "unexpected error try refreshing the page"
+	}
+	if errWrite := s.writePacket(pkt, conn); errWrite != nil {
+		log.Error.Println("failed to send 'error packet' alert to client:", errWrite)
 	}
 }
@@ -0,0 +1,295 @@
+package tcp
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/iLeoon/realtime-gateway/internal/config"
+	"github.com/iLeoon/realtime-gateway/internal/protocol"
+	"github.com/iLeoon/realtime-gateway/internal/protocol/packets"
+	"github.com/iLeoon/realtime-gateway/internal/transport/tcp/worker"
+	"github.com/iLeoon/realtime-gateway/pkg/log"
+)
+
+// TestRateLimits adds two users to a private conversation the engine
+// hadn't seen, the way the REST API does. Its budget allows one message
+// and one typing indicator, the group budget would allow ten.
+func TestRateLimits(t *testing.T) {
+	log.SetLevel("disabled")
+	s := New()
+	s.db = newReplayDB(fixtureSetup)
+	s.messagesCh = make(chan worker.Message, 4)
+	s.limits = newLimiter(config.EngineLimits{
+		UserMessageRate: 0.001, UserMessageBurst: 10,
+		UserTypingRate: 0.001, UserTypingBurst: 10,
+		PrivateMessageRate: 0.001, PrivateMessageBurst: 1,
+		PrivateTypingRate: 0.001, PrivateTypingBurst: 1,
+		GroupMessageRate: 0.001, GroupMessageBurst: 10,
+		GroupTypingRate: 0.001, GroupTypingBurst: 10,
+	})
+
+	out := &memConn{}
+	sender := newPeerConn(out, 8, overflowDisconnect)
+	conns := map[uint32]*peerConn{10: sender, 20: newPeerConn(&memConn{}, 8, overflowDisconnect)}
+	var id uint32
+	hello := &protocol.Frame{Payload: &packets.HelloPacket{MinVersion: packets.Version1, MaxVersion: packets.CurrentVersion, Features: packets.FeatureRateLimited}}
+	if !s.packetsDispatcher(hello, sender, &id, context.Background()) {
+		t.Fatal("handshake failed")
+	}
+	connectAll(t, s, conns)
+	s.AddToRoom(10, 7, privateChat)
+	// As if it had sent a GatewayAuthPacket.
+	conns[20].gateway.Store(true)
+	membership := &protocol.Frame{Payload: &packets.MembershipPacket{UserID: 20, ConversationID: 7, Joined: true, ConversationType: privateChat}}
+	if !s.packetsDispatcher(membership, conns[20], &id, context.Background()) {
+		t.Fatal("membership packet was refused")
+	}
+
+	userID := uint32(10)
+	for range 2 {
+		for _, pkt := range []packets.BuildPayload{
+			&packets.SendMessagePacket{ConversationID: 7, Content: "hello"},
+			&packets.TypingPacket{ConversationID: 7, IsTyping: true},
+		} {
+			if !s.packetsDispatcher(&protocol.Frame{Payload: pkt}, sender, &userID, context.Background()) {
+				t.Fatalf("%v closed the connection", pkt)
+			}
+		}
+	}
+	for _, pc := range conns {
+		pc.stop()
+	}
+
+	limited := make(map[uint8]*packets.RateLimitedPacket)
+	for _, f := range splitFrames(t, out.out.Bytes()) {
+		if p, ok := f.Payload.(*packets.RateLimitedPacket); ok {
+			limited[p.Action] = p
+		}
+	}
+	for _, action := range []uint8{packets.SendMessage, packets.Typing} {
+		p, ok := limited[action]
+		if !ok {
+			t.Fatalf("action %d wasn't rate limited", action)
+		}
+		if p.ConversationID != 7 || p.Scope != packets.LimitScopeConversation || p.RetryAfter <= 0 {
+			t.Fatalf("action %d: %v", action, p)
+		}
+	}
+	if len(s.messagesCh) != 1 {
+		t.Fatalf("%d messages stored, want 1", len(s.messagesCh))
+	}
+}
+
+// TestRateLimitsEdits floods a conversation with edits and deletions. They
+// share the message budgets, past the burst each gets a rate_limited
+// packet and reaches neither the database nor the other members.
+func TestRateLimitsEdits(t *testing.T) {
+	log.SetLevel("disabled")
+	s := New()
+	s.db = newReplayDB(fixtureSetup)
+	s.messagesCh = make(chan worker.Message, 8)
+	s.limits = newLimiter(config.EngineLimits{
+		UserMessageRate: 0.001, UserMessageBurst: 3,
+		UserTypingRate: 0.001, UserTypingBurst: 10,
+		GroupMessageRate: 0.001, GroupMessageBurst: 10,
+		GroupTypingRate: 0.001, GroupTypingBurst: 10,
+	})
+
+	out, other := &memConn{}, &memConn{}
+	sender := newPeerConn(out, 16, overflowDisconnect)
+	conns := map[uint32]*peerConn{10: sender, 20: newPeerConn(other, 16, overflowDisconnect)}
+	var id uint32
+	hello := &protocol.Frame{Payload: &packets.HelloPacket{MinVersion: packets.Version1, MaxVersion: packets.CurrentVersion, Features: packets.FeatureRateLimited}}
+	if !s.packetsDispatcher(hello, sender, &id, context.Background()) {
+		t.Fatal("handshake failed")
+	}
+	connectAll(t, s, conns)
+
+	userID := uint32(10)
+	for range 4 {
+		for _, pkt := range []packets.BuildPayload{
+			&packets.UpdateMessagePacket{MessageID: 99, ConversationID: 1, Content: "edited"},
+			&packets.DeleteMessagePacket{MessageID: 99, ConversationID: 1},
+		} {
+			if !s.packetsDispatcher(&protocol.Frame{Payload: pkt}, sender, &userID, context.Background()) {
+				t.Fatalf("%v closed the connection", pkt)
+			}
+		}
+	}
+	for _, pc := range conns {
+		pc.stop()
+	}
+
+	limited := make(map[uint8]int)
+	for _, f := range splitFrames(t, out.out.Bytes()) {
+		if p, ok := f.Payload.(*packets.RateLimitedPacket); ok {
+			if p.Scope != packets.LimitScopeUser || p.ConversationID != 1 || p.RetryAfter <= 0 {
+				t.Fatalf("rate limited with %v", p)
+			}
+			limited[p.Action]++
+		}
+	}
+	if limited[packets.UpdateMessage] != 2 || limited[packets.DeleteMessage] != 3 {
+		t.Fatalf("rate limited %d edits and %d deletions, want 2 and 3", limited[packets.UpdateMessage], limited[packets.DeleteMessage])
+	}
+	if len(s.messagesCh) != 3 {
+		t.Fatalf("%d changes stored, want 3", len(s.messagesCh))
+	}
+	delivered := countFrames(t, other, packets.UpdateResponse) + countFrames(t, other, packets.DeleteResponse)
+	if delivered != 3 {
+		t.Fatalf("userID 20 got %d changes, want 3", delivered)
+	}
+}
+
+// TestMessageCreatedAt sends a message to a version 3 and a version 2
+// gateway. The first gets the time the message is handed to the worker
+// with, which stores it as is, and the author's profile, the second the
+// layout it knows.
+func TestMessageCreatedAt(t *testing.T) {
+	log.SetLevel("disabled")
+	s := New()
+	s.db = newReplayDB(fixtureSetup)
+	s.messagesCh = make(chan worker.Message, 1)
+
+	v3, v2 := &memConn{}, &memConn{}
+	sender := newPeerConn(&memConn{}, 8, overflowDisconnect)
+	conns := map[uint32]*peerConn{
+		10: newPeerConn(v3, 8, overflowDisconnect),
+		20: newPeerConn(v2, 8, overflowDisconnect),
+		30: sender,
+	}
+	for userID, version := range map[uint32]uint8{10: packets.Version3, 20: packets.Version2} {
+		var id uint32
+		hello := &protocol.Frame{Payload: &packets.HelloPacket{MinVersion: packets.Version1, MaxVersion: version}}
+		if !s.packetsDispatcher(hello, conns[userID], &id, context.Background()) {
+			t.Fatalf("handshake of user %d failed", userID)
+		}
+	}
+	connectAll(t, s, conns)
+
+	userID := uint32(30)
+	frame := &protocol.Frame{Payload: &packets.SendMessagePacket{ConversationID: 1, Content: "hello"}}
+	s.packetsDispatcher(frame, sender, &userID, context.Background())
+	for _, pc := range conns {
+		pc.stop()
+	}
+	stored := <-s.messagesCh
+
+	message := func(c *memConn) *packets.ResponseMessagePacket {
+		t.Helper()
+		for _, f := range splitFrames(t, c.out.Bytes()) {
+			if p, ok := f.Payload.(*packets.ResponseMessagePacket); ok {
+				return p
+			}
+		}
+		t.Fatal("no message was delivered")
+		return nil
+	}
+	got := message(v3)
+	if got.CreatedAt.IsZero() || !got.CreatedAt.Equal(stored.CreatedAt) {
+		t.Fatalf("delivered with created at %v, stored with %v", got.CreatedAt, stored.CreatedAt)
+	}
+	if got.AuthorName != "user 30" {
+		t.Fatalf("author name %q, want %q", got.AuthorName, "user 30")
+	}
+	if old := message(v2); !old.CreatedAt.IsZero() || old.AuthorName != "" || old.ResContent != "hello" {
+		t.Fatalf("version 2 gateway got %v", old)
+	}
+}
+
+// TestLargeMessages sends messages around MESSAGE_MAX_CHARS, the one at
+// the limit is larger than a frame and reaches version 3 gateways in
+// fragments.
+func TestLargeMessages(t *testing.T) {
+	log.SetLevel("disabled")
+	s := New()
+	s.conf.MessageMaxChars = 1500
+	s.db = newReplayDB(fixtureSetup)
+	s.messagesCh = make(chan worker.Message, 1)
+
+	out, refused := &memConn{}, &memConn{}
+	sender := newPeerConn(refused, 8, overflowDisconnect)
+	conns := map[uint32]*peerConn{10: newPeerConn(out, 8, overflowDisconnect), 30: sender}
+	var id uint32
+	hello := &protocol.Frame{Payload: &packets.HelloPacket{MinVersion: packets.Version1, MaxVersion: packets.Version3}}
+	if !s.packetsDispatcher(hello, conns[10], &id, context.Background()) {
+		t.Fatal("handshake failed")
+	}
+	connectAll(t, s, conns)
+
+	userID := uint32(30)
+	content := strings.Repeat("ü", 1500)
+	for _, c := range []string{content, content + "!"} {
+		frame := &protocol.Frame{Payload: &packets.SendMessagePacket{ConversationID: 1, Content: c}}
+		s.packetsDispatcher(frame, sender, &userID, context.Background())
+	}
+	for _, pc := range conns {
+		pc.stop()
+	}
+
+	var delivered []string
+	for _, f := range splitFrames(t, out.out.Bytes()) {
+		if p, ok := f.Payload.(*packets.ResponseMessagePacket); ok {
+			delivered = append(delivered, p.ResContent)
+		}
+	}
+	if len(delivered) != 1 || delivered[0] != content {
+		t.Fatalf("delivered %d messages, want the one of 1500 characters", len(delivered))
+	}
+	if stored := <-s.messagesCh; stored.Content != content {
+		t.Fatalf("stored %d bytes, want %d", len(stored.Content), len(content))
+	}
+	if got := countFrames(t, refused, packets.Error); got != 1 {
+		t.Fatalf("%d errors, want the one refusing 1501 characters", got)
+	}
+}
+
+// TestRegisterMovesStaleConnection registers userID 10's connection again
+// over a new link before the old link's read loop ended, as a gateway that
+// redialed does. Messages go over the new link, and the old link giving
+// up late doesn't take the connection with it.
+func TestRegisterMovesStaleConnection(t *testing.T) {
+	log.SetLevel("disabled")
+	s := New()
+	s.db = newReplayDB(fixtureSetup)
+	s.messagesCh = make(chan worker.Message, 1)
+
+	stale, fresh := &memConn{}, &memConn{}
+	old := newPeerConn(stale, 8, overflowDisconnect)
+	sender := newPeerConn(&memConn{}, 8, overflowDisconnect)
+	connectAll(t, s, map[uint32]*peerConn{10: old, 20: sender})
+
+	redialed := newPeerConn(fresh, 8, overflowDisconnect)
+	connectAll(t, s, map[uint32]*peerConn{10: redialed})
+	s.dropSessions(old)
+	if _, ok := s.registry.member(10, 1); !ok {
+		t.Fatal("userID 10 went offline with the stale link")
+	}
+
+	// Another user can't take the connection over.
+	intruder := &memConn{}
+	other := newPeerConn(intruder, 8, overflowDisconnect)
+	var id uint32
+	connect := &protocol.Frame{Payload: &packets.ConnectPacket{ConnectionID: 10, UserID: 30}}
+	s.packetsDispatcher(connect, other, &id, context.Background())
+
+	userID := uint32(20)
+	frame := &protocol.Frame{Payload: &packets.SendMessagePacket{ConversationID: 1, Content: "hello"}}
+	s.packetsDispatcher(frame, sender, &userID, context.Background())
+	for _, pc := range []*peerConn{old, sender, redialed, other} {
+		pc.stop()
+	}
+	if got := countFrames(t, fresh, packets.ResponseMessage); got != 1 {
+		t.Fatalf("the new link got %d messages, want 1", got)
+	}
+	if got := countFrames(t, stale, packets.ResponseMessage); got != 0 {
+		t.Fatalf("the stale link got %d messages", got)
+	}
+	if got := countFrames(t, fresh, packets.Error); got != 0 {
+		t.Fatalf("registering over the new link failed with %d errors", got)
+	}
+	if got := countFrames(t, intruder, packets.Error); got != 1 {
+		t.Fatalf("userID 30 got %d errors taking over userID 10's connection, want 1", got)
+	}
+}
@@ -2,10 +2,15 @@ package tcp
 
 import (
 	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"math/rand/v2"
 	"net"
 	"testing"
 	"time"
 
+	"github.com/iLeoon/realtime-gateway/internal/config"
 	"github.com/iLeoon/realtime-gateway/internal/protocol"
 	"github.com/iLeoon/realtime-gateway/internal/protocol/packets"
 	"github.com/iLeoon/realtime-gateway/pkg/log"
@@ -13,11 +18,12 @@ import (
 
 func New() *server {
 	return &server{
-		db:                &noDBConn{},
-		connections:       make(map[uint32]net.Conn),
-		clients:           make(map[uint32][]uint32),
-		userConversations: make(map[uint32]map[uint32]struct{}),
-		roomManager:       make(map[uint32]map[uint32]struct{}),
+		// In-memory connections are neither unix sockets nor tls, they
+		// stand in for a trusted link.
+		conf:     &config.Config{TCP: config.TCP{EngineAuth: config.EngineAuth{EngineInsecureConnect: true}}},
+		db:       &noDBConn{},
+		registry: newRegistry(registryShards),
+		done:     make(chan struct{}),
 	}
 }
 
@@ -32,8 +38,26 @@ type noDBConn struct {
 	DBConnection
 }
 
-func (m *noDBConn) FetchMembers(userID uint32, ctx context.Context) ([]MemberShip, error) {
-	return []MemberShip{{1, 10}, {2, 20}, {3, 30}, {4, 40}}, nil
+func (m *noDBConn) FetchMembers(userIDs []uint32, ctx context.Context) (map[uint32][]MemberShip, error) {
+	rows := make(map[uint32][]MemberShip, len(userIDs))
+	for _, id := range userIDs {
+		rows[id] = []MemberShip{{1, 10, privateChat}, {2, 20, groupChat}, {3, 30, groupChat}, {4, 40, groupChat}}
+	}
+	return rows, nil
+}
+
+// ListenMemberships is never notified.
+func (m *noDBConn) ListenMemberships(ctx context.Context, apply func(MembershipChange)) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func (m *noDBConn) FetchAuthor(userID uint32, ctx context.Context) (Author, error) {
+	return Author{Name: fmt.Sprintf("user %d", userID)}, nil
+}
+
+func (m *noDBConn) FetchMsg(ctx context.Context) (uint32, error) {
+	return 1, nil
 }
 
 const (
@@ -78,4 +102,174 @@ func BenchmarkPacketsDispatcher(b *testing.B) {
 
 	b.Run("Update", func(b *testing.B) {})
 
+	// SendMessage fans one message out to the 100 connections of a group,
+	// the frame is encoded once and queued on each connection. It runs
+	// once per transport, "mem" discards the frames without a socket. The
+	// queues are sized so the writers keep up, drops/op shows when they
+	// don't.
+	b.Run("SendMessage", func(b *testing.B) {
+		for _, scheme := range benchTransports {
+			b.Run(scheme, func(b *testing.B) {
+				s := New()
+				ctx := context.Background()
+				var recipients []*peerConn
+				for i, conn := range benchConns(b, scheme, 100) {
+					var userID uint32
+					pc := newPeerConn(conn, 4096, overflowDrop)
+					recipients = append(recipients, pc)
+					frame := &protocol.Frame{
+						Header:  ConnectPacket,
+						Payload: &packets.ConnectPacket{UserID: 20, ConnectionID: uint32(i + 1)}}
+					s.packetsDispatcher(frame, pc, &userID, ctx)
+				}
+				userID := uint32(20)
+				frame := &protocol.Frame{
+					Header:  protocol.FrameHeader{Magic: magic, Opcode: packets.SendMessage},
+					Payload: &packets.SendMessagePacket{ConversationID: 2, Content: "hello group"}}
+				conn := newPeerConn(&noOpConn{}, 0, overflowDrop)
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					s.packetsDispatcher(frame, conn, &userID, ctx)
+				}
+				b.StopTimer()
+
+				var dropped uint64
+				for _, pc := range recipients {
+					pc.stop()
+					dropped += uint64(pc.dropped.Load())
+				}
+				b.ReportMetric(float64(dropped)/float64(b.N), "drops/op")
+			})
+		}
+	})
+
+}
+
+// benchTransports are the links BenchmarkPacketsDispatcher fans out over.
+var benchTransports = []string{"mem", "tcp", "unix", "tls"}
+
+// benchConns returns n engine side connections over scheme, the gateway
+// side reads and discards whatever is written to them.
+func benchConns(b *testing.B, scheme string, n int) []net.Conn {
+	b.Helper()
+	conns := make([]net.Conn, n)
+	if scheme == "mem" {
+		for i := range conns {
+			conns[i] = &noOpConn{}
+		}
+		return conns
+	}
+
+	dir := b.TempDir()
+	var auth config.EngineAuth
+	if scheme == "tls" {
+		auth = writeTestPKI(b, dir)
+	}
+	l, _, gateway := listenTransport(b, scheme, dir, auth)
+	for i := range conns {
+		// The TLS handshake needs both ends, dial while accepting.
+		dialed := make(chan net.Conn, 1)
+		go func() {
+			conn, err := gateway.Dial(context.Background())
+			if err != nil {
+				b.Error(err)
+			}
+			dialed <- conn
+		}()
+		conn, err := l.Accept()
+		if err != nil {
+			b.Fatal(err)
+		}
+		if tc, ok := conn.(*tls.Conn); ok {
+			if err := tc.Handshake(); err != nil {
+				b.Fatal(err)
+			}
+		}
+		client := <-dialed
+		if client == nil {
+			b.FailNow()
+		}
+		go io.Copy(io.Discard, client)
+		b.Cleanup(func() {
+			conn.Close()
+			client.Close()
+		})
+		conns[i] = conn
+	}
+	return conns
+}
+
+// benchRoom is the size of the group every user of BenchmarkRegistry is
+// in, each of them also has a private chat with a neighbour.
+const benchRoom = 50
+
+func benchGroup(userID uint32) uint32 { return (userID-1)/benchRoom + 1 }
+
+// benchMemberships is what FetchMembers returns for userID.
+func benchMemberships(userID uint32, users int) []MemberShip {
+	group := benchGroup(userID)
+	rows := make([]MemberShip, 0, benchRoom+2)
+	for m := (group-1)*benchRoom + 1; m <= group*benchRoom && m <= uint32(users); m++ {
+		rows = append(rows, MemberShip{group, m, groupChat})
+	}
+	private := uint32(users/benchRoom+1) + (userID+1)/2
+	first := userID - (userID+1)%2
+	rows = append(rows, MemberShip{private, first, privateChat}, MemberShip{private, first + 1, privateChat})
+	return rows
+}
+
+// BenchmarkRegistry runs connects, message and typing fan-out snapshots
+// from parallel goroutines against a registry of 10k and 100k online
+// users. One shard is the single lock the server used to have.
+func BenchmarkRegistry(b *testing.B) {
+	workloads := []struct {
+		name string
+		op   func(r *registry, userID uint32, users int, i int, dst []FanOut) []FanOut
+	}{
+		{"Register", func(r *registry, userID uint32, users int, _ int, dst []FanOut) []FanOut {
+			r.unregister(userID, userID, nil)
+			r.register(userID, userID, &noOpConn{}, benchMemberships(userID, users))
+			return dst
+		}},
+		{"Send", func(r *registry, userID uint32, _ int, _ int, dst []FanOut) []FanOut {
+			dst, _ = r.targets(dst[:0], benchGroup(userID), userID, false)
+			return dst
+		}},
+		{"Typing", func(r *registry, userID uint32, _ int, _ int, dst []FanOut) []FanOut {
+			dst, _ = r.targets(dst[:0], benchGroup(userID), userID, true)
+			return dst
+		}},
+		// One connect for every nine fan-outs.
+		{"Mixed", func(r *registry, userID uint32, users int, i int, dst []FanOut) []FanOut {
+			if i%10 == 0 {
+				r.unregister(userID, userID, nil)
+				r.register(userID, userID, &noOpConn{}, benchMemberships(userID, users))
+				return dst
+			}
+			dst, _ = r.targets(dst[:0], benchGroup(userID), userID, i%2 == 0)
+			return dst
+		}},
+	}
+
+	for _, users := range []int{10_000, 100_000} {
+		for _, shards := range []int{1, registryShards} {
+			r := newRegistry(shards)
+			for u := 1; u <= users; u++ {
+				r.register(uint32(u), uint32(u), &noOpConn{}, benchMemberships(uint32(u), users))
+			}
+			for _, w := range workloads {
+				b.Run(fmt.Sprintf("users=%d/shards=%d/%s", users, shards, w.name), func(b *testing.B) {
+					b.ReportAllocs()
+					b.RunParallel(func(pb *testing.PB) {
+						rng := rand.New(rand.NewPCG(rand.Uint64(), rand.Uint64()))
+						var dst []FanOut
+						for i := 0; pb.Next(); i++ {
+							dst = w.op(r, uint32(rng.IntN(users))+1, users, i, dst)
+						}
+					})
+				})
+			}
+		}
+	}
 }
@@ -0,0 +1,247 @@
+package tcp
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/iLeoon/realtime-gateway/internal/config"
+	"github.com/iLeoon/realtime-gateway/internal/errors"
+	"github.com/iLeoon/realtime-gateway/pkg/log"
+)
+
+const transportPath errors.PathName = "tcp/transport"
+
+// Transport is the link between the gateway and the engine. The engine
+// listens on it and the gateway dials it, both ends are built from the
+// same URL:
+//
+//	tcp://host:port          plain TCP, the default
+//	unix:///run/rtg.sock     a Unix socket, when both run on one host
+//	tls://host:port          TCP with mutual TLS, see config.EngineAuth
+type Transport interface {
+	Listen() (net.Listener, error)
+	Dial(ctx context.Context) (net.Conn, error)
+	// String returns the URL the transport was parsed from.
+	String() string
+}
+
+// EngineTransport returns the transport configured with ENGINE_URL, plain
+// TCP on TCP_SERVER_PORT when it's empty.
+func EngineTransport(c *config.Config) (Transport, error) {
+	rawURL := c.EngineURL
+	if rawURL == "" {
+		rawURL = "tcp://" + c.TCPPort
+	}
+	return ParseTransport(rawURL, c.EngineAuth)
+}
+
+// ParseTransport builds the transport rawURL describes. tls:// loads the
+// credentials of auth and fails if they can't be read.
+func ParseTransport(rawURL string, auth config.EngineAuth) (Transport, error) {
+	const op errors.Op = "tcp.ParseTransport"
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, errors.B(transportPath, op, errors.Internal, err)
+	}
+	switch u.Scheme {
+	case "tcp":
+		if u.Host == "" {
+			return nil, errors.B(transportPath, op, errors.Internal, fmt.Errorf("%q has no address", rawURL))
+		}
+		return &streamTransport{network: "tcp", addr: u.Host, url: rawURL}, nil
+	case "unix":
+		if u.Path == "" {
+			return nil, errors.B(transportPath, op, errors.Internal, fmt.Errorf("%q has no socket path", rawURL))
+		}
+		return &streamTransport{network: "unix", addr: u.Path, url: rawURL}, nil
+	case "tls":
+		if u.Host == "" {
+			return nil, errors.B(transportPath, op, errors.Internal, fmt.Errorf("%q has no address", rawURL))
+		}
+		certs, err := newCertReloader(auth)
+		if err != nil {
+			return nil, errors.B(transportPath, op, err)
+		}
+		serverName := auth.EngineTLSServerName
+		if serverName == "" {
+			serverName = u.Hostname()
+		}
+		if serverName == "" {
+			serverName = "localhost"
+		}
+		return &tlsTransport{
+			streamTransport: streamTransport{network: "tcp", addr: u.Host, url: rawURL},
+			certs:           certs,
+			serverName:      serverName,
+		}, nil
+	default:
+		return nil, errors.B(transportPath, op, errors.Internal, fmt.Errorf("unknown engine transport %q, want tcp, unix or tls", u.Scheme))
+	}
+}
+
+// socketMode lets the engine's user and group connect to its Unix socket.
+const socketMode fs.FileMode = 0o660
+
+// streamTransport is a plain TCP or Unix socket.
+type streamTransport struct {
+	network string
+	addr    string
+	url     string
+}
+
+func (t *streamTransport) String() string { return t.url }
+
+func (t *streamTransport) Dial(ctx context.Context) (net.Conn, error) {
+	var d net.Dialer
+	return d.DialContext(ctx, t.network, t.addr)
+}
+
+func (t *streamTransport) Listen() (net.Listener, error) {
+	const op errors.Op = "streamTransport.Listen"
+	if t.network != "unix" {
+		l, err := net.Listen(t.network, t.addr)
+		if err != nil {
+			return nil, errors.B(transportPath, op, err)
+		}
+		return l, nil
+	}
+
+	// A socket left behind by an engine that crashed blocks the bind,
+	// anything else at that path is left alone.
+	if fi, err := os.Lstat(t.addr); err == nil && fi.Mode()&fs.ModeSocket != 0 {
+		os.Remove(t.addr)
+	}
+	l, err := net.Listen("unix", t.addr)
+	if err != nil {
+		return nil, errors.B(transportPath, op, err)
+	}
+	if err := os.Chmod(t.addr, socketMode); err != nil {
+		l.Close()
+		return nil, errors.B(transportPath, op, err)
+	}
+	return l, nil
+}
+
+// tlsTransport is TCP with mutual TLS. Every handshake uses the newest
+// credentials, renewing the certificate or the CA needs no restart.
+type tlsTransport struct {
+	streamTransport
+	certs      *certReloader
+	serverName string
+}
+
+func (t *tlsTransport) Dial(ctx context.Context) (net.Conn, error) {
+	cert, pool := t.certs.current()
+	d := tls.Dialer{Config: &tls.Config{
+		Certificates: []tls.Certificate{*cert},
+		RootCAs:      pool,
+		ServerName:   t.serverName,
+		MinVersion:   tls.VersionTLS13,
+	}}
+	return d.DialContext(ctx, t.network, t.addr)
+}
+
+func (t *tlsTransport) Listen() (net.Listener, error) {
+	l, err := t.streamTransport.Listen()
+	if err != nil {
+		return nil, err
+	}
+	return tls.NewListener(l, &tls.Config{
+		MinVersion: tls.VersionTLS13,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cert, pool := t.certs.current()
+			return &tls.Config{
+				Certificates: []tls.Certificate{*cert},
+				ClientAuth:   tls.RequireAndVerifyClientCert,
+				ClientCAs:    pool,
+				MinVersion:   tls.VersionTLS13,
+			}, nil
+		},
+	}), nil
+}
+
+// certReloader holds the TLS credentials of the engine link and reloads
+// them once their files change. It looks at the files at most once every
+// interval, a reload that fails keeps the previous credentials.
+type certReloader struct {
+	files    [3]string // CA, certificate, key
+	interval time.Duration
+
+	mu      sync.Mutex
+	checked time.Time
+	mtimes  [3]time.Time
+	cert    *tls.Certificate
+	pool    *x509.CertPool
+}
+
+func newCertReloader(auth config.EngineAuth) (*certReloader, error) {
+	const op errors.Op = "tcp.newCertReloader"
+	if auth.EngineTLSCA == "" || auth.EngineTLSCert == "" || auth.EngineTLSKey == "" {
+		return nil, errors.B(transportPath, op, errors.Internal, "tls:// needs ENGINE_TLS_CA, ENGINE_TLS_CERT and ENGINE_TLS_KEY")
+	}
+	r := &certReloader{
+		files:    [3]string{auth.EngineTLSCA, auth.EngineTLSCert, auth.EngineTLSKey},
+		interval: certCheckInterval,
+	}
+	if err := r.load(r.stat()); err != nil {
+		return nil, errors.B(transportPath, op, err)
+	}
+	r.checked = time.Now()
+	return r, nil
+}
+
+// current returns the credentials to use for a new handshake.
+func (r *certReloader) current() (*tls.Certificate, *x509.CertPool) {
+	const op errors.Op = "certReloader.current"
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if now := time.Now(); now.Sub(r.checked) >= r.interval {
+		r.checked = now
+		if mtimes := r.stat(); mtimes != r.mtimes {
+			if err := r.load(mtimes); err != nil {
+				log.Error.Println(errors.B(transportPath, op, "keeping the previous engine link credentials", err))
+			} else {
+				log.Info.Println("reloaded the engine link credentials")
+			}
+		}
+	}
+	return r.cert, r.pool
+}
+
+func (r *certReloader) stat() (mtimes [3]time.Time) {
+	for i, file := range r.files {
+		if fi, err := os.Stat(file); err == nil {
+			mtimes[i] = fi.ModTime()
+		}
+	}
+	return mtimes
+}
+
+// load parses the files and swaps them in when all of them are valid.
+// mtimes is recorded either way, a broken file is reported once.
+func (r *certReloader) load(mtimes [3]time.Time) error {
+	const op errors.Op = "certReloader.load"
+	r.mtimes = mtimes
+	caPEM, err := os.ReadFile(r.files[0])
+	if err != nil {
+		return errors.B(transportPath, op, errors.Internal, "failed to read the engine link CA", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return errors.B(transportPath, op, errors.Internal, fmt.Errorf("no certificate found in %s", r.files[0]))
+	}
+	cert, err := tls.LoadX509KeyPair(r.files[1], r.files[2])
+	if err != nil {
+		return errors.B(transportPath, op, errors.Internal, "failed to load the engine link certificate", err)
+	}
+	r.cert, r.pool = &cert, pool
+	return nil
+}
@@ -0,0 +1,225 @@
+package tcp
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/iLeoon/realtime-gateway/internal/config"
+	"github.com/iLeoon/realtime-gateway/internal/protocol"
+	"github.com/iLeoon/realtime-gateway/internal/protocol/packets"
+	"github.com/iLeoon/realtime-gateway/pkg/log"
+)
+
+// listenTransport starts listening on a transport of the given scheme,
+// on a free port or in dir. It returns the listener, the engine's
+// transport and one for the gateway to dial it with.
+func listenTransport(tb testing.TB, scheme, dir string, auth config.EngineAuth) (l net.Listener, engine, gateway Transport) {
+	tb.Helper()
+	rawURL := scheme + "://127.0.0.1:0"
+	if scheme == "unix" {
+		rawURL = "unix://" + filepath.Join(dir, "engine.sock")
+	}
+	engine, err := ParseTransport(rawURL, auth)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if l, err = engine.Listen(); err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { l.Close() })
+	if scheme == "unix" {
+		return l, engine, engine
+	}
+	if gateway, err = ParseTransport(scheme+"://"+l.Addr().String(), auth); err != nil {
+		tb.Fatal(err)
+	}
+	return l, engine, gateway
+}
+
+// serve runs the engine's accept loop on l until it's closed.
+func serve(s *server, l net.Listener) {
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.handleConn(conn)
+		}
+	}()
+}
+
+func handshake(t *testing.T, transport Transport) error {
+	t.Helper()
+	conn, err := transport.Dial(context.Background())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	// TLS 1.3 clients learn about a rejected certificate on their first read.
+	conn.SetDeadline(time.Now().Add(time.Second))
+	proto, err := protocol.ClientHandshake(conn)
+	if err != nil {
+		return err
+	}
+	if proto.Version != packets.CurrentVersion {
+		t.Fatalf("negotiated version %d", proto.Version)
+	}
+	return nil
+}
+
+func TestTransports(t *testing.T) {
+	log.SetLevel("disabled")
+	dir := t.TempDir()
+	auth := writeTestPKI(t, dir)
+
+	for _, scheme := range []string{"tcp", "unix", "tls"} {
+		t.Run(scheme, func(t *testing.T) {
+			l, _, transport := listenTransport(t, scheme, dir, auth)
+			serve(New(), l)
+			if err := handshake(t, transport); err != nil {
+				t.Fatalf("handshake over %s: %v", transport, err)
+			}
+		})
+	}
+
+	t.Run("socket mode", func(t *testing.T) {
+		_, transport, _ := listenTransport(t, "unix", t.TempDir(), auth)
+		fi, err := os.Stat(transport.(*streamTransport).addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode().Perm() != socketMode {
+			t.Fatalf("socket mode %v, want %v", fi.Mode().Perm(), socketMode)
+		}
+	})
+
+	t.Run("tls without client certificate", func(t *testing.T) {
+		l, _, transport := listenTransport(t, "tls", dir, auth)
+		serve(New(), l)
+		_, pool := transport.(*tlsTransport).certs.current()
+		conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{RootCAs: pool, ServerName: "localhost"})
+		if err == nil {
+			conn.SetDeadline(time.Now().Add(time.Second))
+			_, err = protocol.ClientHandshake(conn)
+			conn.Close()
+		}
+		if err == nil {
+			t.Fatal("a client without a certificate got through")
+		}
+	})
+
+	for _, rawURL := range []string{"quic://localhost:1", "tcp://", "unix://", "tls://localhost:1"} {
+		if _, err := ParseTransport(rawURL, config.EngineAuth{}); err == nil {
+			t.Errorf("ParseTransport(%q) succeeded", rawURL)
+		}
+	}
+}
+
+// TestCertReload renews the PKI while the engine runs. New handshakes use
+// the new credentials, a gateway still holding the old CA is refused.
+func TestCertReload(t *testing.T) {
+	log.SetLevel("disabled")
+	dir := t.TempDir()
+	auth := writeTestPKI(t, dir)
+
+	l, engine, gateway := listenTransport(t, "tls", dir, auth)
+	engine.(*tlsTransport).certs.interval = 0
+	serve(New(), l)
+	if err := handshake(t, gateway); err != nil {
+		t.Fatal(err)
+	}
+
+	renewed := writeTestPKI(t, dir)
+	// Make the change visible on file systems with coarse timestamps.
+	later := time.Now().Add(time.Minute)
+	for _, file := range []string{renewed.EngineTLSCA, renewed.EngineTLSCert, renewed.EngineTLSKey} {
+		if err := os.Chtimes(file, later, later); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fresh, err := ParseTransport("tls://"+l.Addr().String(), renewed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := handshake(t, fresh); err != nil {
+		t.Fatalf("the engine didn't pick up the renewed certificate: %v", err)
+	}
+	// The gateway checks its files every certCheckInterval, it still holds
+	// the old CA and certificate.
+	if err := handshake(t, gateway); err == nil {
+		t.Fatal("the engine accepted the replaced certificate")
+	}
+}
+
+// writeTestPKI writes a fresh CA and a certificate for localhost signed
+// by it, used by both ends of the link.
+func writeTestPKI(tb testing.TB, dir string) config.EngineAuth {
+	tb.Helper()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "engine link CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	leafKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	leafTmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	leafDER, err := x509.CreateCertificate(rand.Reader, leafTmpl, caTmpl, &leafKey.PublicKey, caKey)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(leafKey)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	write := func(name, typ string, der []byte) string {
+		file := filepath.Join(dir, name)
+		if err := os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0o600); err != nil {
+			tb.Fatal(err)
+		}
+		return file
+	}
+	return config.EngineAuth{
+		EngineTLSCA:   write("ca.pem", "CERTIFICATE", caDER),
+		EngineTLSCert: write("engine.pem", "CERTIFICATE", leafDER),
+		EngineTLSKey:  write("engine.key", "EC PRIVATE KEY", keyDER),
+	}
+}
@@ -0,0 +1,236 @@
+package tcp
+
+import (
+	"context"
+	"encoding/gob"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/iLeoon/realtime-gateway/internal/errors"
+	"github.com/iLeoon/realtime-gateway/pkg/log"
+)
+
+// snapshotVersion is bumped whenever engineSnapshot changes shape, older
+// snapshots are ignored.
+const snapshotVersion = 1
+
+// engineSnapshot is what the engine writes to ENGINE_SNAPSHOT_FILE on
+// shutdown.
+type engineSnapshot struct {
+	Version int
+	Taken   time.Time
+	Rooms   []snapshotRoom
+	Online  []uint32
+}
+
+// warmStart holds the memberships of the users expected back after a
+// restart, so their connects don't each query the database.
+//
+// Users are prefetched in batches as soon as the engine starts. With a
+// recent snapshot their memberships are known from its room index even
+// before that, a user registered from the snapshot has their rooms
+// replaced once the database answered for them.
+type warmStart struct {
+	mu    sync.Mutex
+	cache map[uint32]warmEntry // nil once warmTTL passed
+	// restoring are the users whose snapshot entry was taken. The
+	// database's rows wait here when they arrive before the user is
+	// registered.
+	restoring map[uint32]*warmEntry
+	until     time.Time
+}
+
+type warmEntry struct {
+	rows       []MemberShip
+	fresh      bool // the rows came from the database
+	registered bool
+}
+
+// take returns the memberships known for userID, each of them is used
+// once. fresh is false when they came from the snapshot, the caller then
+// reports the registration with registered.
+func (w *warmStart) take(userID uint32) (rows []MemberShip, fresh, ok bool) {
+	if w == nil {
+		return nil, false, false
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if time.Now().After(w.until) {
+		w.cache = nil
+	}
+	e, ok := w.cache[userID]
+	if !ok {
+		return nil, false, false
+	}
+	delete(w.cache, userID)
+	if !e.fresh {
+		w.restoring[userID] = &warmEntry{}
+	}
+	return e.rows, e.fresh, true
+}
+
+// registered records that userID was registered from the snapshot. When
+// the database already answered, its rows are returned to be applied.
+func (w *warmStart) registered(userID uint32) (rows []MemberShip, ok bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	e, ok := w.restoring[userID]
+	if !ok {
+		return nil, false
+	}
+	if e.fresh {
+		delete(w.restoring, userID)
+		return e.rows, true
+	}
+	e.registered = true
+	return nil, false
+}
+
+// loaded stores memberships fetched from the database. It reports whether
+// userID was registered from the snapshot and needs them applied.
+func (w *warmStart) loaded(userID uint32, rows []MemberShip) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if e, ok := w.restoring[userID]; ok {
+		if e.registered {
+			delete(w.restoring, userID)
+			return true
+		}
+		e.rows, e.fresh = rows, true
+		return false
+	}
+	if w.cache != nil {
+		w.cache[userID] = warmEntry{rows: rows, fresh: true}
+	}
+	return false
+}
+
+// newWarmStart builds the warm start of snap, its room index is only used
+// when the snapshot isn't older than maxAge.
+func newWarmStart(snap *engineSnapshot, maxAge time.Duration) *warmStart {
+	w := &warmStart{
+		cache:     make(map[uint32]warmEntry, len(snap.Online)),
+		restoring: make(map[uint32]*warmEntry),
+		until:     time.Now().Add(warmTTL),
+	}
+	if time.Since(snap.Taken) > maxAge {
+		return w
+	}
+	// Only the users that were online are expected back. Their rows are
+	// every member of every room they're in, the way FetchMembers returns
+	// them.
+	online := make(map[uint32]bool, len(snap.Online))
+	for _, id := range snap.Online {
+		online[id] = true
+		w.cache[id] = warmEntry{}
+	}
+	for _, rm := range snap.Rooms {
+		for _, member := range rm.Members {
+			if !online[member] {
+				continue
+			}
+			e := w.cache[member]
+			for _, other := range rm.Members {
+				e.rows = append(e.rows, MemberShip{rm.ID, other, rm.Type})
+			}
+			w.cache[member] = e
+		}
+	}
+	return w
+}
+
+// restore loads ENGINE_SNAPSHOT_FILE, if there is one, and prefetches the
+// memberships of the users that were online when it was written.
+func (s *server) restore() {
+	const op errors.Op = "server.restore"
+	file := s.conf.EngineSnapshotFile
+	snap, err := readSnapshot(file)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Error.Println("the snapshot couldn't be read, starting cold", errors.B(path, op, err))
+		}
+		return
+	}
+	s.warm = newWarmStart(snap, s.conf.EngineSnapshotMaxAge)
+	log.Info.Println("restored the engine snapshot", "taken", snap.Taken, "rooms", len(snap.Rooms), "online", len(snap.Online))
+	go s.prefetch(snap.Online)
+}
+
+// prefetch fetches the memberships of userIDs in batches. Users that
+// connect meanwhile join the batch they're in rather than querying again.
+func (s *server) prefetch(userIDs []uint32) {
+	const op errors.Op = "server.prefetch"
+	batch := s.conf.EngineMemberBatch
+	if batch <= 0 {
+		batch = defaultMemberBatch
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), warmTTL)
+	defer cancel()
+	for start := 0; start < len(userIDs); start += batch {
+		ids := userIDs[start:min(start+batch, len(userIDs))]
+		rows, err := s.members.loadAll(ctx, s.db, batch, ids)
+		if err != nil {
+			log.Error.Println("prefetching memberships failed", errors.B(path, op, err))
+			continue
+		}
+		for _, id := range ids {
+			if s.warm.loaded(id, rows[id]) {
+				s.refresh(id, rows[id])
+			}
+		}
+	}
+	log.Info.Println("prefetched the memberships of returning users", "users", len(userIDs))
+}
+
+// Shutdown writes the snapshot, when ENGINE_SNAPSHOT_FILE is set, and
+// stops the engine's workers.
+func (s *server) Shutdown() {
+	const op errors.Op = "server.Shutdown"
+	if file := s.conf.EngineSnapshotFile; file != "" {
+		rooms, online := s.registry.snapshot()
+		snap := &engineSnapshot{Version: snapshotVersion, Taken: time.Now(), Rooms: rooms, Online: online}
+		if err := writeSnapshot(file, snap); err != nil {
+			log.Error.Println("writing the snapshot failed", errors.B(path, op, err))
+		} else {
+			log.Info.Println("wrote the engine snapshot", "rooms", len(rooms), "online", len(online))
+		}
+	}
+	close(s.done)
+}
+
+// writeSnapshot replaces file with snap. It's written next to it first, a
+// crash never leaves half a snapshot behind.
+func writeSnapshot(file string, snap *engineSnapshot) error {
+	tmp, err := os.CreateTemp(filepath.Dir(file), filepath.Base(file)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := gob.NewEncoder(tmp).Encode(snap); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
+
+func readSnapshot(file string) (*engineSnapshot, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	snap := &engineSnapshot{}
+	if err := gob.NewDecoder(f).Decode(snap); err != nil {
+		return nil, err
+	}
+	if snap.Version != snapshotVersion {
+		return nil, fmt.Errorf("snapshot version %d, want %d", snap.Version, snapshotVersion)
+	}
+	return snap, nil
+}
@@ -0,0 +1,148 @@
+package tcp
+
+import (
+	"context"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/iLeoon/realtime-gateway/internal/protocol/packets"
+	"github.com/iLeoon/realtime-gateway/pkg/log"
+)
+
+// gatedDB answers FetchMembers from a replayDB once open is closed and
+// records the users of every query.
+type gatedDB struct {
+	*replayDB
+	open    chan struct{}
+	mu      sync.Mutex
+	queries [][]uint32
+}
+
+func (d *gatedDB) FetchMembers(userIDs []uint32, ctx context.Context) (map[uint32][]MemberShip, error) {
+	d.mu.Lock()
+	d.queries = append(d.queries, append([]uint32(nil), userIDs...))
+	d.mu.Unlock()
+	select {
+	case <-d.open:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return d.replayDB.FetchMembers(userIDs, ctx)
+}
+
+func (d *gatedDB) queried() [][]uint32 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([][]uint32(nil), d.queries...)
+}
+
+// TestMemberLoader connects many users at once, each of them several
+// times. Every user is fetched once and queries hold at most a batch.
+func TestMemberLoader(t *testing.T) {
+	db := &gatedDB{replayDB: newReplayDB(fixtureSetup), open: make(chan struct{})}
+	var l memberLoader
+	const batch = 8
+
+	var wg sync.WaitGroup
+	for round := 0; round < 5; round++ {
+		for u := uint32(1); u <= 20; u++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if _, err := l.load(context.Background(), db, batch, u); err != nil {
+					t.Error(err)
+				}
+			}()
+		}
+	}
+	// Let the connects pile up before the database answers.
+	time.Sleep(50 * time.Millisecond)
+	close(db.open)
+	wg.Wait()
+
+	fetched := make(map[uint32]int)
+	for _, q := range db.queried() {
+		if len(q) > batch {
+			t.Errorf("a query of %d users, the batch is %d", len(q), batch)
+		}
+		for _, u := range q {
+			fetched[u]++
+		}
+	}
+	for u := uint32(1); u <= 20; u++ {
+		if fetched[u] != 1 {
+			t.Errorf("userID %d was fetched %d times", u, fetched[u])
+		}
+	}
+
+	rows, err := l.load(context.Background(), db, batch, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != len(db.membersOf(20)) {
+		t.Fatalf("userID 20 has %d rows, want %d", len(rows), len(db.membersOf(20)))
+	}
+}
+
+// TestWarmStart restarts an engine from its snapshot while userID 20 was
+// removed from conversation 1. Returning users are registered from the
+// snapshot before the database answers, then get its memberships, all
+// with a single query.
+func TestWarmStart(t *testing.T) {
+	log.SetLevel("disabled")
+	ctx := context.Background()
+	file := filepath.Join(t.TempDir(), "engine.snapshot")
+
+	before := New()
+	before.conf.EngineSnapshotFile = file
+	before.conf.EngineSnapshotMaxAge = time.Minute
+	before.db = newReplayDB(fixtureSetup)
+	for _, u := range []uint32{10, 20} {
+		if err := before.register(&packets.ConnectPacket{ConnectionID: u, UserID: u}, &noOpConn{}, ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	before.Shutdown()
+
+	// The database no longer has userID 20 in conversation 1.
+	removed := newReplayDB(fixtureSetup)
+	removed.members = removed.members[:0]
+	for _, m := range newReplayDB(fixtureSetup).members {
+		if m.conversationID != 1 || m.memberID != 20 {
+			removed.members = append(removed.members, m)
+		}
+	}
+	db := &gatedDB{replayDB: removed, open: make(chan struct{})}
+	after := New()
+	after.conf = before.conf
+	after.db = db
+	after.restore()
+
+	if err := after.register(&packets.ConnectPacket{ConnectionID: 20, UserID: 20}, &noOpConn{}, ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := after.registry.member(20, 1); !ok {
+		t.Fatal("userID 20 wasn't registered from the snapshot")
+	}
+
+	close(db.open)
+	waitFor(t, "the database's memberships replaced the snapshot's", func() bool {
+		_, ok := after.registry.member(20, 1)
+		return !ok
+	})
+	if _, ok := after.registry.member(20, 2); !ok {
+		t.Fatal("userID 20 left conversation 2 too")
+	}
+
+	if err := after.register(&packets.ConnectPacket{ConnectionID: 10, UserID: 10}, &noOpConn{}, ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := after.registry.member(10, 1); !ok {
+		t.Fatal("userID 10 isn't in conversation 1")
+	}
+	if q := db.queried(); len(q) != 1 || len(q[0]) != 2 {
+		t.Fatalf("queries %v, want one for both returning users", q)
+	}
+}
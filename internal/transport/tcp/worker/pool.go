@@ -22,11 +22,17 @@ const (
 	Delete
 )
 
+// execer is the part of the pool the tasks use.
+type execer interface {
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+}
+
 type Message struct {
 	ID             uint32
 	AuthorID       uint32
 	ConversationID uint32
 	Content        string
+	CreatedAt      time.Time // when the engine accepted the message
 	UpdatedAt      time.Time
 	Task           TaskType
 }
@@ -52,7 +58,7 @@ func worker(db *pgxpool.Pool, done <-chan struct{}, messagesCh <-chan Message) {
 	}
 }
 
-func handleTask(task TaskType, db *pgxpool.Pool, message Message) {
+func handleTask(task TaskType, db execer, message Message) {
 	var err error
 	switch task {
 	case Insert:
@@ -67,16 +73,16 @@ func handleTask(task TaskType, db *pgxpool.Pool, message Message) {
 	}
 }
 
-func store(db *pgxpool.Pool, m Message) error {
+func store(db execer, m Message) error {
 	const op errors.Op = "worker.store"
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
 	_, err := db.Exec(ctx,
-		`INSERT INTO messages (message_id, creator_id, conversation_id, content)
-		 VALUES ($1, $2, $3, $4)`,
-		m.ID, m.AuthorID, m.ConversationID, m.Content,
+		`INSERT INTO messages (message_id, creator_id, conversation_id, content, created_at)
+		 VALUES ($1, $2, $3, $4, $5)`,
+		m.ID, m.AuthorID, m.ConversationID, m.Content, m.CreatedAt,
 	)
 	if err != nil {
 		return handleDBError(err, op)
@@ -84,7 +90,7 @@ func store(db *pgxpool.Pool, m Message) error {
 	return nil
 }
 
-func update(db *pgxpool.Pool, m Message) error {
+func update(db execer, m Message) error {
 	const op errors.Op = "worker.update"
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
@@ -105,7 +111,7 @@ func update(db *pgxpool.Pool, m Message) error {
 	return nil
 }
 
-func delete(db *pgxpool.Pool, m Message) error {
+func delete(db execer, m Message) error {
 	const op errors.Op = "worker.delete"
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
@@ -0,0 +1,36 @@
+package worker
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// recordingDB keeps the arguments of the last statement.
+type recordingDB struct {
+	args []any
+}
+
+func (d *recordingDB) Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error) {
+	d.args = args
+	return pgconn.NewCommandTag("INSERT 0 1"), nil
+}
+
+// TestStoreCreatedAt checks the message is stored with the time its
+// recipients were sent, not the time the worker got to it.
+func TestStoreCreatedAt(t *testing.T) {
+	sent := time.UnixMilli(1767225600123).UTC()
+	db := &recordingDB{}
+	if err := store(db, Message{ID: 99, AuthorID: 30, ConversationID: 1, Content: "hello", CreatedAt: sent}); err != nil {
+		t.Fatal(err)
+	}
+	if len(db.args) != 5 {
+		t.Fatalf("stored %d columns, want 5", len(db.args))
+	}
+	got, ok := db.args[4].(time.Time)
+	if !ok || !got.Equal(sent) || got.Location() != time.UTC {
+		t.Fatalf("stored created_at %v, want %v", db.args[4], sent)
+	}
+}
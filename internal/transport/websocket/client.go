@@ -7,6 +7,8 @@ import (
 
 	"github.com/gorilla/websocket"
 	"github.com/iLeoon/realtime-gateway/internal/errors"
+	"github.com/iLeoon/realtime-gateway/internal/protocol/packets"
+	"github.com/iLeoon/realtime-gateway/pkg/codec"
 	"github.com/iLeoon/realtime-gateway/pkg/log"
 	"github.com/iLeoon/realtime-gateway/pkg/session"
 )
@@ -21,7 +23,9 @@ const (
 	writeWait                      = 10 * time.Second
 	pongWait                       = 60 * time.Second
 	pingPeriod                     = (pongWait * 9) / 10
-	maxMessageSize                 = 512
+	envelopeBudget                 = 512 // bytes of a browser message besides its content
+	maxStrikes                     = 5
+	strikeWindow                   = time.Minute
 	clientPath     errors.PathName = "websocket/client"
 )
 
@@ -31,18 +35,31 @@ const (
 // Because the server may need to send messages from many goroutines,
 // We funnel all outgoing messages into `client.send`.
 type client struct {
-	userID        string
-	conn          *websocket.Conn
-	send          chan []byte
-	server        Server
-	tcpClient     session.Session
-	connectionID  uint32
-	burstyLimiter chan time.Time
-	done          chan struct{}
-	once          sync.Once
-	idleElement   *list.Element
-	lastActiveAt  time.Time
-	isActive      bool
+	userID       string
+	conn         *websocket.Conn
+	send         chan []byte
+	server       Server
+	tcpClient    session.Session
+	connectionID uint32
+	once         sync.Once
+	idleElement  *list.Element
+	lastActiveAt time.Time
+	isActive     bool
+	strikes      int       // invalid messages in the current strike window
+	strikesFrom  time.Time // start of the strike window
+	compressFrom int       // message size from which permessage-deflate is used, 0 disables it
+	readLimit    int64     // largest browser message read
+	codec        codec.Codec
+}
+
+// readLimit is the largest browser message whose content holds maxChars
+// characters. A character escaped in JSON as a surrogate pair takes 12
+// bytes, the content is checked against maxChars once decoded.
+func readLimit(maxChars int) int64 {
+	if maxChars <= 0 {
+		maxChars = packets.DefaultContentChars
+	}
+	return envelopeBudget + 12*int64(min(maxChars, packets.MaxContentChars))
 }
 
 func (c *client) readPump() {
@@ -52,7 +69,7 @@ func (c *client) readPump() {
 	defer func() {
 		c.Terminate(wsCode, reason, op)
 	}()
-	c.conn.SetReadLimit(maxMessageSize)
+	c.conn.SetReadLimit(c.readLimit)
 	if err := c.conn.SetReadDeadline(time.Now().Add(pongWait)); err != nil {
 		wrapErr := errors.B(clientPath, op, err)
 		log.Error.Println("failed to read the message from the websocket", wrapErr)
@@ -78,24 +95,29 @@ func (c *client) readPump() {
 			return
 		}
 
-		// Add a throttle for reading messages.
-		_, ok := <-c.burstyLimiter
-		if !ok {
-			return
-		}
-
 		c.server.reclaimConn(c)
 
 		// Forward the messages to WriteToServer with the proper data.
 		if err := c.tcpClient.WriteToServer(message); err != nil {
 			log.Error.Println("faild to send message to the tcp server", err)
-			if errors.Is(err, errors.Client) {
-				wsCode, reason = websocket.ClosePolicyViolation, "invalid data is being used"
-				return
-			} else {
+			if !errors.Is(err, errors.Client) {
 				wsCode, reason = websocket.CloseInternalServerErr, "unexpected error"
 				return
 			}
+			// Invalid messages are reported to the client, only protocol
+			// violations and repeated abuse end the session.
+			code := errors.CodeOf(err)
+			if code == 0 {
+				code = errors.InvalidRequest
+			}
+			if code.Fatal() || !c.strike() {
+				if !code.Fatal() {
+					code = errors.TooManyErrors
+				}
+				wsCode, reason = websocket.ClosePolicyViolation, code.Message()
+				return
+			}
+			c.sendError(code, message)
 		}
 		// Mark the connection inactive after reading.
 		c.server.putConn(c)
@@ -103,6 +125,34 @@ func (c *client) readPump() {
 
 }
 
+// strike records an invalid message, it returns false once the client sent
+// more than maxStrikes of them within strikeWindow. Only readPump calls it.
+func (c *client) strike() bool {
+	now := time.Now()
+	if now.Sub(c.strikesFrom) > strikeWindow {
+		c.strikes, c.strikesFrom = 0, now
+	}
+	c.strikes++
+	return c.strikes <= maxStrikes
+}
+
+// sendError delivers a non fatal error event for the rejected message. The
+// request type and ID are echoed when the message is readable enough.
+func (c *client) sendError(code errors.Code, message []byte) {
+	var req struct {
+		Type string `json:"type"`
+		ID   string `json:"id"`
+	}
+	_ = c.codec.Unmarshal(message, &req)
+
+	payload, err := c.codec.Marshal(code.Event(req.Type, req.ID))
+	if err != nil {
+		log.Error.Println("failed to encode the error event", err)
+		return
+	}
+	c.Enqueue(payload)
+}
+
 func (c *client) writePump() {
 	const op errors.Op = "client.writePump"
 
@@ -146,7 +196,17 @@ func (c *client) writeSocketMessage(message []byte) error {
 		return err
 	}
 
-	w, err := c.conn.NextWriter(websocket.TextMessage)
+	// Small messages cost more CPU to deflate than they save on the wire.
+	// It's a no-op when the browser didn't negotiate permessage-deflate.
+	if c.compressFrom > 0 {
+		c.conn.EnableWriteCompression(len(message) >= c.compressFrom)
+	}
+
+	messageType := websocket.TextMessage
+	if c.codec.Binary() {
+		messageType = websocket.BinaryMessage
+	}
+	w, err := c.conn.NextWriter(messageType)
 	if err != nil {
 		return err
 	}
@@ -165,26 +225,6 @@ func (c *client) writeSocketMessage(message []byte) error {
 
 }
 
-func (c *client) limiterFaucet() {
-	ticker := time.NewTicker(200 * time.Millisecond)
-	defer func() {
-		ticker.Stop()
-		close(c.burstyLimiter)
-	}()
-	for {
-		select {
-		case t := <-ticker.C:
-			select {
-			case c.burstyLimiter <- t:
-			default:
-			}
-
-		case <-c.done:
-			return
-		}
-	}
-}
-
 func (c *client) Enqueue(message []byte) {
 	const op errors.Op = "client.Enqueue"
 	select {
@@ -208,7 +248,6 @@ func (c *client) Terminate(code int, reason string, op errors.Op) {
 		}
 		c.conn.Close()
 		close(c.send)
-		close(c.done)
 		if err := c.tcpClient.OnDisConnect(); err != nil {
 			log.Error.Println("couldn't unregister this client", "ClientID", c.connectionID, "error", err)
 		}
@@ -218,3 +257,7 @@ func (c *client) Terminate(code int, reason string, op errors.Op) {
 func (c *client) ConnectionID() uint32 {
 	return c.connectionID
 }
+
+func (c *client) Codec() codec.Codec {
+	return c.codec
+}
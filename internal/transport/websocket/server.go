@@ -13,6 +13,7 @@ import (
 	"github.com/iLeoon/realtime-gateway/internal/config"
 	"github.com/iLeoon/realtime-gateway/internal/ctx"
 	"github.com/iLeoon/realtime-gateway/internal/errors"
+	"github.com/iLeoon/realtime-gateway/pkg/codec"
 	"github.com/iLeoon/realtime-gateway/pkg/log"
 	"github.com/iLeoon/realtime-gateway/pkg/session"
 )
@@ -23,6 +24,12 @@ type Client interface {
 	Enqueue(message []byte)
 	Terminate(code int, reason string, op errors.Op)
 	ConnectionID() uint32
+	Codec() codec.Codec
+}
+
+// OriginChecker decides which browser origins may open a WebSocket.
+type OriginChecker interface {
+	CheckOrigin(r *http.Request) bool
 }
 
 type signalToWsReq struct {
@@ -36,10 +43,11 @@ type signalToWsReq struct {
 // connected sessions and uses register/unregister channels to handle
 // client lifecycle events
 type server struct {
-	clients     map[string][]Client
-	c           *config.Config
-	signalToWs  chan signalToWsReq
-	mu          sync.Mutex
+	clients    map[string][]Client
+	c          *config.Config
+	origins    OriginChecker
+	signalToWs chan signalToWsReq
+	mu         sync.Mutex
 	// idleList to identify the idle connections in the websocket server and disconnect them.
 	idleList    *list.List
 	maxIdleTime time.Duration
@@ -47,8 +55,9 @@ type server struct {
 }
 
 // New create a new websocket server instance
-func New(c *config.Config) *server {
+func New(c *config.Config, origins OriginChecker) *server {
 	s := &server{
+		origins:    origins,
 		clients:    make(map[string][]Client),
 		signalToWs: make(chan signalToWsReq, 5),
 		idleList:   list.New(),
@@ -75,12 +84,10 @@ func (s *server) Handle(tcp session.InitiateSession) http.HandlerFunc {
 func (s *server) Start(w http.ResponseWriter, r *http.Request, session session.InitiateSession) {
 	// the upgrader configuration
 	var upgrader = websocket.Upgrader{
-		ReadBufferSize:  1024,
-		WriteBufferSize: 1024,
-		CheckOrigin: func(r *http.Request) bool {
-			origin := r.Header.Get("Origin")
-			return s.c.Cors == origin
-		},
+		ReadBufferSize:    1024,
+		WriteBufferSize:   1024,
+		CheckOrigin:       s.origins.CheckOrigin,
+		EnableCompression: s.c.WSCompressionThreshold > 0,
 	}
 	var b [4]byte
 	if _, err := rand.Read(b[:]); err != nil {
@@ -95,14 +102,22 @@ func (s *server) Start(w http.ResponseWriter, r *http.Request, session session.I
 		return
 	}
 
+	// The client names the codecs it speaks in Sec-WebSocket-Protocol, in
+	// order of preference. Without one it speaks JSON as it always did.
+	c, ok := codec.Negotiate(websocket.Subprotocols(r))
+	var header http.Header
+	if ok {
+		header = http.Header{"Sec-Websocket-Protocol": {c.Subprotocol()}}
+	}
+
 	// upgrade the websocket connection.
-	conn, err := upgrader.Upgrade(w, r, nil)
+	conn, err := upgrader.Upgrade(w, r, header)
 	if err != nil {
 		log.Error.Println("error on upgrading raw tcp connection into websocekt", err)
 		return
 	}
 
-	tcpClient, err := session.NewClient(userID, connectionID)
+	tcpClient, err := session.NewClient(userID, connectionID, c)
 	if err != nil {
 		log.Error.Println("error on initializing a new tcp client for the connection between websocket and tcp server")
 		conn.Close()
@@ -110,14 +125,15 @@ func (s *server) Start(w http.ResponseWriter, r *http.Request, session session.I
 	}
 
 	client := &client{
-		userID:        userID,
-		conn:          conn,
-		send:          make(chan []byte, 256),
-		server:        s,
-		tcpClient:     tcpClient,
-		burstyLimiter: make(chan time.Time, 3),
-		connectionID:  connectionID,
-		done:          make(chan struct{}),
+		userID:       userID,
+		conn:         conn,
+		send:         make(chan []byte, 256),
+		server:       s,
+		tcpClient:    tcpClient,
+		connectionID: connectionID,
+		compressFrom: s.c.WSCompressionThreshold,
+		readLimit:    readLimit(s.c.MessageMaxChars),
+		codec:        c,
 	}
 	s.mu.Lock()
 	// Check if the connection was successfully registred to the map
@@ -133,30 +149,40 @@ func (s *server) Start(w http.ResponseWriter, r *http.Request, session session.I
 
 	go client.readPump()
 	go client.writePump()
-	go client.limiterFaucet()
 }
 
 func (s *server) Send(userID string, connectionID uint32, message []byte) error {
+	target, err := s.client(userID, connectionID)
+	if err != nil {
+		return err
+	}
+	target.Enqueue(message)
+	return nil
+}
+
+// Codec returns the codec the client negotiated, JSON once it's gone:
+// Send then reports it missing.
+func (s *server) Codec(userID string, connectionID uint32) codec.Codec {
+	target, err := s.client(userID, connectionID)
+	if err != nil {
+		return codec.JSON
+	}
+	return target.Codec()
+}
+
+func (s *server) client(userID string, connectionID uint32) (Client, error) {
 	s.mu.Lock()
+	defer s.mu.Unlock()
 	clients, ok := s.clients[userID]
 	if !ok {
-		s.mu.Unlock()
-		return fmt.Errorf("no client was found with that userID: %s", userID)
+		return nil, fmt.Errorf("no client was found with that userID: %s", userID)
 	}
-	var target Client
 	for i := range clients {
 		if clients[i].ConnectionID() == connectionID {
-			target = clients[i]
-			break
+			return clients[i], nil
 		}
 	}
-
-	s.mu.Unlock()
-	if target == nil {
-		return fmt.Errorf("no clients were found with that connectionID: %d", connectionID)
-	}
-	target.Enqueue(message)
-	return nil
+	return nil, fmt.Errorf("no clients were found with that connectionID: %d", connectionID)
 }
 
 func (s *server) registerClient(c *client) bool {
@@ -0,0 +1,58 @@
+// Package codec encodes the messages exchanged with WebSocket clients. The
+// client picks a codec with the Sec-WebSocket-Protocol header, the gateway
+// then reads its actions and writes its events in that format.
+//
+// The json struct tags of the message types are the schema of every codec,
+// a message decodes to the same value whichever codec carried it.
+package codec
+
+import "encoding/json"
+
+// Subprotocols, the codecs are versioned along with the message types.
+const (
+	JSONSubprotocol    = "rtg.json.v1"
+	MsgPackSubprotocol = "rtg.msgpack.v1"
+)
+
+// A Codec marshals messages for one subprotocol.
+type Codec interface {
+	// Subprotocol is the Sec-WebSocket-Protocol value that selects the
+	// codec.
+	Subprotocol() string
+	// Binary reports that messages are sent as binary WebSocket messages
+	// rather than text ones.
+	Binary() bool
+	Marshal(v any) ([]byte, error)
+	Unmarshal(data []byte, v any) error
+}
+
+var (
+	// JSON is the codec of clients that don't negotiate one.
+	JSON Codec = jsonCodec{}
+	// MsgPack encodes messages as MessagePack.
+	MsgPack Codec = msgpackCodec{}
+)
+
+var codecs = []Codec{JSON, MsgPack}
+
+// Negotiate picks the first offered subprotocol a codec speaks, in the
+// client's order of preference. ok is false when there is none, the
+// connection then speaks JSON without naming a subprotocol, the way
+// clients that predate negotiation do.
+func Negotiate(offered []string) (c Codec, ok bool) {
+	for _, name := range offered {
+		for _, c := range codecs {
+			if c.Subprotocol() == name {
+				return c, true
+			}
+		}
+	}
+	return JSON, false
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Subprotocol() string                { return JSONSubprotocol }
+func (jsonCodec) Binary() bool                       { return false }
+func (jsonCodec) Marshal(v any) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v any) error { return json.Unmarshal(data, v) }
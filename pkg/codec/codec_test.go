@@ -0,0 +1,191 @@
+package codec_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/iLeoon/realtime-gateway/pkg/codec"
+)
+
+type author struct {
+	DisplayName  string `json:"displayName"`
+	DisplayImage string `json:"displayImage"`
+}
+
+// message has the shapes the gateway's messages are made of.
+type message struct {
+	Type      string          `json:"type"`
+	ID        string          `json:"id,omitempty"`
+	AuthorID  uint32          `json:"authorId"`
+	Offset    int64           `json:"offset"`
+	Big       uint64          `json:"big"`
+	Ratio     float64         `json:"ratio"`
+	Typing    bool            `json:"typing"`
+	CreatedAt time.Time       `json:"createdAt,omitzero"`
+	Author    *author         `json:"author,omitempty"`
+	Tags      []string        `json:"tags"`
+	Payload   json.RawMessage `json:"payload,omitempty"`
+}
+
+func samples() []message {
+	return []message{
+		{Type: "ack"},
+		{
+			Type:      "send_message",
+			ID:        "r1",
+			AuthorID:  math.MaxUint32,
+			Offset:    math.MinInt64,
+			Big:       math.MaxUint64,
+			Ratio:     -1.5,
+			Typing:    true,
+			CreatedAt: time.Date(2026, 10, 19, 8, 30, 0, 123e6, time.UTC),
+			Author:    &author{DisplayName: "Zoë", DisplayImage: "https://example.com/a.png"},
+			Tags:      []string{"", "a", strings.Repeat("ü", 40)},
+			Payload:   json.RawMessage(`{"conversationId":"12","content":"hi <3"}`),
+		},
+		{Type: strings.Repeat("x", 70000), Offset: -40, Big: 300, Tags: make([]string, 20)},
+	}
+}
+
+// TestRoundTrip decodes what each codec encodes back to the same value,
+// and to the value the JSON codec gives: the codecs are interchangeable.
+func TestRoundTrip(t *testing.T) {
+	for _, c := range []codec.Codec{codec.JSON, codec.MsgPack} {
+		for i, want := range samples() {
+			b, err := c.Marshal(want)
+			if err != nil {
+				t.Fatalf("%s: sample %d: %v", c.Subprotocol(), i, err)
+			}
+			var got message
+			if err := c.Unmarshal(b, &got); err != nil {
+				t.Fatalf("%s: sample %d: %v", c.Subprotocol(), i, err)
+			}
+			var viaJSON message
+			jb, _ := codec.JSON.Marshal(want)
+			if err := codec.JSON.Unmarshal(jb, &viaJSON); err != nil {
+				t.Fatal(err)
+			}
+			// Raw JSON keeps its meaning, not its key order.
+			if !sameJSON(t, got.Payload, viaJSON.Payload) {
+				t.Fatalf("%s: sample %d payload %s, want %s", c.Subprotocol(), i, got.Payload, viaJSON.Payload)
+			}
+			got.Payload, viaJSON.Payload = nil, nil
+			if !reflect.DeepEqual(got, viaJSON) {
+				t.Fatalf("%s: sample %d decoded to\n%+v\nwant\n%+v", c.Subprotocol(), i, got, viaJSON)
+			}
+		}
+	}
+}
+
+func sameJSON(t *testing.T, a, b json.RawMessage) bool {
+	t.Helper()
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	var x, y any
+	if err := json.Unmarshal(a, &x); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(b, &y); err != nil {
+		t.Fatal(err)
+	}
+	return reflect.DeepEqual(x, y)
+}
+
+// TestMsgPackWire checks encodings other MessagePack libraries produce
+// and expect.
+func TestMsgPackWire(t *testing.T) {
+	b, err := codec.MsgPack.Marshal(map[string]any{"id": 1, "ok": true, "n": -33, "s": nil})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []byte{0x84, 0xa2, 'i', 'd', 0x01, 0xa1, 'n', 0xd0, 0xdf, 0xa2, 'o', 'k', 0xc3, 0xa1, 's', 0xc0}
+	if !bytes.Equal(b, want) {
+		t.Fatalf("got %x, want %x", b, want)
+	}
+
+	// bin 8 as a string, float 32, int 16 and array 16.
+	in := []byte{0x83, 0xa1, 'b', 0xc4, 0x02, 'h', 'i', 0xa1, 'f', 0xca, 0x3f, 0xc0, 0x00, 0x00,
+		0xa1, 'l', 0xdc, 0x00, 0x01, 0xd1, 0xff, 0x00}
+	var got struct {
+		B string  `json:"b"`
+		F float64 `json:"f"`
+		L []int   `json:"l"`
+	}
+	if err := codec.MsgPack.Unmarshal(in, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.B != "hi" || got.F != 1.5 || len(got.L) != 1 || got.L[0] != -256 {
+		t.Fatalf("decoded %+v", got)
+	}
+}
+
+func TestMsgPackRejects(t *testing.T) {
+	var v any
+	for name, in := range map[string][]byte{
+		"empty":          {},
+		"truncated":      {0xa3, 'a'},
+		"trailing bytes": {0xc0, 0xc0},
+		"integer key":    {0x81, 0x01, 0x01},
+		"extension":      {0xd4, 0x01, 0x00},
+		"lying length":   {0xdd, 0xff, 0xff, 0xff, 0xff},
+		"too deep":       bytes.Repeat([]byte{0x91}, 40),
+	} {
+		if err := codec.MsgPack.Unmarshal(in, &v); err == nil {
+			t.Errorf("%s: decoded %v", name, v)
+		}
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	for _, tt := range []struct {
+		offered []string
+		want    codec.Codec
+		ok      bool
+	}{
+		{nil, codec.JSON, false},
+		{[]string{"chat"}, codec.JSON, false},
+		{[]string{"chat", codec.MsgPackSubprotocol}, codec.MsgPack, true},
+		{[]string{codec.MsgPackSubprotocol, codec.JSONSubprotocol}, codec.MsgPack, true},
+		{[]string{codec.JSONSubprotocol, codec.MsgPackSubprotocol}, codec.JSON, true},
+	} {
+		if c, ok := codec.Negotiate(tt.offered); c != tt.want || ok != tt.ok {
+			t.Errorf("%q: got %s, %v", tt.offered, c.Subprotocol(), ok)
+		}
+	}
+}
+
+// FuzzMsgPack throws arbitrary bytes at the MessagePack decoder. Whatever
+// it accepts must encode again and decode to the same value.
+func FuzzMsgPack(f *testing.F) {
+	// The long sample would only slow the mutator down.
+	for _, m := range samples()[:2] {
+		b, err := codec.MsgPack.Marshal(m)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(b)
+	}
+	f.Fuzz(func(t *testing.T, b []byte) {
+		var v any
+		if err := codec.MsgPack.Unmarshal(b, &v); err != nil {
+			return
+		}
+		again, err := codec.MsgPack.Marshal(v)
+		if err != nil {
+			t.Fatalf("%v decoded but doesn't encode: %v", v, err)
+		}
+		var w any
+		if err := codec.MsgPack.Unmarshal(again, &w); err != nil {
+			t.Fatalf("%v doesn't decode its own encoding: %v", v, err)
+		}
+		if !reflect.DeepEqual(v, w) {
+			t.Fatalf("round trip changed the value\n got %v\nwant %v", w, v)
+		}
+	})
+}
@@ -0,0 +1,357 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+)
+
+// msgpackCodec encodes the values JSON can hold as MessagePack, the rest
+// of the format isn't used. Messages are transcoded through JSON so the
+// json struct tags, omitempty and custom marshalers included, apply as
+// they do with the JSON codec. Binary strings decode as strings, map keys
+// must be strings and extension types are refused.
+type msgpackCodec struct{}
+
+// maxDepth bounds the nesting of decoded arrays and maps, no message
+// comes close.
+const maxDepth = 32
+
+var errShort = errors.New("msgpack: unexpected end of data")
+
+func (msgpackCodec) Subprotocol() string { return MsgPackSubprotocol }
+func (msgpackCodec) Binary() bool        { return true }
+
+func (msgpackCodec) Marshal(v any) ([]byte, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var value any
+	if err := dec.Decode(&value); err != nil {
+		return nil, err
+	}
+	return appendValue(nil, value)
+}
+
+func (msgpackCodec) Unmarshal(data []byte, v any) error {
+	d := &decoder{b: data}
+	value, err := d.value()
+	if err != nil {
+		return err
+	}
+	if len(d.b) != 0 {
+		return fmt.Errorf("msgpack: %d bytes after the value", len(d.b))
+	}
+	b, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("msgpack: %w", err)
+	}
+	return json.Unmarshal(b, v)
+}
+
+// appendValue appends the MessagePack encoding of a value decoded from
+// JSON with UseNumber. Map keys are sorted, a value always encodes to the
+// same bytes.
+func appendValue(b []byte, v any) ([]byte, error) {
+	switch v := v.(type) {
+	case nil:
+		return append(b, 0xc0), nil
+	case bool:
+		if v {
+			return append(b, 0xc3), nil
+		}
+		return append(b, 0xc2), nil
+	case json.Number:
+		if n, err := strconv.ParseInt(string(v), 10, 64); err == nil {
+			return appendInt(b, n), nil
+		}
+		if n, err := strconv.ParseUint(string(v), 10, 64); err == nil {
+			return appendUint(b, n), nil
+		}
+		f, err := strconv.ParseFloat(string(v), 64)
+		if err != nil {
+			return nil, fmt.Errorf("msgpack: number %s: %w", v, err)
+		}
+		b = append(b, 0xcb)
+		return binary.BigEndian.AppendUint64(b, math.Float64bits(f)), nil
+	case string:
+		return appendString(b, v), nil
+	case []any:
+		b = appendLen(b, len(v), 0x90, 16, 0xdc)
+		for _, elem := range v {
+			var err error
+			if b, err = appendValue(b, elem); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	case map[string]any:
+		b = appendLen(b, len(v), 0x80, 16, 0xde)
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		slices.Sort(keys)
+		for _, k := range keys {
+			b = appendString(b, k)
+			var err error
+			if b, err = appendValue(b, v[k]); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	default:
+		return nil, fmt.Errorf("msgpack: unexpected %T", v)
+	}
+}
+
+func appendInt(b []byte, n int64) []byte {
+	switch {
+	case n >= 0:
+		return appendUint(b, uint64(n))
+	case n >= -32:
+		return append(b, byte(n))
+	case n >= math.MinInt8:
+		return append(b, 0xd0, byte(n))
+	case n >= math.MinInt16:
+		return binary.BigEndian.AppendUint16(append(b, 0xd1), uint16(n))
+	case n >= math.MinInt32:
+		return binary.BigEndian.AppendUint32(append(b, 0xd2), uint32(n))
+	default:
+		return binary.BigEndian.AppendUint64(append(b, 0xd3), uint64(n))
+	}
+}
+
+func appendUint(b []byte, n uint64) []byte {
+	switch {
+	case n <= 0x7f:
+		return append(b, byte(n))
+	case n <= math.MaxUint8:
+		return append(b, 0xcc, byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(b, 0xcd), uint16(n))
+	case n <= math.MaxUint32:
+		return binary.BigEndian.AppendUint32(append(b, 0xce), uint32(n))
+	default:
+		return binary.BigEndian.AppendUint64(append(b, 0xcf), n)
+	}
+}
+
+func appendString(b []byte, s string) []byte {
+	if len(s) <= math.MaxUint8 && len(s) >= 32 {
+		b = append(b, 0xd9, byte(len(s)))
+	} else {
+		b = appendLen(b, len(s), 0xa0, 32, 0xda)
+	}
+	return append(b, s...)
+}
+
+// appendLen appends the header of a string, array or map of n elements:
+// the fix form below fixMax, else the 16-bit form at code and the 32-bit
+// one at code+1.
+func appendLen(b []byte, n int, fix byte, fixMax int, code byte) []byte {
+	switch {
+	case n < fixMax:
+		return append(b, fix|byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(b, code), uint16(n))
+	default:
+		return binary.BigEndian.AppendUint32(append(b, code+1), uint32(n))
+	}
+}
+
+// decoder reads MessagePack into the values JSON decodes to.
+type decoder struct {
+	b     []byte
+	depth int
+}
+
+func (d *decoder) next(n int) ([]byte, error) {
+	if n < 0 || n > len(d.b) {
+		return nil, errShort
+	}
+	p := d.b[:n]
+	d.b = d.b[n:]
+	return p, nil
+}
+
+// length reads the size of a str, bin, array or map from the n bytes
+// following its type byte.
+func (d *decoder) length(n int) (int, error) {
+	p, err := d.next(n)
+	if err != nil {
+		return 0, err
+	}
+	switch n {
+	case 1:
+		return int(p[0]), nil
+	case 2:
+		return int(binary.BigEndian.Uint16(p)), nil
+	default:
+		return int(binary.BigEndian.Uint32(p)), nil
+	}
+}
+
+func (d *decoder) value() (any, error) {
+	p, err := d.next(1)
+	if err != nil {
+		return nil, err
+	}
+	switch c := p[0]; {
+	case c <= 0x7f:
+		return int64(c), nil
+	case c >= 0xe0:
+		return int64(int8(c)), nil
+	case c&0xe0 == 0xa0:
+		return d.str(int(c & 0x1f))
+	case c&0xf0 == 0x90:
+		return d.array(int(c & 0x0f))
+	case c&0xf0 == 0x80:
+		return d.object(int(c & 0x0f))
+	}
+
+	switch c := p[0]; c {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xd9: // bin 8, str 8
+		return d.strLen(1)
+	case 0xc5, 0xda: // bin 16, str 16
+		return d.strLen(2)
+	case 0xc6, 0xdb: // bin 32, str 32
+		return d.strLen(4)
+	case 0xca:
+		p, err := d.next(4)
+		if err != nil {
+			return nil, err
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(p))), nil
+	case 0xcb:
+		p, err := d.next(8)
+		if err != nil {
+			return nil, err
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(p)), nil
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		p, err := d.next(1 << (c - 0xcc))
+		if err != nil {
+			return nil, err
+		}
+		var n uint64
+		for _, x := range p {
+			n = n<<8 | uint64(x)
+		}
+		return n, nil
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		size := 1 << (c - 0xd0)
+		p, err := d.next(size)
+		if err != nil {
+			return nil, err
+		}
+		var n uint64
+		for _, x := range p {
+			n = n<<8 | uint64(x)
+		}
+		// Sign-extend from the encoded width.
+		shift := 64 - 8*size
+		return int64(n<<shift) >> shift, nil
+	case 0xdc:
+		n, err := d.length(2)
+		if err != nil {
+			return nil, err
+		}
+		return d.array(n)
+	case 0xdd:
+		n, err := d.length(4)
+		if err != nil {
+			return nil, err
+		}
+		return d.array(n)
+	case 0xde:
+		n, err := d.length(2)
+		if err != nil {
+			return nil, err
+		}
+		return d.object(n)
+	case 0xdf:
+		n, err := d.length(4)
+		if err != nil {
+			return nil, err
+		}
+		return d.object(n)
+	default:
+		return nil, fmt.Errorf("msgpack: unsupported type %#x", c)
+	}
+}
+
+func (d *decoder) strLen(size int) (any, error) {
+	n, err := d.length(size)
+	if err != nil {
+		return nil, err
+	}
+	return d.str(n)
+}
+
+func (d *decoder) str(n int) (any, error) {
+	p, err := d.next(n)
+	if err != nil {
+		return nil, err
+	}
+	return string(p), nil
+}
+
+func (d *decoder) array(n int) (any, error) {
+	// Every element takes a byte at least, a length beyond the data is a
+	// lie and isn't allocated for.
+	if n > len(d.b) {
+		return nil, errShort
+	}
+	if d.depth++; d.depth > maxDepth {
+		return nil, errors.New("msgpack: nested too deep")
+	}
+	defer func() { d.depth-- }()
+	a := make([]any, n)
+	for i := range a {
+		var err error
+		if a[i], err = d.value(); err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+func (d *decoder) object(n int) (any, error) {
+	if 2*n > len(d.b) {
+		return nil, errShort
+	}
+	if d.depth++; d.depth > maxDepth {
+		return nil, errors.New("msgpack: nested too deep")
+	}
+	defer func() { d.depth-- }()
+	m := make(map[string]any, n)
+	for range n {
+		k, err := d.value()
+		if err != nil {
+			return nil, err
+		}
+		key, ok := k.(string)
+		if !ok {
+			return nil, fmt.Errorf("msgpack: map key of type %T, want a string", k)
+		}
+		if m[key], err = d.value(); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
@@ -4,6 +4,8 @@
 // operations required to bridge the two systems.
 package session
 
+import "github.com/iLeoon/realtime-gateway/pkg/codec"
+
 // A Session is responsible for:
 //   - Managing connection lifecycle events (OnConnect, Disconnect)
 //   - Reading messages coming from the WebSocket gateway
@@ -27,8 +29,8 @@ type Session interface {
 
 	// WriteToServer processes incoming data from the WebSocket gateway.
 	// This method typically receives encoded frames or raw messages from
-	// the client, decodes them into packets, and forwards them to the TCP
-	// engine through the transporter.
+	// the client, decodes them with the session's codec into packets, and
+	// forwards them to the TCP engine through the transporter.
 	WriteToServer(data []byte) error
 
 	// ReadFromServer handles data arriving from the TCP engine. It reads
@@ -38,5 +40,7 @@ type Session interface {
 }
 
 type InitiateSession interface {
-	NewClient(string, uint32) (Session, error)
+	// NewClient opens the session of a WebSocket connection that
+	// negotiated codec c.
+	NewClient(userID string, connectionID uint32, c codec.Codec) (Session, error)
 }